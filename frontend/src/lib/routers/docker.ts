@@ -11,6 +11,65 @@ export const dockerRouter = {
     })
     .output(Z.dockerClientInfoSchema.array()),
 
+  // List stored registry credentials
+  registries: base
+    .route({
+      method: "GET",
+      path: "/docker/registries",
+    })
+    .output(Z.registryCredentialSchema.array()),
+
+  // Add registry credentials
+  createRegistry: base
+    .route({
+      method: "POST",
+      path: "/docker/registries",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        body: {
+          registry: z.string(),
+          username: z.string(),
+          password: z.string(),
+        },
+      }),
+    )
+    .output(Z.registryCredentialSchema),
+
+  // Edit registry credentials, an omitted password is kept
+  updateRegistry: base
+    .route({
+      method: "PUT",
+      path: "/docker/registries/{id}",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { id: z.string() },
+        body: {
+          registry: z.string(),
+          username: z.string(),
+          password: z.string().optional(),
+        },
+      }),
+    )
+    .output(Z.registryCredentialSchema),
+
+  // Remove registry credentials
+  deleteRegistry: base
+    .route({
+      method: "DELETE",
+      path: "/docker/registries/{id}",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { id: z.string() },
+      }),
+    )
+    .output(z.object({ message: z.string() })),
+
   // List containers for a specific client
   containers: base
     .route({
@@ -147,9 +206,30 @@ export const dockerRouter = {
     .input(
       detailed({
         params: { clientId: z.string(), id: z.string() },
+        query: {
+          tail: z.string().optional(),
+          since: z.string().optional(),
+          until: z.string().optional(),
+          stream: z.enum(["stdout", "stderr"]).optional(),
+        },
       }),
     )
-    .output(z.string()),
+    .output(Z.containerLogLineSchema.array()),
+
+  // List a directory of a container
+  containerFiles: base
+    .route({
+      method: "GET",
+      path: "/docker/{clientId}/containers/{id}/files",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), id: z.string() },
+        query: { path: z.string().optional() },
+      }),
+    )
+    .output(Z.containerDirectorySchema),
 
   // Create a container
   createContainer: base
@@ -161,14 +241,301 @@ export const dockerRouter = {
     .input(
       detailed({
         params: { clientId: z.string() },
-        query: { name: z.string().optional() },
         body: {
-          Image: z.string(),
-          Cmd: z.array(z.string()).optional(),
-          Env: z.array(z.string()).optional(),
-          ExposedPorts: z.record(z.string(), z.any()).optional(),
+          name: z.string().optional(),
+          config: z
+            .object({
+              Image: z.string(),
+              Cmd: z.array(z.string()).optional(),
+              Env: z.array(z.string()).optional(),
+              ExposedPorts: z.record(z.string(), z.any()).optional(),
+            })
+            .passthrough(),
+          host_config: z.record(z.string(), z.any()).optional(),
+          networking_config: z.record(z.string(), z.any()).optional(),
+          platform: z.string().optional(),
+          pull: z.enum(["never", "missing", "always"]).optional(),
+          start: z.boolean().optional(),
         },
       }),
     )
     .output(Z.containerCreateResponseSchema),
+
+  // List the volumes of a client
+  volumes: base
+    .route({
+      method: "GET",
+      path: "/docker/{clientId}/volumes",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string() },
+      }),
+    )
+    .output(Z.dockerVolumeSchema.array()),
+
+  // Inspect a volume
+  volume: base
+    .route({
+      method: "GET",
+      path: "/docker/{clientId}/volumes/{name}",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), name: z.string() },
+      }),
+    )
+    .output(Z.dockerVolumeSchema),
+
+  // Create a volume
+  createVolume: base
+    .route({
+      method: "POST",
+      path: "/docker/{clientId}/volumes",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string() },
+        body: {
+          name: z.string().optional(),
+          driver: z.string().optional(),
+          driver_opts: z.record(z.string(), z.string()).optional(),
+          labels: z.record(z.string(), z.string()).optional(),
+        },
+      }),
+    )
+    .output(Z.dockerVolumeSchema),
+
+  // Delete a volume, force removes the stopped containers using it
+  deleteVolume: base
+    .route({
+      method: "DELETE",
+      path: "/docker/{clientId}/volumes/{name}",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), name: z.string() },
+        query: { force: z.string().optional() },
+      }),
+    )
+    .output(z.object({ message: z.string() })),
+
+  // List the networks of a client
+  networks: base
+    .route({
+      method: "GET",
+      path: "/docker/{clientId}/networks",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string() },
+      }),
+    )
+    .output(Z.dockerNetworkDetailsSchema.array()),
+
+  // Inspect a network
+  network: base
+    .route({
+      method: "GET",
+      path: "/docker/{clientId}/networks/{id}",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), id: z.string() },
+      }),
+    )
+    .output(Z.dockerNetworkDetailsSchema),
+
+  // Create a bridge, macvlan or ipvlan network
+  createNetwork: base
+    .route({
+      method: "POST",
+      path: "/docker/{clientId}/networks",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string() },
+        body: {
+          name: z.string(),
+          driver: z.enum(["bridge", "macvlan", "ipvlan"]).optional(),
+          parent: z.string().optional(),
+          mode: z.string().optional(),
+          subnets: z.array(Z.networkSubnetSchema).optional(),
+          internal: z.boolean().optional(),
+          attachable: z.boolean().optional(),
+          ipv6: z.boolean().optional(),
+          labels: z.record(z.string(), z.string()).optional(),
+          options: z.record(z.string(), z.string()).optional(),
+        },
+      }),
+    )
+    .output(Z.dockerNetworkDetailsSchema),
+
+  // Delete a network
+  deleteNetwork: base
+    .route({
+      method: "DELETE",
+      path: "/docker/{clientId}/networks/{id}",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), id: z.string() },
+      }),
+    )
+    .output(z.object({ message: z.string() })),
+
+  // Connect a container to a network
+  connectNetwork: base
+    .route({
+      method: "POST",
+      path: "/docker/{clientId}/networks/{id}/connect",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), id: z.string() },
+        body: {
+          container: z.string(),
+          ipv4_address: z.string().optional(),
+          ipv6_address: z.string().optional(),
+          aliases: z.array(z.string()).optional(),
+        },
+      }),
+    )
+    .output(z.object({ message: z.string() })),
+
+  // Disconnect a container from a network
+  disconnectNetwork: base
+    .route({
+      method: "POST",
+      path: "/docker/{clientId}/networks/{id}/disconnect",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), id: z.string() },
+        body: {
+          container: z.string(),
+          force: z.boolean().optional(),
+        },
+      }),
+    )
+    .output(z.object({ message: z.string() })),
+
+  // List the stacks of a client
+  stacks: base
+    .route({
+      method: "GET",
+      path: "/docker/{clientId}/stacks",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string() },
+      }),
+    )
+    .output(Z.stackSchema.array()),
+
+  // Get a stack
+  stack: base
+    .route({
+      method: "GET",
+      path: "/docker/{clientId}/stacks/{name}",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), name: z.string() },
+      }),
+    )
+    .output(Z.stackDetailsSchema),
+
+  // Deploy a Compose stack
+  deployStack: base
+    .route({
+      method: "POST",
+      path: "/docker/{clientId}/stacks",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string() },
+        body: {
+          name: z.string().optional(),
+          compose: z.string(),
+          env: z.string().optional(),
+        },
+      }),
+    )
+    .output(Z.stackDeployResponseSchema),
+
+  // Re-deploy a stack, or list the changes with dry_run
+  updateStack: base
+    .route({
+      method: "PUT",
+      path: "/docker/{clientId}/stacks/{name}",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), name: z.string() },
+        query: { dry_run: z.string().optional() },
+        body: {
+          compose: z.string(),
+          env: z.string().optional(),
+        },
+      }),
+    )
+    .output(Z.stackDeployResponseSchema),
+
+  // Start a stack
+  startStack: base
+    .route({
+      method: "POST",
+      path: "/docker/{clientId}/stacks/{name}/start",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), name: z.string() },
+      }),
+    )
+    .output(z.object({ message: z.string() })),
+
+  // Stop a stack
+  stopStack: base
+    .route({
+      method: "POST",
+      path: "/docker/{clientId}/stacks/{name}/stop",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), name: z.string() },
+      }),
+    )
+    .output(z.object({ message: z.string() })),
+
+  // Remove a stack
+  deleteStack: base
+    .route({
+      method: "DELETE",
+      path: "/docker/{clientId}/stacks/{name}",
+      inputStructure: "detailed",
+    })
+    .input(
+      detailed({
+        params: { clientId: z.string(), name: z.string() },
+        query: { volumes: z.string().optional() },
+      }),
+    )
+    .output(z.object({ message: z.string() })),
 };
@@ -5,7 +5,15 @@ const isoFileInfoSchema = z.object({
   name: z.string(),
   size: z.number(),
   modified: z.string().or(z.instanceof(Date)),
-  is_directory: z.boolean(),
+  sha256: z.string().optional(),
+  checksum_status: z.enum(["pending", "ready", "failed"]),
+  format: z.string().optional(),
+  volume_label: z.string().optional(),
+  system_id: z.string().optional(),
+  created: z.string().optional(),
+  bootable: z.boolean(),
+  boot_platforms: z.array(z.string()).optional(),
+  header_error: z.string().optional(),
 });
 
 const isoUploadResponseSchema = z.object({
@@ -1,5 +1,7 @@
+import { useEffect, useState } from "react";
 import { useQuery, useMutation } from "@tanstack/react-query";
 import { orpc } from "@/lib/orpc";
+import { CONSTANTS } from "@/lib";
 import { Button } from "@/components/ui/button";
 import { Badge } from "@/components/ui/badge";
 import { Tabs, TabsContent, TabsList, TabsTrigger } from "@/components/ui/tabs";
@@ -19,6 +21,10 @@ import type { z } from "zod";
 import type { Z } from "@/types";
 
 type DockerContainer = z.infer<typeof Z.dockerContainerSchema>;
+type ContainerLogLine = z.infer<typeof Z.containerLogLineSchema>;
+
+// Lines fetched when opening the logs, and kept while following them
+const LOG_TAIL = 500;
 
 interface ContainerDetailsContentProps {
   clientId: string | null;
@@ -56,6 +62,7 @@ export function ContainerDetailsContent({
     orpc.docker.containerLogs.queryOptions({
       input: {
         params: { clientId: clientId!, id: container?.Id! },
+        query: { tail: String(LOG_TAIL) },
       },
       queryOptions: {
         enabled: !!clientId && !!container?.Id,
@@ -63,6 +70,38 @@ export function ContainerDetailsContent({
     }),
   );
 
+  const health = useQuery(
+    orpc.health.check.queryOptions({
+      queryOptions: {
+        staleTime: CONSTANTS.POLLING_INTERVAL_MS,
+      },
+    }),
+  );
+  const baseURL = health.data?.base_url;
+
+  // Follow mode streams new lines after the fetched ones
+  const [follow, setFollow] = useState(false);
+  const [followedLines, setFollowedLines] = useState<ContainerLogLine[]>([]);
+  useEffect(() => {
+    setFollowedLines([]);
+    if (!follow || !baseURL || !clientId || !container?.Id) {
+      return;
+    }
+    const source = new EventSource(
+      `${baseURL}/api/docker/${clientId}/containers/${container.Id}/logs/stream?tail=0`,
+      { withCredentials: true },
+    );
+    source.onmessage = (event) => {
+      const line = JSON.parse(event.data) as ContainerLogLine;
+      setFollowedLines((lines) => [...lines, line].slice(-LOG_TAIL));
+    };
+    return () => source.close();
+  }, [follow, baseURL, clientId, container?.Id]);
+
+  const logLines = [...(logsQuery.data ?? []), ...followedLines].slice(
+    -LOG_TAIL,
+  );
+
   const startMutation = useMutation(
     orpc.docker.startContainer.mutationOptions({
       onSuccess: () => toast.success("Container started"),
@@ -248,17 +287,29 @@ export function ContainerDetailsContent({
                 <FileText className="h-4 w-4" />
                 Container Logs
               </h4>
-              <Button
-                variant="outline"
-                size="sm"
-                onClick={() => logsQuery.refetch()}
-                disabled={logsQuery.isFetching}
-              >
-                <RefreshCw
-                  className={`mr-1 h-4 w-4 ${logsQuery.isFetching ? "animate-spin" : ""}`}
-                />
-                Refresh
-              </Button>
+              <div className="flex items-center gap-2">
+                <Button
+                  variant={follow ? "default" : "outline"}
+                  size="sm"
+                  onClick={() => setFollow((f) => !f)}
+                >
+                  {follow ? "Following" : "Follow"}
+                </Button>
+                <Button
+                  variant="outline"
+                  size="sm"
+                  onClick={() => {
+                    setFollowedLines([]);
+                    logsQuery.refetch();
+                  }}
+                  disabled={logsQuery.isFetching}
+                >
+                  <RefreshCw
+                    className={`mr-1 h-4 w-4 ${logsQuery.isFetching ? "animate-spin" : ""}`}
+                  />
+                  Refresh
+                </Button>
+              </div>
             </div>
             <div className="rounded-lg border bg-muted/50 p-4">
               {logsQuery.isLoading ? (
@@ -267,9 +318,23 @@ export function ContainerDetailsContent({
                 </div>
               ) : logsQuery.error ? (
                 <p className="text-destructive">Failed to load logs</p>
-              ) : logsQuery.data ? (
+              ) : logLines.length > 0 ? (
                 <pre className="max-h-[400px] overflow-auto whitespace-pre-wrap break-all font-mono text-xs">
-                  {logsQuery.data || "No logs available"}
+                  {logLines.map((line, i) => (
+                    <div
+                      key={i}
+                      className={
+                        line.stream === "stderr" ? "text-destructive" : undefined
+                      }
+                    >
+                      {line.timestamp && (
+                        <span className="mr-2 text-muted-foreground">
+                          {new Date(line.timestamp).toLocaleTimeString()}
+                        </span>
+                      )}
+                      {line.line}
+                    </div>
+                  ))}
                 </pre>
               ) : (
                 <p className="text-muted-foreground">No logs available</p>
@@ -44,8 +44,9 @@ export function CreateContainerContent({
 
   const createContainerMutation = useMutation(
     orpc.docker.createContainer.mutationOptions({
-      onSuccess() {
+      onSuccess(data) {
         toast.success("Container created successfully");
+        data.warnings.forEach((warning) => toast.warning(warning));
         resetForm();
         onSuccess?.();
         onClose?.();
@@ -114,22 +115,34 @@ export function CreateContainerContent({
       .map((e) => `${e.key}=${e.value}`);
 
     const exposedPorts: Record<string, object> = {};
+    const portBindings: Record<string, { HostPort: string }[]> = {};
     ports
       .filter((p) => p.container.trim())
       .forEach((p) => {
-        exposedPorts[`${p.container}/tcp`] = {};
+        const port = `${p.container.trim()}/tcp`;
+        exposedPorts[port] = {};
+        if (p.host.trim()) {
+          portBindings[port] = [{ HostPort: p.host.trim() }];
+        }
       });
 
     const cmdArray = command.trim() ? command.split(" ") : undefined;
 
     createContainerMutation.mutate({
       params: { clientId },
-      query: { name: containerName.trim() || undefined },
       body: {
-        Image: image,
-        Cmd: cmdArray,
-        Env: envArray.length > 0 ? envArray : undefined,
-        ExposedPorts: Object.keys(exposedPorts).length > 0 ? exposedPorts : undefined,
+        name: containerName.trim() || undefined,
+        config: {
+          Image: image,
+          Cmd: cmdArray,
+          Env: envArray.length > 0 ? envArray : undefined,
+          ExposedPorts:
+            Object.keys(exposedPorts).length > 0 ? exposedPorts : undefined,
+        },
+        host_config:
+          Object.keys(portBindings).length > 0
+            ? { PortBindings: portBindings }
+            : undefined,
       },
     });
   };
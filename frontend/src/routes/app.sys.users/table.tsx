@@ -34,6 +34,7 @@ const AVAILABLE_ROLES = [
   { value: "docker_write", label: "Docker Write" },
   { value: "docker_update", label: "Docker Update" },
   { value: "docker_delete", label: "Docker Delete" },
+  { value: "docker_exec", label: "Docker Exec" },
   { value: "qemu_read", label: "QEMU Read" },
   { value: "qemu_write", label: "QEMU Write" },
   { value: "qemu_update", label: "QEMU Update" },
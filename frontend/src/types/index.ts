@@ -228,7 +228,20 @@ export namespace T {
 // Docker SDK Types (external types from docker/docker library - not auto-generated)
 const dockerClientInfoSchema = z.object({
   id: z.number(),
+  name: z.string(),
+  endpoint: z.string(),
+  tls: z.boolean(),
+  client_cert: z.boolean(),
   status: z.string(),
+  error: z.string().optional(),
+  last_ping: z.string().optional(),
+  latency_ms: z.number(),
+  engine_version: z.string().optional(),
+  api_version: z.string().optional(),
+  failures: z.number().optional(),
+  next_check: z.string().optional(),
+  created_at: z.string(),
+  updated_at: z.string(),
 });
 
 const dockerPortSchema = z.object({
@@ -305,9 +318,173 @@ const dockerImageSchema = z.object({
   Size: z.number(),
 });
 
+const containerLogLineSchema = z.object({
+  stream: z.enum(["stdout", "stderr"]),
+  timestamp: z.string().optional(),
+  line: z.string(),
+});
+
 const containerCreateResponseSchema = z.object({
-  Id: z.string(),
-  Warnings: z.array(z.string()).nullable(),
+  id: z.string(),
+  name: z.string(),
+  warnings: z.array(z.string()),
+  pulled: z.boolean(),
+  started: z.boolean(),
+  start_error: z.string().optional(),
+});
+
+const imagePullProgressSchema = z.object({
+  id: z.string().optional(),
+  status: z.string(),
+  current: z.number().optional(),
+  total: z.number().optional(),
+});
+
+// A line of the NDJSON stream of an image pull
+const imagePullEventSchema = z.object({
+  progress: imagePullProgressSchema.optional(),
+  result: z
+    .object({
+      image: z.string(),
+      id: z.string().optional(),
+      authenticated: z.boolean(),
+    })
+    .optional(),
+  error: z.string().optional(),
+});
+
+// A line of the NDJSON stream of an image build
+const imageBuildEventSchema = z.object({
+  output: z.string().optional(),
+  progress: imagePullProgressSchema.optional(),
+  result: z
+    .object({
+      id: z.string(),
+      tags: z.array(z.string()),
+    })
+    .optional(),
+  error: z.string().optional(),
+});
+
+const registryCredentialSchema = z.object({
+  id: z.number(),
+  registry: z.string(),
+  username: z.string(),
+  created_at: z.string(),
+  updated_at: z.string(),
+});
+
+const dockerVolumeSchema = z.object({
+  name: z.string(),
+  driver: z.string(),
+  mountpoint: z.string(),
+  scope: z.string(),
+  created_at: z.string().optional(),
+  labels: z.record(z.string(), z.string()),
+  options: z.record(z.string(), z.string()),
+  size: z.number(),
+  containers: z.array(
+    z.object({
+      id: z.string(),
+      name: z.string(),
+      state: z.string(),
+      destination: z.string(),
+      read_only: z.boolean(),
+    }),
+  ),
+});
+
+const networkSubnetSchema = z.object({
+  subnet: z.string(),
+  gateway: z.string().optional(),
+  ip_range: z.string().optional(),
+});
+
+const dockerNetworkDetailsSchema = z.object({
+  id: z.string(),
+  name: z.string(),
+  driver: z.string(),
+  scope: z.string(),
+  created: z.string(),
+  internal: z.boolean(),
+  attachable: z.boolean(),
+  ipv6: z.boolean(),
+  builtin: z.boolean(),
+  subnets: z.array(networkSubnetSchema),
+  labels: z.record(z.string(), z.string()),
+  options: z.record(z.string(), z.string()),
+  containers: z.array(
+    z.object({
+      id: z.string(),
+      name: z.string(),
+      ipv4_address: z.string().optional(),
+      ipv6_address: z.string().optional(),
+      mac_address: z.string().optional(),
+    }),
+  ),
+});
+
+const containerFileSchema = z.object({
+  name: z.string(),
+  path: z.string(),
+  type: z.enum(["file", "directory", "symlink", "other"]),
+  size: z.number(),
+  mode: z.string(),
+  mod_time: z.string(),
+  link_target: z.string().optional(),
+});
+
+const containerDirectorySchema = z.object({
+  path: z.string(),
+  entries: z.array(containerFileSchema),
+  truncated: z.boolean(),
+});
+
+const containerUploadResponseSchema = z.object({
+  path: z.string(),
+  files: z.array(z.string()),
+  size: z.number(),
+});
+
+const stackSchema = z.object({
+  id: z.number(),
+  client_id: z.number(),
+  name: z.string(),
+  status: z.enum(["running", "partial", "stopped"]),
+  service_count: z.number(),
+  running: z.number(),
+  created_at: z.string(),
+  updated_at: z.string(),
+});
+
+const stackDetailsSchema = stackSchema.extend({
+  compose: z.string(),
+  env: z.string().optional(),
+  services: z.array(
+    z.object({
+      name: z.string(),
+      image: z.string(),
+      container_id: z.string().optional(),
+      container_name: z.string().optional(),
+      state: z.string().optional(),
+      status: z.string().optional(),
+    }),
+  ),
+  networks: z.array(z.string()),
+  volumes: z.array(z.string()),
+});
+
+const stackDeployResponseSchema = z.object({
+  name: z.string(),
+  dry_run: z.boolean(),
+  changes: z.array(
+    z.object({
+      type: z.enum(["service", "network", "volume"]),
+      name: z.string(),
+      action: z.enum(["create", "recreate", "keep", "remove"]),
+      reason: z.string().optional(),
+    }),
+  ),
 });
 
 // Override virtualMachineWithInfoSchema to flatten the nested VirtualMachineInfo
@@ -336,6 +513,20 @@ export const Z = {
   dockerContainerSchema,
   dockerImageSchema,
   containerCreateResponseSchema,
+  containerLogLineSchema,
+  containerFileSchema,
+  containerDirectorySchema,
+  containerUploadResponseSchema,
+  imagePullProgressSchema,
+  imagePullEventSchema,
+  imageBuildEventSchema,
+  registryCredentialSchema,
+  dockerVolumeSchema,
+  networkSubnetSchema,
+  dockerNetworkDetailsSchema,
+  stackSchema,
+  stackDetailsSchema,
+  stackDeployResponseSchema,
   // Override for flattened VM type
   virtualMachineWithInfoSchema,
   isHttpError: (obj: any) => {
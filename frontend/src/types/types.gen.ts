@@ -86,6 +86,14 @@ export const RBAC_DOCKER_READ: RBACPolicy = "docker_read";
 export const RBAC_DOCKER_WRITE: RBACPolicy = "docker_write";
 export const RBAC_DOCKER_UPDATE: RBACPolicy = "docker_update";
 export const RBAC_DOCKER_DELETE: RBACPolicy = "docker_delete";
+/**
+ * RBAC_DOCKER_EXEC allows running commands inside containers, which is
+ * a shell on the host for privileged ones, so it is not implied by any
+ * other docker policy. Downloading and uploading container files, and
+ * creating containers with access to the host, are as powerful and
+ * require it too
+ */
+export const RBAC_DOCKER_EXEC: RBACPolicy = "docker_exec";
 export const RBAC_QEMU_READ: RBACPolicy = "qemu_read";
 export const RBAC_QEMU_WRITE: RBACPolicy = "qemu_write";
 export const RBAC_QEMU_UPDATE: RBACPolicy = "qemu_update";
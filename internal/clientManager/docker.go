@@ -2,193 +2,405 @@ package clientmanager
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"visory/internal/database/dockerhosts"
+	"visory/internal/models"
 	"visory/internal/utils"
 
 	"github.com/docker/docker/client"
 	"github.com/labstack/echo/v4"
 )
 
-type ClientInfo struct {
-	ID     int    `json:"id"`
-	Status string `json:"status"`
+const (
+	// pingTimeout bounds the connection test of a Docker host
+	pingTimeout = 10 * time.Second
+	// watchdogTick is how often the watchdog looks for hosts due a check
+	watchdogTick = 5 * time.Second
+	// healthCheckInterval spaces the checks of connected hosts
+	healthCheckInterval = 15 * time.Second
+	// Disconnected hosts are retried after retryMinBackoff, doubled on each
+	// failure up to retryMaxBackoff
+	retryMinBackoff = 5 * time.Second
+	retryMaxBackoff = 5 * time.Minute
+)
+
+// dockerClient is a configured Docker host with its client and the result of
+// its last health check. Hosts stay registered while they are unreachable so
+// their ID keeps resolving
+type dockerClient struct {
+	host dockerhosts.DockerHost
+	cli  *client.Client
+	err  error
+
+	lastPing      time.Time
+	latency       time.Duration
+	engineVersion string
+	apiVersion    string
+	failures      int
+	nextCheck     time.Time
+}
+
+// healthCheck is the outcome of probing a host
+type healthCheck struct {
+	cli           *client.Client
+	at            time.Time
+	latency       time.Duration
+	engineVersion string
+	apiVersion    string
+	err           error
 }
 
 type Docker struct {
 	Dispatcher   *utils.Dispatcher
 	Logger       *slog.Logger
-	clients      map[int]*client.Client
+	clients      map[int64]*dockerClient
 	clientsMutex sync.RWMutex
-	nextClientID int
 }
 
 // NewDockerService creates a new DockerService with dependency injection
 func NewDockerClientManager(dispatcher *utils.Dispatcher, logger *slog.Logger) *Docker {
 	return &Docker{
-		Dispatcher:   dispatcher.WithGroup("dockerClientManager"),
-		Logger:       logger.WithGroup("dockerClientManager"),
-		clients:      make(map[int]*client.Client),
-		nextClientID: 0,
+		Dispatcher: dispatcher.WithGroup("dockerClientManager"),
+		Logger:     logger.WithGroup("dockerClientManager"),
+		clients:    make(map[int64]*dockerClient),
+	}
+}
+
+// NewClient creates a Docker client for a host without connecting to it. It
+// fails when the endpoint or the TLS certificates are invalid
+func NewClient(host dockerhosts.DockerHost) (*client.Client, error) {
+	opts := []client.Opt{client.WithAPIVersionNegotiation()}
+	if host.Endpoint == "" {
+		opts = append(opts, client.FromEnv)
+	}
+
+	tlsConfig, err := hostTLSConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		// The transport has to be set before the host, which picks https
+		// when the transport carries a TLS configuration
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}))
+	}
+
+	if host.Endpoint != "" {
+		if _, err := client.ParseHostURL(host.Endpoint); err != nil {
+			return nil, fmt.Errorf("invalid endpoint: %w", err)
+		}
+		opts = append(opts, client.WithHost(host.Endpoint))
+	}
+	return client.NewClientWithOpts(opts...)
+}
+
+// hostTLSConfig builds the TLS configuration of a host from its PEM encoded
+// certificates, nil when none are set
+func hostTLSConfig(host dockerhosts.DockerHost) (*tls.Config, error) {
+	ca, cert, key := pemValue(host.TlsCa), pemValue(host.TlsCert), pemValue(host.TlsKey)
+	if ca == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, errors.New("invalid TLS CA certificate")
+		}
+		cfg.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("TLS client certificate and key must be set together")
+		}
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
+
+func pemValue(v *string) string {
+	if v == nil {
+		return ""
 	}
+	return strings.TrimSpace(*v)
 }
 
-// RegisterClient registers a new Docker client and returns the assigned ID
-func (s *Docker) RegisterClient(endpoint string, cli *client.Client) int {
+// Connect registers a host under its database ID, replacing any previous
+// client of that host, and tests the connection. The host is registered even
+// when it cannot be reached, the watchdog keeps retrying it
+func (s *Docker) Connect(host dockerhosts.DockerHost) error {
+	entry := &dockerClient{host: host}
+	check := s.probe(host, nil)
 	s.clientsMutex.Lock()
-	defer s.clientsMutex.Unlock()
+	previous := s.clients[host.ID]
+	s.clients[host.ID] = entry
+	entry.cli = check.cli
+	entry.record(check)
+	s.clientsMutex.Unlock()
+	if previous != nil && previous.cli != nil {
+		previous.cli.Close()
+	}
+
+	if check.err != nil {
+		s.Logger.Error("failed to connect docker client", "id", host.ID, "name", host.Name, "endpoint", host.Endpoint, "error", check.err)
+		return check.err
+	}
+	s.Logger.Info("Docker client registered", "id", host.ID, "name", host.Name, "endpoint", host.Endpoint, "version", check.engineVersion)
+	return nil
+}
+
+// probe checks a host with its current client. Without a client, a new one
+// is created, so a dropped connection is fully re-established
+func (s *Docker) probe(host dockerhosts.DockerHost, cli *client.Client) healthCheck {
+	check := healthCheck{cli: cli, at: time.Now()}
+	if check.cli == nil {
+		check.cli, check.err = NewClient(host)
+		if check.err != nil {
+			return check
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	ping, err := check.cli.Ping(ctx)
+	check.latency = time.Since(check.at)
+	if err != nil {
+		check.err = err
+		return check
+	}
+	check.apiVersion = ping.APIVersion
+	version, err := check.cli.ServerVersion(ctx)
+	if err != nil {
+		check.err = err
+		return check
+	}
+	check.engineVersion = version.Version
+	return check
+}
 
-	id := s.nextClientID
-	s.clients[id] = cli
-	s.nextClientID++
+// record stores the outcome of a check and schedules the next one. The
+// caller holds clientsMutex
+func (e *dockerClient) record(check healthCheck) {
+	e.err = check.err
+	e.lastPing = check.at
+	e.latency = check.latency
+	if check.err != nil {
+		e.failures++
+		backoff := retryMinBackoff << min(e.failures-1, 10)
+		e.nextCheck = check.at.Add(min(backoff, retryMaxBackoff))
+		return
+	}
+	e.failures = 0
+	e.engineVersion = check.engineVersion
+	e.apiVersion = check.apiVersion
+	e.nextCheck = check.at.Add(healthCheckInterval)
+}
 
-	s.Logger.Info("Docker client registered", "id", id, "endpoint", endpoint)
-	return id
+// Remove closes and forgets the client of a host
+func (s *Docker) Remove(id int64) {
+	s.clientsMutex.Lock()
+	entry := s.clients[id]
+	delete(s.clients, id)
+	s.clientsMutex.Unlock()
+	if entry != nil && entry.cli != nil {
+		entry.cli.Close()
+	}
+}
+
+// Host returns a registered host and its connection state
+func (s *Docker) Host(id int64) (models.DockerHost, bool) {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	entry, ok := s.clients[id]
+	if !ok {
+		return models.DockerHost{}, false
+	}
+	return entry.info(), true
+}
+
+func (e *dockerClient) info() models.DockerHost {
+	info := models.DockerHost{
+		ID:         e.host.ID,
+		Name:       e.host.Name,
+		Endpoint:   e.host.Endpoint,
+		TLS:        pemValue(e.host.TlsCa) != "" || pemValue(e.host.TlsCert) != "",
+		ClientCert: pemValue(e.host.TlsCert) != "",
+		Status:     models.DockerHostConnected,
+		CreatedAt:  e.host.CreatedAt,
+		UpdatedAt:  e.host.UpdatedAt,
+	}
+	if !e.lastPing.IsZero() {
+		lastPing, nextCheck := e.lastPing, e.nextCheck
+		info.LastPing = &lastPing
+		info.NextCheck = &nextCheck
+		info.LatencyMs = float64(e.latency.Microseconds()) / 1000
+	}
+	info.EngineVersion = e.engineVersion
+	info.APIVersion = e.apiVersion
+	info.Failures = e.failures
+	if e.err != nil {
+		info.Status = models.DockerHostDisconnected
+		info.Error = e.err.Error()
+	}
+	return info
 }
 
 // GetClient retrieves a Docker client by ID from context
 func (s *Docker) GetClient(c echo.Context) (*client.Client, error) {
 	clientIDStr := c.Param("clientid")
-	clientID, err := strconv.Atoi(clientIDStr)
+	clientID, err := strconv.ParseInt(clientIDStr, 10, 64)
 	if err != nil {
-		return nil, s.Dispatcher.NewInternalServerError("Invalid client ID", err)
+		return nil, s.Dispatcher.NewBadRequest("Invalid client ID", err)
 	}
 
+	// The watchdog replaces the client of an entry under the lock. A client
+	// it replaces right after is still usable, closing it only drops its
+	// idle connections
 	s.clientsMutex.RLock()
-	cli, exists := s.clients[clientID]
+	entry, exists := s.clients[clientID]
+	var cli *client.Client
+	var cliErr error
+	if exists {
+		cli, cliErr = entry.cli, entry.err
+	}
 	s.clientsMutex.RUnlock()
 
 	if !exists {
-		return nil, s.Dispatcher.NewInternalServerError("Client not found", nil)
+		return nil, s.Dispatcher.NewNotFound("Client not found", nil)
+	}
+	if cli == nil {
+		return nil, s.Dispatcher.NewInternalServerError("Client is not available", cliErr)
 	}
 	return cli, nil
 }
 
-// ListClients returns all available Docker clients
-func (s *Docker) ListClients() []ClientInfo {
+// ListClients returns all configured Docker hosts ordered by ID
+func (s *Docker) ListClients() []models.DockerHost {
 	s.clientsMutex.RLock()
 	defer s.clientsMutex.RUnlock()
 
-	clients := make([]ClientInfo, 0, len(s.clients))
-	for id, cli := range s.clients {
-		status := "connected"
-		if cli == nil {
-			status = "disconnected"
-		}
-		clients = append(clients, ClientInfo{
-			ID:     id,
-			Status: status,
-		})
+	clients := make([]models.DockerHost, 0, len(s.clients))
+	for _, entry := range s.clients {
+		clients = append(clients, entry.info())
 	}
+	slices.SortFunc(clients, func(a, b models.DockerHost) int {
+		return int(a.ID - b.ID)
+	})
 	return clients
 }
 
-// WatchDogClients monitors the health of registered Docker clients forever
-func (s *Docker) WatchDogClients() {
-	for {
-		var wg sync.WaitGroup
-		for _, c := range s.clients {
-			wg.Add(1)
-			go func(c *client.Client) {
-				defer wg.Done()
-				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-				defer cancel()
-				_, err := c.Ping(ctx)
-				if err != nil {
-					s.Dispatcher.NewInternalServerError("Client health check failed", err)
-				}
-			}(c)
+// StartWatchdog checks the registered hosts until ctx is cancelled.
+// Connected hosts are pinged regularly, disconnected ones are reconnected
+// with a backoff, and every change of state is notified
+func (s *Docker) StartWatchdog(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(watchdogTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.checkClients(time.Now())
+			}
 		}
-		wg.Wait()
-		// Sleep before next health check iteration
-		time.Sleep(5 * time.Second)
-	}
+	}()
 }
 
-// GetAvailableClients returns all registered Docker clients
-func (s *Docker) GetAvailableClients(c echo.Context) error {
-	clients := s.ListClients()
-	return c.JSON(http.StatusOK, clients)
-}
-
-// func (s *Docker) IsValidClient(clientId string) (*client.Client, error) {
-// 	s.clientsMutex.RLock()
-// 	defer s.clientsMutex.RUnlock()
-// 	id, err := strconv.Atoi(clientId)
-// 	if err != nil {
-// 		return nil, s.Dispatcher.NewInternalServerError("Invalid client ID", err)
-// 	}
-// 	client, exists := s.clients[id]
-// 	if !exists {
-// 		return nil, s.Dispatcher.NewInternalServerError("Client not found", nil)
-// 	}
-// 	return client, nil
-// }
-
-// initializeDockerClients reads Docker client configurations from environment variables
-// and registers them with the Docker service
-func (s *Docker) InitializeDockerClients() {
-	// Look for VISORY_DOCKER_CLIENT_<ID> environment variables
-	for i := range 100 {
-		i++ // we start from 1 because 0 is reserved for default client
-		envKey := fmt.Sprintf("VISORY_DOCKER_CLIENT_%d", i)
-		endpoint := os.Getenv(envKey)
-		if endpoint == "" {
-			continue
-		}
-
-		endpoint = strings.TrimSpace(endpoint)
-
-		// Create Docker client
-		cli, err := client.NewClientWithOpts(
-			client.WithHost(endpoint),
-			client.WithAPIVersionNegotiation(),
-		)
-		if err != nil {
-			s.Logger.Error("failed to create docker client", "id", i, "endpoint", endpoint, "error", err)
-			continue
-		}
-
-		// Test connection
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		_, err = cli.Ping(ctx)
-		cancel()
-		if err != nil {
-			s.Logger.Error("failed to ping docker client", "id", i, "endpoint", endpoint, "error", err)
-			cli.Close()
-			continue
+// checkClients checks the hosts due a check at now, concurrently
+func (s *Docker) checkClients(now time.Time) {
+	s.clientsMutex.RLock()
+	var due []*dockerClient
+	for _, entry := range s.clients {
+		if !now.Before(entry.nextCheck) {
+			due = append(due, entry)
 		}
+	}
+	s.clientsMutex.RUnlock()
 
-		s.RegisterClient(endpoint, cli)
+	var wg sync.WaitGroup
+	for _, entry := range due {
+		wg.Add(1)
+		go func(entry *dockerClient) {
+			defer wg.Done()
+			s.checkClient(entry)
+		}(entry)
 	}
+	wg.Wait()
 }
 
-func (s *Docker) InitilizeDefaultDockerClient() {
-	// Create default Docker client
-	cli, err := client.NewClientWithOpts(
-		client.FromEnv,
-		client.WithAPIVersionNegotiation(),
-	)
-	if err != nil {
-		s.Logger.Error("failed to create default docker client", "error", err)
-		return
+func (s *Docker) checkClient(entry *dockerClient) {
+	s.clientsMutex.RLock()
+	host, cli, wasConnected := entry.host, entry.cli, entry.err == nil
+	s.clientsMutex.RUnlock()
+	if !wasConnected {
+		// Reconnect from scratch rather than reusing a client that may hold
+		// broken connections or a stale tunnel
+		cli = nil
 	}
+	check := s.probe(host, cli)
 
-	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	_, err = cli.Ping(ctx)
-	cancel()
-	if err != nil {
-		s.Logger.Error("failed to ping default docker client", "error", err)
-		cli.Close()
+	s.clientsMutex.Lock()
+	if s.clients[host.ID] != entry {
+		// The host was edited or removed while it was checked
+		s.clientsMutex.Unlock()
+		if check.cli != nil && check.cli != cli {
+			check.cli.Close()
+		}
 		return
 	}
-	s.RegisterClient("0", cli)
+	var stale *client.Client
+	if check.cli != nil && check.cli != entry.cli {
+		if check.err == nil {
+			stale, entry.cli = entry.cli, check.cli
+		} else {
+			stale = check.cli
+		}
+	}
+	entry.record(check)
+	info := entry.info()
+	s.clientsMutex.Unlock()
+	if stale != nil {
+		stale.Close()
+	}
+
+	fields := map[string]string{
+		"ID":       strconv.FormatInt(host.ID, 10),
+		"Endpoint": info.Endpoint,
+	}
+	switch {
+	case wasConnected && check.err != nil:
+		s.Logger.Warn("Docker host disconnected", "id", host.ID, "name", host.Name, "error", check.err)
+		fields["Error"] = check.err.Error()
+		s.Dispatcher.SendWarning("Docker host disconnected", fmt.Sprintf("'%s' cannot be reached", host.Name), fields)
+	case !wasConnected && check.err == nil:
+		s.Logger.Info("Docker host reconnected", "id", host.ID, "name", host.Name, "version", info.EngineVersion)
+		fields["Version"] = info.EngineVersion
+		s.Dispatcher.SendSuccess("Docker host reconnected", fmt.Sprintf("'%s' is reachable again", host.Name), fields)
+	case check.err != nil:
+		s.Logger.Debug("Docker host still unreachable", "id", host.ID, "name", host.Name, "failures", info.Failures, "error", check.err)
+	}
+}
+
+// GetAvailableClients returns all registered Docker clients
+func (s *Docker) GetAvailableClients(c echo.Context) error {
+	clients := s.ListClients()
+	return c.JSON(http.StatusOK, clients)
 }
@@ -0,0 +1,179 @@
+package clientmanager
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"visory/internal/database/dockerhosts"
+	"visory/internal/models"
+	"visory/internal/notifications"
+	"visory/internal/utils"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDaemon answers the ping and version endpoints of the Docker API while
+// it is up
+func fakeDaemon(t *testing.T, up *atomic.Bool) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "daemon is down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Api-Version", "1.47")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_ping"):
+			_, _ = w.Write([]byte("OK"))
+		case strings.HasSuffix(r.URL.Path, "/version"):
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"Version":"27.3.1","ApiVersion":"1.47"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "tcp://" + srv.Listener.Addr().String()
+}
+
+type recordingSender struct {
+	sent chan notifications.Notification
+}
+
+func (r *recordingSender) Name() string                                   { return "recording" }
+func (r *recordingSender) IsEnabled(notifications.NotificationLevel) bool { return true }
+func (r *recordingSender) Send(n notifications.Notification) error {
+	r.sent <- n
+	return nil
+}
+
+func (r *recordingSender) next(t *testing.T) notifications.Notification {
+	t.Helper()
+	select {
+	case n := <-r.sent:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification sent")
+		return notifications.Notification{}
+	}
+}
+
+// TestWatchdog tests health tracking, backoff and reconnection of a host
+func TestWatchdog(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	endpoint := fakeDaemon(t, &up)
+
+	sender := &recordingSender{sent: make(chan notifications.Notification, 4)}
+	notifier := notifications.NewManager()
+	notifier.RegisterSender(sender)
+	manager := NewDockerClientManager(utils.NewDispatcher(nil, notifier), slog.Default())
+
+	require.NoError(t, manager.Connect(dockerhosts.DockerHost{ID: 7, Name: "edge", Endpoint: endpoint}))
+	host, ok := manager.Host(7)
+	require.True(t, ok)
+	assert.Equal(t, models.DockerHostConnected, host.Status)
+	assert.Equal(t, "27.3.1", host.EngineVersion)
+	assert.Equal(t, "1.47", host.APIVersion)
+	require.NotNil(t, host.LastPing)
+	require.NotNil(t, host.NextCheck)
+	assert.Equal(t, healthCheckInterval, host.NextCheck.Sub(*host.LastPing))
+
+	// Nothing is due yet
+	manager.checkClients(time.Now())
+	after, _ := manager.Host(7)
+	assert.Equal(t, host.LastPing, after.LastPing)
+
+	up.Store(false)
+	manager.checkClients(time.Now().Add(healthCheckInterval))
+	host, _ = manager.Host(7)
+	assert.Equal(t, models.DockerHostDisconnected, host.Status)
+	assert.NotEmpty(t, host.Error)
+	assert.Equal(t, 1, host.Failures)
+	assert.Equal(t, retryMinBackoff, host.NextCheck.Sub(*host.LastPing))
+	n := sender.next(t)
+	assert.Equal(t, notifications.LevelWarning, n.Level)
+	assert.Equal(t, "Docker host disconnected", n.Title)
+
+	// Still down: the retry is backed off further and nothing is notified
+	manager.checkClients(host.NextCheck.Add(time.Second))
+	host, _ = manager.Host(7)
+	assert.Equal(t, 2, host.Failures)
+	assert.Equal(t, 2*retryMinBackoff, host.NextCheck.Sub(*host.LastPing))
+
+	up.Store(true)
+	manager.checkClients(host.NextCheck.Add(time.Second))
+	host, _ = manager.Host(7)
+	assert.Equal(t, models.DockerHostConnected, host.Status)
+	assert.Empty(t, host.Error)
+	assert.Zero(t, host.Failures)
+	n = sender.next(t)
+	assert.Equal(t, notifications.LevelSuccess, n.Level)
+	assert.Equal(t, "Docker host reconnected", n.Title)
+	select {
+	case n := <-sender.sent:
+		t.Fatalf("unexpected notification %q", n.Title)
+	default:
+	}
+}
+
+// TestWatchdogRetriesFailedStartup tests that a host unreachable when it was
+// registered is connected by the watchdog once it comes up
+func TestWatchdogRetriesFailedStartup(t *testing.T) {
+	var up atomic.Bool
+	endpoint := fakeDaemon(t, &up)
+	manager := NewDockerClientManager(utils.NewDispatcher(nil, nil), slog.Default())
+
+	assert.Error(t, manager.Connect(dockerhosts.DockerHost{ID: 1, Name: "late", Endpoint: endpoint}))
+	host, ok := manager.Host(1)
+	require.True(t, ok)
+	assert.Equal(t, models.DockerHostDisconnected, host.Status)
+
+	up.Store(true)
+	manager.checkClients(host.NextCheck.Add(time.Second))
+	host, _ = manager.Host(1)
+	assert.Equal(t, models.DockerHostConnected, host.Status)
+	assert.Equal(t, "27.3.1", host.EngineVersion)
+}
+
+// TestGetClientDuringReconnect tests that handlers get a client while the
+// watchdog replaces it. Run with -race
+func TestGetClientDuringReconnect(t *testing.T) {
+	var up atomic.Bool
+	endpoint := fakeDaemon(t, &up)
+	manager := NewDockerClientManager(utils.NewDispatcher(nil, nil), slog.Default())
+	assert.Error(t, manager.Connect(dockerhosts.DockerHost{ID: 1, Name: "flaky", Endpoint: endpoint}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		now := time.Now()
+		for i := range 20 {
+			up.Store(i%2 == 1)
+			now = now.Add(retryMaxBackoff + healthCheckInterval)
+			manager.checkClients(now)
+		}
+	}()
+
+	e := echo.New()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		c.SetParamNames("clientid")
+		c.SetParamValues("1")
+		cli, err := manager.GetClient(c)
+		require.NoError(t, err)
+		require.NotNil(t, cli)
+	}
+}
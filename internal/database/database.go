@@ -8,8 +8,12 @@ import (
 	"log/slog"
 	"time"
 
+	"visory/internal/database/backups"
+	"visory/internal/database/dockerhosts"
+	"visory/internal/database/dockerstacks"
 	"visory/internal/database/logs"
 	"visory/internal/database/notifications"
+	"visory/internal/database/registries"
 	"visory/internal/database/sessions"
 	"visory/internal/database/user"
 	"visory/internal/models"
@@ -40,6 +44,10 @@ type Service struct {
 	Session      *sessions.Queries
 	Log          *logs.Queries
 	Notification *notifications.Queries
+	Backup       *backups.Queries
+	DockerHost   *dockerhosts.Queries
+	DockerStack  *dockerstacks.Queries
+	Registry     *registries.Queries
 }
 
 func New() *Service {
@@ -85,6 +93,10 @@ func New() *Service {
 		Session:      sessions.New(db),
 		Log:          logs.New(db),
 		Notification: notifications.New(db),
+		Backup:       backups.New(db),
+		DockerHost:   dockerhosts.New(db),
+		DockerStack:  dockerstacks.New(db),
+		Registry:     registries.New(db),
 	}
 	return dbInstance
 }
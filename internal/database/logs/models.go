@@ -8,6 +8,27 @@ import (
 	"time"
 )
 
+type DockerHost struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Endpoint  string    `json:"endpoint"`
+	TlsCa     *string   `json:"tls_ca"`
+	TlsCert   *string   `json:"tls_cert"`
+	TlsKey    *string   `json:"tls_key"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type DockerStack struct {
+	ID        int64     `json:"id"`
+	ClientID  int64     `json:"client_id"`
+	Name      string    `json:"name"`
+	Compose   string    `json:"compose"`
+	Env       *string   `json:"env"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
 type Log struct {
 	ID           int64     `json:"id"`
 	UserID       int64     `json:"user_id"`
@@ -40,6 +61,15 @@ type NotificationSetting struct {
 	UpdatedAt     time.Time `json:"updated_at"`
 }
 
+type RegistryCredential struct {
+	ID        int64     `json:"id"`
+	Registry  string    `json:"registry"`
+	Username  string    `json:"username"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
 type User struct {
 	ID        int64     `json:"id"`
 	Username  string    `json:"username"`
@@ -57,3 +87,33 @@ type UserSession struct {
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 }
+
+type VmBackup struct {
+	ID          int64      `json:"id"`
+	VmUuid      string     `json:"vm_uuid"`
+	VmName      string     `json:"vm_name"`
+	Mode        string     `json:"mode"`
+	Status      string     `json:"status"`
+	ParentID    *int64     `json:"parent_id"`
+	Checkpoint  *string    `json:"checkpoint"`
+	Path        string     `json:"path"`
+	SizeBytes   int64      `json:"size_bytes"`
+	Error       *string    `json:"error"`
+	Scheduled   bool       `json:"scheduled"`
+	CreatedBy   int64      `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+type VmBackupPolicy struct {
+	ID              int64      `json:"id"`
+	VmUuid          string     `json:"vm_uuid"`
+	Enabled         bool       `json:"enabled"`
+	IntervalMinutes int64      `json:"interval_minutes"`
+	Mode            string     `json:"mode"`
+	FullEvery       int64      `json:"full_every"`
+	Retention       int64      `json:"retention"`
+	LastRunAt       *time.Time `json:"last_run_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
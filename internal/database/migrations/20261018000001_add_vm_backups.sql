@@ -0,0 +1,42 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE vm_backups (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  vm_uuid TEXT NOT NULL,
+  vm_name TEXT NOT NULL,
+  mode TEXT NOT NULL,
+  status TEXT NOT NULL,
+  parent_id INTEGER,
+  checkpoint TEXT,
+  path TEXT NOT NULL,
+  size_bytes INTEGER NOT NULL DEFAULT 0,
+  error TEXT,
+  scheduled BOOLEAN NOT NULL DEFAULT FALSE,
+  created_by INTEGER NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  completed_at TIMESTAMP,
+  FOREIGN KEY (parent_id) REFERENCES vm_backups (id)
+);
+
+CREATE INDEX idx_vm_backups_vm_uuid ON vm_backups (vm_uuid);
+
+CREATE TABLE vm_backup_policies (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  vm_uuid TEXT NOT NULL UNIQUE,
+  enabled BOOLEAN NOT NULL DEFAULT TRUE,
+  interval_minutes INTEGER NOT NULL,
+  mode TEXT NOT NULL DEFAULT 'full',
+  full_every INTEGER NOT NULL DEFAULT 7,
+  retention INTEGER NOT NULL DEFAULT 7,
+  last_run_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_vm_backups_vm_uuid;
+DROP TABLE IF EXISTS vm_backups;
+DROP TABLE IF EXISTS vm_backup_policies;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE docker_hosts (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL UNIQUE,
+  endpoint TEXT NOT NULL DEFAULT '',
+  tls_ca TEXT,
+  tls_cert TEXT,
+  tls_key TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+-- The local daemon, an empty endpoint follows DOCKER_HOST
+INSERT INTO docker_hosts (name, endpoint) VALUES ('local', '');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS docker_hosts;
+-- +goose StatementEnd
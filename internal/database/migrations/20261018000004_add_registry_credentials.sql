@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The secret is the password or token, encrypted with CREDENTIALS_KEY
+CREATE TABLE registry_credentials (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  registry TEXT NOT NULL UNIQUE,
+  username TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS registry_credentials;
+-- +goose StatementEnd
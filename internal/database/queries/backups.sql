@@ -0,0 +1,123 @@
+-- name: CreateBackup :one
+INSERT INTO vm_backups (
+  vm_uuid,
+  vm_name,
+  mode,
+  status,
+  parent_id,
+  checkpoint,
+  path,
+  scheduled,
+  created_by
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+RETURNING *;
+
+-- name: CompleteBackup :one
+UPDATE vm_backups
+SET
+  status = ?,
+  size_bytes = ?,
+  error = ?,
+  completed_at = CURRENT_TIMESTAMP
+WHERE
+  id = ?
+RETURNING *;
+
+-- name: FailRunningBackups :exec
+UPDATE vm_backups
+SET
+  status = 'failed',
+  error = 'interrupted by restart',
+  completed_at = CURRENT_TIMESTAMP
+WHERE
+  status = 'running';
+
+-- name: GetBackupByID :one
+SELECT
+  *
+FROM
+  vm_backups
+WHERE
+  id = ?;
+
+-- name: ListBackups :many
+SELECT
+  *
+FROM
+  vm_backups
+ORDER BY
+  created_at DESC, id DESC;
+
+-- name: ListBackupsByVM :many
+SELECT
+  *
+FROM
+  vm_backups
+WHERE
+  vm_uuid = ?
+ORDER BY
+  created_at DESC, id DESC;
+
+-- name: GetLatestCompletedBackupByVM :one
+SELECT
+  *
+FROM
+  vm_backups
+WHERE
+  vm_uuid = ? AND status = 'completed'
+ORDER BY
+  created_at DESC, id DESC
+LIMIT 1;
+
+-- name: CountBackupChildren :one
+SELECT
+  COUNT(*)
+FROM
+  vm_backups
+WHERE
+  parent_id = ?;
+
+-- name: DeleteBackup :exec
+DELETE FROM vm_backups WHERE id = ?;
+
+-- name: GetBackupPolicyByVM :one
+SELECT
+  *
+FROM
+  vm_backup_policies
+WHERE
+  vm_uuid = ?;
+
+-- name: ListEnabledBackupPolicies :many
+SELECT
+  *
+FROM
+  vm_backup_policies
+WHERE
+  enabled = TRUE;
+
+-- name: UpsertBackupPolicy :one
+INSERT INTO vm_backup_policies (
+  vm_uuid,
+  enabled,
+  interval_minutes,
+  mode,
+  full_every,
+  retention,
+  updated_at
+) VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+ON CONFLICT(vm_uuid) DO UPDATE SET
+  enabled = excluded.enabled,
+  interval_minutes = excluded.interval_minutes,
+  mode = excluded.mode,
+  full_every = excluded.full_every,
+  retention = excluded.retention,
+  updated_at = CURRENT_TIMESTAMP
+RETURNING *;
+
+-- name: UpdateBackupPolicyLastRun :exec
+UPDATE vm_backup_policies
+SET
+  last_run_at = ?
+WHERE
+  vm_uuid = ?;
@@ -0,0 +1,43 @@
+-- name: ListDockerHosts :many
+SELECT
+  *
+FROM
+  docker_hosts
+ORDER BY
+  id;
+
+-- name: GetDockerHostByID :one
+SELECT
+  *
+FROM
+  docker_hosts
+WHERE
+  id = ?;
+
+-- name: CreateDockerHost :one
+INSERT INTO docker_hosts (
+  name,
+  endpoint,
+  tls_ca,
+  tls_cert,
+  tls_key
+) VALUES (?, ?, ?, ?, ?)
+RETURNING *;
+
+-- name: UpdateDockerHost :one
+UPDATE docker_hosts
+SET
+  name = ?,
+  endpoint = ?,
+  tls_ca = ?,
+  tls_cert = ?,
+  tls_key = ?,
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  id = ?
+RETURNING *;
+
+-- name: DeleteDockerHost :exec
+DELETE FROM docker_hosts
+WHERE
+  id = ?;
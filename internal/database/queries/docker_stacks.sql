@@ -0,0 +1,47 @@
+-- name: ListDockerStacks :many
+SELECT
+  *
+FROM
+  docker_stacks
+WHERE
+  client_id = ?
+ORDER BY
+  name;
+
+-- name: GetDockerStack :one
+SELECT
+  *
+FROM
+  docker_stacks
+WHERE
+  client_id = ?
+  AND name = ?;
+
+-- name: CreateDockerStack :one
+INSERT INTO docker_stacks (
+  client_id,
+  name,
+  compose,
+  env
+) VALUES (?, ?, ?, ?)
+RETURNING *;
+
+-- name: UpdateDockerStack :one
+UPDATE docker_stacks
+SET
+  compose = ?,
+  env = ?,
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  id = ?
+RETURNING *;
+
+-- name: DeleteDockerStack :exec
+DELETE FROM docker_stacks
+WHERE
+  id = ?;
+
+-- name: DeleteDockerStacksByClient :exec
+DELETE FROM docker_stacks
+WHERE
+  client_id = ?;
@@ -0,0 +1,47 @@
+-- name: ListRegistryCredentials :many
+SELECT
+  *
+FROM
+  registry_credentials
+ORDER BY
+  registry;
+
+-- name: GetRegistryCredentialByID :one
+SELECT
+  *
+FROM
+  registry_credentials
+WHERE
+  id = ?;
+
+-- name: GetRegistryCredentialByRegistry :one
+SELECT
+  *
+FROM
+  registry_credentials
+WHERE
+  registry = ?;
+
+-- name: CreateRegistryCredential :one
+INSERT INTO registry_credentials (
+  registry,
+  username,
+  secret
+) VALUES (?, ?, ?)
+RETURNING *;
+
+-- name: UpdateRegistryCredential :one
+UPDATE registry_credentials
+SET
+  registry = ?,
+  username = ?,
+  secret = ?,
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  id = ?
+RETURNING *;
+
+-- name: DeleteRegistryCredential :exec
+DELETE FROM registry_credentials
+WHERE
+  id = ?;
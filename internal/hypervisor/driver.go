@@ -0,0 +1,104 @@
+// Package hypervisor abstracts the hypervisor calls made by the QEMU and
+// backup services so they can run against libvirt or an in-memory fake.
+package hypervisor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Driver is the subset of the libvirt API visory uses. Method signatures
+// mirror go-libvirt so *libvirt.Libvirt satisfies it as is
+type Driver interface {
+	// Host
+	ConnectGetCapabilities() (string, error)
+	NodeGetInfo() (rModel [32]int8, rMemory uint64, rCpus int32, rMhz int32, rNodes int32, rSockets int32, rCores int32, rThreads int32, err error)
+	NodeGetFreeMemory() (uint64, error)
+
+	// Listing and lookup
+	ConnectListAllDomains(NeedResults int32, Flags libvirt.ConnectListAllDomainsFlags) ([]libvirt.Domain, uint32, error)
+	ConnectGetAllDomainStats(Doms []libvirt.Domain, Stats uint32, Flags uint32) ([]libvirt.DomainStatsRecord, error)
+	DomainLookupByUUID(UUID libvirt.UUID) (libvirt.Domain, error)
+	DomainGetInfo(Dom libvirt.Domain) (uint8, uint64, uint64, uint16, uint64, error)
+	DomainGetXMLDesc(Dom libvirt.Domain, Flags libvirt.DomainXMLFlags) (string, error)
+	DomainIsActive(Dom libvirt.Domain) (int32, error)
+	DomainIsPersistent(Dom libvirt.Domain) (int32, error)
+
+	// Lifecycle
+	DomainCreateXML(XMLDesc string, Flags libvirt.DomainCreateFlags) (libvirt.Domain, error)
+	DomainDefineXML(XML string) (libvirt.Domain, error)
+	DomainDefineXMLFlags(XML string, Flags libvirt.DomainDefineFlags) (libvirt.Domain, error)
+	DomainUndefineFlags(Dom libvirt.Domain, Flags libvirt.DomainUndefineFlagsValues) error
+	DomainCreate(Dom libvirt.Domain) error
+	DomainCreateWithFlags(Dom libvirt.Domain, Flags uint32) (libvirt.Domain, error)
+	DomainResume(Dom libvirt.Domain) error
+	DomainReboot(Dom libvirt.Domain, Flags libvirt.DomainRebootFlagValues) error
+	DomainShutdown(Dom libvirt.Domain) error
+	LifecycleEvents(ctx context.Context) (<-chan libvirt.DomainEventLifecycleMsg, error)
+
+	// Devices
+	DomainUpdateDeviceFlags(Dom libvirt.Domain, XML string, Flags libvirt.DomainDeviceModifyFlags) error
+
+	// Display and metadata
+	DomainScreenshot(Dom libvirt.Domain, inStream io.Writer, Screen uint32, Flags uint32) (libvirt.OptString, error)
+	DomainSetMetadata(Dom libvirt.Domain, Type int32, Metadata libvirt.OptString, Key libvirt.OptString, Uri libvirt.OptString, Flags libvirt.DomainModificationImpact) error
+
+	// Backups
+	DomainBackupBegin(Dom libvirt.Domain, BackupXML string, CheckpointXML libvirt.OptString, Flags libvirt.DomainBackupBeginFlags) error
+	DomainGetJobStats(Dom libvirt.Domain, Flags libvirt.DomainGetJobStatsFlags) (int32, []libvirt.TypedParam, error)
+	DomainAbortJob(Dom libvirt.Domain) error
+	DomainCheckpointLookupByName(Dom libvirt.Domain, Name string, Flags uint32) (libvirt.DomainCheckpoint, error)
+	DomainCheckpointDelete(Checkpoint libvirt.DomainCheckpoint, Flags libvirt.DomainCheckpointDeleteFlags) error
+}
+
+// DiskCreator is implemented by drivers that provision disk images
+// themselves instead of relying on qemu-img on the host
+type DiskCreator interface {
+	CreateDiskImage(path string, sizeMB uint) (string, error)
+}
+
+// DiskImageTool is implemented by drivers that inspect and convert disk
+// images themselves instead of relying on qemu-img on the host
+type DiskImageTool interface {
+	DiskImageInfo(path string) ([]models.DiskImageLayer, error)
+	ConvertDiskImage(ctx context.Context, src, dst string, opts utils.DiskConvertOptions) error
+}
+
+var _ DiskImageTool = utils.QemuImg{}
+
+// Driver names accepted by New
+const (
+	DriverLibvirt = "libvirt"
+	DriverFake    = "fake"
+)
+
+var _ Driver = (*libvirt.Libvirt)(nil)
+
+// New returns the driver called name. The libvirt driver connects to the
+// local QEMU session, the fake driver is seeded with a few demo domains
+func New(name string) (Driver, error) {
+	switch name {
+	case "", DriverLibvirt:
+		uri, _ := url.Parse(string(libvirt.QEMUSession))
+		l, err := libvirt.ConnectToURI(uri)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	case DriverFake:
+		f := NewFake()
+		if err := f.SeedDemo(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("unknown hypervisor driver %q", name)
+	}
+}
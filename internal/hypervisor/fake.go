@@ -0,0 +1,1023 @@
+package hypervisor
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/gofrs/uuid"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	fakeScreenWidth  = 640
+	fakeScreenHeight = 400
+	fakeVNCBasePort  = 5900
+)
+
+// The fake host has two NUMA nodes, each with two cores of two threads
+const (
+	fakeHostNodes         = 2
+	fakeHostCoresPerNode  = 2
+	fakeHostThreads       = 2
+	fakeHostNodeMemoryKiB = 16 * 1024 * 1024
+	fakeHostHugepages     = 512 // 2 MiB pages per node
+)
+
+// Fake is an in-memory Driver. Domains only exist inside the process, which
+// makes it suitable for tests and for running the dashboard without KVM
+type Fake struct {
+	mu      sync.Mutex
+	domains map[libvirt.UUID]*fakeDomain
+	nextID  int32
+	subs    map[chan libvirt.DomainEventLifecycleMsg]struct{}
+}
+
+type fakeDomain struct {
+	def         libvirtxml.Domain
+	metadata    map[string]string // namespace URI -> element XML
+	state       uint8
+	id          int32
+	persistent  bool
+	startedAt   time.Time
+	cpuTime     uint64
+	checkpoints map[string]bool
+	lastJob     libvirt.DomainJobType
+}
+
+var (
+	_ Driver      = (*Fake)(nil)
+	_ DiskCreator = (*Fake)(nil)
+)
+
+// NewFake returns an empty fake driver
+func NewFake() *Fake {
+	return &Fake{
+		domains: map[libvirt.UUID]*fakeDomain{},
+		nextID:  1,
+		subs:    map[chan libvirt.DomainEventLifecycleMsg]struct{}{},
+	}
+}
+
+// SeedDemo defines a handful of labelled demo domains, two of them running
+func (f *Fake) SeedDemo() error {
+	demo := []struct {
+		name        string
+		description string
+		memoryMiB   uint
+		vcpus       uint
+		labels      map[string]string
+		running     bool
+	}{
+		{"demo-web", "Public web frontend", 2048, 2, map[string]string{"env": "demo", "role": "web"}, true},
+		{"demo-db", "PostgreSQL primary", 4096, 4, map[string]string{"env": "demo", "role": "database"}, true},
+		{"demo-build", "CI build agent", 1024, 1, map[string]string{"env": "demo", "role": "ci"}, false},
+	}
+
+	for _, d := range demo {
+		meta := &utils.VMMetadata{}
+		meta.SetLabels(d.labels)
+		metaXML, err := meta.Marshal()
+		if err != nil {
+			return err
+		}
+		def := libvirtxml.Domain{
+			Type:          "kvm",
+			Name:          d.name,
+			Description:   d.description,
+			Metadata:      &libvirtxml.DomainMetadata{XML: metaXML},
+			Memory:        &libvirtxml.DomainMemory{Value: d.memoryMiB, Unit: "MiB"},
+			CurrentMemory: &libvirtxml.DomainCurrentMemory{Value: d.memoryMiB, Unit: "MiB"},
+			VCPU:          &libvirtxml.DomainVCPU{Placement: "static", Value: d.vcpus},
+			OS:            &libvirtxml.DomainOS{Type: &libvirtxml.DomainOSType{Arch: "x86_64", Type: "hvm"}},
+			Devices: &libvirtxml.DomainDeviceList{
+				Graphics: []libvirtxml.DomainGraphic{{VNC: &libvirtxml.DomainGraphicVNC{AutoPort: "yes", Listen: "127.0.0.1"}}},
+			},
+		}
+		domXML, err := def.Marshal()
+		if err != nil {
+			return err
+		}
+		dom, err := f.DomainDefineXML(domXML)
+		if err != nil {
+			return err
+		}
+		if d.running {
+			if err := f.DomainCreate(dom); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *Fake) ConnectGetCapabilities() (string, error) {
+	caps := libvirtxml.Caps{
+		Host: libvirtxml.CapsHost{
+			CPU: &libvirtxml.CapsHostCPU{
+				Arch:   "x86_64",
+				Model:  "Fake-Host-CPU",
+				Vendor: "Visory",
+				Topology: &libvirtxml.CapsHostCPUTopology{
+					Sockets: fakeHostNodes,
+					Cores:   fakeHostCoresPerNode,
+					Threads: fakeHostThreads,
+				},
+			},
+			NUMA: &libvirtxml.CapsHostNUMATopology{
+				Cells: &libvirtxml.CapsHostNUMACells{Num: fakeHostNodes},
+			},
+		},
+	}
+
+	cpu := 0
+	for node := range fakeHostNodes {
+		cell := libvirtxml.CapsHostNUMACell{
+			ID:     node,
+			Memory: &libvirtxml.CapsHostNUMAMemory{Size: fakeHostNodeMemoryKiB, Unit: "KiB"},
+			PageInfo: []libvirtxml.CapsHostNUMAPageInfo{
+				{Size: 4, Unit: "KiB", Count: fakeHostNodeMemoryKiB / 4},
+				{Size: 2048, Unit: "KiB", Count: fakeHostHugepages},
+				{Size: 1048576, Unit: "KiB", Count: 0},
+			},
+			CPUS: &libvirtxml.CapsHostNUMACPUs{Num: fakeHostCoresPerNode * fakeHostThreads},
+		}
+		for core := range fakeHostCoresPerNode {
+			first := cpu
+			for range fakeHostThreads {
+				socket, coreID := node, core
+				cell.CPUS.CPUs = append(cell.CPUS.CPUs, libvirtxml.CapsHostNUMACPU{
+					ID:       cpu,
+					SocketID: &socket,
+					CoreID:   &coreID,
+					Siblings: fmt.Sprintf("%d-%d", first, first+fakeHostThreads-1),
+				})
+				cpu++
+			}
+		}
+		caps.Host.NUMA.Cells.Cells = append(caps.Host.NUMA.Cells.Cells, cell)
+	}
+	return caps.Marshal()
+}
+
+// NodeGetInfo reports the fake host described by ConnectGetCapabilities.
+// Memory is in KiB
+func (f *Fake) NodeGetInfo() ([32]int8, uint64, int32, int32, int32, int32, int32, int32, error) {
+	var model [32]int8
+	for i, b := range []byte("x86_64") {
+		model[i] = int8(b)
+	}
+	cpus := int32(fakeHostNodes * fakeHostCoresPerNode * fakeHostThreads)
+	return model, fakeHostNodes * fakeHostNodeMemoryKiB, cpus, 2400, fakeHostNodes, 1, fakeHostCoresPerNode, fakeHostThreads, nil
+}
+
+// NodeGetFreeMemory returns the host memory not used by running domains,
+// in bytes
+func (f *Fake) NodeGetFreeMemory() (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	free := uint64(fakeHostNodes*fakeHostNodeMemoryKiB) * 1024
+	for _, d := range f.domains {
+		if d.active() {
+			free -= min(free, d.memoryKiB()*1024)
+		}
+	}
+	return free, nil
+}
+
+func (f *Fake) ConnectListAllDomains(NeedResults int32, Flags libvirt.ConnectListAllDomainsFlags) ([]libvirt.Domain, uint32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	wantActive := Flags&libvirt.ConnectListDomainsActive != 0
+	wantInactive := Flags&libvirt.ConnectListDomainsInactive != 0
+	if !wantActive && !wantInactive {
+		wantActive, wantInactive = true, true
+	}
+
+	var out []libvirt.Domain
+	for _, d := range f.sorted() {
+		if (d.active() && wantActive) || (!d.active() && wantInactive) {
+			out = append(out, d.handle())
+		}
+	}
+	return out, uint32(len(out)), nil
+}
+
+func (f *Fake) ConnectGetAllDomainStats(Doms []libvirt.Domain, Stats uint32, Flags uint32) ([]libvirt.DomainStatsRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var domains []*fakeDomain
+	if len(Doms) == 0 {
+		wantActive := Flags&uint32(libvirt.ConnectGetAllDomainsStatsActive) != 0
+		wantInactive := Flags&uint32(libvirt.ConnectGetAllDomainsStatsInactive) != 0
+		for _, d := range f.sorted() {
+			if (!wantActive && !wantInactive) || (d.active() && wantActive) || (!d.active() && wantInactive) {
+				domains = append(domains, d)
+			}
+		}
+	} else {
+		for _, dom := range Doms {
+			d, err := f.lookup(dom)
+			if err != nil {
+				return nil, err
+			}
+			domains = append(domains, d)
+		}
+	}
+
+	records := make([]libvirt.DomainStatsRecord, 0, len(domains))
+	for _, d := range domains {
+		var params []libvirt.TypedParam
+		if Stats&uint32(libvirt.DomainStatsState) != 0 {
+			params = append(params,
+				libvirt.TypedParam{Field: "state.state", Value: libvirt.TypedParamValue{D: 1, I: int32(d.state)}},
+				libvirt.TypedParam{Field: "state.reason", Value: libvirt.TypedParamValue{D: 1, I: int32(0)}},
+			)
+		}
+		if Stats&uint32(libvirt.DomainStatsCPUTotal) != 0 {
+			params = append(params, libvirt.TypedParam{Field: "cpu.time", Value: libvirt.TypedParamValue{D: 4, I: d.currentCPUTime()}})
+		}
+		if Stats&uint32(libvirt.DomainStatsBalloon) != 0 {
+			params = append(params,
+				libvirt.TypedParam{Field: "balloon.current", Value: libvirt.TypedParamValue{D: 4, I: d.memoryKiB()}},
+				libvirt.TypedParam{Field: "balloon.maximum", Value: libvirt.TypedParamValue{D: 4, I: d.memoryKiB()}},
+			)
+		}
+		if Stats&uint32(libvirt.DomainStatsVCPU) != 0 {
+			params = append(params,
+				libvirt.TypedParam{Field: "vcpu.current", Value: libvirt.TypedParamValue{D: 2, I: uint32(d.vcpus())}},
+				libvirt.TypedParam{Field: "vcpu.maximum", Value: libvirt.TypedParamValue{D: 2, I: uint32(d.vcpus())}},
+			)
+		}
+		records = append(records, libvirt.DomainStatsRecord{Dom: d.handle(), Params: params})
+	}
+	return records, nil
+}
+
+func (f *Fake) DomainLookupByUUID(UUID libvirt.UUID) (libvirt.Domain, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.domains[UUID]
+	if !ok {
+		return libvirt.Domain{}, errNoDomain
+	}
+	return d.handle(), nil
+}
+
+func (f *Fake) DomainGetInfo(Dom libvirt.Domain) (uint8, uint64, uint64, uint16, uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+	return d.state, d.memoryKiB(), d.memoryKiB(), d.vcpus(), d.currentCPUTime(), nil
+}
+
+func (f *Fake) DomainGetXMLDesc(Dom libvirt.Domain, Flags libvirt.DomainXMLFlags) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return "", err
+	}
+	return d.xml(Flags&libvirt.DomainXMLInactive == 0)
+}
+
+func (f *Fake) DomainIsActive(Dom libvirt.Domain) (int32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return 0, err
+	}
+	if d.active() {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (f *Fake) DomainIsPersistent(Dom libvirt.Domain) (int32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return 0, err
+	}
+	if d.persistent {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (f *Fake) DomainCreateXML(XMLDesc string, Flags libvirt.DomainCreateFlags) (libvirt.Domain, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.parse(XMLDesc)
+	if err != nil {
+		return libvirt.Domain{}, err
+	}
+	if err := f.checkUnique(d, false); err != nil {
+		return libvirt.Domain{}, err
+	}
+
+	f.domains[d.key()] = d
+	f.start(d)
+	if Flags&libvirt.DomainStartPaused != 0 {
+		d.state = uint8(libvirt.DomainPaused)
+	}
+	return d.handle(), nil
+}
+
+func (f *Fake) DomainDefineXML(XML string) (libvirt.Domain, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.parse(XML)
+	if err != nil {
+		return libvirt.Domain{}, err
+	}
+
+	if existing, ok := f.domains[d.key()]; ok {
+		existing.def = d.def
+		existing.metadata = d.metadata
+		existing.persistent = true
+		f.emit(existing, libvirt.DomainEventDefined, int32(libvirt.DomainEventDefinedUpdated))
+		return existing.handle(), nil
+	}
+	if err := f.checkUnique(d, true); err != nil {
+		return libvirt.Domain{}, err
+	}
+
+	d.persistent = true
+	f.domains[d.key()] = d
+	f.emit(d, libvirt.DomainEventDefined, int32(libvirt.DomainEventDefinedAdded))
+	return d.handle(), nil
+}
+
+func (f *Fake) DomainDefineXMLFlags(XML string, Flags libvirt.DomainDefineFlags) (libvirt.Domain, error) {
+	return f.DomainDefineXML(XML)
+}
+
+func (f *Fake) DomainUndefineFlags(Dom libvirt.Domain, Flags libvirt.DomainUndefineFlagsValues) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+	if !d.persistent {
+		return operationInvalid("cannot undefine transient domain")
+	}
+	// A running domain stays around as a transient one until it stops
+	d.persistent = false
+	f.emit(d, libvirt.DomainEventUndefined, int32(libvirt.DomainEventUndefinedRemoved))
+	if !d.active() {
+		delete(f.domains, d.key())
+	}
+	return nil
+}
+
+func (f *Fake) DomainCreateWithFlags(Dom libvirt.Domain, Flags uint32) (libvirt.Domain, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return libvirt.Domain{}, err
+	}
+	if d.active() {
+		return libvirt.Domain{}, operationInvalid("domain is already running")
+	}
+	f.start(d)
+	if Flags&uint32(libvirt.DomainStartPaused) != 0 {
+		d.state = uint8(libvirt.DomainPaused)
+	}
+	return d.handle(), nil
+}
+
+func (f *Fake) DomainCreate(Dom libvirt.Domain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+	if d.active() {
+		return operationInvalid("domain is already running")
+	}
+	f.start(d)
+	return nil
+}
+
+func (f *Fake) DomainResume(Dom libvirt.Domain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+	if d.state != uint8(libvirt.DomainPaused) {
+		return operationInvalid("domain is not paused")
+	}
+	d.state = uint8(libvirt.DomainRunning)
+	f.emit(d, libvirt.DomainEventResumed, int32(libvirt.DomainEventResumedUnpaused))
+	return nil
+}
+
+func (f *Fake) DomainReboot(Dom libvirt.Domain, Flags libvirt.DomainRebootFlagValues) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+	if !d.active() {
+		return operationInvalid("domain is not running")
+	}
+	return nil
+}
+
+func (f *Fake) DomainShutdown(Dom libvirt.Domain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+	if !d.active() {
+		return operationInvalid("domain is not running")
+	}
+	f.stop(d, int32(libvirt.DomainEventStoppedShutdown))
+	return nil
+}
+
+func (f *Fake) LifecycleEvents(ctx context.Context) (<-chan libvirt.DomainEventLifecycleMsg, error) {
+	ch := make(chan libvirt.DomainEventLifecycleMsg, 64)
+
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		delete(f.subs, ch)
+		close(ch)
+		f.mu.Unlock()
+	}()
+	return ch, nil
+}
+
+// DomainScreenshot writes a generated PPM image, distinct per domain
+// DomainUpdateDeviceFlags only supports changing the media of CD-ROM and
+// floppy drives, like QEMU does for live domains
+func (f *Fake) DomainUpdateDeviceFlags(Dom libvirt.Domain, XML string, Flags libvirt.DomainDeviceModifyFlags) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+	if Flags&libvirt.DomainDeviceModifyLive != 0 && !d.active() {
+		return operationInvalid("domain is not running")
+	}
+
+	var update libvirtxml.DomainDisk
+	if err := update.Unmarshal(XML); err != nil {
+		return fmt.Errorf("invalid device XML: %w", err)
+	}
+	if update.Target == nil {
+		return operationInvalid("device has no target")
+	}
+	if d.def.Devices != nil {
+		for i, disk := range d.def.Devices.Disks {
+			if disk.Target == nil || disk.Target.Dev != update.Target.Dev {
+				continue
+			}
+			if disk.Device != "cdrom" && disk.Device != "floppy" {
+				return operationInvalid("only cdrom and floppy media can be changed")
+			}
+			d.def.Devices.Disks[i].Source = update.Source
+			return nil
+		}
+	}
+	return operationInvalid(fmt.Sprintf("no disk with target %s", update.Target.Dev))
+}
+
+func (f *Fake) DomainScreenshot(Dom libvirt.Domain, inStream io.Writer, Screen uint32, Flags uint32) (libvirt.OptString, error) {
+	f.mu.Lock()
+	d, err := f.lookup(Dom)
+	if err == nil && !d.active() {
+		err = operationInvalid("domain is not running")
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	seed := Dom.UUID
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "P6\n%d %d\n255\n", fakeScreenWidth, fakeScreenHeight)
+	row := make([]byte, fakeScreenWidth*3)
+	for y := range fakeScreenHeight {
+		for x := range fakeScreenWidth {
+			row[x*3] = seed[0] ^ byte(x*255/fakeScreenWidth)
+			row[x*3+1] = seed[1] ^ byte(y*255/fakeScreenHeight)
+			row[x*3+2] = seed[2]
+		}
+		buf.Write(row)
+	}
+	if _, err := io.WriteString(inStream, buf.String()); err != nil {
+		return nil, err
+	}
+	return libvirt.OptString{"image/x-portable-pixmap"}, nil
+}
+
+func (f *Fake) DomainSetMetadata(Dom libvirt.Domain, Type int32, Metadata libvirt.OptString, Key libvirt.OptString, Uri libvirt.OptString, Flags libvirt.DomainModificationImpact) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+
+	value := ""
+	if len(Metadata) > 0 {
+		value = Metadata[0]
+	}
+	switch libvirt.DomainMetadataType(Type) {
+	case libvirt.DomainMetadataDescription:
+		d.def.Description = value
+	case libvirt.DomainMetadataTitle:
+		d.def.Title = value
+	case libvirt.DomainMetadataElement:
+		if len(Uri) == 0 || Uri[0] == "" {
+			return operationInvalid("metadata namespace URI is required")
+		}
+		if value == "" {
+			delete(d.metadata, Uri[0])
+		} else {
+			d.metadata[Uri[0]] = value
+		}
+	default:
+		return operationInvalid("unknown metadata type")
+	}
+	return nil
+}
+
+// DomainBackupBegin completes instantly, writing a placeholder file for
+// every disk target in the backup XML
+func (f *Fake) DomainBackupBegin(Dom libvirt.Domain, BackupXML string, CheckpointXML libvirt.OptString, Flags libvirt.DomainBackupBeginFlags) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+	if !d.active() {
+		return operationInvalid("domain is not running")
+	}
+
+	var backup struct {
+		Disks []struct {
+			Target struct {
+				File string `xml:"file,attr"`
+			} `xml:"target"`
+		} `xml:"disks>disk"`
+	}
+	if err := xml.Unmarshal([]byte(BackupXML), &backup); err != nil {
+		return err
+	}
+	for _, disk := range backup.Disks {
+		if disk.Target.File == "" {
+			continue
+		}
+		if err := os.WriteFile(disk.Target.File, nil, 0o644); err != nil {
+			return err
+		}
+	}
+
+	if len(CheckpointXML) > 0 {
+		var cp struct {
+			Name string `xml:"name"`
+		}
+		if err := xml.Unmarshal([]byte(CheckpointXML[0]), &cp); err != nil {
+			return err
+		}
+		d.checkpoints[cp.Name] = true
+	}
+	d.lastJob = libvirt.DomainJobCompleted
+	return nil
+}
+
+func (f *Fake) DomainGetJobStats(Dom libvirt.Domain, Flags libvirt.DomainGetJobStatsFlags) (int32, []libvirt.TypedParam, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return 0, nil, err
+	}
+	if Flags&libvirt.DomainJobStatsCompleted != 0 {
+		return int32(d.lastJob), nil, nil
+	}
+	return int32(libvirt.DomainJobNone), nil, nil
+}
+
+func (f *Fake) DomainAbortJob(Dom libvirt.Domain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+	d.lastJob = libvirt.DomainJobCancelled
+	return nil
+}
+
+func (f *Fake) DomainCheckpointLookupByName(Dom libvirt.Domain, Name string, Flags uint32) (libvirt.DomainCheckpoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return libvirt.DomainCheckpoint{}, err
+	}
+	if !d.checkpoints[Name] {
+		return libvirt.DomainCheckpoint{}, libvirt.Error{Code: uint32(libvirt.ErrNoDomainCheckpoint), Message: "Domain checkpoint not found"}
+	}
+	return libvirt.DomainCheckpoint{Name: Name, Dom: d.handle()}, nil
+}
+
+func (f *Fake) DomainCheckpointDelete(Checkpoint libvirt.DomainCheckpoint, Flags libvirt.DomainCheckpointDeleteFlags) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Checkpoint.Dom)
+	if err != nil {
+		return err
+	}
+	delete(d.checkpoints, Checkpoint.Name)
+	return nil
+}
+
+// Crash stops a running domain the way a crashed guest would, which lets
+// tests exercise the restart watchdog
+func (f *Fake) Crash(Dom libvirt.Domain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.lookup(Dom)
+	if err != nil {
+		return err
+	}
+	if !d.active() {
+		return operationInvalid("domain is not running")
+	}
+	f.stop(d, int32(libvirt.DomainEventStoppedCrashed))
+	return nil
+}
+
+// CreateDiskImage creates a placeholder instead of a real qcow2 image
+func (f *Fake) CreateDiskImage(path string, sizeMB uint) (string, error) {
+	filename := path + ".qcow2"
+	if err := writeFakeDiskImage(filename, "qcow2", int64(sizeMB)<<20, ""); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// Fake disk images start with the magic of their format followed by their
+// virtual size and backing file. Files without a known magic are raw
+var fakeDiskMagic = map[string]string{
+	"qcow2": "QFI\xfb",
+	"vmdk":  "KDMV",
+	"vdi":   "<<< ",
+	"vhdx":  "vhdx",
+}
+
+const fakeDiskMaxChain = 16
+
+// DiskImageInfo reads the chain of a fake disk image
+func (f *Fake) DiskImageInfo(path string) ([]models.DiskImageLayer, error) {
+	var chain []models.DiskImageLayer
+	for path != "" {
+		if len(chain) == fakeDiskMaxChain {
+			return nil, fmt.Errorf("backing chain of %s is too long", chain[0].Path)
+		}
+		layer, backing, err := readFakeDiskImage(path)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, layer)
+		path = backing
+	}
+	return chain, nil
+}
+
+// ConvertDiskImage writes a fake image of the requested format with the
+// virtual size of src
+func (f *Fake) ConvertDiskImage(ctx context.Context, src, dst string, opts utils.DiskConvertOptions) error {
+	chain, err := f.DiskImageInfo(src)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if opts.Format == "raw" {
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		return out.Truncate(chain[0].VirtualSize)
+	}
+	if _, ok := fakeDiskMagic[opts.Format]; !ok {
+		return fmt.Errorf("unknown disk image format %q", opts.Format)
+	}
+	return writeFakeDiskImage(dst, opts.Format, chain[0].VirtualSize, opts.BackingFile)
+}
+
+func writeFakeDiskImage(path, format string, size int64, backing string) error {
+	header := []byte(fakeDiskMagic[format])
+	header = binary.BigEndian.AppendUint64(header, uint64(size))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(backing)))
+	header = append(header, backing...)
+	return os.WriteFile(path, header, 0o644)
+}
+
+func readFakeDiskImage(path string) (models.DiskImageLayer, string, error) {
+	layer := models.DiskImageLayer{Path: path, Format: "raw"}
+	file, err := os.Open(path)
+	if err != nil {
+		return layer, "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return layer, "", err
+	}
+	layer.ActualSize = info.Size()
+	layer.VirtualSize = info.Size()
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return layer, "", nil
+	}
+	for format, magic := range fakeDiskMagic {
+		if string(header[:4]) != magic {
+			continue
+		}
+		layer.Format = format
+		layer.VirtualSize = int64(binary.BigEndian.Uint64(header[4:12]))
+		backing := make([]byte, binary.BigEndian.Uint16(header[12:14]))
+		if _, err := io.ReadFull(file, backing); err != nil {
+			return layer, "", fmt.Errorf("truncated image %s: %w", path, err)
+		}
+		return layer, string(backing), nil
+	}
+	return layer, "", nil
+}
+
+var errNoDomain = libvirt.Error{Code: uint32(libvirt.ErrNoDomain), Message: "Domain not found"}
+
+func operationInvalid(msg string) error {
+	return libvirt.Error{Code: uint32(libvirt.ErrOperationInvalid), Message: msg}
+}
+
+// lookup must be called with f.mu held
+func (f *Fake) lookup(dom libvirt.Domain) (*fakeDomain, error) {
+	d, ok := f.domains[dom.UUID]
+	if !ok {
+		return nil, errNoDomain
+	}
+	return d, nil
+}
+
+func (f *Fake) sorted() []*fakeDomain {
+	out := make([]*fakeDomain, 0, len(f.domains))
+	for _, d := range f.domains {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].def.Name < out[j].def.Name })
+	return out
+}
+
+func (f *Fake) parse(domainXML string) (*fakeDomain, error) {
+	var def libvirtxml.Domain
+	if err := def.Unmarshal(domainXML); err != nil {
+		return nil, err
+	}
+	if def.Name == "" {
+		return nil, operationInvalid("domain name is required")
+	}
+	if def.UUID == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+		def.UUID = id.String()
+	}
+	if _, err := uuid.FromString(def.UUID); err != nil {
+		return nil, operationInvalid("invalid domain uuid")
+	}
+
+	metadata := map[string]string{}
+	if def.Metadata != nil {
+		var err error
+		if metadata, err = splitMetadata(def.Metadata.XML); err != nil {
+			return nil, err
+		}
+	}
+	def.Metadata = nil
+	def.ID = nil
+
+	return &fakeDomain{
+		def:         def,
+		metadata:    metadata,
+		state:       uint8(libvirt.DomainShutoff),
+		id:          -1,
+		checkpoints: map[string]bool{},
+	}, nil
+}
+
+func (f *Fake) checkUnique(d *fakeDomain, allowSameUUID bool) error {
+	for key, other := range f.domains {
+		if key == d.key() && !allowSameUUID {
+			return libvirt.Error{Code: uint32(libvirt.ErrOperationFailed), Message: "domain with this uuid already exists"}
+		}
+		if other.def.Name == d.def.Name && key != d.key() {
+			return libvirt.Error{Code: uint32(libvirt.ErrOperationFailed), Message: fmt.Sprintf("domain '%s' already exists", d.def.Name)}
+		}
+	}
+	return nil
+}
+
+func (f *Fake) start(d *fakeDomain) {
+	d.state = uint8(libvirt.DomainRunning)
+	d.id = f.nextID
+	f.nextID++
+	d.startedAt = time.Now()
+	f.emit(d, libvirt.DomainEventStarted, int32(libvirt.DomainEventStartedBooted))
+}
+
+func (f *Fake) stop(d *fakeDomain, detail int32) {
+	d.cpuTime = d.currentCPUTime()
+	d.state = uint8(libvirt.DomainShutoff)
+	d.id = -1
+	f.emit(d, libvirt.DomainEventStopped, detail)
+	if !d.persistent {
+		delete(f.domains, d.key())
+	}
+}
+
+// emit delivers a lifecycle event without blocking on slow subscribers
+func (f *Fake) emit(d *fakeDomain, event libvirt.DomainEventType, detail int32) {
+	msg := libvirt.DomainEventLifecycleMsg{Dom: d.handle(), Event: int32(event), Detail: detail}
+	for ch := range f.subs {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+func (d *fakeDomain) key() libvirt.UUID {
+	id, _ := uuid.FromString(d.def.UUID)
+	var key libvirt.UUID
+	copy(key[:], id.Bytes())
+	return key
+}
+
+func (d *fakeDomain) handle() libvirt.Domain {
+	return libvirt.Domain{Name: d.def.Name, UUID: d.key(), ID: d.id}
+}
+
+func (d *fakeDomain) active() bool {
+	return d.state == uint8(libvirt.DomainRunning) || d.state == uint8(libvirt.DomainPaused) || d.state == uint8(libvirt.DomainBlocked)
+}
+
+func (d *fakeDomain) currentCPUTime() uint64 {
+	if d.state != uint8(libvirt.DomainRunning) {
+		return d.cpuTime
+	}
+	return d.cpuTime + uint64(time.Since(d.startedAt).Nanoseconds())/10
+}
+
+func (d *fakeDomain) vcpus() uint16 {
+	if d.def.VCPU == nil {
+		return 1
+	}
+	return uint16(d.def.VCPU.Value)
+}
+
+func (d *fakeDomain) memoryKiB() uint64 {
+	if d.def.Memory == nil {
+		return 0
+	}
+	return utils.ToKiB(uint64(d.def.Memory.Value), d.def.Memory.Unit)
+}
+
+// xml renders the domain definition. Live XML carries the domain id and
+// the VNC port a real hypervisor would have assigned
+func (d *fakeDomain) xml(live bool) (string, error) {
+	raw, err := d.def.Marshal()
+	if err != nil {
+		return "", err
+	}
+	var out libvirtxml.Domain
+	if err := out.Unmarshal(raw); err != nil {
+		return "", err
+	}
+
+	if len(d.metadata) > 0 {
+		uris := make([]string, 0, len(d.metadata))
+		for uri := range d.metadata {
+			uris = append(uris, uri)
+		}
+		sort.Strings(uris)
+		var inner strings.Builder
+		for _, uri := range uris {
+			inner.WriteString(d.metadata[uri])
+		}
+		out.Metadata = &libvirtxml.DomainMetadata{XML: inner.String()}
+	}
+
+	if live && d.active() {
+		id := int(d.id)
+		out.ID = &id
+		if out.Devices != nil {
+			for i := range out.Devices.Graphics {
+				if vnc := out.Devices.Graphics[i].VNC; vnc != nil && vnc.AutoPort == "yes" {
+					vnc.Port = fakeVNCBasePort + id
+				}
+			}
+		}
+	}
+	return out.Marshal()
+}
+
+// splitMetadata returns each top level element of a <metadata> block keyed by
+// its namespace, the way libvirt stores custom metadata
+func splitMetadata(inner string) (map[string]string, error) {
+	out := map[string]string{}
+	dec := xml.NewDecoder(strings.NewReader(inner))
+	depth := 0
+	var start int64
+	var ns string
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				start = offset
+				ns = t.Name.Space
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 && ns != "" {
+				out[ns] = inner[start:dec.InputOffset()]
+			}
+		}
+	}
+}
@@ -14,6 +14,12 @@ const (
 	RBAC_DOCKER_WRITE  RBACPolicy = "docker_write"
 	RBAC_DOCKER_UPDATE RBACPolicy = "docker_update"
 	RBAC_DOCKER_DELETE RBACPolicy = "docker_delete"
+	// RBAC_DOCKER_EXEC allows running commands inside containers, which is
+	// a shell on the host for privileged ones, so it is not implied by any
+	// other docker policy. Downloading and uploading container files, and
+	// creating containers with access to the host, are as powerful and
+	// require it too
+	RBAC_DOCKER_EXEC RBACPolicy = "docker_exec"
 
 	RBAC_QEMU_READ   RBACPolicy = "qemu_read"
 	RBAC_QEMU_WRITE  RBACPolicy = "qemu_write"
@@ -40,6 +46,7 @@ var AllRBACPolicies = map[string]RBACPolicy{
 	string(RBAC_DOCKER_WRITE):  RBAC_DOCKER_WRITE,
 	string(RBAC_DOCKER_UPDATE): RBAC_DOCKER_UPDATE,
 	string(RBAC_DOCKER_DELETE): RBAC_DOCKER_DELETE,
+	string(RBAC_DOCKER_EXEC):   RBAC_DOCKER_EXEC,
 
 	string(RBAC_QEMU_READ):   RBAC_QEMU_READ,
 	string(RBAC_QEMU_WRITE):  RBAC_QEMU_WRITE,
@@ -0,0 +1,34 @@
+package models
+
+// Backup modes
+const (
+	BackupModeFull        = "full"
+	BackupModeIncremental = "incremental"
+)
+
+// Backup statuses
+const (
+	BackupStatusRunning   = "running"
+	BackupStatusCompleted = "completed"
+	BackupStatusFailed    = "failed"
+)
+
+// CreateBackupRequest represents a request to back up a virtual machine
+type CreateBackupRequest struct {
+	Mode string `json:"mode"`
+}
+
+// BackupPolicyRequest represents the schedule and retention of a VM's backups
+type BackupPolicyRequest struct {
+	Enabled         bool   `json:"enabled"`
+	IntervalMinutes int64  `json:"interval_minutes"`
+	Mode            string `json:"mode"`
+	FullEvery       int64  `json:"full_every"`
+	Retention       int64  `json:"retention"`
+}
+
+// RestoreBackupRequest represents a request to restore a backup into a new VM
+type RestoreBackupRequest struct {
+	Name  string `json:"name"`
+	Start bool   `json:"start"`
+}
@@ -0,0 +1,186 @@
+package models
+
+import (
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// Docker host connection statuses
+const (
+	DockerHostConnected    = "connected"
+	DockerHostDisconnected = "disconnected"
+)
+
+// DockerHostRequest represents a Docker host to add or edit. An empty
+// endpoint uses DOCKER_HOST, or the local socket when it is unset. Omitted
+// TLS fields keep their current value on update, empty strings remove them
+type DockerHostRequest struct {
+	Name     string  `json:"name"`
+	Endpoint string  `json:"endpoint"`
+	TLSCA    *string `json:"tls_ca,omitempty"`
+	TLSCert  *string `json:"tls_cert,omitempty"`
+	TLSKey   *string `json:"tls_key,omitempty"`
+}
+
+// DockerHost represents a configured Docker host and its connection state.
+// Certificates are never returned, only whether they are set
+type DockerHost struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Endpoint   string `json:"endpoint"`
+	TLS        bool   `json:"tls"`
+	ClientCert bool   `json:"client_cert"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	// Health of the connection, from the last check of the watchdog
+	LastPing      *time.Time `json:"last_ping,omitempty"`
+	LatencyMs     float64    `json:"latency_ms"`
+	EngineVersion string     `json:"engine_version,omitempty"`
+	APIVersion    string     `json:"api_version,omitempty"`
+	// Failures counts the failed checks in a row, the next reconnect attempt
+	// is backed off accordingly
+	Failures  int        `json:"failures,omitempty"`
+	NextCheck *time.Time `json:"next_check,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Exec terminal control message types
+const (
+	ExecMessageResize = "resize"
+	ExecMessageExit   = "exit"
+	ExecMessageError  = "error"
+)
+
+// ExecMessage is a control message of a container terminal, sent as a text
+// frame. Terminal input and output travel as binary frames. Clients send
+// resize messages, the server sends exit or error before closing
+type ExecMessage struct {
+	Type     string `json:"type"`
+	Cols     uint   `json:"cols,omitempty"`
+	Rows     uint   `json:"rows,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Container log streams
+const (
+	LogStreamStdout = "stdout"
+	LogStreamStderr = "stderr"
+)
+
+// ContainerLogLine is a single line of a container log
+type ContainerLogLine struct {
+	Stream    string     `json:"stream"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Line      string     `json:"line"`
+}
+
+// Image pull policies of a container creation
+const (
+	PullNever   = "never"
+	PullMissing = "missing"
+	PullAlways  = "always"
+)
+
+// CreateContainerRequest is the complete specification of a container, as
+// taken by the Docker API, plus what to do around its creation
+type CreateContainerRequest struct {
+	Name             string                    `json:"name"`
+	Config           container.Config          `json:"config"`
+	HostConfig       *container.HostConfig     `json:"host_config,omitempty"`
+	NetworkingConfig *network.NetworkingConfig `json:"networking_config,omitempty"`
+	// Platform of the image, os[/arch[/variant]]
+	Platform string `json:"platform,omitempty"`
+	// Pull is never (default), missing or always
+	Pull  string `json:"pull,omitempty"`
+	Start bool   `json:"start"`
+}
+
+// CreateContainerResponse describes a created container. Warnings are those
+// of the daemon
+type CreateContainerResponse struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Warnings   []string `json:"warnings"`
+	Pulled     bool     `json:"pulled"`
+	Started    bool     `json:"started"`
+	StartError string   `json:"start_error,omitempty"`
+}
+
+// ImagePullProgress reports the progress of one layer of an image pull, or
+// the status of the whole pull when ID is empty
+type ImagePullProgress struct {
+	ID      string `json:"id,omitempty"`
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+}
+
+// CreateContainerEvent is a line of a container creation streamed with its
+// pull progress: progress lines, then a result or an error
+type CreateContainerEvent struct {
+	Progress *ImagePullProgress       `json:"progress,omitempty"`
+	Result   *CreateContainerResponse `json:"result,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// ImagePullRequest is an image to pull. Tag is appended to Image when set,
+// otherwise latest is pulled unless Image has a tag or digest. Platform is
+// os[/arch[/variant]], the platform of the host by default
+type ImagePullRequest struct {
+	Image    string `json:"image"`
+	Tag      string `json:"tag,omitempty"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// ImagePullResult is a pulled image. Authenticated is set when stored
+// credentials of its registry were used
+type ImagePullResult struct {
+	Image         string `json:"image"`
+	ID            string `json:"id,omitempty"`
+	Authenticated bool   `json:"authenticated"`
+}
+
+// ImagePullEvent is a line of a streamed image pull: progress lines, then a
+// result or an error
+type ImagePullEvent struct {
+	Progress *ImagePullProgress `json:"progress,omitempty"`
+	Result   *ImagePullResult   `json:"result,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// ImageBuildResult is a built image
+type ImageBuildResult struct {
+	ID   string   `json:"id"`
+	Tags []string `json:"tags"`
+}
+
+// ImageBuildEvent is a line of a streamed image build: output of the build
+// steps and progress of base image pulls, then a result or an error
+type ImageBuildEvent struct {
+	Output   string             `json:"output,omitempty"`
+	Progress *ImagePullProgress `json:"progress,omitempty"`
+	Result   *ImageBuildResult  `json:"result,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// RegistryCredentialRequest is the credentials of an image registry.
+// Registry is its address, docker.io for Docker Hub. Password is a password
+// or access token, kept unchanged when omitted on update
+type RegistryCredentialRequest struct {
+	Registry string  `json:"registry"`
+	Username string  `json:"username"`
+	Password *string `json:"password,omitempty"`
+}
+
+// RegistryCredential is stored registry credentials, without their secret
+type RegistryCredential struct {
+	ID        int64     `json:"id"`
+	Registry  string    `json:"registry"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// Container file types
+const (
+	ContainerFileRegular   = "file"
+	ContainerFileDirectory = "directory"
+	ContainerFileSymlink   = "symlink"
+	ContainerFileOther     = "other"
+)
+
+// ContainerFile is an entry of a directory inside a container. Mode is in
+// ls notation, such as drwxr-xr-x
+type ContainerFile struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"`
+	ModTime    time.Time `json:"mod_time"`
+	LinkTarget string    `json:"link_target,omitempty"`
+}
+
+// ContainerDirectory is the listing of a directory inside a container.
+// Truncated is set when the directory holds too much to be listed whole
+type ContainerDirectory struct {
+	Path      string          `json:"path"`
+	Entries   []ContainerFile `json:"entries"`
+	Truncated bool            `json:"truncated"`
+}
+
+// ContainerUploadResponse lists the files uploaded into a container
+type ContainerUploadResponse struct {
+	Path  string   `json:"path"`
+	Files []string `json:"files"`
+	Size  int64    `json:"size"`
+}
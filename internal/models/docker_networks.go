@@ -0,0 +1,81 @@
+package models
+
+import "time"
+
+// Network drivers that can be created
+const (
+	NetworkDriverBridge  = "bridge"
+	NetworkDriverMacvlan = "macvlan"
+	NetworkDriverIPvlan  = "ipvlan"
+)
+
+// DockerNetwork is a network of a Docker client with the containers
+// attached to it. Builtin networks are the daemon's bridge, host and none
+// networks, which cannot be deleted
+type DockerNetwork struct {
+	ID         string             `json:"id"`
+	Name       string             `json:"name"`
+	Driver     string             `json:"driver"`
+	Scope      string             `json:"scope"`
+	Created    time.Time          `json:"created"`
+	Internal   bool               `json:"internal"`
+	Attachable bool               `json:"attachable"`
+	IPv6       bool               `json:"ipv6"`
+	Builtin    bool               `json:"builtin"`
+	Subnets    []NetworkSubnet    `json:"subnets"`
+	Labels     map[string]string  `json:"labels"`
+	Options    map[string]string  `json:"options"`
+	Containers []NetworkContainer `json:"containers"`
+}
+
+// NetworkSubnet is an address pool of a network. IPRange restricts the
+// addresses given to containers to a part of Subnet
+type NetworkSubnet struct {
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway,omitempty"`
+	IPRange string `json:"ip_range,omitempty"`
+}
+
+// NetworkContainer is a container attached to a network. Addresses are in
+// CIDR notation
+type NetworkContainer struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	IPv4Address string `json:"ipv4_address,omitempty"`
+	IPv6Address string `json:"ipv6_address,omitempty"`
+	MacAddress  string `json:"mac_address,omitempty"`
+}
+
+// CreateNetworkRequest is a network to create. Driver defaults to bridge.
+// Parent is the host interface of macvlan and ipvlan networks, and Mode
+// their macvlan_mode (bridge, vepa, private, passthru) or ipvlan_mode (l2,
+// l3, l3s). An IPv6 subnet enables IPv6
+type CreateNetworkRequest struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver,omitempty"`
+	Parent     string            `json:"parent,omitempty"`
+	Mode       string            `json:"mode,omitempty"`
+	Subnets    []NetworkSubnet   `json:"subnets,omitempty"`
+	Internal   bool              `json:"internal,omitempty"`
+	Attachable bool              `json:"attachable,omitempty"`
+	IPv6       bool              `json:"ipv6,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Options    map[string]string `json:"options,omitempty"`
+}
+
+// NetworkConnectRequest attaches a container to a network. The addresses
+// are static IPs from a subnet of the network, assigned automatically when
+// empty
+type NetworkConnectRequest struct {
+	Container   string   `json:"container"`
+	IPv4Address string   `json:"ipv4_address,omitempty"`
+	IPv6Address string   `json:"ipv6_address,omitempty"`
+	Aliases     []string `json:"aliases,omitempty"`
+}
+
+// NetworkDisconnectRequest detaches a container from a network. Force
+// detaches a container the daemon no longer knows
+type NetworkDisconnectRequest struct {
+	Container string `json:"container"`
+	Force     bool   `json:"force,omitempty"`
+}
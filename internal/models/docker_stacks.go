@@ -0,0 +1,86 @@
+package models
+
+import "time"
+
+// Stack statuses, from the state of the containers of its services
+const (
+	StackRunning = "running"
+	StackPartial = "partial"
+	StackStopped = "stopped"
+)
+
+// Stack change actions reported by a deploy
+const (
+	StackChangeCreate   = "create"
+	StackChangeRecreate = "recreate"
+	StackChangeKeep     = "keep"
+	StackChangeRemove   = "remove"
+)
+
+// Stack resource types
+const (
+	StackResourceService = "service"
+	StackResourceNetwork = "network"
+	StackResourceVolume  = "volume"
+)
+
+// StackRequest is a Compose project to deploy. Env holds the content of a
+// .env file, used to interpolate variables of the Compose file. The name
+// defaults to the name of the Compose file and is ignored on update
+type StackRequest struct {
+	Name    string `json:"name"`
+	Compose string `json:"compose"`
+	Env     string `json:"env,omitempty"`
+}
+
+// Stack summarizes a deployed Compose project
+type Stack struct {
+	ID       int64  `json:"id"`
+	ClientID int64  `json:"client_id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	// ServiceCount services are defined, Running of them have a running
+	// container
+	ServiceCount int       `json:"service_count"`
+	Running      int       `json:"running"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// StackService is a service of a stack and the container running it. The
+// container fields are empty when the service has no container
+type StackService struct {
+	Name          string `json:"name"`
+	Image         string `json:"image"`
+	ContainerID   string `json:"container_id,omitempty"`
+	ContainerName string `json:"container_name,omitempty"`
+	State         string `json:"state,omitempty"`
+	Status        string `json:"status,omitempty"`
+}
+
+// StackDetails is a stack with its definition and resources
+type StackDetails struct {
+	Stack
+	Compose  string         `json:"compose"`
+	Env      string         `json:"env,omitempty"`
+	Services []StackService `json:"services"`
+	Networks []string       `json:"networks"`
+	Volumes  []string       `json:"volumes"`
+}
+
+// StackChange is what a deploy does, or would do, to one resource of a
+// stack. Reason explains why a service is recreated
+type StackChange struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// StackDeployResponse lists the changes of a deploy. On a dry run nothing
+// was changed
+type StackDeployResponse struct {
+	Name    string        `json:"name"`
+	DryRun  bool          `json:"dry_run"`
+	Changes []StackChange `json:"changes"`
+}
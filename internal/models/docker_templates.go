@@ -87,3 +87,11 @@ type DeployResponse struct {
 	Name        string `json:"name"`
 	Message     string `json:"message"`
 }
+
+// DeployTemplateEvent is a line of a template deploy streamed with its pull
+// progress: progress lines, then a result or an error
+type DeployTemplateEvent struct {
+	Progress *ImagePullProgress `json:"progress,omitempty"`
+	Result   *DeployResponse    `json:"result,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
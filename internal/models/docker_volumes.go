@@ -0,0 +1,35 @@
+package models
+
+// DockerVolume is a volume of a Docker client with its disk usage and the
+// containers mounting it
+type DockerVolume struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Mountpoint string            `json:"mountpoint"`
+	Scope      string            `json:"scope"`
+	CreatedAt  string            `json:"created_at,omitempty"`
+	Labels     map[string]string `json:"labels"`
+	Options    map[string]string `json:"options"`
+	// Size is in bytes, -1 when the daemon does not report it, as for
+	// volumes of drivers other than local
+	Size       int64             `json:"size"`
+	Containers []VolumeContainer `json:"containers"`
+}
+
+// VolumeContainer is a container mounting a volume
+type VolumeContainer struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"read_only"`
+}
+
+// CreateVolumeRequest is a volume to create. Driver defaults to local,
+// whose options include type, device and o to mount NFS shares or devices
+type CreateVolumeRequest struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver,omitempty"`
+	DriverOpts map[string]string `json:"driver_opts,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
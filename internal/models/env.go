@@ -19,9 +19,12 @@ type EnvVars struct {
 	GithubOAuthKey    string `envconfig:"GITHUB_OAUTH_KEY" required:"true"`
 	GithubOAuthSecret string `envconfig:"GITHUB_OAUTH_SECRET" required:"true"`
 	// OAuthCallbackURL  string `envconfig:"OAUTH_CALLBACK_URL" default:"http://localhost:9999/api/auth/oauth/callback" required:"true"`
-	BaseUrl         string `envconfig:"BASE_URL" default:"http://localhost"`
-	Directory       string `envconfig:"DIRECTORY" required:"true" default:"tmp/"`
-	SessionSecret   string `envconfig:"SESSION_SECRET" required:"true"`
+	BaseUrl       string `envconfig:"BASE_URL" default:"http://localhost"`
+	Directory     string `envconfig:"DIRECTORY" required:"true" default:"tmp/"`
+	SessionSecret string `envconfig:"SESSION_SECRET" required:"true"`
+	// CredentialsKey encrypts stored credentials, SESSION_SECRET when unset.
+	// Set it to rotate SESSION_SECRET without losing stored registry secrets
+	CredentialsKey  string `envconfig:"CREDENTIALS_KEY"`
 	FRONTEND_DASH   string `envconfig:"FRONTEND_DASH_URL" default:"http://localhost:5173/app"`
 	BaseUrlWithPort string
 
@@ -30,6 +33,26 @@ type EnvVars struct {
 	DiscordNotifyOnError bool   `envconfig:"DISCORD_NOTIFY_ON_ERROR" default:"true"`
 	DiscordNotifyOnWarn  bool   `envconfig:"DISCORD_NOTIFY_ON_WARN" default:"false"`
 	DiscordNotifyOnInfo  bool   `envconfig:"DISCORD_NOTIFY_ON_INFO" default:"false"`
+
+	// VM Backup Configuration
+	BackupDirectory string `envconfig:"BACKUP_DIRECTORY"`
+	BackupRetention int    `envconfig:"BACKUP_RETENTION" default:"7"`
+
+	// Hypervisor Configuration
+	HypervisorDriver string `envconfig:"HYPERVISOR_DRIVER" default:"libvirt"`
+
+	// VM Restart Watchdog Configuration
+	VMRestartMaxAttempts int `envconfig:"VM_RESTART_MAX_ATTEMPTS" default:"5"`
+
+	// Host Capacity Configuration
+	CapacityMode          string  `envconfig:"CAPACITY_MODE" default:"reject"`
+	CPUOvercommitRatio    float64 `envconfig:"CPU_OVERCOMMIT_RATIO" default:"4"`
+	MemoryOvercommitRatio float64 `envconfig:"MEMORY_OVERCOMMIT_RATIO" default:"1"`
+	MinFreeMemoryMB       uint64  `envconfig:"MIN_FREE_MEMORY_MB" default:"512"`
+	MinFreeDiskPercent    float64 `envconfig:"MIN_FREE_DISK_PERCENT" default:"10"`
+
+	// Resumable Upload Configuration
+	UploadExpiryHours int `envconfig:"UPLOAD_EXPIRY_HOURS" default:"24"`
 }
 
 var ENV_VARS EnvVars
@@ -0,0 +1,88 @@
+package models
+
+import "time"
+
+// ISO download statuses
+const (
+	ISODownloadStatusRunning   = "running"
+	ISODownloadStatusVerifying = "verifying"
+	ISODownloadStatusCompleted = "completed"
+	ISODownloadStatusFailed    = "failed"
+)
+
+// ISODownloadRequest represents a request to fetch an ISO from a URL into the
+// ISO library
+type ISODownloadRequest struct {
+	URL           string `json:"url" validate:"required"`
+	Filename      string `json:"filename"`       // Defaults to the last segment of the URL path
+	SHA256        string `json:"sha256"`         // Expected checksum, hex encoded
+	SHA256SumsURL string `json:"sha256sums_url"` // SHA256SUMS file listing the checksum, used when sha256 is empty
+}
+
+// ISODownload reports the state of a background ISO download
+type ISODownload struct {
+	ID            string     `json:"id"`
+	URL           string     `json:"url"`
+	Filename      string     `json:"filename"`
+	SHA256        string     `json:"sha256,omitempty"`
+	SHA256SumsURL string     `json:"sha256sums_url,omitempty"`
+	Status        string     `json:"status"`
+	BytesDone     int64      `json:"bytes_done"`
+	BytesTotal    int64      `json:"bytes_total"` // 0 while unknown
+	Progress      float64    `json:"progress"`    // Percent, 0 while the size is unknown
+	BytesPerSec   int64      `json:"bytes_per_sec"`
+	Resumes       int        `json:"resumes"` // Times the transfer continued from a partial file
+	Verified      bool       `json:"verified"`
+	Error         string     `json:"error,omitempty"`
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	UserID        int64      `json:"user_id"`
+}
+
+// Upload targets, picked with the "type" upload metadata
+const (
+	UploadTypeISO   = "iso"   // Stored in the ISO library
+	UploadTypeImage = "image" // Stored with the VM disk images
+)
+
+// UploadSession is a resumable (tus) upload
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Type      string    `json:"type"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	SHA256    string    `json:"sha256,omitempty"` // Checked once the upload is complete
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"` // Pushed back by every chunk
+	UserID    int64     `json:"user_id"`
+}
+
+// Checksum states of a file in the ISO library
+const (
+	ISOChecksumPending = "pending" // Being computed in the background
+	ISOChecksumReady   = "ready"
+	ISOChecksumFailed  = "failed"
+)
+
+// ISOHeader holds what the volume descriptors of an ISO 9660 or UDF image
+// tell about it
+type ISOHeader struct {
+	Format        string     `json:"format,omitempty"` // iso9660, udf or iso9660+udf, empty when not recognized
+	VolumeLabel   string     `json:"volume_label,omitempty"`
+	SystemID      string     `json:"system_id,omitempty"`
+	Created       *time.Time `json:"created,omitempty"`
+	Bootable      bool       `json:"bootable"`                 // Has an El Torito boot catalog
+	BootPlatforms []string   `json:"boot_platforms,omitempty"` // e.g. bios and efi
+}
+
+// ISOInfo describes a file of the ISO library
+type ISOInfo struct {
+	Name           string    `json:"name"`
+	Size           int64     `json:"size"`
+	Modified       time.Time `json:"modified"`
+	SHA256         string    `json:"sha256,omitempty"`
+	ChecksumStatus string    `json:"checksum_status"`
+	ISOHeader
+	HeaderError string `json:"header_error,omitempty"` // Why the header could not be read, e.g. a truncated file
+}
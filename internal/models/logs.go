@@ -26,6 +26,18 @@ type LogRequestData struct {
 	Bytes     int64         `json:"Bytes"`
 	Error     any           `json:"Error"`
 }
+
+// LogEventData describes a background event written to the audit log,
+// e.g. a scheduled backup or an automatic VM restart
+type LogEventData struct {
+	UserId  int64             `json:"User_id"`
+	Event   string            `json:"Event"`
+	Subject string            `json:"Subject"`
+	Level   string            `json:"Level"`
+	Message string            `json:"Message"`
+	Fields  map[string]string `json:"Fields,omitempty"`
+}
+
 type GetLogsResponse struct {
 	Logs       []LogResponse `json:"logs"`
 	Total      int64         `json:"total"`
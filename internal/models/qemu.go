@@ -1,10 +1,15 @@
 package models
 
+import "time"
+
 // VirtualMachine represents a QEMU virtual machine
 type VirtualMachine struct {
-	ID   int32  `json:"id"`
-	Name string `json:"name"`
-	UUID string `json:"uuid"`
+	ID          int32             `json:"id"`
+	Name        string            `json:"name"`
+	UUID        string            `json:"uuid"`
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Warnings    []string          `json:"warnings,omitempty"` // e.g. capacity warnings when the VM was created
 }
 
 // VirtualMachineInfo contains detailed information about a virtual machine
@@ -20,20 +25,51 @@ type VirtualMachineInfo struct {
 
 // VirtualMachineWithInfo combines VM details with runtime information
 type VirtualMachineWithInfo struct {
-	ID   int32  `json:"id"`
-	Name string `json:"name"`
-	UUID string `json:"uuid"`
+	ID          int32             `json:"id"`
+	Name        string            `json:"name"`
+	UUID        string            `json:"uuid"`
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
 	VirtualMachineInfo
 }
 
 // CreateVMRequest represents a request to create a new virtual machine
 type CreateVMRequest struct {
 	Name      string `json:"name" validate:"required"`
-	Memory    int64  `json:"memory" validate:"required"`
-	VCPUs     int32  `json:"vcpus" validate:"required"`
-	DiskSize  int64  `json:"disk" validate:"required"`
+	Memory    int64  `json:"memory"` // MiB, defaults to the OS profile
+	VCPUs     int32  `json:"vcpus"`  // Defaults to the OS profile
+	DiskSize  int64  `json:"disk"`   // MiB, defaults to the OS profile
 	OSImage   string `json:"os_image"`
 	Autostart bool   `json:"autostart"`
+
+	Description string            `json:"description"`
+	Labels      map[string]string `json:"labels"`
+
+	RestartPolicy string `json:"restart_policy"` // never (default), on-crash or always
+
+	OSVariant string `json:"os_variant"` // OS profile id, detected from the OS image when empty
+	DiskBus   string `json:"disk_bus"`   // virtio, sata or ide, defaults to the OS profile
+	NICModel  string `json:"nic_model"`  // virtio, e1000e, e1000 or rtl8139, defaults to the OS profile
+	Firmware  string `json:"firmware"`   // bios or efi, defaults to the OS profile
+
+	Tuning *VMTuning `json:"tuning"`
+}
+
+// VMListRequest represents query parameters for filtering VM lists
+type VMListRequest struct {
+	Selector string `query:"selector"`  // Label selector, e.g. env=staging,owner!=alice,!temporary
+	State    string `query:"state"`     // Comma separated state names, e.g. running,paused
+	Search   string `query:"search"`    // Case insensitive name search
+	Sort     string `query:"sort"`      // name, state, memory, vcpus or id, prefix with - to reverse
+	Page     int    `query:"page"`      // Page number (default 1)
+	PageSize int    `query:"page_size"` // Page size (default all)
+}
+
+// UpdateVMMetadataRequest represents a request to change VM description or labels.
+// Nil fields are left unchanged, an empty labels object removes all labels
+type UpdateVMMetadataRequest struct {
+	Description *string           `json:"description"`
+	Labels      map[string]string `json:"labels"`
 }
 
 // VMActionResponse represents the response from VM control operations
@@ -53,3 +89,289 @@ const (
 	VIR_DOMAIN_CRASHED            // The domain is crashed
 	VIR_DOMAIN_PMSUSPENDED        // The domain is suspended by guest power management
 )
+
+// VMStateNames maps the state names accepted by list filters to libvirt domain states
+var VMStateNames = map[string]uint8{
+	"nostate":     VIR_DOMAIN_NOSTATE,
+	"running":     VIR_DOMAIN_RUNNING,
+	"blocked":     VIR_DOMAIN_BLOCKED,
+	"paused":      VIR_DOMAIN_PAUSED,
+	"shutdown":    VIR_DOMAIN_SHUTDOWN,
+	"shutoff":     VIR_DOMAIN_SHUTOFF,
+	"crashed":     VIR_DOMAIN_CRASHED,
+	"pmsuspended": VIR_DOMAIN_PMSUSPENDED,
+}
+
+// VM restart policies enforced by the crash watchdog
+const (
+	RestartPolicyNever   = "never"    // Never restart the VM
+	RestartPolicyOnCrash = "on-crash" // Restart after the VM crashed or failed
+	RestartPolicyAlways  = "always"   // Restart whenever the VM stops, unless stopped from Visory
+)
+
+// RestartPolicies lists the accepted restart policies
+var RestartPolicies = []string{RestartPolicyNever, RestartPolicyOnCrash, RestartPolicyAlways}
+
+// UpdateRestartPolicyRequest represents a request to change a VM's restart policy
+type UpdateRestartPolicyRequest struct {
+	Policy      string `json:"policy" validate:"required"`
+	MaxAttempts int    `json:"max_attempts"` // Consecutive restarts before giving up, 0 uses the server default
+}
+
+// VMRestartStatus reports a VM's restart policy and the watchdog's state for it
+type VMRestartStatus struct {
+	Policy      string     `json:"policy"`
+	MaxAttempts int        `json:"max_attempts"`
+	Attempts    int        `json:"attempts"`
+	GivenUp     bool       `json:"given_up"`
+	LastRestart *time.Time `json:"last_restart,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+}
+
+// VMMedia describes the installation media and boot order of a VM
+type VMMedia struct {
+	Device    string   `json:"device"`             // Target of the CD-ROM drive, e.g. sda
+	OSImage   string   `json:"os_image,omitempty"` // ISO from the library, empty when ejected or outside it
+	Path      string   `json:"path,omitempty"`     // Path of the inserted image
+	BootOrder []string `json:"boot_order"`
+}
+
+// ChangeMediaRequest represents a request to insert or swap the ISO of a VM
+type ChangeMediaRequest struct {
+	OSImage string `json:"os_image" validate:"required"` // ISO from the library
+}
+
+// UpdateBootOrderRequest represents a request to change a VM's boot order
+type UpdateBootOrderRequest struct {
+	Order []string `json:"order" validate:"required"` // disk, cdrom and network, first to last
+}
+
+// VMBootOrderResponse is returned after the boot order of a VM changed
+type VMBootOrderResponse struct {
+	Order           []string `json:"order"`
+	RestartRequired bool     `json:"restart_required"` // Changes apply on the next boot of a running VM
+}
+
+// OSProfile holds the recommended virtual hardware for a guest OS
+type OSProfile struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Family   string `json:"family"` // windows, linux, bsd, dos or other
+	Memory   int64  `json:"memory"` // MiB
+	VCPUs    int32  `json:"vcpus"`
+	DiskSize int64  `json:"disk"` // MiB
+	DiskBus  string `json:"disk_bus"`
+	NICModel string `json:"nic_model"`
+	Firmware string `json:"firmware"`
+	TPM      bool   `json:"tpm"`
+}
+
+// OSDetection is the OS identified for an installation image
+type OSDetection struct {
+	OSImage     string    `json:"os_image"`
+	VolumeLabel string    `json:"volume_label,omitempty"`
+	MatchedBy   string    `json:"matched_by"` // volume_label, filename, os_variant or default
+	Profile     OSProfile `json:"profile"`
+}
+
+// VMTuning holds the performance settings of a VM. Updates replace all of
+// them, zero values restore the defaults
+type VMTuning struct {
+	VCPUPins        []VCPUPin     `json:"vcpu_pins,omitempty"`
+	EmulatorPin     string        `json:"emulator_pin,omitempty"` // Host cpuset, e.g. "0-1"
+	IOThreads       uint          `json:"iothreads,omitempty"`
+	IOThreadPins    []IOThreadPin `json:"iothread_pins,omitempty"`
+	Hugepages       bool          `json:"hugepages,omitempty"`
+	HugepageSizeKiB uint          `json:"hugepage_size_kib,omitempty"` // 0 uses the host default
+	DiskCache       string        `json:"disk_cache,omitempty"`        // default, none, writethrough, writeback, directsync or unsafe
+	DiskIO          string        `json:"disk_io,omitempty"`           // native, threads or io_uring
+	NetQueues       uint          `json:"net_queues,omitempty"`        // virtio-net multiqueue, at most one per vCPU
+	Topology        *CPUTopology  `json:"topology,omitempty"`
+}
+
+// VCPUPin pins a guest vCPU to a set of host CPUs
+type VCPUPin struct {
+	VCPU   uint   `json:"vcpu"`
+	CPUSet string `json:"cpuset"`
+}
+
+// IOThreadPin pins an IO thread (numbered from 1) to a set of host CPUs
+type IOThreadPin struct {
+	IOThread uint   `json:"iothread"`
+	CPUSet   string `json:"cpuset"`
+}
+
+// CPUTopology is the guest CPU layout, its product must equal the vCPU count
+type CPUTopology struct {
+	Sockets int `json:"sockets"`
+	Cores   int `json:"cores"`
+	Threads int `json:"threads"`
+}
+
+// VMTuningResponse is returned after the tuning of a VM changed
+type VMTuningResponse struct {
+	Tuning          VMTuning `json:"tuning"`
+	RestartRequired bool     `json:"restart_required"` // Changes apply on the next boot of a running VM
+}
+
+// HostTopology describes the host CPUs and NUMA layout, for choosing pinning
+type HostTopology struct {
+	Arch      string         `json:"arch"`
+	Model     string         `json:"model"`
+	Vendor    string         `json:"vendor"`
+	Sockets   int            `json:"sockets"`
+	Cores     int            `json:"cores"`   // Per socket
+	Threads   int            `json:"threads"` // Per core
+	CPUs      int            `json:"cpus"`
+	NUMANodes []HostNUMANode `json:"numa_nodes"`
+}
+
+// HostNUMANode is a NUMA cell of the host
+type HostNUMANode struct {
+	ID        int            `json:"id"`
+	MemoryKiB uint64         `json:"memory_kib"`
+	CPUs      []HostCPU      `json:"cpus"`
+	Hugepages []HugepagePool `json:"hugepages"`
+}
+
+// HostCPU is a logical CPU of the host
+type HostCPU struct {
+	ID       int    `json:"id"`
+	SocketID int    `json:"socket_id"`
+	CoreID   int    `json:"core_id"`
+	Siblings string `json:"siblings"`
+}
+
+// HugepagePool is the number of pages of one size reserved on a NUMA node
+type HugepagePool struct {
+	SizeKiB uint64 `json:"size_kib"`
+	Count   uint64 `json:"count"`
+}
+
+// What CreateVirtualMachine does when a new VM exceeds the host's capacity
+const (
+	CapacityModeReject = "reject" // Refuse to create the VM
+	CapacityModeWarn   = "warn"   // Create the VM and report a warning
+	CapacityModeOff    = "off"    // Skip the checks
+)
+
+// CapacityModes lists the accepted capacity modes
+var CapacityModes = []string{CapacityModeReject, CapacityModeWarn, CapacityModeOff}
+
+// CapacityRequest holds the resources of a planned VM to check against the
+// host's capacity
+type CapacityRequest struct {
+	Memory   int64 `query:"memory"` // MiB
+	VCPUs    int32 `query:"vcpus"`
+	DiskSize int64 `query:"disk"` // MiB
+}
+
+// HostCapacity summarizes how much of the host is allocated to running VMs
+// and the limits applied before creating new ones
+type HostCapacity struct {
+	Mode string `json:"mode"`
+
+	CPUs               int     `json:"cpus"`
+	AllocatedVCPUs     uint64  `json:"allocated_vcpus"`
+	CPUOvercommitRatio float64 `json:"cpu_overcommit_ratio"`
+	VCPULimit          uint64  `json:"vcpu_limit"`
+
+	MemoryKiB             uint64  `json:"memory_kib"`
+	FreeMemoryKiB         uint64  `json:"free_memory_kib"`
+	AllocatedMemoryKiB    uint64  `json:"allocated_memory_kib"`
+	MemoryOvercommitRatio float64 `json:"memory_overcommit_ratio"`
+	MemoryLimitKiB        uint64  `json:"memory_limit_kib"`
+	MinFreeMemoryKiB      uint64  `json:"min_free_memory_kib"`
+
+	DiskPath           string  `json:"disk_path"`
+	DiskTotalBytes     uint64  `json:"disk_total_bytes"`
+	DiskFreeBytes      uint64  `json:"disk_free_bytes"`
+	MinFreeDiskPercent float64 `json:"min_free_disk_percent"`
+
+	Checks []CapacityCheck `json:"checks,omitempty"` // Only when resources were requested
+}
+
+// CapacityCheck is the outcome of checking one resource of a planned VM
+type CapacityCheck struct {
+	Resource  string `json:"resource"`  // vcpus, memory, free_memory or disk
+	Requested uint64 `json:"requested"` // vCPUs, KiB of memory or bytes of disk
+	Available uint64 `json:"available"` // Headroom left before the limit, same unit
+	OK        bool   `json:"ok"`
+	Message   string `json:"message,omitempty"`
+}
+
+// DiskImageFormats are the formats disk images can be converted to
+var DiskImageFormats = []string{"qcow2", "raw", "vmdk", "vdi", "vhdx"}
+
+// DiskImage describes a file in the disk image directory
+type DiskImage struct {
+	Name         string           `json:"name"`
+	Path         string           `json:"path"`
+	Format       string           `json:"format,omitempty"`
+	VirtualSize  int64            `json:"virtual_size"` // Size seen by the guest
+	ActualSize   int64            `json:"actual_size"`  // Bytes allocated on the host
+	Modified     time.Time        `json:"modified"`
+	BackingChain []DiskImageLayer `json:"backing_chain,omitempty"` // Backing files, nearest first
+	UsedBy       []DiskImageUser  `json:"used_by,omitempty"`
+	BackingOf    []string         `json:"backing_of,omitempty"` // Images of the directory built on top of this one
+	Orphaned     bool             `json:"orphaned"`             // Nothing uses it, it can be deleted
+	Job          *DiskImageJob    `json:"job,omitempty"`        // Running convert or compact
+	Error        string           `json:"error,omitempty"`      // Why the image could not be inspected
+}
+
+// DiskImageLayer is one file of a backing chain
+type DiskImageLayer struct {
+	Path        string `json:"path"`
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual_size"`
+	ActualSize  int64  `json:"actual_size"`
+}
+
+// DiskImageUser is a domain disk that uses an image
+type DiskImageUser struct {
+	UUID    string `json:"uuid"`
+	Name    string `json:"name"`
+	Device  string `json:"device"` // Target of the disk, e.g. vda
+	Active  bool   `json:"active"`
+	Backing bool   `json:"backing"` // Used as a backing file of the disk rather than the disk itself
+}
+
+// ConvertDiskImageRequest represents a request to convert a disk image to
+// another format. The original is kept
+type ConvertDiskImageRequest struct {
+	Format   string `json:"format" validate:"required"`
+	Name     string `json:"name"`     // Defaults to the original name with the extension of the format
+	Compress bool   `json:"compress"` // qcow2 only
+}
+
+// CompactDiskImageRequest represents a request to rewrite a disk image
+// without its unused clusters
+type CompactDiskImageRequest struct {
+	Compress bool `json:"compress"` // qcow2 only
+}
+
+// Disk image job operations and statuses
+const (
+	DiskImageJobConvert = "convert"
+	DiskImageJobCompact = "compact"
+
+	DiskImageJobStatusRunning   = "running"
+	DiskImageJobStatusCompleted = "completed"
+	DiskImageJobStatusFailed    = "failed"
+)
+
+// DiskImageJob reports a convert or compact running in the background
+type DiskImageJob struct {
+	ID         string     `json:"id"`
+	Operation  string     `json:"operation"`
+	Image      string     `json:"image"`
+	Target     string     `json:"target"` // Image written by the job, the same as image for compact
+	Format     string     `json:"format"`
+	Status     string     `json:"status"`
+	SizeBefore int64      `json:"size_before"` // Actual size of the image
+	SizeAfter  int64      `json:"size_after,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	UserID     int64      `json:"user_id"`
+}
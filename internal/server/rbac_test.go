@@ -10,12 +10,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"visory/internal/database"
 	dbsessions "visory/internal/database/sessions"
 	"visory/internal/database/user"
+	"visory/internal/hypervisor"
 	"visory/internal/models"
 	"visory/internal/notifications"
 	"visory/internal/services"
@@ -72,10 +74,11 @@ func setupTestServer(t *testing.T) *testHelper {
 	dbService := database.New()
 	dispatcher := utils.NewDispatcher(dbService, nil)
 
-	dockerService := services.NewDockerService(dispatcher, logger)
+	dockerService := services.NewDockerService(dbService, dispatcher, logger)
 	notifManager := notifications.NewManager()
 
 	fs := utils.NewFS(fmt.Sprintf("%v-test-%d", "visory", time.Now().UnixNano()))
+	qemuService := services.NewQemuServiceWithDriver(dispatcher, fs, logger, hypervisor.NewFake())
 	s := &Server{
 		port:             9999,
 		logger:           logger,
@@ -87,12 +90,13 @@ func setupTestServer(t *testing.T) *testHelper {
 		logsService:      services.NewLogsService(dbService, dispatcher, logger),
 		metricsService:   services.NewMetricsService(dbService, dispatcher, logger),
 		storageService:   services.NewStorageService(dispatcher, logger),
-		qemuService:      services.NewQemuService(dispatcher, fs, logger),
+		qemuService:      qemuService,
+		backupService:    services.NewBackupService(dbService, dispatcher, qemuService, fs, logger),
 		isoService:       services.NewISOService(dispatcher, fs, logger),
 		dockerService:    dockerService,
 		docsService:      services.NewDocsService(dbService, dispatcher, logger),
 		firewallService:  services.NewFirewallService(dispatcher, logger),
-		templatesService: services.NewTemplatesService(dispatcher, logger, dockerService.ClientManager),
+		templatesService: services.NewTemplatesService(dispatcher, logger, dockerService.ClientManager, dockerService.Registries),
 		settingsService:  services.NewSettingsService(dbService, dispatcher, logger, notifManager),
 		vncProxy:         services.NewVNCProxy(logger),
 	}
@@ -633,6 +637,7 @@ func TestAllRBACPolicies(t *testing.T) {
 		models.RBAC_DOCKER_WRITE,
 		models.RBAC_DOCKER_UPDATE,
 		models.RBAC_DOCKER_DELETE,
+		models.RBAC_DOCKER_EXEC,
 		models.RBAC_QEMU_READ,
 		models.RBAC_QEMU_WRITE,
 		models.RBAC_QEMU_UPDATE,
@@ -738,6 +743,22 @@ func TestRBACQemu(t *testing.T) {
 			statusCode: http.StatusOK,
 			desc:       "User with qemu_read should access VM info",
 		},
+		{
+			name:       "qemu_read can list disk image jobs",
+			method:     "GET",
+			path:       "/api/qemu/image-jobs",
+			token:      &qemuReadToken,
+			statusCode: http.StatusOK,
+			desc:       "User with qemu_read should list image jobs",
+		},
+		{
+			name:       "disk image named jobs is not shadowed",
+			method:     "GET",
+			path:       "/api/qemu/images/jobs",
+			token:      &qemuReadToken,
+			statusCode: http.StatusNotFound,
+			desc:       "Image paths should only reach disk images",
+		},
 		{
 			name:       "docker_only cannot access qemu endpoints",
 			method:     "GET",
@@ -889,6 +910,56 @@ func TestRBACDocker(t *testing.T) {
 			statusCode: http.StatusForbidden,
 			desc:       "docker_delete only should not read docker list",
 		},
+		// Docker Exec tests
+		{
+			name:       "docker_read cannot open a container terminal",
+			method:     "GET",
+			path:       "/api/docker/1/containers/web/exec",
+			token:      &dockerReadToken,
+			statusCode: http.StatusForbidden,
+			desc:       "docker_read should not grant exec",
+		},
+		{
+			name:       "docker_full cannot open a container terminal",
+			method:     "GET",
+			path:       "/api/docker/1/containers/web/exec",
+			token:      &dockerFullToken,
+			statusCode: http.StatusForbidden,
+			desc:       "exec requires docker_exec even with every other docker policy",
+		},
+		// Container files tests
+		{
+			name:       "docker_read cannot download container files",
+			method:     "GET",
+			path:       "/api/docker/1/containers/web/files/download?path=/run/secrets/db",
+			token:      &dockerReadToken,
+			statusCode: http.StatusForbidden,
+			desc:       "downloading container files requires docker_exec",
+		},
+		{
+			name:       "docker_full cannot download container files",
+			method:     "GET",
+			path:       "/api/docker/1/containers/web/files/download?path=/run/secrets/db",
+			token:      &dockerFullToken,
+			statusCode: http.StatusForbidden,
+			desc:       "downloading container files requires docker_exec even with every other docker policy",
+		},
+		{
+			name:       "docker_update cannot upload container files",
+			method:     "POST",
+			path:       "/api/docker/1/containers/web/files?path=/etc",
+			token:      &dockerUpdateToken,
+			statusCode: http.StatusForbidden,
+			desc:       "uploading container files requires docker_exec",
+		},
+		{
+			name:       "docker_full cannot upload container files",
+			method:     "POST",
+			path:       "/api/docker/1/containers/web/files?path=/etc",
+			token:      &dockerFullToken,
+			statusCode: http.StatusForbidden,
+			desc:       "uploading container files requires docker_exec even with every other docker policy",
+		},
 		// Full permissions
 		{
 			name:       "docker_full can access read endpoints",
@@ -908,6 +979,88 @@ func TestRBACDocker(t *testing.T) {
 	}
 }
 
+// TestRBACContainerHostAccess tests that containers with access to the
+// Docker host can only be created with docker_exec
+func TestRBACContainerHostAccess(t *testing.T) {
+	th := setupTestServer(t)
+
+	dockerFullToken := th.createTestUser(t, "docker_full@test.com",
+		"docker_read,docker_write,docker_update,docker_delete")
+	dockerExecToken := th.createTestUser(t, "docker_exec@test.com", "docker_write,docker_exec")
+	adminToken := th.createTestUser(t, "admin@test.com", string(models.RBAC_USER_ADMIN))
+
+	hostRoot := map[string]any{
+		"config":      map[string]any{"Image": "alpine"},
+		"host_config": map[string]any{"Privileged": true, "Binds": []string{"/:/host"}},
+	}
+	for name, body := range map[string]map[string]any{
+		"privileged":   {"config": map[string]any{"Image": "alpine"}, "host_config": map[string]any{"Privileged": true}},
+		"capabilities": {"config": map[string]any{"Image": "alpine"}, "host_config": map[string]any{"CapAdd": []string{"SYS_ADMIN"}}},
+		"pid host":     {"config": map[string]any{"Image": "alpine"}, "host_config": map[string]any{"PidMode": "host"}},
+		"host bind":    {"config": map[string]any{"Image": "alpine"}, "host_config": map[string]any{"Binds": []string{"/:/host"}}},
+	} {
+		t.Run("docker_full cannot create "+name, func(t *testing.T) {
+			resp, _ := th.makeRequest(t, "POST", "/api/docker/1/containers", &dockerFullToken, body)
+			assertStatusCode(t, resp, http.StatusForbidden, "host access requires docker_exec")
+		})
+	}
+
+	// The daemon of the test client is unreachable, so allowed requests fail
+	// later on, but never with 403
+	for name, token := range map[string]*string{"docker_exec": &dockerExecToken, "admin": &adminToken} {
+		t.Run(name+" can create a privileged container", func(t *testing.T) {
+			resp, _ := th.makeRequest(t, "POST", "/api/docker/1/containers", token, hostRoot)
+			if resp.Code == http.StatusForbidden {
+				t.Errorf("%s should be allowed host access, got 403. Body: %s", name, resp.Body.String())
+			}
+		})
+	}
+	t.Run("docker_full can create a plain container", func(t *testing.T) {
+		body := map[string]any{"config": map[string]any{"Image": "alpine"}, "host_config": map[string]any{"Binds": []string{"data:/data"}}}
+		resp, _ := th.makeRequest(t, "POST", "/api/docker/1/containers", &dockerFullToken, body)
+		if resp.Code == http.StatusForbidden {
+			t.Errorf("plain container should not need docker_exec. Body: %s", resp.Body.String())
+		}
+	})
+}
+
+// TestRBACStackHostAccess tests that stacks whose services have access to
+// the Docker host can only be deployed with docker_exec
+func TestRBACStackHostAccess(t *testing.T) {
+	th := setupTestServer(t)
+
+	dockerFullToken := th.createTestUser(t, "docker_full@test.com",
+		"docker_read,docker_write,docker_update,docker_delete")
+	dockerExecToken := th.createTestUser(t, "docker_exec@test.com", "docker_write,docker_exec")
+
+	for name, compose := range map[string]string{
+		"privileged":   "services:\n  app:\n    image: alpine\n    privileged: true\n",
+		"capabilities": "services:\n  app:\n    image: alpine\n    cap_add: [SYS_ADMIN]\n",
+		"host network": "services:\n  app:\n    image: alpine\n    network_mode: host\n",
+		"host bind":    "services:\n  app:\n    image: alpine\n    volumes: [\"/:/host\"]\n",
+	} {
+		body := map[string]string{"name": strings.ReplaceAll(name, " ", "-"), "compose": compose}
+		t.Run("docker_full cannot deploy "+name, func(t *testing.T) {
+			resp, _ := th.makeRequest(t, "POST", "/api/docker/1/stacks", &dockerFullToken, body)
+			assertStatusCode(t, resp, http.StatusForbidden, "host access requires docker_exec")
+		})
+		// The daemon of the test client is unreachable, so the deploy fails
+		// later on, but never with 403
+		t.Run("docker_exec can deploy "+name, func(t *testing.T) {
+			resp, _ := th.makeRequest(t, "POST", "/api/docker/1/stacks", &dockerExecToken, body)
+			if resp.Code == http.StatusForbidden {
+				t.Errorf("docker_exec should be allowed host access, got 403. Body: %s", resp.Body.String())
+			}
+		})
+	}
+
+	body := map[string]string{"name": "plain", "compose": "services:\n  app:\n    image: alpine\n    volumes: [\"data:/data\"]\nvolumes:\n  data:\n"}
+	resp, _ := th.makeRequest(t, "POST", "/api/docker/1/stacks", &dockerFullToken, body)
+	if resp.Code == http.StatusForbidden {
+		t.Errorf("plain stack should not need docker_exec. Body: %s", resp.Body.String())
+	}
+}
+
 // TestRBACFirewall tests RBAC on Firewall endpoints
 func TestRBACFirewall(t *testing.T) {
 	th := setupTestServer(t)
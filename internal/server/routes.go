@@ -23,9 +23,17 @@ func (s *Server) RegisterRoutes() http.Handler {
 	api := e.Group("/api")
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins:     []string{"https://*", "http://*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowHeaders:     []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowOrigins: []string{"https://*", "http://*"},
+		AllowMethods: []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
+		AllowHeaders: []string{
+			"Accept", "Authorization", "Content-Type", "X-CSRF-Token",
+			// Resumable (tus) uploads
+			"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum",
+		},
+		ExposeHeaders: []string{
+			"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Checksum-Algorithm",
+			"Upload-Offset", "Upload-Length", "Upload-Expires",
+		},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -82,10 +90,38 @@ func (s *Server) RegisterRoutes() http.Handler {
 	qemuGroup.GET("/virtual-machines/info", s.qemuService.GetVirtualMachinesInfo, Roles(models.RBAC_QEMU_READ))
 	qemuGroup.GET("/virtual-machines/:uuid", s.qemuService.GetVirtualMachine, Roles(models.RBAC_QEMU_READ))
 	qemuGroup.GET("/virtual-machines/:uuid/info", s.qemuService.GetVirtualMachineInfo, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.GET("/virtual-machines/:uuid/screenshot", s.qemuService.GetVirtualMachineScreenshot, Roles(models.RBAC_QEMU_READ))
 	qemuGroup.POST("/virtual-machines", s.qemuService.CreateVirtualMachine, Roles(models.RBAC_QEMU_WRITE))
+	qemuGroup.GET("/os-profiles", s.qemuService.GetOSProfiles, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.GET("/os-profiles/detect", s.qemuService.DetectOSProfile, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.GET("/host/topology", s.qemuService.GetHostTopology, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.GET("/capacity", s.qemuService.GetHostCapacity, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.PUT("/virtual-machines/:uuid/metadata", s.qemuService.UpdateVirtualMachineMetadata, Roles(models.RBAC_QEMU_UPDATE))
+	qemuGroup.GET("/virtual-machines/:uuid/restart-policy", s.qemuService.GetVirtualMachineRestartPolicy, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.PUT("/virtual-machines/:uuid/restart-policy", s.qemuService.UpdateVirtualMachineRestartPolicy, Roles(models.RBAC_QEMU_UPDATE))
+	qemuGroup.GET("/virtual-machines/:uuid/tuning", s.qemuService.GetVirtualMachineTuning, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.PUT("/virtual-machines/:uuid/tuning", s.qemuService.UpdateVirtualMachineTuning, Roles(models.RBAC_QEMU_UPDATE))
+	qemuGroup.GET("/virtual-machines/:uuid/media", s.qemuService.GetVirtualMachineMedia, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.PUT("/virtual-machines/:uuid/media", s.qemuService.InsertVirtualMachineMedia, Roles(models.RBAC_QEMU_UPDATE))
+	qemuGroup.DELETE("/virtual-machines/:uuid/media", s.qemuService.EjectVirtualMachineMedia, Roles(models.RBAC_QEMU_UPDATE))
+	qemuGroup.PUT("/virtual-machines/:uuid/boot-order", s.qemuService.UpdateVirtualMachineBootOrder, Roles(models.RBAC_QEMU_UPDATE))
 	qemuGroup.POST("/virtual-machines/:uuid/start", s.qemuService.StartVirtualMachine, Roles(models.RBAC_QEMU_WRITE))
 	qemuGroup.POST("/virtual-machines/:uuid/reboot", s.qemuService.RebootVirtualMachine, Roles(models.RBAC_QEMU_UPDATE))
 	qemuGroup.POST("/virtual-machines/:uuid/shutdown", s.qemuService.ShutdownVirtualMachine, Roles(models.RBAC_QEMU_UPDATE))
+	qemuGroup.GET("/virtual-machines/:uuid/backups", s.backupService.ListVirtualMachineBackups, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.POST("/virtual-machines/:uuid/backups", s.backupService.CreateBackup, Roles(models.RBAC_QEMU_WRITE))
+	qemuGroup.GET("/virtual-machines/:uuid/backup-policy", s.backupService.GetBackupPolicy, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.PUT("/virtual-machines/:uuid/backup-policy", s.backupService.UpdateBackupPolicy, Roles(models.RBAC_QEMU_UPDATE))
+	qemuGroup.GET("/images", s.qemuService.ListDiskImages, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.GET("/images/:name", s.qemuService.GetDiskImage, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.POST("/images/:name/convert", s.qemuService.ConvertDiskImage, Roles(models.RBAC_QEMU_WRITE))
+	qemuGroup.POST("/images/:name/compact", s.qemuService.CompactDiskImage, Roles(models.RBAC_QEMU_UPDATE))
+	qemuGroup.DELETE("/images/:name", s.qemuService.DeleteDiskImage, Roles(models.RBAC_QEMU_DELETE))
+	qemuGroup.GET("/image-jobs", s.qemuService.ListDiskImageJobs, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.GET("/image-jobs/:id", s.qemuService.GetDiskImageJob, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.GET("/backups", s.backupService.ListBackups, Roles(models.RBAC_QEMU_READ))
+	qemuGroup.DELETE("/backups/:id", s.backupService.DeleteBackup, Roles(models.RBAC_QEMU_DELETE))
+	qemuGroup.POST("/backups/:id/restore", s.backupService.RestoreBackup, Roles(models.RBAC_QEMU_WRITE))
 	// qemuGroup.GET("/virtual-machines/:uuid/console", s.VNCConsoleHandler, Roles(models.RBAC_QEMU_READ))
 	e.GET("/api/qemu/virtual-machines/:uuid/console", s.VNCConsoleHandler)
 
@@ -94,6 +130,17 @@ func (s *Server) RegisterRoutes() http.Handler {
 	isoGroup.GET("", s.isoService.ListISOs, Roles(models.RBAC_QEMU_READ))
 	isoGroup.GET("/:filename", s.isoService.GetISOInfo, Roles(models.RBAC_QEMU_READ))
 	isoGroup.POST("", s.isoService.UploadISO, Roles(models.RBAC_QEMU_WRITE))
+	isoGroup.POST("/download", s.isoService.StartISODownload, Roles(models.RBAC_QEMU_WRITE))
+	isoGroup.GET("/downloads", s.isoService.ListISODownloads, Roles(models.RBAC_QEMU_READ))
+	isoGroup.GET("/downloads/:id", s.isoService.GetISODownload, Roles(models.RBAC_QEMU_READ))
+	isoGroup.POST("/downloads/:id/resume", s.isoService.ResumeISODownload, Roles(models.RBAC_QEMU_WRITE))
+	isoGroup.DELETE("/downloads/:id", s.isoService.CancelISODownload, Roles(models.RBAC_QEMU_DELETE))
+	isoGroup.OPTIONS("/uploads", s.isoService.UploadOptions, Roles(models.RBAC_QEMU_WRITE))
+	isoGroup.GET("/uploads", s.isoService.ListUploads, Roles(models.RBAC_QEMU_READ))
+	isoGroup.POST("/uploads", s.isoService.CreateUpload, Roles(models.RBAC_QEMU_WRITE))
+	isoGroup.HEAD("/uploads/:id", s.isoService.HeadUpload, Roles(models.RBAC_QEMU_WRITE))
+	isoGroup.PATCH("/uploads/:id", s.isoService.PatchUpload, Roles(models.RBAC_QEMU_WRITE))
+	isoGroup.DELETE("/uploads/:id", s.isoService.DeleteUpload, Roles(models.RBAC_QEMU_WRITE))
 	isoGroup.DELETE("/:filename", s.isoService.DeleteISO, Roles(models.RBAC_QEMU_DELETE))
 	isoGroup.GET("/:filename/download", s.isoService.DownloadISO, Roles(models.RBAC_QEMU_READ))
 
@@ -101,21 +148,54 @@ func (s *Server) RegisterRoutes() http.Handler {
 	dockerLogger := RequestLogger(s.dockerService.Logger, s.dockerService.Dispatcher)
 	dockerGroup := api.Group("/docker", s.authService.AuthMiddleware, dockerLogger)
 	dockerGroup.GET("", s.dockerService.GetAvailableClients, Roles(models.RBAC_DOCKER_READ))
+	dockerGroup.GET("/hosts", s.dockerService.GetAvailableClients, Roles(models.RBAC_DOCKER_READ))
+	dockerGroup.GET("/hosts/:id", s.dockerService.GetDockerHost, Roles(models.RBAC_DOCKER_READ))
+	dockerGroup.POST("/hosts", s.dockerService.CreateDockerHost, Roles(models.RBAC_DOCKER_WRITE))
+	dockerGroup.PUT("/hosts/:id", s.dockerService.UpdateDockerHost, Roles(models.RBAC_DOCKER_UPDATE))
+	dockerGroup.DELETE("/hosts/:id", s.dockerService.DeleteDockerHost, Roles(models.RBAC_DOCKER_DELETE))
+	dockerGroup.GET("/registries", s.dockerService.ListRegistries, Roles(models.RBAC_DOCKER_READ))
+	dockerGroup.POST("/registries", s.dockerService.CreateRegistry, Roles(models.RBAC_DOCKER_WRITE))
+	dockerGroup.PUT("/registries/:id", s.dockerService.UpdateRegistry, Roles(models.RBAC_DOCKER_UPDATE))
+	dockerGroup.DELETE("/registries/:id", s.dockerService.DeleteRegistry, Roles(models.RBAC_DOCKER_DELETE))
 
 	// Docker client routes with validation middleware
 	dockerClientGroup := dockerGroup.Group("/:clientid", s.dockerService.ValidateDockerClientMiddleware)
 	dockerClientGroup.GET("/containers", s.dockerService.ListContainers, Roles(models.RBAC_DOCKER_READ))
 	dockerClientGroup.GET("/images", s.dockerService.ListImages, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.POST("/images/pull", s.dockerService.PullImage, Roles(models.RBAC_DOCKER_WRITE))
+	dockerClientGroup.POST("/images/build", s.dockerService.BuildImage, Roles(models.RBAC_DOCKER_WRITE))
 	dockerClientGroup.DELETE("/images/:id", s.dockerService.DeleteImage, Roles(models.RBAC_DOCKER_DELETE))
 	dockerClientGroup.GET("/containers/:id", s.dockerService.InspectContainer, Roles(models.RBAC_DOCKER_READ))
 	dockerClientGroup.GET("/containers/:id/stats", s.dockerService.ContainerStats, Roles(models.RBAC_DOCKER_READ))
 	dockerClientGroup.GET("/containers/:id/stats/stream", s.dockerService.ContainerStatsStream, Roles(models.RBAC_DOCKER_READ))
 	dockerClientGroup.GET("/containers/:id/logs", s.dockerService.ContainerLogs, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.GET("/containers/:id/logs/stream", s.dockerService.ContainerLogsStream, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.GET("/containers/:id/exec", s.dockerService.ExecContainer, Roles(models.RBAC_DOCKER_EXEC))
+	dockerClientGroup.GET("/containers/:id/files", s.dockerService.ListContainerFiles, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.GET("/containers/:id/files/download", s.dockerService.DownloadContainerFiles, Roles(models.RBAC_DOCKER_EXEC))
+	dockerClientGroup.POST("/containers/:id/files", s.dockerService.UploadContainerFiles, Roles(models.RBAC_DOCKER_EXEC))
 	dockerClientGroup.POST("/containers", s.dockerService.CreateContainer, Roles(models.RBAC_DOCKER_WRITE))
 	dockerClientGroup.POST("/containers/:id/start", s.dockerService.StartContainer, Roles(models.RBAC_DOCKER_UPDATE))
 	dockerClientGroup.POST("/containers/:id/stop", s.dockerService.StopContainer, Roles(models.RBAC_DOCKER_UPDATE))
 	dockerClientGroup.POST("/containers/:id/restart", s.dockerService.RestartContainer, Roles(models.RBAC_DOCKER_UPDATE))
 	dockerClientGroup.DELETE("/containers/:id", s.dockerService.DeleteContainer, Roles(models.RBAC_DOCKER_DELETE))
+	dockerClientGroup.GET("/volumes", s.dockerService.ListVolumes, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.GET("/volumes/:name", s.dockerService.InspectVolume, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.POST("/volumes", s.dockerService.CreateVolume, Roles(models.RBAC_DOCKER_WRITE))
+	dockerClientGroup.DELETE("/volumes/:name", s.dockerService.DeleteVolume, Roles(models.RBAC_DOCKER_DELETE))
+	dockerClientGroup.GET("/networks", s.dockerService.ListNetworks, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.GET("/networks/:id", s.dockerService.InspectNetwork, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.POST("/networks", s.dockerService.CreateNetwork, Roles(models.RBAC_DOCKER_WRITE))
+	dockerClientGroup.DELETE("/networks/:id", s.dockerService.DeleteNetwork, Roles(models.RBAC_DOCKER_DELETE))
+	dockerClientGroup.POST("/networks/:id/connect", s.dockerService.ConnectNetwork, Roles(models.RBAC_DOCKER_UPDATE))
+	dockerClientGroup.POST("/networks/:id/disconnect", s.dockerService.DisconnectNetwork, Roles(models.RBAC_DOCKER_UPDATE))
+	dockerClientGroup.GET("/stacks", s.dockerService.ListStacks, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.GET("/stacks/:name", s.dockerService.GetStack, Roles(models.RBAC_DOCKER_READ))
+	dockerClientGroup.POST("/stacks", s.dockerService.DeployStack, Roles(models.RBAC_DOCKER_WRITE))
+	dockerClientGroup.PUT("/stacks/:name", s.dockerService.UpdateStack, Roles(models.RBAC_DOCKER_UPDATE))
+	dockerClientGroup.POST("/stacks/:name/start", s.dockerService.StartStack, Roles(models.RBAC_DOCKER_UPDATE))
+	dockerClientGroup.POST("/stacks/:name/stop", s.dockerService.StopStack, Roles(models.RBAC_DOCKER_UPDATE))
+	dockerClientGroup.DELETE("/stacks/:name", s.dockerService.DeleteStack, Roles(models.RBAC_DOCKER_DELETE))
 
 	// Docker Templates routes
 	templatesLogger := RequestLogger(s.templatesService.Logger, s.templatesService.Dispatcher)
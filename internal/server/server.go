@@ -37,6 +37,7 @@ type Server struct {
 	docsService      *services.DocsService
 	metricsService   *services.MetricsService
 	qemuService      *services.QemuService
+	backupService    *services.BackupService
 	isoService       *services.ISOService
 	dockerService    *services.DockerService
 	vncProxy         *services.VNCProxy
@@ -80,11 +81,11 @@ func NewServer() *http.Server {
 	storageService := services.NewStorageService(serverDispatcher, logger)
 	logsService := services.NewLogsService(db, serverDispatcher, logger)
 	metricsService := services.NewMetricsService(db, serverDispatcher, logger)
-	dockerService := services.NewDockerService(serverDispatcher, logger)
+	dockerService := services.NewDockerService(db, serverDispatcher, logger)
+	dockerService.ClientManager.StartWatchdog(context.Background())
 	firewallService := services.NewFirewallService(serverDispatcher, logger)
-	templatesService := services.NewTemplatesService(serverDispatcher, logger, dockerService.ClientManager)
+	templatesService := services.NewTemplatesService(serverDispatcher, logger, dockerService.ClientManager, dockerService.Registries)
 
-	// Initialize Docker clients from environment variables
 	docsService := services.NewDocsService(db, serverDispatcher, logger)
 	settingsService := services.NewSettingsService(db, serverDispatcher, logger, notifier)
 
@@ -92,6 +93,9 @@ func NewServer() *http.Server {
 	loadNotificationSettingsFromDB(db, notifier)
 	qemuService := services.NewQemuService(serverDispatcher, fs, logger)
 	isoService := services.NewISOService(serverDispatcher, fs, logger)
+	isoService.StartUploadCleanup(context.Background())
+	backupService := services.NewBackupService(db, serverDispatcher, qemuService, fs, logger)
+	backupService.StartScheduler(context.Background())
 	vncProxy := services.NewVNCProxy(logger)
 
 	NewServer := &Server{
@@ -109,6 +113,7 @@ func NewServer() *http.Server {
 		dockerService:    dockerService,
 		docsService:      docsService,
 		qemuService:      qemuService,
+		backupService:    backupService,
 		isoService:       isoService,
 		firewallService:  firewallService,
 		templatesService: templatesService,
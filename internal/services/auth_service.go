@@ -78,6 +78,18 @@ func (s *AuthService) RBACMiddleware(policies ...models.RBACPolicy) echo.Middlew
 	}
 }
 
+// hasPolicy reports whether the authenticated user of the request holds a
+// policy, for handlers that need more than their route requires only for
+// some requests
+func hasPolicy(c echo.Context, policy models.RBACPolicy) bool {
+	u, ok := c.Get("userWithSession").(user.GetUserAndSessionByTokenRow)
+	if !ok {
+		return false
+	}
+	policies := models.RoleToRBACPolicies(u.User.Role)
+	return policies[models.RBAC_USER_ADMIN] || policies[policy]
+}
+
 // NewAuthService creates a new AuthService with dependency injection
 func NewAuthService(db *database.Service, dispatcher *utils.Dispatcher, logger *slog.Logger) *AuthService {
 	// Create a grouped logger for auth service
@@ -0,0 +1,898 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"visory/internal/database"
+	"visory/internal/database/backups"
+	"visory/internal/database/user"
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo/v4"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	backupSchedulerInterval = time.Minute
+	backupJobPollInterval   = 2 * time.Second
+	backupDomainXMLFile     = "domain.xml"
+	// backupJobTimeout bounds a live backup job, which is aborted after it
+	backupJobTimeout = 12 * time.Hour
+	// systemUserID is recorded for actions not triggered by a user
+	systemUserID = -1
+)
+
+var errBackupRunning = errors.New("a backup of this virtual machine is already running")
+
+// errDiskImageBusy is returned while a disk image job rewrites a disk of
+// the virtual machine
+var errDiskImageBusy = errors.New("a disk of this virtual machine is being rewritten")
+
+type BackupService struct {
+	db         *database.Service
+	Dispatcher *utils.Dispatcher
+	Logger     *slog.Logger
+	Qemu       *QemuService
+	FS         *utils.FS
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// NewBackupService creates a new BackupService with dependency injection
+func NewBackupService(db *database.Service, dispatcher *utils.Dispatcher, qemu *QemuService, fs *utils.FS, logger *slog.Logger) *BackupService {
+	return &BackupService{
+		db:         db,
+		Dispatcher: dispatcher.WithGroup("backup"),
+		Logger:     logger.WithGroup("backup"),
+		Qemu:       qemu,
+		FS:         fs,
+		running:    map[string]bool{},
+	}
+}
+
+//	@Summary      List backups
+//	@Description  Get all VM backups, newest first
+//	@Tags         qemu
+//	@Produce      json
+//	@Success      200  {array}   backups.VmBackup
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/backups [get]
+//
+// ListBackups returns every backup known to the server
+func (s *BackupService) ListBackups(c echo.Context) error {
+	items, err := s.db.Backup.ListBackups(c.Request().Context())
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to list backups", err)
+	}
+	if items == nil {
+		items = []backups.VmBackup{}
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+//	@Summary      List virtual machine backups
+//	@Description  Get the backups of a specific virtual machine, newest first
+//	@Tags         qemu
+//	@Param        uuid  path  string  true  "Virtual Machine UUID"
+//	@Produce      json
+//	@Success      200  {array}   backups.VmBackup
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/backups [get]
+//
+// ListVirtualMachineBackups returns the backups of a single VM
+func (s *BackupService) ListVirtualMachineBackups(c echo.Context) error {
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	items, err := s.db.Backup.ListBackupsByVM(c.Request().Context(), vmUUID)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to list backups", err)
+	}
+	if items == nil {
+		items = []backups.VmBackup{}
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+//	@Summary      Back up virtual machine
+//	@Description  Start a full or incremental backup of a virtual machine's disks. The backup runs in the background
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        uuid  path  string                      true   "Virtual Machine UUID"
+//	@Param        body  body  models.CreateBackupRequest  false  "Backup parameters"
+//	@Produce      json
+//	@Success      202  {object}  backups.VmBackup
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/backups [post]
+//
+// CreateBackup starts an on-demand backup of a VM
+func (s *BackupService) CreateBackup(c echo.Context) error {
+	if s.Qemu.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	req := new(models.CreateBackupRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	if req.Mode == "" {
+		req.Mode = models.BackupModeFull
+	}
+	if !validBackupMode(req.Mode) {
+		return s.Dispatcher.NewBadRequest("Backup mode must be 'full' or 'incremental'", nil)
+	}
+
+	domain, err := s.Qemu.GetDomainByUUID(vmUUID)
+	if err != nil {
+		return s.Qemu.domainLookupError(err)
+	}
+
+	rec, err := s.startBackup(domain, vmUUID, req.Mode, false, userIDFromContext(c))
+	if err != nil {
+		if errors.Is(err, errBackupRunning) || errors.Is(err, errDiskImageBusy) {
+			return s.Dispatcher.NewConflict(err.Error(), err)
+		}
+		s.Logger.Error("Failed to start backup", "uuid", vmUUID, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to start backup", err)
+	}
+
+	return c.JSON(http.StatusAccepted, rec)
+}
+
+//	@Summary      Delete backup
+//	@Description  Delete a backup and its files. Backups that incremental backups depend on cannot be deleted
+//	@Tags         qemu
+//	@Param        id  path  int  true  "Backup ID"
+//	@Produce      json
+//	@Success      200  {object}  models.VMActionResponse
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/backups/{id} [delete]
+//
+// DeleteBackup removes a single backup
+func (s *BackupService) DeleteBackup(c echo.Context) error {
+	rec, err := s.backupFromParam(c)
+	if err != nil {
+		return err
+	}
+	if rec.Status == models.BackupStatusRunning {
+		return s.Dispatcher.NewConflict("Backup is still running", nil)
+	}
+
+	children, err := s.db.Backup.CountBackupChildren(c.Request().Context(), &rec.ID)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to delete backup", err)
+	}
+	if children > 0 {
+		return s.Dispatcher.NewConflict("Backup has incremental backups depending on it", nil)
+	}
+
+	if err := s.removeBackup(c.Request().Context(), rec); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to delete backup", err)
+	}
+
+	return c.JSON(http.StatusOK, models.VMActionResponse{
+		Success: true,
+		Message: fmt.Sprintf("Backup %d deleted successfully", rec.ID),
+	})
+}
+
+//	@Summary      Restore backup
+//	@Description  Restore a backup into a new virtual machine. The restore runs in the background
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        id    path  int                          true   "Backup ID"
+//	@Param        body  body  models.RestoreBackupRequest  false  "Restore parameters"
+//	@Produce      json
+//	@Success      202  {object}  models.VirtualMachine
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/backups/{id}/restore [post]
+//
+// RestoreBackup restores a backup into a new VM
+func (s *BackupService) RestoreBackup(c echo.Context) error {
+	if s.Qemu.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	rec, err := s.backupFromParam(c)
+	if err != nil {
+		return err
+	}
+	if rec.Status != models.BackupStatusCompleted {
+		return s.Dispatcher.NewConflict("Only completed backups can be restored", nil)
+	}
+
+	req := new(models.RestoreBackupRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	if req.Name == "" {
+		req.Name = fmt.Sprintf("%s-restore-%d", rec.VmName, rec.ID)
+	}
+
+	newUUID, err := uuid.NewV4()
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to restore backup", err)
+	}
+
+	userID := userIDFromContext(c)
+	go s.restore(rec, newUUID.String(), req.Name, req.Start, userID)
+
+	return c.JSON(http.StatusAccepted, models.VirtualMachine{
+		ID:   -1,
+		Name: req.Name,
+		UUID: newUUID.String(),
+	})
+}
+
+//	@Summary      Get backup policy
+//	@Description  Get the backup schedule and retention of a virtual machine
+//	@Tags         qemu
+//	@Param        uuid  path  string  true  "Virtual Machine UUID"
+//	@Produce      json
+//	@Success      200  {object}  backups.VmBackupPolicy
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/backup-policy [get]
+//
+// GetBackupPolicy returns the backup policy of a VM
+func (s *BackupService) GetBackupPolicy(c echo.Context) error {
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	policy, err := s.db.Backup.GetBackupPolicyByVM(c.Request().Context(), vmUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return s.Dispatcher.NewNotFound("Backup policy not found", err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to fetch backup policy", err)
+	}
+	return c.JSON(http.StatusOK, policy)
+}
+
+//	@Summary      Update backup policy
+//	@Description  Create or update the backup schedule and retention of a virtual machine
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        uuid  path  string                      true  "Virtual Machine UUID"
+//	@Param        body  body  models.BackupPolicyRequest  true  "Backup policy"
+//	@Produce      json
+//	@Success      200  {object}  backups.VmBackupPolicy
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/backup-policy [put]
+//
+// UpdateBackupPolicy creates or replaces the backup policy of a VM
+func (s *BackupService) UpdateBackupPolicy(c echo.Context) error {
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	req := new(models.BackupPolicyRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	if req.Mode == "" {
+		req.Mode = models.BackupModeFull
+	}
+	if !validBackupMode(req.Mode) {
+		return s.Dispatcher.NewBadRequest("Backup mode must be 'full' or 'incremental'", nil)
+	}
+	if req.IntervalMinutes <= 0 {
+		return s.Dispatcher.NewBadRequest("Interval must be greater than 0", nil)
+	}
+	if req.Retention <= 0 {
+		req.Retention = int64(models.ENV_VARS.BackupRetention)
+	}
+	if req.Retention <= 0 {
+		return s.Dispatcher.NewBadRequest("Retention must be greater than 0", nil)
+	}
+	if req.FullEvery <= 0 {
+		req.FullEvery = 7
+	}
+
+	policy, err := s.db.Backup.UpsertBackupPolicy(c.Request().Context(), backups.UpsertBackupPolicyParams{
+		VmUuid:          vmUUID,
+		Enabled:         req.Enabled,
+		IntervalMinutes: req.IntervalMinutes,
+		Mode:            req.Mode,
+		FullEvery:       req.FullEvery,
+		Retention:       req.Retention,
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to save backup policy", err)
+	}
+	return c.JSON(http.StatusOK, policy)
+}
+
+// StartScheduler runs due backup policies until ctx is cancelled. Backups
+// left running by a previous process are marked as failed first
+func (s *BackupService) StartScheduler(ctx context.Context) {
+	if err := s.db.Backup.FailRunningBackups(ctx); err != nil {
+		s.Logger.Warn("Failed to mark interrupted backups", "error", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(backupSchedulerInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.runDuePolicies(ctx)
+			}
+		}
+	}()
+}
+
+func (s *BackupService) runDuePolicies(ctx context.Context) {
+	if s.Qemu.LibVirt == nil {
+		return
+	}
+
+	policies, err := s.db.Backup.ListEnabledBackupPolicies(ctx)
+	if err != nil {
+		s.Logger.Error("Failed to list backup policies", "error", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, p := range policies {
+		interval := time.Duration(p.IntervalMinutes) * time.Minute
+		if p.LastRunAt != nil && now.Sub(*p.LastRunAt) < interval {
+			continue
+		}
+
+		if err := s.db.Backup.UpdateBackupPolicyLastRun(ctx, backups.UpdateBackupPolicyLastRunParams{
+			LastRunAt: &now,
+			VmUuid:    p.VmUuid,
+		}); err != nil {
+			s.Logger.Error("Failed to update backup policy", "uuid", p.VmUuid, "error", err)
+			continue
+		}
+
+		domain, err := s.Qemu.GetDomainByUUID(p.VmUuid)
+		if err != nil {
+			s.Logger.Warn("Skipping scheduled backup of missing virtual machine", "uuid", p.VmUuid, "error", err)
+			continue
+		}
+
+		mode := s.scheduledMode(ctx, p)
+		_, err = s.startBackup(domain, p.VmUuid, mode, true, systemUserID)
+		switch {
+		case err == nil, errors.Is(err, errBackupRunning):
+		case errors.Is(err, errDiskImageBusy):
+			s.Logger.Warn("Skipping scheduled backup of virtual machine with a disk being rewritten", "uuid", p.VmUuid, "error", err)
+		default:
+			s.Logger.Error("Failed to start scheduled backup", "uuid", p.VmUuid, "error", err)
+		}
+	}
+}
+
+// scheduledMode picks incremental for a policy unless the current chain
+// already holds FullEvery backups
+func (s *BackupService) scheduledMode(ctx context.Context, p backups.VmBackupPolicy) string {
+	if p.Mode != models.BackupModeIncremental {
+		return models.BackupModeFull
+	}
+
+	items, err := s.db.Backup.ListBackupsByVM(ctx, p.VmUuid)
+	if err != nil {
+		return models.BackupModeFull
+	}
+	var chain int64
+	for _, b := range items {
+		if b.Status != models.BackupStatusCompleted {
+			continue
+		}
+		chain++
+		if b.Mode == models.BackupModeFull {
+			break
+		}
+	}
+	if chain == 0 || chain >= p.FullEvery {
+		return models.BackupModeFull
+	}
+	return models.BackupModeIncremental
+}
+
+// startBackup records a new backup and runs it in the background
+func (s *BackupService) startBackup(domain libvirt.Domain, vmUUID, mode string, scheduled bool, userID int64) (backups.VmBackup, error) {
+	s.mu.Lock()
+	if s.running[vmUUID] {
+		s.mu.Unlock()
+		return backups.VmBackup{}, errBackupRunning
+	}
+	s.running[vmUUID] = true
+	s.mu.Unlock()
+
+	if job := s.Qemu.domainImageJob(domain); job != nil {
+		s.release(vmUUID)
+		return backups.VmBackup{}, fmt.Errorf("%w: image '%s' is busy with a %s job", errDiskImageBusy, job.Target, job.Operation)
+	}
+
+	rec, err := s.prepareBackup(domain, vmUUID, mode, scheduled, userID)
+	if err != nil {
+		s.release(vmUUID)
+		return backups.VmBackup{}, err
+	}
+	return rec.VmBackup, nil
+}
+
+type backupJob struct {
+	backups.VmBackup
+	domain    libvirt.Domain
+	domainXML string
+	disks     []utils.BackupDisk
+	parent    *backups.VmBackup
+	userID    int64
+}
+
+func (s *BackupService) prepareBackup(domain libvirt.Domain, vmUUID, mode string, scheduled bool, userID int64) (*backupJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	domainXML, err := s.Qemu.LibVirt.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain xml: %w", err)
+	}
+	disks, err := utils.BackupDisksFromDomainXML(domainXML)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse domain xml: %w", err)
+	}
+	if len(disks) == 0 {
+		return nil, fmt.Errorf("virtual machine has no disks to back up")
+	}
+
+	active, err := s.Qemu.LibVirt.DomainIsActive(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain state: %w", err)
+	}
+
+	job := &backupJob{domain: domain, domainXML: domainXML, disks: disks, userID: userID}
+
+	// Incremental backups need a live domain and a checkpoint to diff against,
+	// otherwise fall back to a full backup that starts a new chain
+	if mode == models.BackupModeIncremental {
+		parent, err := s.db.Backup.GetLatestCompletedBackupByVM(ctx, vmUUID)
+		if err == nil && parent.Checkpoint != nil && active == 1 {
+			job.parent = &parent
+		} else {
+			mode = models.BackupModeFull
+		}
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	dir := filepath.Join(s.FS.Backups, vmUUID, stamp)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, backupDomainXMLFile), []byte(domainXML), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to save domain xml: %w", err)
+	}
+
+	var checkpoint *string
+	if active == 1 {
+		name := "visory-" + stamp
+		checkpoint = &name
+	}
+	var parentID *int64
+	if job.parent != nil {
+		parentID = &job.parent.ID
+	}
+
+	rec, err := s.db.Backup.CreateBackup(ctx, backups.CreateBackupParams{
+		VmUuid:     vmUUID,
+		VmName:     domain.Name,
+		Mode:       mode,
+		Status:     models.BackupStatusRunning,
+		ParentID:   parentID,
+		Checkpoint: checkpoint,
+		Path:       dir,
+		Scheduled:  scheduled,
+		CreatedBy:  userID,
+	})
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to record backup: %w", err)
+	}
+	job.VmBackup = rec
+
+	go s.runBackup(job)
+	return job, nil
+}
+
+func (s *BackupService) runBackup(job *backupJob) {
+	defer s.release(job.VmUuid)
+
+	var err error
+	if job.Checkpoint != nil {
+		err = s.backupLive(job)
+	} else {
+		err = s.backupOffline(job)
+	}
+
+	status := models.BackupStatusCompleted
+	var errMsg *string
+	if err != nil {
+		status = models.BackupStatusFailed
+		msg := err.Error()
+		errMsg = &msg
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rec, dbErr := s.db.Backup.CompleteBackup(ctx, backups.CompleteBackupParams{
+		Status:    status,
+		SizeBytes: utils.DirSize(job.Path),
+		Error:     errMsg,
+		ID:        job.ID,
+	})
+	if dbErr != nil {
+		s.Logger.Error("Failed to record backup result", "id", job.ID, "error", dbErr)
+		rec = job.VmBackup
+	}
+
+	fields := map[string]string{
+		"VM":     job.VmName,
+		"UUID":   job.VmUuid,
+		"Backup": strconv.FormatInt(job.ID, 10),
+		"Mode":   job.Mode,
+	}
+	if err != nil {
+		s.Logger.Error("Backup failed", "id", job.ID, "uuid", job.VmUuid, "error", err)
+		fields["Error"] = err.Error()
+		s.Dispatcher.SendError("Backup failed", fmt.Sprintf("Backup of '%s' failed", job.VmName), fields)
+		_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+			UserId: job.userID, Event: "BACKUP", Subject: job.VmUuid, Level: "ERROR",
+			Message: err.Error(), Fields: fields,
+		})
+		return
+	}
+
+	fields["Size"] = strconv.FormatInt(rec.SizeBytes, 10)
+	s.Logger.Info("Backup completed", "id", job.ID, "uuid", job.VmUuid, "mode", job.Mode)
+	s.Dispatcher.SendSuccess("Backup completed", fmt.Sprintf("Backup of '%s' completed", job.VmName), fields)
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: job.userID, Event: "BACKUP", Subject: job.VmUuid, Level: "INFO",
+		Message: fmt.Sprintf("%s backup completed", job.Mode), Fields: fields,
+	})
+
+	s.prune(job.VmUuid)
+}
+
+// backupLive runs a libvirt push mode backup job and records a checkpoint
+// so the next incremental backup only copies changed blocks
+func (s *BackupService) backupLive(job *backupJob) error {
+	targets := make(map[string]string, len(job.disks))
+	for _, d := range job.disks {
+		targets[d.Target] = filepath.Join(job.Path, d.Target+".qcow2")
+	}
+
+	incremental := ""
+	if job.parent != nil {
+		incremental = *job.parent.Checkpoint
+	}
+	backupXML, err := utils.BuildBackupXML(job.disks, targets, incremental)
+	if err != nil {
+		return err
+	}
+	checkpointXML, err := utils.BuildCheckpointXML(*job.Checkpoint, job.disks)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Qemu.LibVirt.DomainBackupBegin(job.domain, backupXML, libvirt.OptString{checkpointXML}, 0); err != nil {
+		return fmt.Errorf("failed to begin backup job: %w", err)
+	}
+	if err := s.waitForJob(job.domain, backupJobTimeout); err != nil {
+		return err
+	}
+
+	// Chain incremental images onto their parent so restores see full disks
+	if job.parent != nil {
+		for _, d := range job.disks {
+			backing := filepath.Join(job.parent.Path, d.Target+".qcow2")
+			if err := utils.RebaseDiskImage(targets[d.Target], backing); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// waitForJob waits for the backup job of domain to end, aborting it when it
+// runs for longer than timeout
+func (s *BackupService) waitForJob(domain libvirt.Domain, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(backupJobPollInterval)
+		jobType, _, err := s.Qemu.LibVirt.DomainGetJobStats(domain, 0)
+		if err != nil {
+			return fmt.Errorf("failed to get backup job state: %w", err)
+		}
+		if libvirt.DomainJobType(jobType) != libvirt.DomainJobNone {
+			if time.Now().Before(deadline) {
+				continue
+			}
+			if err := s.Qemu.LibVirt.DomainAbortJob(domain); err != nil {
+				return fmt.Errorf("backup job timed out after %s and could not be aborted: %w", timeout, err)
+			}
+			return fmt.Errorf("backup job timed out after %s", timeout)
+		}
+
+		jobType, _, err = s.Qemu.LibVirt.DomainGetJobStats(domain, libvirt.DomainJobStatsCompleted)
+		if err != nil {
+			return fmt.Errorf("failed to get backup job result: %w", err)
+		}
+		if libvirt.DomainJobType(jobType) == libvirt.DomainJobFailed {
+			return fmt.Errorf("backup job failed")
+		}
+		return nil
+	}
+}
+
+// backupOffline copies the disks of a stopped domain with qemu-img
+func (s *BackupService) backupOffline(job *backupJob) error {
+	for _, d := range job.disks {
+		if err := utils.ConvertDiskImage(d.Source, filepath.Join(job.Path, d.Target+".qcow2")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BackupService) release(vmUUID string) {
+	s.mu.Lock()
+	delete(s.running, vmUUID)
+	s.mu.Unlock()
+}
+
+// prune keeps the newest retention chains of a VM (a full backup and the
+// incremental backups built on it) and removes everything older
+func (s *BackupService) prune(vmUUID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	retention := int64(models.ENV_VARS.BackupRetention)
+	if policy, err := s.db.Backup.GetBackupPolicyByVM(ctx, vmUUID); err == nil {
+		retention = policy.Retention
+	}
+	if retention <= 0 {
+		return
+	}
+
+	items, err := s.db.Backup.ListBackupsByVM(ctx, vmUUID)
+	if err != nil {
+		s.Logger.Error("Failed to list backups for retention", "uuid", vmUUID, "error", err)
+		return
+	}
+
+	// items are newest first, so everything after the last kept full
+	// backup belongs to an expired chain. Walk oldest first to remove
+	// incremental children before their parents
+	var fulls int64
+	cutoff := len(items)
+	for i, b := range items {
+		if b.Mode == models.BackupModeFull && b.Status == models.BackupStatusCompleted {
+			fulls++
+			if fulls == retention {
+				cutoff = i + 1
+				break
+			}
+		}
+	}
+	for i := len(items) - 1; i >= cutoff; i-- {
+		if items[i].Status == models.BackupStatusRunning {
+			continue
+		}
+		if err := s.removeBackup(ctx, items[i]); err != nil {
+			s.Logger.Error("Failed to prune backup", "id", items[i].ID, "error", err)
+			return
+		}
+		s.Logger.Info("Pruned backup", "id", items[i].ID, "uuid", vmUUID)
+	}
+}
+
+func (s *BackupService) removeBackup(ctx context.Context, rec backups.VmBackup) error {
+	if rec.Checkpoint != nil && s.Qemu.LibVirt != nil {
+		if domain, err := s.Qemu.GetDomainByUUID(rec.VmUuid); err == nil {
+			if cp, err := s.Qemu.LibVirt.DomainCheckpointLookupByName(domain, *rec.Checkpoint, 0); err == nil {
+				// Without flags, libvirt merges the checkpoint's dirty
+				// bitmap into its parent and removes it from the disks
+				if err := s.Qemu.LibVirt.DomainCheckpointDelete(cp, 0); err != nil {
+					s.Logger.Warn("Failed to delete checkpoint", "checkpoint", *rec.Checkpoint, "error", err)
+				}
+			}
+		}
+	}
+	if err := os.RemoveAll(rec.Path); err != nil {
+		return err
+	}
+	return s.db.Backup.DeleteBackup(ctx, rec.ID)
+}
+
+// restore flattens a backup chain into new disk images and defines a new
+// persistent domain using them
+func (s *BackupService) restore(rec backups.VmBackup, newUUID, name string, start bool, userID int64) {
+	fields := map[string]string{
+		"Backup": strconv.FormatInt(rec.ID, 10),
+		"Source": rec.VmName,
+		"VM":     name,
+		"UUID":   newUUID,
+	}
+
+	err := s.restoreDomain(rec, newUUID, name, start)
+	if err != nil {
+		s.Logger.Error("Restore failed", "backup", rec.ID, "error", err)
+		fields["Error"] = err.Error()
+		s.Dispatcher.SendError("Restore failed", fmt.Sprintf("Restoring backup %d of '%s' failed", rec.ID, rec.VmName), fields)
+		_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+			UserId: userID, Event: "RESTORE", Subject: newUUID, Level: "ERROR",
+			Message: err.Error(), Fields: fields,
+		})
+		return
+	}
+
+	s.Logger.Info("Restore completed", "backup", rec.ID, "uuid", newUUID)
+	s.Dispatcher.SendSuccess("Restore completed", fmt.Sprintf("Backup %d of '%s' restored as '%s'", rec.ID, rec.VmName, name), fields)
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userID, Event: "RESTORE", Subject: newUUID, Level: "INFO",
+		Message: "backup restored", Fields: fields,
+	})
+}
+
+func (s *BackupService) restoreDomain(rec backups.VmBackup, newUUID, name string, start bool) error {
+	raw, err := os.ReadFile(filepath.Join(rec.Path, backupDomainXMLFile))
+	if err != nil {
+		return fmt.Errorf("failed to read backed up domain xml: %w", err)
+	}
+	var dom libvirtxml.Domain
+	if err := dom.Unmarshal(string(raw)); err != nil {
+		return fmt.Errorf("failed to parse backed up domain xml: %w", err)
+	}
+
+	dom.ID = nil
+	dom.Name = name
+	dom.UUID = newUUID
+
+	var created []string
+	cleanup := func() {
+		for _, p := range created {
+			_ = os.Remove(p)
+		}
+	}
+
+	if dom.Devices != nil {
+		for i := range dom.Devices.Disks {
+			disk := &dom.Devices.Disks[i]
+			if disk.Target == nil {
+				continue
+			}
+			src := filepath.Join(rec.Path, disk.Target.Dev+".qcow2")
+			if _, err := os.Stat(src); err != nil {
+				continue
+			}
+			dst := filepath.Join(s.FS.Images, fmt.Sprintf("%s-%s.qcow2", newUUID, disk.Target.Dev))
+			if err := utils.ConvertDiskImage(src, dst); err != nil {
+				cleanup()
+				return err
+			}
+			created = append(created, dst)
+
+			disk.Source = &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: dst}}
+			disk.Driver = &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2"}
+			disk.BackingStore = nil
+			disk.Alias = nil
+		}
+		// Let libvirt assign fresh MAC addresses and display ports so the
+		// restored VM can run next to the original
+		for i := range dom.Devices.Interfaces {
+			dom.Devices.Interfaces[i].MAC = nil
+		}
+		for i := range dom.Devices.Graphics {
+			g := &dom.Devices.Graphics[i]
+			if g.VNC != nil {
+				g.VNC.Port = 0
+				g.VNC.AutoPort = "yes"
+			}
+			if g.Spice != nil {
+				g.Spice.Port = 0
+				g.Spice.TLSPort = 0
+				g.Spice.AutoPort = "yes"
+			}
+		}
+	}
+
+	domXML, err := dom.Marshal()
+	if err != nil {
+		cleanup()
+		return err
+	}
+	newDom, err := s.Qemu.LibVirt.DomainDefineXML(domXML)
+	if err != nil {
+		cleanup()
+		return fmt.Errorf("failed to define restored domain: %w", err)
+	}
+	if start {
+		if err := s.Qemu.LibVirt.DomainCreate(newDom); err != nil {
+			return fmt.Errorf("restored domain defined but failed to start: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *BackupService) backupFromParam(c echo.Context) (backups.VmBackup, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return backups.VmBackup{}, s.Dispatcher.NewBadRequest("Invalid backup ID", err)
+	}
+	rec, err := s.db.Backup.GetBackupByID(c.Request().Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return backups.VmBackup{}, s.Dispatcher.NewNotFound("Backup not found", err)
+		}
+		return backups.VmBackup{}, s.Dispatcher.NewInternalServerError("Failed to fetch backup", err)
+	}
+	return rec, nil
+}
+
+func validBackupMode(mode string) bool {
+	return mode == models.BackupModeFull || mode == models.BackupModeIncremental
+}
+
+// userIDFromContext returns the id of the authenticated user, or
+// systemUserID when the request has no session
+func userIDFromContext(c echo.Context) int64 {
+	if u, ok := c.Get("userWithSession").(user.GetUserAndSessionByTokenRow); ok {
+		return u.User.ID
+	}
+	return systemUserID
+}
@@ -0,0 +1,350 @@
+package services
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"visory/internal/models"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/build"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// maxBuildContextSize is the largest build context accepted, compressed
+	// or not
+	maxBuildContextSize = 1 << 30 // 1GB
+	// uploadFormOverhead leaves room for the fields and part headers of a
+	// multipart upload on top of its files
+	uploadFormOverhead = 1 << 20 // 1MB
+	// uploadBodyTimeout replaces the server timeouts for multipart uploads
+	uploadBodyTimeout = time.Hour
+)
+
+// uploadedFile is an uploaded file placed at Path of a tar archive, such as
+// a build context
+type uploadedFile struct {
+	Path string
+	File *multipart.FileHeader
+}
+
+//	@Summary      Build image
+//	@Description  Build an image from an uploaded context: a tar archive, optionally compressed, or a Dockerfile with the files it needs. The response is a stream of models.ImageBuildEvent lines (application/x-ndjson): the build output and base image pulls, then the result or an error
+//	@Tags         docker
+//	@Accept       multipart/form-data
+//	@Param        clientid         path      int     true   "Docker client ID"
+//	@Param        context          formData  file    false  "Build context archive (tar, tar.gz, tar.bz2 or tar.xz)"
+//	@Param        dockerfile       formData  file    false  "Dockerfile, when no context archive is sent"
+//	@Param        files            formData  file    false  "Files of the context, with a Dockerfile"
+//	@Param        paths            formData  string  false  "Path in the context of each file, in order. Defaults to the file name"
+//	@Param        dockerfile_path  formData  string  false  "Path of the Dockerfile in the context, Dockerfile by default"
+//	@Param        tags             formData  string  false  "Tag of the image, repeatable"
+//	@Param        build_args       formData  string  false  "Build argument as KEY=VALUE, repeatable"
+//	@Param        target           formData  string  false  "Stage to build"
+//	@Param        no_cache         formData  bool    false  "Build without the cache"
+//	@Param        pull             formData  bool    false  "Pull newer versions of the base images"
+//	@Param        platform         formData  string  false  "Platform as os[/arch[/variant]]"
+//	@Produce      json
+//	@Success      200  {object}  models.ImageBuildEvent
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      413  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/images/build [post]
+//
+// BuildImage builds an image and streams its output
+func (s *DockerService) BuildImage(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	limitUploadBody(c, maxBuildContextSize)
+	form, err := c.MultipartForm()
+	if err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			return s.Dispatcher.NewHTTPError(http.StatusRequestEntityTooLarge, "Build context exceeds the maximum size of 1GB", err)
+		}
+		return s.Dispatcher.NewBadRequest("Invalid build context upload", err)
+	}
+	defer form.RemoveAll()
+
+	opts, err := s.imageBuildOptions(form.Value)
+	if err != nil {
+		return err
+	}
+	buildContext, source, err := s.openBuildContext(form, opts.Dockerfile)
+	if err != nil {
+		return err
+	}
+	defer buildContext.Close()
+	if opts.AuthConfigs, err = s.Registries.AuthConfigs(ctx); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to read registry credentials", err)
+	}
+
+	// The status is sent before the build starts, its outcome is reported in
+	// the stream. Builds run for longer than the write timeout
+	stream := startNDJSON(c, func(message string) models.ImageBuildEvent {
+		return models.ImageBuildEvent{Error: message}
+	})
+
+	s.Logger.Info("Building image", "tags", opts.Tags, "target", opts.Target, "context", source)
+	id, err := buildImage(ctx, cli, buildContext, opts, stream.Send)
+	subject := "untagged"
+	if len(opts.Tags) > 0 {
+		subject = opts.Tags[0]
+	}
+	fields := map[string]string{
+		"Client":  c.Param("clientid"),
+		"Context": source,
+		"Tags":    strings.Join(opts.Tags, ", "),
+		"Target":  opts.Target,
+		"NoCache": strconv.FormatBool(opts.NoCache),
+	}
+	if err != nil {
+		fields["Error"] = err.Error()
+		_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+			UserId: userIDFromContext(c), Event: "DOCKER_IMAGE_BUILD", Subject: subject, Level: "ERROR",
+			Message: "image build failed", Fields: fields,
+		})
+		stream.Send(models.ImageBuildEvent{Error: err.Error()})
+		return nil
+	}
+
+	fields["ID"] = id
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_IMAGE_BUILD", Subject: subject, Level: "INFO",
+		Message: "image built", Fields: fields,
+	})
+	stream.Send(models.ImageBuildEvent{Result: &models.ImageBuildResult{ID: id, Tags: opts.Tags}})
+	return nil
+}
+
+// limitUploadBody bounds the body of a multipart upload of limit bytes of
+// files, so an oversized upload is refused before it is spooled to disk.
+// Large uploads outlast the server timeouts, which are extended
+func limitUploadBody(c echo.Context, limit int64) {
+	req, rc := c.Request(), http.NewResponseController(c.Response().Writer)
+	req.Body = http.MaxBytesReader(c.Response().Writer, req.Body, limit+uploadFormOverhead)
+	_ = rc.SetReadDeadline(time.Now().Add(uploadBodyTimeout))
+	_ = rc.SetWriteDeadline(time.Now().Add(uploadBodyTimeout))
+}
+
+// imageBuildOptions reads and validates the build options of the form
+func (s *DockerService) imageBuildOptions(values map[string][]string) (build.ImageBuildOptions, error) {
+	value := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+	opts := build.ImageBuildOptions{
+		Version:    build.BuilderV1,
+		Remove:     true,
+		Dockerfile: "Dockerfile",
+		Target:     value("target"),
+		Platform:   value("platform"),
+		BuildArgs:  map[string]*string{},
+		Tags:       []string{},
+	}
+
+	if p := value("dockerfile_path"); p != "" {
+		clean, err := cleanContextPath(p)
+		if err != nil {
+			return opts, s.Dispatcher.NewBadRequest(err.Error(), err)
+		}
+		opts.Dockerfile = clean
+	}
+	for _, tag := range values["tags"] {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return opts, s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid tag '%s'", tag), err)
+		}
+		if _, ok := named.(reference.Digested); ok {
+			return opts, s.Dispatcher.NewBadRequest(fmt.Sprintf("Tag '%s' cannot have a digest", tag), nil)
+		}
+		opts.Tags = append(opts.Tags, reference.FamiliarString(reference.TagNameOnly(named)))
+	}
+	for _, arg := range values["build_args"] {
+		key, val, ok := strings.Cut(arg, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return opts, s.Dispatcher.NewBadRequest(fmt.Sprintf("Build argument '%s' must be KEY=VALUE", arg), nil)
+		}
+		opts.BuildArgs[strings.TrimSpace(key)] = &val
+	}
+	for key, dst := range map[string]*bool{"no_cache": &opts.NoCache, "pull": &opts.PullParent} {
+		if v := value(key); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid %s value '%s'", key, v), err)
+			}
+			*dst = b
+		}
+	}
+	if _, err := parsePlatform(opts.Platform); err != nil {
+		return opts, s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+	return opts, nil
+}
+
+// openBuildContext returns the build context of the form, the uploaded
+// archive as is or a tar of the Dockerfile and files. source describes it
+// for the audit log
+func (s *DockerService) openBuildContext(form *multipart.Form, dockerfilePath string) (io.ReadCloser, string, error) {
+	archives, dockerfiles := form.File["context"], form.File["dockerfile"]
+	switch {
+	case len(archives) > 1 || len(dockerfiles) > 1:
+		return nil, "", s.Dispatcher.NewBadRequest("Only one context archive or Dockerfile can be sent", nil)
+	case len(archives) == 1 && (len(dockerfiles) > 0 || len(form.File["files"]) > 0):
+		return nil, "", s.Dispatcher.NewBadRequest("Send either a context archive or a Dockerfile with files", nil)
+	case len(archives) == 1:
+		if archives[0].Size > maxBuildContextSize {
+			return nil, "", s.Dispatcher.NewBadRequest("Build context exceeds the maximum size of 1GB", nil)
+		}
+		f, err := archives[0].Open()
+		if err != nil {
+			return nil, "", s.Dispatcher.NewInternalServerError("Failed to read the build context", err)
+		}
+		// The daemon detects and decompresses compressed archives
+		return f, "archive " + archives[0].Filename, nil
+	case len(dockerfiles) == 0:
+		return nil, "", s.Dispatcher.NewBadRequest("A context archive or a Dockerfile is required", nil)
+	}
+
+	files := form.File["files"]
+	paths := form.Value["paths"]
+	if len(paths) > len(files) {
+		return nil, "", s.Dispatcher.NewBadRequest("More paths than files were sent", nil)
+	}
+	entries := []uploadedFile{{Path: dockerfilePath, File: dockerfiles[0]}}
+	seen := map[string]bool{dockerfilePath: true}
+	size := dockerfiles[0].Size
+	for i, file := range files {
+		name := file.Filename
+		if i < len(paths) && strings.TrimSpace(paths[i]) != "" {
+			name = paths[i]
+		}
+		clean, err := cleanContextPath(name)
+		if err != nil {
+			return nil, "", s.Dispatcher.NewBadRequest(err.Error(), err)
+		}
+		if seen[clean] {
+			return nil, "", s.Dispatcher.NewBadRequest(fmt.Sprintf("Path '%s' is sent twice", clean), nil)
+		}
+		seen[clean] = true
+		size += file.Size
+		entries = append(entries, uploadedFile{Path: clean, File: file})
+	}
+	if size > maxBuildContextSize {
+		return nil, "", s.Dispatcher.NewBadRequest("Build context exceeds the maximum size of 1GB", nil)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		// A fixed time keeps the build cache valid across uploads
+		w.CloseWithError(writeUploadTar(w, entries, time.Unix(0, 0)))
+	}()
+	return r, fmt.Sprintf("%d files", len(entries)), nil
+}
+
+// cleanContextPath validates a path inside a build context and returns it
+// relative and cleaned
+func cleanContextPath(p string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(strings.TrimSpace(p), "\\", "/"))
+	if clean == "." || clean == "/" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid context path '%s'", p)
+	}
+	return clean, nil
+}
+
+// writeUploadTar writes uploaded files as a tar archive, modified at modTime
+func writeUploadTar(w io.Writer, entries []uploadedFile, modTime time.Time) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    entry.Path,
+			Mode:    0o644,
+			Size:    entry.File.Size,
+			ModTime: modTime,
+		}); err != nil {
+			return err
+		}
+		f, err := entry.File.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// buildImage builds an image and reports its output. It returns the ID of
+// the image, the daemon reports build failures inside the stream
+func buildImage(ctx context.Context, cli *client.Client, buildContext io.Reader, opts build.ImageBuildOptions, send func(models.ImageBuildEvent)) (string, error) {
+	resp, err := cli.ImageBuild(ctx, buildContext, opts)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	id := ""
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return "", err
+		}
+		switch {
+		case msg.Error != nil:
+			return "", errors.New(msg.Error.Message)
+		case msg.Aux != nil:
+			var result build.Result
+			if err := json.Unmarshal(*msg.Aux, &result); err == nil && result.ID != "" {
+				id = result.ID
+			}
+		case msg.Stream != "":
+			send(models.ImageBuildEvent{Output: msg.Stream})
+		case msg.Status != "":
+			p := models.ImagePullProgress{ID: msg.ID, Status: msg.Status}
+			if msg.Progress != nil {
+				p.Current, p.Total = msg.Progress.Current, msg.Progress.Total
+			}
+			send(models.ImageBuildEvent{Progress: &p})
+		}
+	}
+
+	// Daemons without the aux message are left with the tag to resolve
+	if id == "" && len(opts.Tags) > 0 {
+		inspect, err := cli.ImageInspect(ctx, opts.Tags[0])
+		if err != nil {
+			return "", err
+		}
+		id = inspect.ID
+	}
+	return id, nil
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/docker/docker/api/types/build"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestImageBuildOptions tests that the form is read into build options and
+// invalid values are rejected
+func TestImageBuildOptions(t *testing.T) {
+	service := &DockerService{Dispatcher: utils.NewDispatcher(nil, nil), Logger: slog.Default()}
+
+	opts, err := service.imageBuildOptions(map[string][]string{
+		"tags":            {"tools/report", "ghcr.io/acme/report:1.2", ""},
+		"build_args":      {"VERSION=1.2", "EMPTY=", "URL=http://x?a=b"},
+		"target":          {"runtime"},
+		"no_cache":        {"true"},
+		"dockerfile_path": {"./build/Dockerfile"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tools/report:latest", "ghcr.io/acme/report:1.2"}, opts.Tags)
+	assert.Equal(t, "1.2", *opts.BuildArgs["VERSION"])
+	assert.Equal(t, "", *opts.BuildArgs["EMPTY"])
+	assert.Equal(t, "http://x?a=b", *opts.BuildArgs["URL"])
+	assert.Equal(t, "runtime", opts.Target)
+	assert.True(t, opts.NoCache)
+	assert.False(t, opts.PullParent)
+	assert.Equal(t, "build/Dockerfile", opts.Dockerfile)
+	assert.Equal(t, build.BuilderV1, opts.Version)
+
+	invalid := map[string]map[string][]string{
+		"tag":             {"tags": {"Invalid Tag"}},
+		"digest":          {"tags": {"nginx@sha256:" + string(bytes.Repeat([]byte("a"), 64))}},
+		"build arg":       {"build_args": {"VERSION"}},
+		"no cache":        {"no_cache": {"maybe"}},
+		"platform":        {"platform": {"linux/"}},
+		"dockerfile path": {"dockerfile_path": {"../Dockerfile"}},
+	}
+	for name, values := range invalid {
+		_, err := service.imageBuildOptions(values)
+		assert.Error(t, err, name)
+	}
+}
+
+// TestOpenBuildContext tests that a Dockerfile and files are assembled into
+// a tar context
+func TestOpenBuildContext(t *testing.T) {
+	service := &DockerService{Dispatcher: utils.NewDispatcher(nil, nil), Logger: slog.Default()}
+	form := buildForm(t, map[string][]string{"paths": {"src/main.go"}}, map[string][][2]string{
+		"dockerfile": {{"Dockerfile", "FROM golang:1.25\nCOPY . .\n"}},
+		"files":      {{"main.go", "package main\n"}, {"go.mod", "module tool\n"}},
+	})
+
+	r, source, err := service.openBuildContext(form, "Dockerfile")
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, "3 files", source)
+
+	content := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		content[hdr.Name] = string(data)
+	}
+	assert.Equal(t, map[string]string{
+		"Dockerfile":  "FROM golang:1.25\nCOPY . .\n",
+		"src/main.go": "package main\n",
+		"go.mod":      "module tool\n",
+	}, content)
+
+	invalid := map[string]*multipart.Form{
+		"nothing": buildForm(t, nil, nil),
+		"both": buildForm(t, nil, map[string][][2]string{
+			"context":    {{"ctx.tar", ""}},
+			"dockerfile": {{"Dockerfile", "FROM scratch\n"}},
+		}),
+		"escaping path": buildForm(t, map[string][]string{"paths": {"../etc/passwd"}}, map[string][][2]string{
+			"dockerfile": {{"Dockerfile", "FROM scratch\n"}},
+			"files":      {{"passwd", "root"}},
+		}),
+		"duplicate path": buildForm(t, map[string][]string{"paths": {"Dockerfile"}}, map[string][][2]string{
+			"dockerfile": {{"Dockerfile", "FROM scratch\n"}},
+			"files":      {{"other", "FROM alpine\n"}},
+		}),
+	}
+	for name, form := range invalid {
+		_, _, err := service.openBuildContext(form, "Dockerfile")
+		assert.Error(t, err, name)
+	}
+}
+
+// TestBuildImage tests reading the output of a build and the failures the
+// daemon reports inside the stream
+func TestBuildImage(t *testing.T) {
+	stream := `{"stream":"Step 1/2 : FROM alpine\n"}
+{"status":"Pulling from library/alpine","id":"latest"}
+{"stream":" ---> a1b2c3\n"}
+{"aux":{"ID":"sha256:built"}}
+`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("target") == "broken" {
+			_, _ = w.Write([]byte(`{"errorDetail":{"message":"RUN failed"},"error":"RUN failed"}` + "\n"))
+			return
+		}
+		_, _ = w.Write([]byte(stream))
+	}))
+	t.Cleanup(srv.Close)
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+srv.Listener.Addr().String()), client.WithVersion("1.47"))
+	require.NoError(t, err)
+
+	var events []models.ImageBuildEvent
+	id, err := buildImage(context.Background(), cli, bytes.NewReader(nil), build.ImageBuildOptions{}, func(e models.ImageBuildEvent) {
+		events = append(events, e)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:built", id)
+	require.Len(t, events, 3)
+	assert.Equal(t, "Step 1/2 : FROM alpine\n", events[0].Output)
+	assert.Equal(t, &models.ImagePullProgress{ID: "latest", Status: "Pulling from library/alpine"}, events[1].Progress)
+
+	_, err = buildImage(context.Background(), cli, bytes.NewReader(nil), build.ImageBuildOptions{Target: "broken"}, func(models.ImageBuildEvent) {})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "RUN failed")
+}
+
+// TestLimitUploadBody tests that uploads over the limit are refused while
+// the form is read
+func TestLimitUploadBody(t *testing.T) {
+	upload := func(size int) error {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		w, err := mw.CreateFormFile("files", "data.bin")
+		require.NoError(t, err)
+		_, err = w.Write(bytes.Repeat([]byte("x"), size))
+		require.NoError(t, err)
+		require.NoError(t, mw.Close())
+
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		req.Header.Set(echo.HeaderContentType, mw.FormDataContentType())
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		limitUploadBody(c, 1024)
+		form, err := c.MultipartForm()
+		if err == nil {
+			_ = form.RemoveAll()
+		}
+		return err
+	}
+
+	require.NoError(t, upload(1024))
+	err := upload(uploadFormOverhead + 2048)
+	require.Error(t, err)
+	assert.True(t, errors.As(err, new(*http.MaxBytesError)))
+}
+
+// buildForm parses a multipart form of values and files, given as name and
+// content pairs
+func buildForm(t *testing.T, values map[string][]string, files map[string][][2]string) *multipart.Form {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for key, vs := range values {
+		for _, v := range vs {
+			require.NoError(t, mw.WriteField(key, v))
+		}
+	}
+	for field, fs := range files {
+		for _, f := range fs {
+			w, err := mw.CreateFormFile(field, f[0])
+			require.NoError(t, err)
+			_, err = w.Write([]byte(f[1]))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, mw.Close())
+	form, err := multipart.NewReader(body, mw.Boundary()).ReadForm(1 << 20)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = form.RemoveAll() })
+	return form
+}
@@ -0,0 +1,1035 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"visory/internal/models"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Labels set on the resources of a stack, those of Docker Compose so the
+// docker CLI recognizes the project
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	composeNumberLabel  = "com.docker.compose.container-number"
+	composeOneoffLabel  = "com.docker.compose.oneoff"
+	composeHashLabel    = "com.docker.compose.config-hash"
+	composeNetworkLabel = "com.docker.compose.network"
+	composeVolumeLabel  = "com.docker.compose.volume"
+)
+
+// validStackName is the project name format of Docker Compose
+var validStackName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// composeFile is the part of the Compose specification stacks support.
+// Unknown keys are ignored, as Docker Compose does for extensions
+type composeFile struct {
+	Name     string                     `yaml:"name"`
+	Services map[string]composeService  `yaml:"services"`
+	Networks map[string]*composeNetwork `yaml:"networks"`
+	Volumes  map[string]*composeVolume  `yaml:"volumes"`
+}
+
+type composeService struct {
+	Image         string                 `yaml:"image"`
+	Build         *yaml.Node             `yaml:"build"`
+	PullPolicy    string                 `yaml:"pull_policy"`
+	ContainerName string                 `yaml:"container_name"`
+	Command       composeCommand         `yaml:"command"`
+	Entrypoint    composeCommand         `yaml:"entrypoint"`
+	Environment   composeMapping         `yaml:"environment"`
+	Labels        composeMapping         `yaml:"labels"`
+	Ports         []composePort          `yaml:"ports"`
+	Volumes       []composeMount         `yaml:"volumes"`
+	Networks      composeServiceNetworks `yaml:"networks"`
+	NetworkMode   string                 `yaml:"network_mode"`
+	DependsOn     composeDependsOn       `yaml:"depends_on"`
+	Restart       string                 `yaml:"restart"`
+	User          string                 `yaml:"user"`
+	WorkingDir    string                 `yaml:"working_dir"`
+	Hostname      string                 `yaml:"hostname"`
+	Privileged    bool                   `yaml:"privileged"`
+	Tty           bool                   `yaml:"tty"`
+	StdinOpen     bool                   `yaml:"stdin_open"`
+	CapAdd        []string               `yaml:"cap_add"`
+	CapDrop       []string               `yaml:"cap_drop"`
+	ExtraHosts    composeExtraHosts      `yaml:"extra_hosts"`
+	MemLimit      string                 `yaml:"mem_limit"`
+	Cpus          float64                `yaml:"cpus"`
+	Healthcheck   *composeHealthcheck    `yaml:"healthcheck"`
+}
+
+type composeNetwork struct {
+	Name       string            `yaml:"name"`
+	External   bool              `yaml:"external"`
+	Driver     string            `yaml:"driver"`
+	DriverOpts map[string]string `yaml:"driver_opts"`
+	Internal   bool              `yaml:"internal"`
+	Attachable bool              `yaml:"attachable"`
+	EnableIPv6 bool              `yaml:"enable_ipv6"`
+	Labels     composeMapping    `yaml:"labels"`
+	Ipam       *struct {
+		Driver string `yaml:"driver"`
+		Config []struct {
+			Subnet  string `yaml:"subnet"`
+			Gateway string `yaml:"gateway"`
+			IPRange string `yaml:"ip_range"`
+		} `yaml:"config"`
+	} `yaml:"ipam"`
+}
+
+type composeVolume struct {
+	Name       string            `yaml:"name"`
+	External   bool              `yaml:"external"`
+	Driver     string            `yaml:"driver"`
+	DriverOpts map[string]string `yaml:"driver_opts"`
+	Labels     composeMapping    `yaml:"labels"`
+}
+
+type composeHealthcheck struct {
+	Test        composeHealthTest `yaml:"test"`
+	Interval    string            `yaml:"interval"`
+	Timeout     string            `yaml:"timeout"`
+	StartPeriod string            `yaml:"start_period"`
+	Retries     int               `yaml:"retries"`
+	Disable     bool              `yaml:"disable"`
+}
+
+// composeCommand is a command given as a list, or as a string split like a
+// shell would
+type composeCommand []string
+
+func (c *composeCommand) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		args, err := splitCommand(value.Value)
+		*c = args
+		return err
+	}
+	var args []string
+	if err := value.Decode(&args); err != nil {
+		return err
+	}
+	*c = args
+	return nil
+}
+
+// composeHealthTest is a healthcheck test, a string runs in a shell
+type composeHealthTest []string
+
+func (t *composeHealthTest) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = []string{"CMD-SHELL", value.Value}
+		return nil
+	}
+	var test []string
+	if err := value.Decode(&test); err != nil {
+		return err
+	}
+	*t = test
+	return nil
+}
+
+// composeMapping is a mapping given as a map or as a list of KEY=VALUE. A
+// nil value is a key without value
+type composeMapping map[string]*string
+
+func (m *composeMapping) UnmarshalYAML(value *yaml.Node) error {
+	mapping := composeMapping{}
+	if value.Kind == yaml.SequenceNode {
+		var items []string
+		if err := value.Decode(&items); err != nil {
+			return err
+		}
+		for _, item := range items {
+			k, v, ok := strings.Cut(item, "=")
+			if ok {
+				mapping[k] = &v
+			} else {
+				mapping[k] = nil
+			}
+		}
+		*m = mapping
+		return nil
+	}
+	var raw map[string]*string
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	for k, v := range raw {
+		mapping[k] = v
+	}
+	*m = mapping
+	return nil
+}
+
+// values returns the keys set to a value, as a map
+func (m composeMapping) values() map[string]string {
+	values := make(map[string]string, len(m))
+	for k, v := range m {
+		if v != nil {
+			values[k] = *v
+		} else {
+			values[k] = ""
+		}
+	}
+	return values
+}
+
+// composeExtraHosts is a list of host:ip or a map of host to ip
+type composeExtraHosts []string
+
+func (h *composeExtraHosts) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var hosts []string
+		if err := value.Decode(&hosts); err != nil {
+			return err
+		}
+		*h = hosts
+		return nil
+	}
+	var raw map[string]string
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	hosts := make([]string, 0, len(raw))
+	for host, ip := range raw {
+		hosts = append(hosts, host+":"+ip)
+	}
+	sort.Strings(hosts)
+	*h = hosts
+	return nil
+}
+
+// composePort is a port in the short syntax, or in the long one
+type composePort struct {
+	Short     string `yaml:"-"`
+	Target    int    `yaml:"target"`
+	Published string `yaml:"published"`
+	HostIP    string `yaml:"host_ip"`
+	Protocol  string `yaml:"protocol"`
+}
+
+func (p *composePort) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		p.Short = value.Value
+		return nil
+	}
+	type long composePort
+	return value.Decode((*long)(p))
+}
+
+// composeMount is a service volume in the short syntax, or in the long one
+type composeMount struct {
+	Short    string `yaml:"-"`
+	Type     string `yaml:"type"`
+	Source   string `yaml:"source"`
+	Target   string `yaml:"target"`
+	ReadOnly bool   `yaml:"read_only"`
+}
+
+func (m *composeMount) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		m.Short = value.Value
+		return nil
+	}
+	type long composeMount
+	return value.Decode((*long)(m))
+}
+
+type composeServiceNetwork struct {
+	Aliases     []string `yaml:"aliases"`
+	Ipv4Address string   `yaml:"ipv4_address"`
+	Ipv6Address string   `yaml:"ipv6_address"`
+}
+
+// composeServiceNetworks is a list of network names, or a map of network
+// names to their settings
+type composeServiceNetworks map[string]*composeServiceNetwork
+
+func (n *composeServiceNetworks) UnmarshalYAML(value *yaml.Node) error {
+	networks := composeServiceNetworks{}
+	if value.Kind == yaml.SequenceNode {
+		var names []string
+		if err := value.Decode(&names); err != nil {
+			return err
+		}
+		for _, name := range names {
+			networks[name] = nil
+		}
+		*n = networks
+		return nil
+	}
+	var raw map[string]*composeServiceNetwork
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	for k, v := range raw {
+		networks[k] = v
+	}
+	*n = networks
+	return nil
+}
+
+// composeDependsOn is a list of services, or a map of services to their
+// condition. Conditions are not waited for, only the start order is kept
+type composeDependsOn []string
+
+func (d *composeDependsOn) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var services []string
+		if err := value.Decode(&services); err != nil {
+			return err
+		}
+		*d = services
+		return nil
+	}
+	var raw map[string]yaml.Node
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	services := make([]string, 0, len(raw))
+	for name := range raw {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	*d = services
+	return nil
+}
+
+// stackProject is a Compose file resolved into the resources to create on a
+// Docker host
+type stackProject struct {
+	Name string
+	// Services are in start order, dependencies first
+	Services []stackService
+	Networks []stackNetwork
+	Volumes  []stackVolume
+}
+
+type stackService struct {
+	Name          string
+	ContainerName string
+	Pull          string
+	Config        container.Config
+	HostConfig    container.HostConfig
+	// Networks are attached in order, the first one when the container is
+	// created
+	Networks []stackEndpoint
+	// Hash identifies the configuration, a container with another hash is
+	// recreated
+	Hash string
+}
+
+type stackEndpoint struct {
+	Network  string
+	Settings network.EndpointSettings
+}
+
+type stackNetwork struct {
+	Key      string
+	Name     string
+	External bool
+	Options  network.CreateOptions
+}
+
+type stackVolume struct {
+	Key      string
+	Name     string
+	External bool
+	Options  volume.CreateOptions
+}
+
+// loadStack parses a Compose file into a project. Variables are
+// interpolated from the .env content only, never from the environment of
+// Visory. An empty name uses the name of the Compose file
+func loadStack(name, compose, envFile string) (*stackProject, error) {
+	env := map[string]string{}
+	if strings.TrimSpace(envFile) != "" {
+		var err error
+		if env, err = godotenv.Unmarshal(envFile); err != nil {
+			return nil, fmt.Errorf("invalid .env file: %w", err)
+		}
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(compose), &root); err != nil {
+		return nil, fmt.Errorf("invalid Compose file: %w", err)
+	}
+	if len(root.Content) == 0 {
+		return nil, errors.New("the Compose file is empty")
+	}
+	if err := interpolateNode(&root, env); err != nil {
+		return nil, err
+	}
+	var file composeFile
+	if err := root.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid Compose file: %w", err)
+	}
+
+	if name == "" {
+		name = file.Name
+	}
+	if name == "" {
+		return nil, errors.New("a stack name is required")
+	}
+	if !validStackName.MatchString(name) {
+		return nil, fmt.Errorf("invalid stack name '%s', use lowercase letters, digits, '_' and '-'", name)
+	}
+	if len(file.Services) == 0 {
+		return nil, errors.New("the Compose file defines no service")
+	}
+
+	p := &stackProject{Name: name}
+	order, err := serviceOrder(file.Services)
+	if err != nil {
+		return nil, err
+	}
+	containerNames := make(map[string]string, len(order))
+	for _, svcName := range order {
+		containerNames[svcName] = file.Services[svcName].ContainerName
+		if containerNames[svcName] == "" {
+			containerNames[svcName] = fmt.Sprintf("%s-%s-1", name, svcName)
+		}
+	}
+
+	usedNetworks := map[string]bool{}
+	usedVolumes := map[string]bool{}
+	for _, svcName := range order {
+		svc, err := p.service(svcName, file, env, containerNames, usedNetworks, usedVolumes)
+		if err != nil {
+			return nil, fmt.Errorf("service '%s': %w", svcName, err)
+		}
+		p.Services = append(p.Services, svc)
+	}
+
+	for _, key := range sortedKeys(usedNetworks) {
+		def := file.Networks[key]
+		if def == nil {
+			def = &composeNetwork{}
+		}
+		n := stackNetwork{Key: key, Name: p.resourceName(key, def.Name, def.External), External: def.External}
+		if !def.External {
+			n.Options = network.CreateOptions{
+				Driver:     def.Driver,
+				Options:    def.DriverOpts,
+				Internal:   def.Internal,
+				Attachable: def.Attachable,
+				Labels:     def.Labels.values(),
+			}
+			if def.EnableIPv6 {
+				n.Options.EnableIPv6 = &def.EnableIPv6
+			}
+			if def.Ipam != nil {
+				n.Options.IPAM = &network.IPAM{Driver: def.Ipam.Driver}
+				for _, c := range def.Ipam.Config {
+					n.Options.IPAM.Config = append(n.Options.IPAM.Config, network.IPAMConfig{
+						Subnet: c.Subnet, Gateway: c.Gateway, IPRange: c.IPRange,
+					})
+				}
+			}
+			n.Options.Labels[composeProjectLabel] = name
+			n.Options.Labels[composeNetworkLabel] = key
+		}
+		p.Networks = append(p.Networks, n)
+	}
+
+	for _, key := range sortedKeys(usedVolumes) {
+		def := file.Volumes[key]
+		if def == nil {
+			def = &composeVolume{}
+		}
+		v := stackVolume{Key: key, Name: p.resourceName(key, def.Name, def.External), External: def.External}
+		if !def.External {
+			v.Options = volume.CreateOptions{
+				Name:       v.Name,
+				Driver:     def.Driver,
+				DriverOpts: def.DriverOpts,
+				Labels:     def.Labels.values(),
+			}
+			v.Options.Labels[composeProjectLabel] = name
+			v.Options.Labels[composeVolumeLabel] = key
+		}
+		p.Volumes = append(p.Volumes, v)
+	}
+	return p, nil
+}
+
+// resourceName is the name of a network or volume on the host. Resources of
+// the project are prefixed with its name, unless named explicitly
+func (p *stackProject) resourceName(key, name string, external bool) string {
+	switch {
+	case name != "":
+		return name
+	case external:
+		return key
+	}
+	return p.Name + "_" + key
+}
+
+// service resolves a service into its container configuration, recording
+// the networks and volumes it uses
+func (p *stackProject) service(name string, file composeFile, env map[string]string, containerNames map[string]string, usedNetworks, usedVolumes map[string]bool) (stackService, error) {
+	def := file.Services[name]
+	svc := stackService{Name: name, ContainerName: containerNames[name]}
+	if def.Build != nil {
+		return svc, errors.New("build is not supported, set an image")
+	}
+	if strings.TrimSpace(def.Image) == "" {
+		return svc, errors.New("an image is required")
+	}
+	if !validContainerName.MatchString(svc.ContainerName) {
+		return svc, fmt.Errorf("invalid container name '%s'", svc.ContainerName)
+	}
+
+	switch def.PullPolicy {
+	case "", "missing", "if_not_present":
+		svc.Pull = models.PullMissing
+	case "always":
+		svc.Pull = models.PullAlways
+	case "never":
+		svc.Pull = models.PullNever
+	default:
+		return svc, fmt.Errorf("unsupported pull_policy '%s'", def.PullPolicy)
+	}
+
+	svc.Config = container.Config{
+		Image:        strings.TrimSpace(def.Image),
+		Cmd:          strslice.StrSlice(def.Command),
+		Entrypoint:   strslice.StrSlice(def.Entrypoint),
+		User:         def.User,
+		WorkingDir:   def.WorkingDir,
+		Hostname:     def.Hostname,
+		Tty:          def.Tty,
+		OpenStdin:    def.StdinOpen,
+		Labels:       def.Labels.values(),
+		ExposedPorts: nat.PortSet{},
+	}
+	for _, k := range sortedKeys(def.Environment) {
+		switch v := def.Environment[k]; {
+		case v != nil:
+			svc.Config.Env = append(svc.Config.Env, k+"="+*v)
+		case env[k] != "":
+			svc.Config.Env = append(svc.Config.Env, k+"="+env[k])
+		}
+	}
+
+	svc.HostConfig = container.HostConfig{
+		Privileged:   def.Privileged,
+		CapAdd:       def.CapAdd,
+		CapDrop:      def.CapDrop,
+		ExtraHosts:   def.ExtraHosts,
+		PortBindings: nat.PortMap{},
+	}
+	if err := setRestartPolicy(&svc.HostConfig, def.Restart); err != nil {
+		return svc, err
+	}
+	if def.MemLimit != "" {
+		mem, err := units.RAMInBytes(def.MemLimit)
+		if err != nil {
+			return svc, fmt.Errorf("invalid mem_limit '%s'", def.MemLimit)
+		}
+		svc.HostConfig.Memory = mem
+	}
+	if def.Cpus < 0 {
+		return svc, errors.New("cpus cannot be negative")
+	}
+	svc.HostConfig.NanoCPUs = int64(def.Cpus * 1e9)
+
+	if hc := def.Healthcheck; hc != nil {
+		health, err := healthConfig(hc)
+		if err != nil {
+			return svc, err
+		}
+		svc.Config.Healthcheck = health
+	}
+
+	for _, port := range def.Ports {
+		if err := addPort(&svc, port); err != nil {
+			return svc, err
+		}
+	}
+	for _, m := range def.Volumes {
+		if err := p.addMount(&svc, m, file, usedVolumes); err != nil {
+			return svc, err
+		}
+	}
+
+	for _, dep := range def.DependsOn {
+		if _, ok := file.Services[dep]; !ok {
+			return svc, fmt.Errorf("depends on undefined service '%s'", dep)
+		}
+	}
+
+	switch mode := def.NetworkMode; {
+	case mode != "" && len(def.Networks) > 0:
+		return svc, errors.New("network_mode and networks cannot be used together")
+	case strings.HasPrefix(mode, "service:"):
+		target, ok := containerNames[strings.TrimPrefix(mode, "service:")]
+		if !ok {
+			return svc, fmt.Errorf("network_mode uses undefined service '%s'", strings.TrimPrefix(mode, "service:"))
+		}
+		svc.HostConfig.NetworkMode = container.NetworkMode("container:" + target)
+	case mode != "":
+		svc.HostConfig.NetworkMode = container.NetworkMode(mode)
+	default:
+		networks := def.Networks
+		if len(networks) == 0 {
+			networks = composeServiceNetworks{"default": nil}
+		}
+		for _, key := range sortedKeys(networks) {
+			netDef, declared := file.Networks[key]
+			if !declared && key != "default" {
+				return svc, fmt.Errorf("uses undefined network '%s'", key)
+			}
+			usedNetworks[key] = true
+			netName := p.resourceName(key, "", false)
+			if netDef != nil {
+				netName = p.resourceName(key, netDef.Name, netDef.External)
+			}
+
+			endpoint := stackEndpoint{Network: netName}
+			endpoint.Settings.Aliases = []string{name}
+			if cfg := networks[key]; cfg != nil {
+				endpoint.Settings.Aliases = append(endpoint.Settings.Aliases, cfg.Aliases...)
+				if cfg.Ipv4Address != "" || cfg.Ipv6Address != "" {
+					endpoint.Settings.IPAMConfig = &network.EndpointIPAMConfig{
+						IPv4Address: cfg.Ipv4Address,
+						IPv6Address: cfg.Ipv6Address,
+					}
+				}
+			}
+			svc.Networks = append(svc.Networks, endpoint)
+		}
+		svc.HostConfig.NetworkMode = container.NetworkMode(svc.Networks[0].Network)
+	}
+
+	svc.Config.Labels[composeProjectLabel] = p.Name
+	svc.Config.Labels[composeServiceLabel] = name
+	svc.Config.Labels[composeNumberLabel] = "1"
+	svc.Config.Labels[composeOneoffLabel] = "False"
+
+	hash, err := json.Marshal(struct {
+		Name       string
+		Config     container.Config
+		HostConfig container.HostConfig
+		Networks   []stackEndpoint
+	}{svc.ContainerName, svc.Config, svc.HostConfig, svc.Networks})
+	if err != nil {
+		return svc, err
+	}
+	sum := sha256.Sum256(hash)
+	svc.Hash = hex.EncodeToString(sum[:])
+	svc.Config.Labels[composeHashLabel] = svc.Hash
+	return svc, nil
+}
+
+func setRestartPolicy(hc *container.HostConfig, restart string) error {
+	policy := container.RestartPolicy{Name: container.RestartPolicyDisabled}
+	if restart != "" {
+		mode, retries, hasRetries := strings.Cut(restart, ":")
+		policy.Name = container.RestartPolicyMode(mode)
+		if hasRetries {
+			n, err := strconv.Atoi(retries)
+			if err != nil {
+				return fmt.Errorf("invalid restart policy '%s'", restart)
+			}
+			policy.MaximumRetryCount = n
+		}
+	}
+	if err := container.ValidateRestartPolicy(policy); err != nil {
+		return err
+	}
+	hc.RestartPolicy = policy
+	return nil
+}
+
+func healthConfig(hc *composeHealthcheck) (*container.HealthConfig, error) {
+	if hc.Disable {
+		return &container.HealthConfig{Test: []string{"NONE"}}, nil
+	}
+	health := &container.HealthConfig{Test: hc.Test, Retries: hc.Retries}
+	for _, d := range []struct {
+		name  string
+		value string
+		out   *time.Duration
+	}{
+		{"interval", hc.Interval, &health.Interval},
+		{"timeout", hc.Timeout, &health.Timeout},
+		{"start_period", hc.StartPeriod, &health.StartPeriod},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid healthcheck %s '%s'", d.name, d.value)
+		}
+		*d.out = v
+	}
+	return health, nil
+}
+
+// addPort publishes a port of a service
+func addPort(svc *stackService, port composePort) error {
+	spec := port.Short
+	if spec == "" {
+		if port.Target <= 0 {
+			return errors.New("a port needs a target")
+		}
+		proto := port.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		spec = fmt.Sprintf("%d/%s", port.Target, proto)
+		if port.Published != "" {
+			spec = port.Published + ":" + spec
+			if port.HostIP != "" {
+				spec = port.HostIP + ":" + spec
+			}
+		}
+	}
+	mappings, err := nat.ParsePortSpec(spec)
+	if err != nil {
+		return fmt.Errorf("invalid port '%s': %w", spec, err)
+	}
+	for _, pm := range mappings {
+		svc.Config.ExposedPorts[pm.Port] = struct{}{}
+		if pm.Binding.HostPort != "" || pm.Binding.HostIP != "" {
+			svc.HostConfig.PortBindings[pm.Port] = append(svc.HostConfig.PortBindings[pm.Port], pm.Binding)
+		}
+	}
+	return nil
+}
+
+// addMount mounts a bind, volume or tmpfs into a service. Named volumes
+// must be declared at the top level
+func (p *stackProject) addMount(svc *stackService, m composeMount, file composeFile, usedVolumes map[string]bool) error {
+	volumeName := func(key string) (string, error) {
+		def, ok := file.Volumes[key]
+		if !ok {
+			return "", fmt.Errorf("uses undefined volume '%s'", key)
+		}
+		usedVolumes[key] = true
+		if def == nil {
+			return p.resourceName(key, "", false), nil
+		}
+		return p.resourceName(key, def.Name, def.External), nil
+	}
+	isBind := func(source string) (bool, error) {
+		if strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~") {
+			return false, fmt.Errorf("relative bind source '%s' is not supported, stacks have no project directory", source)
+		}
+		return path.IsAbs(source), nil
+	}
+
+	if m.Short != "" {
+		parts := strings.Split(m.Short, ":")
+		if len(parts) > 3 {
+			return fmt.Errorf("invalid volume '%s'", m.Short)
+		}
+		if len(parts) == 1 {
+			if !path.IsAbs(parts[0]) {
+				return fmt.Errorf("volume target '%s' must be an absolute path", parts[0])
+			}
+			if svc.Config.Volumes == nil {
+				svc.Config.Volumes = map[string]struct{}{}
+			}
+			svc.Config.Volumes[parts[0]] = struct{}{}
+			return nil
+		}
+		if !path.IsAbs(parts[1]) {
+			return fmt.Errorf("volume target '%s' must be an absolute path", parts[1])
+		}
+		bind, err := isBind(parts[0])
+		if err != nil {
+			return err
+		}
+		if !bind {
+			if parts[0], err = volumeName(parts[0]); err != nil {
+				return err
+			}
+		}
+		svc.HostConfig.Binds = append(svc.HostConfig.Binds, strings.Join(parts, ":"))
+		return nil
+	}
+
+	if !path.IsAbs(m.Target) {
+		return fmt.Errorf("volume target '%s' must be an absolute path", m.Target)
+	}
+	mnt := mount.Mount{Type: mount.Type(m.Type), Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly}
+	switch mnt.Type {
+	case mount.TypeBind:
+		bind, err := isBind(m.Source)
+		if err != nil {
+			return err
+		}
+		if !bind {
+			return fmt.Errorf("bind source '%s' must be an absolute path", m.Source)
+		}
+	case mount.TypeVolume:
+		if m.Source != "" {
+			var err error
+			if mnt.Source, err = volumeName(m.Source); err != nil {
+				return err
+			}
+		}
+	case mount.TypeTmpfs:
+		mnt.Source = ""
+	default:
+		return fmt.Errorf("unsupported volume type '%s'", m.Type)
+	}
+	svc.HostConfig.Mounts = append(svc.HostConfig.Mounts, mnt)
+	return nil
+}
+
+// serviceOrder sorts services so dependencies start first, alphabetically
+// among services ready at the same time
+func serviceOrder(services map[string]composeService) ([]string, error) {
+	pending := make(map[string]int, len(services))
+	dependents := map[string][]string{}
+	for name, svc := range services {
+		deps := slices.Clone([]string(svc.DependsOn))
+		if target, ok := strings.CutPrefix(svc.NetworkMode, "service:"); ok {
+			deps = append(deps, target)
+		}
+		for _, dep := range deps {
+			if _, ok := services[dep]; !ok {
+				continue
+			}
+			pending[name]++
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+
+	var ready, order []string
+	for name := range services {
+		if pending[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+		for _, dependent := range dependents[name] {
+			if pending[dependent]--; pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(order) != len(services) {
+		var cycle []string
+		for name := range services {
+			if pending[name] > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("services %s depend on each other", strings.Join(cycle, ", "))
+	}
+	return order, nil
+}
+
+// interpolateNode replaces variables in the values of a YAML document.
+// Plain scalars that changed are resolved again, so "${PORT}" can be an int
+func interpolateNode(node *yaml.Node, env map[string]string) error {
+	if node.Kind == yaml.ScalarNode {
+		value, err := interpolate(node.Value, env)
+		if err != nil {
+			return err
+		}
+		if value != node.Value {
+			node.Value = value
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+		return nil
+	}
+	for i, child := range node.Content {
+		// Keys of mappings are not interpolated
+		if node.Kind == yaml.MappingNode && i%2 == 0 {
+			continue
+		}
+		if err := interpolateNode(child, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interpolate replaces $VAR and ${VAR} in s, supporting the ${VAR:-default},
+// ${VAR-default}, ${VAR:+alt}, ${VAR+alt}, ${VAR:?error} and ${VAR?error}
+// forms. $$ is a literal $
+func interpolate(s string, env map[string]string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch next := s[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '{':
+			depth, end := 1, -1
+			for j := i + 2; j < len(s) && end < 0; j++ {
+				switch s[j] {
+				case '{':
+					depth++
+				case '}':
+					if depth--; depth == 0 {
+						end = j
+					}
+				}
+			}
+			if end < 0 {
+				return "", fmt.Errorf("unclosed variable in '%s'", s)
+			}
+			value, err := expandVariable(s[i+2:end], env)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end
+		case next == '_' || isAlpha(next):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || isAlpha(s[j]) || (s[j] >= '0' && s[j] <= '9')) {
+				j++
+			}
+			b.WriteString(env[s[i+1:j]])
+			i = j - 1
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// expandVariable expands the content of a ${...} expression
+func expandVariable(expr string, env map[string]string) (string, error) {
+	end := strings.IndexAny(expr, ":-+?")
+	if end < 0 {
+		return env[expr], nil
+	}
+	name, op := expr[:end], expr[end:]
+	value, set := env[name]
+	// With a colon, an empty variable counts as unset
+	if strings.HasPrefix(op, ":") {
+		op = op[1:]
+		set = set && value != ""
+	}
+	if op == "" {
+		return "", fmt.Errorf("invalid variable '${%s}'", expr)
+	}
+	arg, err := interpolate(op[1:], env)
+	if err != nil {
+		return "", err
+	}
+	switch op[0] {
+	case '-':
+		if !set {
+			return arg, nil
+		}
+	case '+':
+		if set {
+			return arg, nil
+		}
+		return "", nil
+	case '?':
+		if !set {
+			if arg == "" {
+				arg = "is required"
+			}
+			return "", fmt.Errorf("variable %s %s", name, arg)
+		}
+	default:
+		return "", fmt.Errorf("invalid variable '${%s}'", expr)
+	}
+	return value, nil
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// splitCommand splits a command string into arguments, honouring quotes and
+// backslash escapes like a shell
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				i++
+				current.WriteByte(s[i])
+			} else {
+				current.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == '\\' && i+1 < len(s):
+			i++
+			current.WriteByte(s[i])
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed quote in command '%s'", s)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
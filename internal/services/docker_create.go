@@ -0,0 +1,343 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"visory/internal/models"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-connections/nat"
+	"github.com/labstack/echo/v4"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// validContainerName is the name format accepted by the Docker daemon
+var validContainerName = regexp.MustCompile(`^/?[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+//	@Summary      Create container
+//	@Description  Create a container from a complete specification: config, host config, networking config and platform. The image can be pulled first and the container started after. With progress, the response is a stream of models.CreateContainerEvent lines (application/x-ndjson) reporting the pull
+//	@Tags         docker
+//	@Accept       json
+//	@Param        clientid  path   int                            true   "Docker client ID"
+//	@Param        progress  query  bool                           false  "Stream the pull progress"
+//	@Param        body      body   models.CreateContainerRequest  true   "Container specification"
+//	@Produce      json
+//	@Success      201  {object}  models.CreateContainerResponse
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/containers [post]
+//
+// CreateContainer creates a new container
+func (s *DockerService) CreateContainer(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+
+	req := new(models.CreateContainerRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	platform, err := s.validateCreateContainerRequest(req)
+	if err != nil {
+		return err
+	}
+	if access := hostAccess(req.HostConfig); len(access) > 0 && !hasPolicy(c, models.RBAC_DOCKER_EXEC) {
+		return s.Dispatcher.NewForbidden(fmt.Sprintf("Creating a container with %s requires the docker_exec policy", strings.Join(access, ", ")), nil)
+	}
+
+	pull := req.Pull == models.PullAlways
+	if req.Pull == models.PullMissing {
+		_, err := cli.ImageInspect(ctx, req.Config.Image)
+		switch {
+		case cerrdefs.IsNotFound(err):
+			pull = true
+		case err != nil:
+			return s.Dispatcher.NewInternalServerError("Failed to inspect image", err)
+		}
+	}
+
+	// With progress, the status is sent before the pull starts so the
+	// outcome is reported in the stream rather than as an HTTP error
+	stream := progressNDJSON(c, func(message string) models.CreateContainerEvent {
+		return models.CreateContainerEvent{Error: message}
+	})
+
+	result := models.CreateContainerResponse{Name: strings.TrimPrefix(req.Name, "/"), Warnings: []string{}}
+	if pull {
+		s.Logger.Info("Pulling image", "image", req.Config.Image, "platform", req.Platform)
+		var progress func(models.ImagePullProgress)
+		if stream != nil {
+			progress = func(p models.ImagePullProgress) {
+				stream.Send(models.CreateContainerEvent{Progress: &p})
+			}
+		}
+		if err := s.Registries.Pull(ctx, cli, req.Config.Image, image.PullOptions{Platform: req.Platform}, progress); err != nil {
+			return stream.Fail(s.Dispatcher.NewInternalServerError("Failed to pull image", err))
+		}
+		result.Pulled = true
+	}
+
+	resp, err := cli.ContainerCreate(ctx, &req.Config, req.HostConfig, req.NetworkingConfig, platform, req.Name)
+	if err != nil {
+		switch {
+		case cerrdefs.IsNotFound(err):
+			return stream.Fail(s.Dispatcher.NewNotFound("Image or network not found", err))
+		case cerrdefs.IsConflict(err):
+			return stream.Fail(s.Dispatcher.NewConflict("Container name is already in use", err))
+		case cerrdefs.IsInvalidArgument(err):
+			return stream.Fail(s.Dispatcher.NewBadRequest(err.Error(), err))
+		}
+		return stream.Fail(s.Dispatcher.NewInternalServerError("Failed to create container", err))
+	}
+	result.ID = resp.ID
+	result.Warnings = append(result.Warnings, resp.Warnings...)
+
+	if req.Start {
+		if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+			// The container is kept, its configuration may only need a fix
+			s.Logger.Warn("Failed to start created container", "container", resp.ID, "error", err)
+			result.StartError = err.Error()
+		} else {
+			result.Started = true
+		}
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_CONTAINER_CREATE", Subject: result.Name, Level: "INFO",
+		Message: "container created", Fields: map[string]string{
+			"Client":    c.Param("clientid"),
+			"Container": resp.ID,
+			"Image":     req.Config.Image,
+			"Started":   fmt.Sprint(result.Started),
+		},
+	})
+
+	if stream != nil {
+		stream.Send(models.CreateContainerEvent{Result: &result})
+		return nil
+	}
+	return c.JSON(http.StatusCreated, result)
+}
+
+// validateCreateContainerRequest checks what the daemon would otherwise
+// reject with a less helpful message, and exposes the published ports
+func (s *DockerService) validateCreateContainerRequest(req *models.CreateContainerRequest) (*ocispec.Platform, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Config.Image = strings.TrimSpace(req.Config.Image)
+	if req.Config.Image == "" {
+		return nil, s.Dispatcher.NewBadRequest("Image is required", nil)
+	}
+	if req.Name != "" && !validContainerName.MatchString(req.Name) {
+		return nil, s.Dispatcher.NewBadRequest("Container name may only contain letters, digits, '_', '.' and '-'", nil)
+	}
+	switch req.Pull {
+	case "":
+		req.Pull = models.PullNever
+	case models.PullNever, models.PullMissing, models.PullAlways:
+	default:
+		return nil, s.Dispatcher.NewBadRequest("Pull must be 'never', 'missing' or 'always'", nil)
+	}
+
+	platform, err := parsePlatform(req.Platform)
+	if err != nil {
+		return nil, s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+
+	hc := req.HostConfig
+	if hc == nil {
+		return platform, nil
+	}
+	if err := container.ValidateRestartPolicy(hc.RestartPolicy); err != nil {
+		return nil, s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+
+	for name, value := range map[string]int64{
+		"memory":             hc.Memory,
+		"memory reservation": hc.MemoryReservation,
+		"nano CPUs":          hc.NanoCPUs,
+		"CPU shares":         hc.CPUShares,
+		"CPU quota":          hc.CPUQuota,
+		"CPU period":         hc.CPUPeriod,
+	} {
+		if value < 0 {
+			return nil, s.Dispatcher.NewBadRequest(fmt.Sprintf("The %s limit cannot be negative", name), nil)
+		}
+	}
+	if hc.MemorySwap < -1 {
+		return nil, s.Dispatcher.NewBadRequest("The memory swap limit must be -1 (unlimited) or positive", nil)
+	}
+
+	for port, bindings := range hc.PortBindings {
+		if _, err := nat.ParsePort(port.Port()); err != nil || port.Port() == "" {
+			return nil, s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid container port '%s'", port), err)
+		}
+		if proto := port.Proto(); proto != "tcp" && proto != "udp" && proto != "sctp" {
+			return nil, s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid protocol of port '%s'", port), nil)
+		}
+		for _, b := range bindings {
+			if b.HostPort == "" {
+				continue
+			}
+			if _, _, err := nat.ParsePortRange(b.HostPort); err != nil {
+				return nil, s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid host port '%s'", b.HostPort), err)
+			}
+		}
+		// Published ports must be exposed, as the docker CLI does
+		if req.Config.ExposedPorts == nil {
+			req.Config.ExposedPorts = nat.PortSet{}
+		}
+		req.Config.ExposedPorts[port] = struct{}{}
+	}
+
+	for _, bind := range hc.Binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || !path.IsAbs(parts[1]) {
+			return nil, s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid bind '%s', expected source:/container/path[:options]", bind), nil)
+		}
+	}
+	for _, m := range hc.Mounts {
+		switch m.Type {
+		case mount.TypeBind, mount.TypeVolume, mount.TypeTmpfs, mount.TypeImage:
+		default:
+			return nil, s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid mount type '%s'", m.Type), nil)
+		}
+		if !path.IsAbs(m.Target) {
+			return nil, s.Dispatcher.NewBadRequest(fmt.Sprintf("Mount target '%s' must be an absolute path", m.Target), nil)
+		}
+		if m.Type == mount.TypeBind && m.Source == "" {
+			return nil, s.Dispatcher.NewBadRequest(fmt.Sprintf("Bind mount on '%s' needs a source", m.Target), nil)
+		}
+	}
+	return platform, nil
+}
+
+// hostAccess lists the settings of a host config that give the container
+// root on the Docker host. Like exec, they need the docker_exec policy
+func hostAccess(hc *container.HostConfig) []string {
+	if hc == nil {
+		return nil
+	}
+	var access []string
+	if hc.Privileged {
+		access = append(access, "privileged mode")
+	}
+	if len(hc.CapAdd) > 0 {
+		access = append(access, "added capabilities")
+	}
+	if len(hc.Devices) > 0 || len(hc.DeviceCgroupRules) > 0 {
+		access = append(access, "host devices")
+	}
+	for _, opt := range hc.SecurityOpt {
+		if strings.Contains(opt, "unconfined") || strings.Contains(opt, "disable") {
+			access = append(access, "security option '"+opt+"'")
+		}
+	}
+	namespaces := []struct {
+		name string
+		host bool
+	}{
+		{"pid", hc.PidMode.IsHost()},
+		{"ipc", hc.IpcMode.IsHost()},
+		{"network", hc.NetworkMode.IsHost()},
+		{"uts", hc.UTSMode.IsHost()},
+		{"user", hc.UsernsMode.IsHost()},
+		{"cgroup", hc.CgroupnsMode.IsHost()},
+	}
+	for _, ns := range namespaces {
+		if ns.host {
+			access = append(access, "the host "+ns.name+" namespace")
+		}
+	}
+	for _, bind := range hc.Binds {
+		if source, _, _ := strings.Cut(bind, ":"); path.IsAbs(source) {
+			access = append(access, "host path '"+source+"'")
+		}
+	}
+	for _, m := range hc.Mounts {
+		if m.Type == mount.TypeBind {
+			access = append(access, "host path '"+m.Source+"'")
+		}
+	}
+	return access
+}
+
+// parsePlatform parses a platform given as os[/arch[/variant]], nil when
+// none is given
+func parsePlatform(value string) (*ocispec.Platform, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, "/")
+	if len(parts) > 3 || slicesContainEmpty(parts) {
+		return nil, errors.New("Platform must be os[/arch[/variant]]")
+	}
+	platform := &ocispec.Platform{OS: parts[0]}
+	if len(parts) > 1 {
+		platform.Architecture = parts[1]
+	}
+	if len(parts) > 2 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+func slicesContainEmpty(parts []string) bool {
+	for _, p := range parts {
+		if p == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// pullImage pulls an image and reports each progress message. The daemon
+// reports pull failures inside the stream, after a successful response
+func pullImage(ctx context.Context, cli *client.Client, ref string, opts image.PullOptions, progress func(models.ImagePullProgress)) error {
+	reader, err := cli.ImagePull(ctx, ref, opts)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return errors.New(msg.Error.Message)
+		}
+		if progress == nil {
+			continue
+		}
+		p := models.ImagePullProgress{ID: msg.ID, Status: msg.Status}
+		if msg.Progress != nil {
+			p.Current, p.Total = msg.Progress.Current, msg.Progress.Total
+		}
+		progress(p)
+	}
+}
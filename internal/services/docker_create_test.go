@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/labstack/echo/v4"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestValidateCreateContainerRequest tests that invalid specs are rejected
+// before they reach the daemon
+func TestValidateCreateContainerRequest(t *testing.T) {
+	service := &DockerService{Dispatcher: utils.NewDispatcher(nil, nil), Logger: slog.Default()}
+
+	req := &models.CreateContainerRequest{
+		Name:     "web",
+		Config:   container.Config{Image: " nginx:1.27 "},
+		Platform: "linux/arm64/v8",
+		HostConfig: &container.HostConfig{
+			PortBindings:  nat.PortMap{"80/tcp": {{HostPort: "8080"}}},
+			Binds:         []string{"/srv/www:/usr/share/nginx/html:ro"},
+			RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyUnlessStopped},
+		},
+	}
+	platform, err := service.validateCreateContainerRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "nginx:1.27", req.Config.Image)
+	assert.Equal(t, models.PullNever, req.Pull)
+	assert.Contains(t, req.Config.ExposedPorts, nat.Port("80/tcp"))
+	require.NotNil(t, platform)
+	assert.Equal(t, "linux", platform.OS)
+	assert.Equal(t, "arm64", platform.Architecture)
+	assert.Equal(t, "v8", platform.Variant)
+
+	invalid := map[string]func(*models.CreateContainerRequest){
+		"missing image":  func(r *models.CreateContainerRequest) { r.Config.Image = "" },
+		"name":           func(r *models.CreateContainerRequest) { r.Name = "my web" },
+		"pull policy":    func(r *models.CreateContainerRequest) { r.Pull = "sometimes" },
+		"platform":       func(r *models.CreateContainerRequest) { r.Platform = "linux//v8" },
+		"restart policy": func(r *models.CreateContainerRequest) { r.HostConfig.RestartPolicy.Name = "sometimes" },
+		"restart retries": func(r *models.CreateContainerRequest) {
+			r.HostConfig.RestartPolicy = container.RestartPolicy{Name: container.RestartPolicyAlways, MaximumRetryCount: 3}
+		},
+		"memory":         func(r *models.CreateContainerRequest) { r.HostConfig.Memory = -1 },
+		"container port": func(r *models.CreateContainerRequest) { r.HostConfig.PortBindings = nat.PortMap{"http/tcp": nil} },
+		"host port":      func(r *models.CreateContainerRequest) { r.HostConfig.PortBindings["80/tcp"][0].HostPort = "web" },
+		"bind":           func(r *models.CreateContainerRequest) { r.HostConfig.Binds = []string{"/srv/www:html"} },
+		"mount target": func(r *models.CreateContainerRequest) {
+			r.HostConfig.Mounts = []mount.Mount{{Type: mount.TypeVolume, Source: "data", Target: "data"}}
+		},
+	}
+	for name, mutate := range invalid {
+		t.Run(name, func(t *testing.T) {
+			req := &models.CreateContainerRequest{
+				Config: container.Config{Image: "nginx"},
+				HostConfig: &container.HostConfig{
+					PortBindings: nat.PortMap{"80/tcp": {{HostPort: "8080"}}},
+				},
+			}
+			mutate(req)
+			_, err := service.validateCreateContainerRequest(req)
+			var httpErr *echo.HTTPError
+			require.ErrorAs(t, err, &httpErr)
+			assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+		})
+	}
+}
+
+// TestHostAccess tests the settings that hand a container the Docker host
+// are found, and that plain containers need none of them
+func TestHostAccess(t *testing.T) {
+	assert.Empty(t, hostAccess(nil))
+	assert.Empty(t, hostAccess(&container.HostConfig{
+		Binds:       []string{"data:/var/lib/data", "cache:/cache:ro"},
+		Mounts:      []mount.Mount{{Type: mount.TypeVolume, Source: "logs", Target: "/logs"}},
+		NetworkMode: "bridge",
+		SecurityOpt: []string{"no-new-privileges"},
+	}))
+
+	assert.Equal(t, []string{
+		"privileged mode",
+		"added capabilities",
+		"host devices",
+		"security option 'seccomp=unconfined'",
+		"the host pid namespace",
+		"the host network namespace",
+		"host path '/'",
+		"host path '/var/run/docker.sock'",
+	}, hostAccess(&container.HostConfig{
+		Privileged:  true,
+		CapAdd:      []string{"SYS_ADMIN"},
+		Resources:   container.Resources{Devices: []container.DeviceMapping{{PathOnHost: "/dev/sda", PathInContainer: "/dev/sda"}}},
+		SecurityOpt: []string{"seccomp=unconfined"},
+		PidMode:     "host",
+		NetworkMode: "host",
+		Binds:       []string{"/:/host"},
+		Mounts:      []mount.Mount{{Type: mount.TypeBind, Source: "/var/run/docker.sock", Target: "/var/run/docker.sock"}},
+	}))
+}
+
+// TestParsePlatform tests the platforms shared by container creation, pulls
+// and builds
+func TestParsePlatform(t *testing.T) {
+	platform, err := parsePlatform("")
+	assert.NoError(t, err)
+	assert.Nil(t, platform)
+
+	platform, err = parsePlatform("linux/amd64")
+	require.NoError(t, err)
+	assert.Equal(t, &ocispec.Platform{OS: "linux", Architecture: "amd64"}, platform)
+
+	for _, value := range []string{"linux/", "/amd64", "linux/arm64/v8/extra"} {
+		_, err := parsePlatform(value)
+		assert.Error(t, err, value)
+	}
+}
+
+// TestPullImage tests reading the progress of a pull and the failures the
+// daemon reports inside the stream
+func TestPullImage(t *testing.T) {
+	stream := `{"status":"Pulling from library/nginx","id":"1.27"}
+{"status":"Downloading","id":"a1b2","progressDetail":{"current":512,"total":2048}}
+`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(stream))
+		if r.URL.Query().Get("tag") == "missing" {
+			_, _ = w.Write([]byte(`{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}` + "\n"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+srv.Listener.Addr().String()), client.WithVersion("1.47"))
+	require.NoError(t, err)
+
+	var progress []models.ImagePullProgress
+	err = pullImage(context.Background(), cli, "nginx:1.27", image.PullOptions{}, func(p models.ImagePullProgress) {
+		progress = append(progress, p)
+	})
+	require.NoError(t, err)
+	require.Len(t, progress, 2)
+	assert.Equal(t, "Pulling from library/nginx", progress[0].Status)
+	assert.Equal(t, models.ImagePullProgress{ID: "a1b2", Status: "Downloading", Current: 512, Total: 2048}, progress[1])
+
+	err = pullImage(context.Background(), cli, "nginx:missing", image.PullOptions{}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "manifest unknown")
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"visory/internal/models"
+
+	"github.com/coder/websocket"
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo/v4"
+)
+
+// defaultExecShell starts bash when the image has it, sh otherwise
+var defaultExecShell = []string{"/bin/sh", "-c", "command -v bash >/dev/null 2>&1 && exec bash || exec sh"}
+
+const (
+	defaultExecCols = 80
+	defaultExecRows = 24
+	// execMaxTerminalSize bounds the terminal size accepted from clients
+	execMaxTerminalSize = 1000
+)
+
+//	@Summary      Container terminal WebSocket
+//	@Description  Open an interactive terminal inside a running container. Terminal input and output are binary frames, control messages (models.ExecMessage) are JSON text frames
+//	@Tags         docker
+//	@Param        clientid  path   int     true   "Docker client ID"
+//	@Param        id        path   string  true   "Container ID"
+//	@Param        shell     query  string  false  "Shell to run, bash or sh by default"
+//	@Param        user      query  string  false  "User to run the shell as, the container user by default"
+//	@Param        workdir   query  string  false  "Working directory, the container one by default"
+//	@Param        cols      query  int     false  "Initial terminal width"
+//	@Param        rows      query  int     false  "Initial terminal height"
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/containers/{id}/exec [get]
+//
+// ExecContainer relays an interactive shell of a container over a WebSocket
+func (s *DockerService) ExecContainer(c echo.Context) error {
+	ctx := c.Request().Context()
+	containerID := c.Param("id")
+
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+
+	cmd := defaultExecShell
+	if shell := strings.TrimSpace(c.QueryParam("shell")); shell != "" {
+		if strings.ContainsAny(shell, " \t\n") {
+			return s.Dispatcher.NewBadRequest("Shell must be a single executable", nil)
+		}
+		cmd = []string{shell}
+	}
+	cols, err := execTerminalSize(c.QueryParam("cols"), defaultExecCols)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid terminal width", err)
+	}
+	rows, err := execTerminalSize(c.QueryParam("rows"), defaultExecRows)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid terminal height", err)
+	}
+
+	info, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return s.Dispatcher.NewNotFound("Container not found", err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to inspect container", err)
+	}
+	if info.State == nil || !info.State.Running {
+		return s.Dispatcher.NewConflict("Container is not running", nil)
+	}
+
+	// The exec is created and attached before the upgrade so failures are
+	// still reported as HTTP errors
+	consoleSize := &[2]uint{rows, cols}
+	exec, err := cli.ContainerExecCreate(ctx, info.ID, container.ExecOptions{
+		User:         c.QueryParam("user"),
+		WorkingDir:   c.QueryParam("workdir"),
+		Cmd:          cmd,
+		Env:          []string{"TERM=xterm-256color"},
+		Tty:          true,
+		ConsoleSize:  consoleSize,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to create exec session", err)
+	}
+	hijack, err := cli.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{
+		Tty:         true,
+		ConsoleSize: consoleSize,
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to attach to exec session", err)
+	}
+	defer hijack.Close()
+
+	socket, err := websocket.Accept(c.Response().Writer, c.Request(), nil)
+	if err != nil {
+		// Accept has already written the error response
+		s.Logger.Error("could not open exec websocket", "container", info.ID, "error", err)
+		return nil
+	}
+	defer socket.CloseNow()
+
+	name := strings.TrimPrefix(info.Name, "/")
+	s.Logger.Info("Exec session started", "container", name, "exec", exec.ID, "shell", strings.Join(cmd, " "))
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_EXEC", Subject: name, Level: "INFO",
+		Message: "container terminal opened", Fields: map[string]string{
+			"Client":    c.Param("clientid"),
+			"Container": info.ID,
+			"Shell":     strings.Join(cmd, " "),
+			"User":      c.QueryParam("user"),
+			"Workdir":   c.QueryParam("workdir"),
+		},
+	})
+
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		s.relayExecInput(ctx, socket, cli, exec.ID, hijack)
+	}()
+	relayErr := relayExecOutput(ctx, socket, hijack.Reader)
+
+	select {
+	case <-clientGone:
+		s.Logger.Info("Exec session closed by client", "container", name, "exec", exec.ID)
+		return nil
+	default:
+	}
+
+	msg := models.ExecMessage{Type: models.ExecMessageExit}
+	if relayErr != nil {
+		msg = models.ExecMessage{Type: models.ExecMessageError, Error: relayErr.Error()}
+	} else if code, err := execExitCode(cli, exec.ID); err != nil {
+		msg = models.ExecMessage{Type: models.ExecMessageError, Error: err.Error()}
+	} else {
+		msg.ExitCode = &code
+	}
+	if payload, err := json.Marshal(msg); err == nil {
+		_ = socket.Write(ctx, websocket.MessageText, payload)
+	}
+	s.Logger.Info("Exec session ended", "container", name, "exec", exec.ID, "exit_code", msg.ExitCode, "error", msg.Error)
+	_ = socket.Close(websocket.StatusNormalClosure, "process exited")
+	return nil
+}
+
+// execExitCode waits for an exec process to be reported as exited, which
+// can lag a moment behind the end of its output
+func execExitCode(cli *client.Client, execID string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		state, err := cli.ContainerExecInspect(ctx, execID)
+		if err != nil {
+			return 0, err
+		}
+		if !state.Running {
+			return state.ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, errors.New("process did not exit")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// relayExecInput writes binary frames to the process and applies resize
+// messages. The terminal is hung up when the client goes away
+func (s *DockerService) relayExecInput(ctx context.Context, socket *websocket.Conn, cli *client.Client, execID string, hijack types.HijackedResponse) {
+	defer hijack.Close()
+	for {
+		typ, data, err := socket.Read(ctx)
+		if err != nil {
+			return
+		}
+		if typ == websocket.MessageBinary {
+			if _, err := hijack.Conn.Write(data); err != nil {
+				return
+			}
+			continue
+		}
+
+		var msg models.ExecMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type != models.ExecMessageResize {
+			continue
+		}
+		if msg.Cols == 0 || msg.Rows == 0 || msg.Cols > execMaxTerminalSize || msg.Rows > execMaxTerminalSize {
+			continue
+		}
+		if err := cli.ContainerExecResize(ctx, execID, container.ResizeOptions{Height: msg.Rows, Width: msg.Cols}); err != nil {
+			s.Logger.Warn("Failed to resize exec session", "exec", execID, "error", err)
+		}
+	}
+}
+
+// relayExecOutput sends the terminal output as binary frames until the
+// process closes it
+func relayExecOutput(ctx context.Context, socket *websocket.Conn, output io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := output.Read(buf)
+		if n > 0 {
+			if werr := socket.Write(ctx, websocket.MessageBinary, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func execTerminalSize(value string, fallback uint) (uint, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 || n > execMaxTerminalSize {
+		return 0, errors.New("terminal size out of range")
+	}
+	return uint(n), nil
+}
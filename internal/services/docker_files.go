@@ -0,0 +1,395 @@
+package services
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"visory/internal/models"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// maxContainerListEntries and maxContainerListScan bound a directory
+	// listing. The archive API sends the whole tree, so listing a large
+	// directory stops early and is reported as truncated
+	maxContainerListEntries = 5000
+	maxContainerListScan    = 256 << 20 // 256MB
+	// maxContainerTransferSize bounds downloads and uploads
+	maxContainerTransferSize = 1 << 30 // 1GB
+)
+
+// Download formats
+const (
+	containerDownloadFile = "file"
+	containerDownloadTar  = "tar"
+)
+
+//	@Summary      List container directory
+//	@Description  List a directory inside a container, running or not. Symlinks to directories are followed. Listings of large trees are truncated
+//	@Tags         docker
+//	@Param        clientid  path   int     true   "Docker client ID"
+//	@Param        id        path   string  true   "Container ID"
+//	@Param        path      query  string  false  "Absolute path of the directory, / by default"
+//	@Produce      json
+//	@Success      200  {object}  models.ContainerDirectory
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/containers/{id}/files [get]
+//
+// ListContainerFiles lists a directory of a container
+func (s *DockerService) ListContainerFiles(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	id := c.Param("id")
+	dir, stat, err := s.resolveContainerPath(ctx, cli, id, c.QueryParam("path"))
+	if err != nil {
+		return err
+	}
+	if !stat.Mode.IsDir() {
+		return s.Dispatcher.NewBadRequest(fmt.Sprintf("'%s' is not a directory", dir), nil)
+	}
+
+	reader, _, err := cli.CopyFromContainer(ctx, id, dir)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to read directory", err)
+	}
+	defer reader.Close()
+	listing, err := readDirectoryArchive(reader, dir, maxContainerListEntries, maxContainerListScan)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to read directory", err)
+	}
+	return c.JSON(http.StatusOK, listing)
+}
+
+//	@Summary      Download container files
+//	@Description  Download a file or directory of a container. A file is sent as is, a directory as a tar archive. format=tar also sends a file as a tar archive, keeping its mode and owner
+//	@Tags         docker
+//	@Param        clientid  path   int     true   "Docker client ID"
+//	@Param        id        path   string  true   "Container ID"
+//	@Param        path      query  string  true   "Absolute path of the file or directory"
+//	@Param        format    query  string  false  "file or tar, from the type of the path by default"
+//	@Produce      octet-stream
+//	@Success      200  {file}    file
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/containers/{id}/files/download [get]
+//
+// DownloadContainerFiles sends a file or directory of a container
+func (s *DockerService) DownloadContainerFiles(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	id := c.Param("id")
+	if c.QueryParam("path") == "" {
+		return s.Dispatcher.NewBadRequest("Path is required", nil)
+	}
+	target, stat, err := s.resolveContainerPath(ctx, cli, id, c.QueryParam("path"))
+	if err != nil {
+		return err
+	}
+
+	format := c.QueryParam("format")
+	switch {
+	case format == "" && stat.Mode.IsRegular():
+		format = containerDownloadFile
+	case format == "":
+		format = containerDownloadTar
+	case format != containerDownloadFile && format != containerDownloadTar:
+		return s.Dispatcher.NewBadRequest("Format must be 'file' or 'tar'", nil)
+	case format == containerDownloadFile && !stat.Mode.IsRegular():
+		return s.Dispatcher.NewBadRequest(fmt.Sprintf("'%s' is not a regular file, download it as tar", target), nil)
+	}
+	if stat.Mode.IsRegular() && stat.Size > maxContainerTransferSize {
+		return s.Dispatcher.NewBadRequest("File exceeds the maximum download size of 1GB", nil)
+	}
+
+	reader, _, err := cli.CopyFromContainer(ctx, id, target)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to read from container", err)
+	}
+	defer reader.Close()
+
+	name := path.Base(target)
+	if name == "/" {
+		name = "root"
+	}
+	res := c.Response()
+	var content io.Reader
+	if format == containerDownloadFile {
+		tr := tar.NewReader(reader)
+		hdr, err := tr.Next()
+		if err != nil {
+			return s.Dispatcher.NewInternalServerError("Failed to read from container", err)
+		}
+		content = tr
+		res.Header().Set(echo.HeaderContentType, "application/octet-stream")
+		res.Header().Set(echo.HeaderContentLength, strconv.FormatInt(hdr.Size, 10))
+	} else {
+		content = reader
+		name += ".tar"
+		res.Header().Set(echo.HeaderContentType, "application/x-tar")
+	}
+	res.Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	res.WriteHeader(http.StatusOK)
+
+	// Directory sizes are only known once sent, so an archive over the
+	// limit is cut by aborting the connection rather than ending it as if
+	// it were complete
+	written, err := io.Copy(res, io.LimitReader(content, maxContainerTransferSize+1))
+	fields := map[string]string{
+		"Client":    c.Param("clientid"),
+		"Container": id,
+		"Format":    format,
+		"Size":      strconv.FormatInt(written, 10),
+	}
+	if err == nil && written > maxContainerTransferSize {
+		err = errors.New("download exceeds the maximum size of 1GB")
+	}
+	if err != nil {
+		fields["Error"] = err.Error()
+		_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+			UserId: userIDFromContext(c), Event: "DOCKER_FILE_DOWNLOAD", Subject: target, Level: "ERROR",
+			Message: "container file download failed", Fields: fields,
+		})
+		s.Logger.Warn("Container file download aborted", "container", id, "path", target, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_FILE_DOWNLOAD", Subject: target, Level: "INFO",
+		Message: "container files downloaded", Fields: fields,
+	})
+	return nil
+}
+
+//	@Summary      Upload files to container
+//	@Description  Upload files into a directory of a container, replacing files of the same name. Uploaded files are owned by root with mode 0644
+//	@Tags         docker
+//	@Accept       multipart/form-data
+//	@Param        clientid  path      int     true  "Docker client ID"
+//	@Param        id        path      string  true  "Container ID"
+//	@Param        path      query     string  true  "Absolute path of the target directory"
+//	@Param        files     formData  file    true  "Files to upload, repeatable"
+//	@Produce      json
+//	@Success      201  {object}  models.ContainerUploadResponse
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      413  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/containers/{id}/files [post]
+//
+// UploadContainerFiles copies uploaded files into a container
+func (s *DockerService) UploadContainerFiles(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	id := c.Param("id")
+	if c.QueryParam("path") == "" {
+		return s.Dispatcher.NewBadRequest("Path is required", nil)
+	}
+	limitUploadBody(c, maxContainerTransferSize)
+	form, err := c.MultipartForm()
+	if err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			return s.Dispatcher.NewHTTPError(http.StatusRequestEntityTooLarge, "Upload exceeds the maximum size of 1GB", err)
+		}
+		return s.Dispatcher.NewBadRequest("Invalid file upload", err)
+	}
+	defer form.RemoveAll()
+
+	files := form.File["files"]
+	if len(files) == 0 {
+		return s.Dispatcher.NewBadRequest("No file was uploaded", nil)
+	}
+	result := models.ContainerUploadResponse{Files: make([]string, 0, len(files))}
+	entries := make([]uploadedFile, 0, len(files))
+	for _, file := range files {
+		name, err := cleanContextPath(file.Filename)
+		if err != nil || strings.Contains(name, "/") {
+			return s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid file name '%s'", file.Filename), err)
+		}
+		if slices.Contains(result.Files, name) {
+			return s.Dispatcher.NewBadRequest(fmt.Sprintf("File '%s' is uploaded twice", name), nil)
+		}
+		result.Files = append(result.Files, name)
+		result.Size += file.Size
+		entries = append(entries, uploadedFile{Path: name, File: file})
+	}
+	if result.Size > maxContainerTransferSize {
+		return s.Dispatcher.NewBadRequest("Upload exceeds the maximum size of 1GB", nil)
+	}
+
+	dir, stat, err := s.resolveContainerPath(ctx, cli, id, c.QueryParam("path"))
+	if err != nil {
+		return err
+	}
+	if !stat.Mode.IsDir() {
+		return s.Dispatcher.NewBadRequest(fmt.Sprintf("'%s' is not a directory", dir), nil)
+	}
+	result.Path = dir
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeUploadTar(w, entries, time.Now()))
+	}()
+	err = cli.CopyToContainer(ctx, id, dir, r, container.CopyToContainerOptions{})
+	r.Close()
+	if err != nil {
+		switch {
+		case cerrdefs.IsNotFound(err):
+			return s.Dispatcher.NewNotFound("Container not found", err)
+		case cerrdefs.IsInvalidArgument(err), cerrdefs.IsPermissionDenied(err):
+			// Read-only root filesystems and files replacing directories
+			return s.Dispatcher.NewBadRequest(err.Error(), err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to copy files into container", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_FILE_UPLOAD", Subject: dir, Level: "INFO",
+		Message: "files uploaded to container", Fields: map[string]string{
+			"Client":    c.Param("clientid"),
+			"Container": id,
+			"Files":     strings.Join(result.Files, ", "),
+			"Size":      strconv.FormatInt(result.Size, 10),
+		},
+	})
+	return c.JSON(http.StatusCreated, result)
+}
+
+// resolveContainerPath cleans an absolute path of a container and follows
+// it when it is a symlink
+func (s *DockerService) resolveContainerPath(ctx context.Context, cli *client.Client, id, p string) (string, container.PathStat, error) {
+	if p == "" {
+		p = "/"
+	}
+	if !path.IsAbs(p) {
+		return "", container.PathStat{}, s.Dispatcher.NewBadRequest(fmt.Sprintf("Path '%s' must be absolute", p), nil)
+	}
+	p = path.Clean(p)
+
+	stat, err := cli.ContainerStatPath(ctx, id, p)
+	if err == nil && stat.Mode&os.ModeSymlink != 0 && stat.LinkTarget != "" {
+		p = stat.LinkTarget
+		stat, err = cli.ContainerStatPath(ctx, id, p)
+	}
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return "", stat, s.Dispatcher.NewNotFound(fmt.Sprintf("Container or path '%s' not found", p), err)
+		}
+		return "", stat, s.Dispatcher.NewInternalServerError("Failed to read container path", err)
+	}
+	return p, stat, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readDirectoryArchive lists the direct entries of the directory an archive
+// of the archive API holds. The first entry is the directory itself. It
+// stops at maxEntries entries or after maxBytes of the archive
+func readDirectoryArchive(r io.Reader, dir string, maxEntries int, maxBytes int64) (models.ContainerDirectory, error) {
+	listing := models.ContainerDirectory{Path: dir, Entries: []models.ContainerFile{}}
+	counter := &countingReader{r: r}
+	tr := tar.NewReader(counter)
+	root := ""
+	for first := true; ; first = false {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return listing, err
+		}
+		name := path.Clean(hdr.Name)
+		if first {
+			root = name
+			continue
+		}
+		if path.Dir(name) != root {
+			if counter.n > maxBytes {
+				listing.Truncated = true
+				break
+			}
+			continue
+		}
+		if len(listing.Entries) >= maxEntries || counter.n > maxBytes {
+			listing.Truncated = true
+			break
+		}
+		listing.Entries = append(listing.Entries, containerFile(hdr, dir))
+	}
+
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		a, b := listing.Entries[i], listing.Entries[j]
+		if (a.Type == models.ContainerFileDirectory) != (b.Type == models.ContainerFileDirectory) {
+			return a.Type == models.ContainerFileDirectory
+		}
+		return a.Name < b.Name
+	})
+	return listing, nil
+}
+
+// containerFile describes an archive entry found in dir
+func containerFile(hdr *tar.Header, dir string) models.ContainerFile {
+	name := path.Base(path.Clean(hdr.Name))
+	file := models.ContainerFile{
+		Name:    name,
+		Path:    path.Join(dir, name),
+		Type:    models.ContainerFileOther,
+		Size:    hdr.Size,
+		Mode:    hdr.FileInfo().Mode().String(),
+		ModTime: hdr.ModTime.UTC(),
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		file.Type = models.ContainerFileDirectory
+		file.Size = 0
+	case tar.TypeSymlink:
+		file.Type = models.ContainerFileSymlink
+		file.LinkTarget = hdr.Linkname
+	case tar.TypeReg, tar.TypeLink:
+		file.Type = models.ContainerFileRegular
+	}
+	return file
+}
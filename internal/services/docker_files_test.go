@@ -0,0 +1,76 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"visory/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testArchive builds an archive as the archive API sends a directory
+func testArchive(t *testing.T, headers ...tar.Header) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range headers {
+		data := bytes.Repeat([]byte("x"), int(hdr.Size))
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf
+}
+
+// TestReadDirectoryArchive tests that only the direct entries of the
+// directory are listed, directories first
+func TestReadDirectoryArchive(t *testing.T) {
+	mtime := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	archive := testArchive(t,
+		tar.Header{Name: "nginx/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		tar.Header{Name: "nginx/nginx.conf", Typeflag: tar.TypeReg, Mode: 0o644, Size: 12, ModTime: mtime},
+		tar.Header{Name: "nginx/conf.d/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		tar.Header{Name: "nginx/conf.d/default.conf", Typeflag: tar.TypeReg, Mode: 0o644, Size: 30, ModTime: mtime},
+		tar.Header{Name: "nginx/modules", Typeflag: tar.TypeSymlink, Linkname: "/usr/lib/nginx/modules", Mode: 0o777, ModTime: mtime},
+	)
+
+	listing, err := readDirectoryArchive(archive, "/etc/nginx", 100, 1<<20)
+	require.NoError(t, err)
+	assert.False(t, listing.Truncated)
+	assert.Equal(t, "/etc/nginx", listing.Path)
+	assert.Equal(t, []models.ContainerFile{
+		{Name: "conf.d", Path: "/etc/nginx/conf.d", Type: models.ContainerFileDirectory, Mode: "drwxr-xr-x", ModTime: mtime},
+		{Name: "modules", Path: "/etc/nginx/modules", Type: models.ContainerFileSymlink, Mode: "Lrwxrwxrwx", ModTime: mtime, LinkTarget: "/usr/lib/nginx/modules"},
+		{Name: "nginx.conf", Path: "/etc/nginx/nginx.conf", Type: models.ContainerFileRegular, Size: 12, Mode: "-rw-r--r--", ModTime: mtime},
+	}, listing.Entries)
+}
+
+// TestReadDirectoryArchiveLimits tests that large directories are listed
+// partially
+func TestReadDirectoryArchiveLimits(t *testing.T) {
+	headers := []tar.Header{{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755}}
+	for _, name := range []string{"./a", "./b", "./c"} {
+		headers = append(headers, tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: 4096})
+	}
+
+	listing, err := readDirectoryArchive(testArchive(t, headers...), "/", 2, 1<<20)
+	require.NoError(t, err)
+	assert.True(t, listing.Truncated)
+	require.Len(t, listing.Entries, 2)
+	assert.Equal(t, "/a", listing.Entries[0].Path)
+
+	listing, err = readDirectoryArchive(testArchive(t, headers...), "/", 100, 1024)
+	require.NoError(t, err)
+	assert.True(t, listing.Truncated)
+	assert.Less(t, len(listing.Entries), 3)
+
+	listing, err = readDirectoryArchive(testArchive(t, headers...), "/", 100, 1<<20)
+	require.NoError(t, err)
+	assert.False(t, listing.Truncated)
+	assert.Len(t, listing.Entries, 3)
+}
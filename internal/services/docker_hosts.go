@@ -0,0 +1,312 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	clientmanager "visory/internal/clientManager"
+	"visory/internal/database/dockerhosts"
+	"visory/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// initializeDockerHosts connects the hosts stored in the database. Endpoints
+// still configured through VISORY_DOCKER_CLIENT_<N> are imported first, so
+// they get a stable ID like hosts added at runtime
+func (s *DockerService) initializeDockerHosts() {
+	ctx := context.Background()
+	hosts, err := s.db.DockerHost.ListDockerHosts(ctx)
+	if err != nil {
+		s.Logger.Error("failed to list docker hosts", "error", err)
+		return
+	}
+
+	known := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		known[h.Endpoint] = true
+	}
+	for i := 1; i <= 100; i++ {
+		envKey := fmt.Sprintf("VISORY_DOCKER_CLIENT_%d", i)
+		endpoint := strings.TrimSpace(os.Getenv(envKey))
+		if endpoint == "" || known[endpoint] {
+			continue
+		}
+		host, err := s.db.DockerHost.CreateDockerHost(ctx, dockerhosts.CreateDockerHostParams{
+			Name:     endpoint,
+			Endpoint: endpoint,
+		})
+		if err != nil {
+			s.Logger.Error("failed to import docker host", "variable", envKey, "endpoint", endpoint, "error", err)
+			continue
+		}
+		s.Logger.Info("Docker host imported from environment", "variable", envKey, "id", host.ID, "endpoint", endpoint)
+		known[endpoint] = true
+		hosts = append(hosts, host)
+	}
+
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(h dockerhosts.DockerHost) {
+			defer wg.Done()
+			_ = s.ClientManager.Connect(h)
+		}(h)
+	}
+	wg.Wait()
+}
+
+//	@Summary      Get Docker host
+//	@Description  Get a configured Docker host and its connection status
+//	@Tags         docker
+//	@Param        id  path  int  true  "Docker host ID"
+//	@Produce      json
+//	@Success      200  {object}  models.DockerHost
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Router       /docker/hosts/{id} [get]
+//
+// GetDockerHost returns a single Docker host
+func (s *DockerService) GetDockerHost(c echo.Context) error {
+	host, err := s.dockerHostFromParam(c)
+	if err != nil {
+		return err
+	}
+	info, ok := s.ClientManager.Host(host.ID)
+	if !ok {
+		return s.Dispatcher.NewNotFound("Docker host not found", nil)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+//	@Summary      Add Docker host
+//	@Description  Add a Docker host and connect to it. The host is saved even when it cannot be reached
+//	@Tags         docker
+//	@Accept       json
+//	@Param        body  body  models.DockerHostRequest  true  "Docker host"
+//	@Produce      json
+//	@Success      201  {object}  models.DockerHost
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/hosts [post]
+//
+// CreateDockerHost adds a Docker host
+func (s *DockerService) CreateDockerHost(c echo.Context) error {
+	req := new(models.DockerHostRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+
+	host := dockerhosts.DockerHost{}
+	if err := s.applyDockerHostRequest(&host, req); err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	if err := s.checkDockerHostName(ctx, host); err != nil {
+		return err
+	}
+
+	host, err := s.db.DockerHost.CreateDockerHost(ctx, dockerhosts.CreateDockerHostParams{
+		Name:     host.Name,
+		Endpoint: host.Endpoint,
+		TlsCa:    host.TlsCa,
+		TlsCert:  host.TlsCert,
+		TlsKey:   host.TlsKey,
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to save Docker host", err)
+	}
+
+	_ = s.ClientManager.Connect(host)
+	info, _ := s.ClientManager.Host(host.ID)
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_HOST_CREATE", Subject: host.Name, Level: "INFO",
+		Message: "docker host added", Fields: map[string]string{
+			"ID":       strconv.FormatInt(host.ID, 10),
+			"Endpoint": host.Endpoint,
+			"Status":   info.Status,
+		},
+	})
+	return c.JSON(http.StatusCreated, info)
+}
+
+//	@Summary      Edit Docker host
+//	@Description  Change the name, endpoint or TLS certificates of a Docker host and reconnect to it. Omitted certificates are kept, empty ones are removed
+//	@Tags         docker
+//	@Accept       json
+//	@Param        id    path  int                       true  "Docker host ID"
+//	@Param        body  body  models.DockerHostRequest  true  "Docker host"
+//	@Produce      json
+//	@Success      200  {object}  models.DockerHost
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/hosts/{id} [put]
+//
+// UpdateDockerHost edits a Docker host
+func (s *DockerService) UpdateDockerHost(c echo.Context) error {
+	host, err := s.dockerHostFromParam(c)
+	if err != nil {
+		return err
+	}
+	req := new(models.DockerHostRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+
+	previous := host
+	if err := s.applyDockerHostRequest(&host, req); err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	if err := s.checkDockerHostName(ctx, host); err != nil {
+		return err
+	}
+
+	host, err = s.db.DockerHost.UpdateDockerHost(ctx, dockerhosts.UpdateDockerHostParams{
+		Name:     host.Name,
+		Endpoint: host.Endpoint,
+		TlsCa:    host.TlsCa,
+		TlsCert:  host.TlsCert,
+		TlsKey:   host.TlsKey,
+		ID:       host.ID,
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to save Docker host", err)
+	}
+
+	_ = s.ClientManager.Connect(host)
+	info, _ := s.ClientManager.Host(host.ID)
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_HOST_UPDATE", Subject: host.Name, Level: "INFO",
+		Message: "docker host updated", Fields: map[string]string{
+			"ID":       strconv.FormatInt(host.ID, 10),
+			"Name":     previous.Name + " -> " + host.Name,
+			"Endpoint": previous.Endpoint + " -> " + host.Endpoint,
+			"TLS":      strconv.FormatBool(info.TLS),
+			"Status":   info.Status,
+		},
+	})
+	return c.JSON(http.StatusOK, info)
+}
+
+//	@Summary      Remove Docker host
+//	@Description  Disconnect from a Docker host and remove it. Nothing on the host itself is changed
+//	@Tags         docker
+//	@Param        id  path  int  true  "Docker host ID"
+//	@Produce      json
+//	@Success      200  {object}  map[string]string
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/hosts/{id} [delete]
+//
+// DeleteDockerHost removes a Docker host
+func (s *DockerService) DeleteDockerHost(c echo.Context) error {
+	host, err := s.dockerHostFromParam(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	if err := s.db.DockerHost.DeleteDockerHost(ctx, host.ID); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to delete Docker host", err)
+	}
+	// The stacks keep running on the host, only their definitions go
+	if err := s.db.DockerStack.DeleteDockerStacksByClient(ctx, host.ID); err != nil {
+		s.Logger.Warn("Failed to delete stacks of Docker host", "id", host.ID, "error", err)
+	}
+	s.ClientManager.Remove(host.ID)
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_HOST_DELETE", Subject: host.Name, Level: "INFO",
+		Message: "docker host removed", Fields: map[string]string{
+			"ID":       strconv.FormatInt(host.ID, 10),
+			"Endpoint": host.Endpoint,
+		},
+	})
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Docker host '%s' removed successfully", host.Name),
+	})
+}
+
+// applyDockerHostRequest validates a request and applies it to host
+func (s *DockerService) applyDockerHostRequest(host *dockerhosts.DockerHost, req *models.DockerHostRequest) error {
+	host.Name = strings.TrimSpace(req.Name)
+	host.Endpoint = strings.TrimSpace(req.Endpoint)
+	if host.Name == "" {
+		return s.Dispatcher.NewBadRequest("Docker host name is required", nil)
+	}
+
+	for _, f := range []struct {
+		value *string
+		field **string
+	}{
+		{req.TLSCA, &host.TlsCa},
+		{req.TLSCert, &host.TlsCert},
+		{req.TLSKey, &host.TlsKey},
+	} {
+		if f.value == nil {
+			continue
+		}
+		if v := strings.TrimSpace(*f.value); v != "" {
+			*f.field = &v
+		} else {
+			*f.field = nil
+		}
+	}
+
+	// Building the client checks the endpoint and certificates without
+	// connecting, a host that is down can still be saved
+	cli, err := clientmanager.NewClient(*host)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+	cli.Close()
+	return nil
+}
+
+// checkDockerHostName rejects names already used by another host
+func (s *DockerService) checkDockerHostName(ctx context.Context, host dockerhosts.DockerHost) error {
+	hosts, err := s.db.DockerHost.ListDockerHosts(ctx)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to list Docker hosts", err)
+	}
+	for _, h := range hosts {
+		if h.ID != host.ID && strings.EqualFold(h.Name, host.Name) {
+			return s.Dispatcher.NewConflict(fmt.Sprintf("Docker host '%s' already exists", host.Name), nil)
+		}
+	}
+	return nil
+}
+
+func (s *DockerService) dockerHostFromParam(c echo.Context) (dockerhosts.DockerHost, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return dockerhosts.DockerHost{}, s.Dispatcher.NewBadRequest("Invalid Docker host ID", err)
+	}
+	host, err := s.db.DockerHost.GetDockerHostByID(c.Request().Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return dockerhosts.DockerHost{}, s.Dispatcher.NewNotFound("Docker host not found", err)
+		}
+		return dockerhosts.DockerHost{}, s.Dispatcher.NewInternalServerError("Failed to fetch Docker host", err)
+	}
+	return host, nil
+}
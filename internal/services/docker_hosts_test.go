@@ -0,0 +1,120 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"visory/internal/database"
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDockerService(t *testing.T) *DockerService {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "visory.db")
+	sqlDb, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	require.NoError(t, database.Migrate(sqlDb))
+	sqlDb.Close()
+
+	env := models.ENV_VARS
+	t.Cleanup(func() { models.ENV_VARS = env })
+	models.ENV_VARS.DBPath = dbPath
+
+	// Nothing listens there, so no test talks to a real daemon
+	t.Setenv("DOCKER_HOST", "tcp://127.0.0.1:1")
+	t.Setenv("VISORY_DOCKER_CLIENT_1", "tcp://127.0.0.1:2")
+
+	db := database.New()
+	return NewDockerService(db, utils.NewDispatcher(db, nil), slog.Default())
+}
+
+func dockerHostRequest(t *testing.T, service *DockerService, handler echo.HandlerFunc, method, id, body string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	e := echo.New()
+	req := httptest.NewRequest(method, "/docker/hosts", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if id != "" {
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+	}
+	return rec, handler(c)
+}
+
+// TestDockerHosts tests that hosts keep their ID across failed connections
+// and restarts
+func TestDockerHosts(t *testing.T) {
+	service := newTestDockerService(t)
+
+	// The seeded local host and the one imported from the environment
+	hosts := service.ClientManager.ListClients()
+	require.Len(t, hosts, 2)
+	assert.Equal(t, "local", hosts[0].Name)
+	assert.Equal(t, "tcp://127.0.0.1:2", hosts[1].Endpoint)
+	for _, h := range hosts {
+		assert.Equal(t, models.DockerHostDisconnected, h.Status)
+		assert.NotEmpty(t, h.Error)
+	}
+
+	rec, err := dockerHostRequest(t, service, service.CreateDockerHost, http.MethodPost, "",
+		`{"name":"build","endpoint":"tcp://127.0.0.1:3"}`)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var created models.DockerHost
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.Equal(t, "build", created.Name)
+	assert.Equal(t, models.DockerHostDisconnected, created.Status)
+	assert.False(t, created.TLS)
+	id := strconv.FormatInt(created.ID, 10)
+
+	_, err = dockerHostRequest(t, service, service.CreateDockerHost, http.MethodPost, "",
+		`{"name":"BUILD","endpoint":"tcp://127.0.0.1:4"}`)
+	var httpErr *echo.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusConflict, httpErr.Code)
+	_, err = dockerHostRequest(t, service, service.CreateDockerHost, http.MethodPost, "",
+		`{"name":"bad","endpoint":"not a url"}`)
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+	_, err = dockerHostRequest(t, service, service.CreateDockerHost, http.MethodPost, "",
+		`{"name":"bad","endpoint":"tcp://127.0.0.1:4","tls_cert":"garbage"}`)
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+
+	rec, err = dockerHostRequest(t, service, service.UpdateDockerHost, http.MethodPut, id,
+		`{"name":"builder","endpoint":"tcp://127.0.0.1:5"}`)
+	require.NoError(t, err)
+	var updated models.DockerHost
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &updated))
+	assert.Equal(t, created.ID, updated.ID)
+	assert.Equal(t, "builder", updated.Name)
+	assert.Equal(t, "tcp://127.0.0.1:5", updated.Endpoint)
+
+	// A restart reconnects the same hosts without importing the env one again
+	restarted := NewDockerService(service.db, service.Dispatcher, slog.Default())
+	hosts = restarted.ClientManager.ListClients()
+	require.Len(t, hosts, 3)
+	assert.Equal(t, created.ID, hosts[2].ID)
+	assert.Equal(t, "builder", hosts[2].Name)
+
+	_, err = dockerHostRequest(t, service, service.DeleteDockerHost, http.MethodDelete, id, "")
+	require.NoError(t, err)
+	_, ok := service.ClientManager.Host(created.ID)
+	assert.False(t, ok)
+	_, err = dockerHostRequest(t, service, service.GetDockerHost, http.MethodGet, id, "")
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusNotFound, httpErr.Code)
+}
@@ -0,0 +1,321 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"visory/internal/models"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	timetypes "github.com/docker/docker/api/types/time"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/labstack/echo/v4"
+)
+
+// logStreamHeartbeat keeps idle log streams open through proxies
+const logStreamHeartbeat = 15 * time.Second
+
+//	@Summary      Container logs
+//	@Description  Get the log of a container as lines tagged with their stream and timestamp. With follow, lines are streamed as server-sent events until the client disconnects
+//	@Tags         docker
+//	@Param        clientid  path   int     true   "Docker client ID"
+//	@Param        id        path   string  true   "Container ID"
+//	@Param        tail      query  string  false  "Number of lines from the end, or all (default)"
+//	@Param        since     query  string  false  "Only lines after this RFC 3339 time, unix timestamp or duration ago (10m)"
+//	@Param        until     query  string  false  "Only lines before this RFC 3339 time, unix timestamp or duration ago"
+//	@Param        stream    query  string  false  "stdout or stderr, both by default"
+//	@Param        follow    query  bool    false  "Stream new lines as server-sent events"
+//	@Produce      json
+//	@Success      200  {array}   models.ContainerLogLine
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/containers/{id}/logs [get]
+//
+// ContainerLogs returns container logs
+func (s *DockerService) ContainerLogs(c echo.Context) error {
+	follow := false
+	if v := c.QueryParam("follow"); v != "" {
+		var err error
+		if follow, err = strconv.ParseBool(v); err != nil {
+			return s.Dispatcher.NewBadRequest("Invalid follow value", err)
+		}
+	}
+	return s.containerLogs(c, follow)
+}
+
+//	@Summary      Follow container logs
+//	@Description  Stream the log of a container as server-sent events, one models.ContainerLogLine per event. Takes the same filters as the logs endpoint
+//	@Tags         docker
+//	@Param        clientid  path   int     true   "Docker client ID"
+//	@Param        id        path   string  true   "Container ID"
+//	@Param        tail      query  string  false  "Number of lines from the end, or all (default)"
+//	@Param        since     query  string  false  "Only lines after this RFC 3339 time, unix timestamp or duration ago (10m)"
+//	@Param        until     query  string  false  "Only lines before this RFC 3339 time, unix timestamp or duration ago"
+//	@Param        stream    query  string  false  "stdout or stderr, both by default"
+//	@Produce      text/event-stream
+//	@Success      200  {object}  models.ContainerLogLine
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/containers/{id}/logs/stream [get]
+//
+// ContainerLogsStream follows container logs
+func (s *DockerService) ContainerLogsStream(c echo.Context) error {
+	return s.containerLogs(c, true)
+}
+
+func (s *DockerService) containerLogs(c echo.Context, follow bool) error {
+	ctx := c.Request().Context()
+	containerID := c.Param("id")
+
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+
+	opts := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+		Follow:     follow,
+		Tail:       c.QueryParam("tail"),
+		Since:      c.QueryParam("since"),
+		Until:      c.QueryParam("until"),
+	}
+	if opts.Tail != "" && opts.Tail != "all" {
+		if n, err := strconv.Atoi(opts.Tail); err != nil || n < 0 {
+			return s.Dispatcher.NewBadRequest("Tail must be a number of lines or 'all'", err)
+		}
+	}
+	for name, value := range map[string]string{"since": opts.Since, "until": opts.Until} {
+		if value == "" {
+			continue
+		}
+		if _, err := timetypes.GetTimestamp(value, time.Now()); err != nil {
+			return s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid %s value", name), err)
+		}
+	}
+	switch c.QueryParam("stream") {
+	case "":
+	case models.LogStreamStdout:
+		opts.ShowStderr = false
+	case models.LogStreamStderr:
+		opts.ShowStdout = false
+	default:
+		return s.Dispatcher.NewBadRequest("Stream must be 'stdout' or 'stderr'", nil)
+	}
+
+	// Logs of containers with a TTY are a single raw stream, the others are
+	// multiplexed
+	info, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return s.Dispatcher.NewNotFound("Container not found", err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to inspect container", err)
+	}
+	tty := info.Config != nil && info.Config.Tty
+
+	logs, err := cli.ContainerLogs(ctx, info.ID, opts)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to get container logs", err)
+	}
+	defer logs.Close()
+
+	if !follow {
+		lines := []models.ContainerLogLine{}
+		err := demuxContainerLogs(logs, tty, func(line models.ContainerLogLine) error {
+			lines = append(lines, line)
+			return nil
+		})
+		if err != nil {
+			return s.Dispatcher.NewInternalServerError("Failed to read container logs", err)
+		}
+		return c.JSON(http.StatusOK, lines)
+	}
+
+	clearWriteDeadline(c)
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	var mu sync.Mutex
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	defer stopHeartbeat()
+	go func() {
+		ticker := time.NewTicker(logStreamHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeatCtx.Done():
+				return
+			case <-ticker.C:
+				mu.Lock()
+				_, _ = io.WriteString(res, ": heartbeat\n\n")
+				res.Flush()
+				mu.Unlock()
+			}
+		}
+	}()
+
+	err = demuxContainerLogs(logs, tty, func(line models.ContainerLogLine) error {
+		payload, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := fmt.Fprintf(res, "data: %s\n\n", payload); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		s.Logger.Warn("Container log stream ended", "container", info.ID, "error", err)
+	}
+	return nil
+}
+
+// clearWriteDeadline lifts the server's write timeout from a response that
+// is streamed for as long as the work it reports on
+func clearWriteDeadline(c echo.Context) {
+	_ = http.NewResponseController(c.Response().Writer).SetWriteDeadline(time.Time{})
+}
+
+// ndjsonStream reports the progress of a long running request as
+// application/x-ndjson lines of events E. Once started, the status is sent
+// so errors become the last event of the stream. A nil stream, for requests
+// without progress, sends nothing and returns errors as they are
+type ndjsonStream[E any] struct {
+	res        *echo.Response
+	enc        *json.Encoder
+	errorEvent func(message string) E
+}
+
+// startNDJSON sends the status and headers of a stream of events E.
+// errorEvent builds the event reporting a failure
+func startNDJSON[E any](c echo.Context, errorEvent func(message string) E) *ndjsonStream[E] {
+	clearWriteDeadline(c)
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+	return &ndjsonStream[E]{res: res, enc: json.NewEncoder(res), errorEvent: errorEvent}
+}
+
+// progressNDJSON starts a stream only when the request asks for progress
+func progressNDJSON[E any](c echo.Context, errorEvent func(message string) E) *ndjsonStream[E] {
+	if c.QueryParam("progress") != "true" {
+		return nil
+	}
+	return startNDJSON(c, errorEvent)
+}
+
+// Send writes an event and flushes it to the client
+func (s *ndjsonStream[E]) Send(event E) {
+	if s == nil {
+		return
+	}
+	_ = s.enc.Encode(event)
+	s.res.Flush()
+}
+
+// Fail returns httpErr, or sends it as an error event once streaming
+func (s *ndjsonStream[E]) Fail(httpErr *echo.HTTPError) error {
+	if s == nil {
+		return httpErr
+	}
+	s.Send(s.errorEvent(fmt.Sprint(httpErr.Message)))
+	return nil
+}
+
+// demuxContainerLogs splits a Docker log stream into lines and calls emit for
+// each of them, in order. Lines start with the timestamp Docker adds
+func demuxContainerLogs(r io.Reader, tty bool, emit func(models.ContainerLogLine) error) error {
+	var emitErr error
+	emitLine := func(stream string, raw []byte) {
+		if emitErr != nil {
+			return
+		}
+		emitErr = emit(parseContainerLogLine(stream, raw))
+	}
+	stdout := &logLineWriter{stream: models.LogStreamStdout, emit: emitLine}
+	stderr := &logLineWriter{stream: models.LogStreamStderr, emit: emitLine}
+
+	var err error
+	if tty {
+		_, err = io.Copy(stdout, r)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, r)
+	}
+	// A log ending without a newline still has a last line
+	stdout.flush()
+	stderr.flush()
+	if emitErr != nil {
+		return emitErr
+	}
+	return err
+}
+
+// logLineWriter cuts the frames of one stream into lines. Frames do not
+// follow line boundaries, the partial line is kept for the next frame
+type logLineWriter struct {
+	stream  string
+	emit    func(stream string, raw []byte)
+	partial []byte
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	data := p
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		if len(w.partial) > 0 {
+			w.emit(w.stream, append(w.partial, data[:i]...))
+			w.partial = w.partial[:0]
+		} else {
+			w.emit(w.stream, data[:i])
+		}
+		data = data[i+1:]
+	}
+	w.partial = append(w.partial, data...)
+	return len(p), nil
+}
+
+func (w *logLineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.emit(w.stream, w.partial)
+		w.partial = nil
+	}
+}
+
+func parseContainerLogLine(stream string, raw []byte) models.ContainerLogLine {
+	text := strings.TrimSuffix(string(raw), "\r")
+	line := models.ContainerLogLine{Stream: stream, Line: text}
+	if ts, rest, ok := strings.Cut(text, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			line.Timestamp = &t
+			line.Line = rest
+		}
+	}
+	return line
+}
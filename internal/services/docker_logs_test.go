@@ -0,0 +1,108 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	clientmanager "visory/internal/clientManager"
+	"visory/internal/database/dockerhosts"
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDemuxContainerLogs tests splitting multiplexed and raw log streams
+// into lines
+func TestDemuxContainerLogs(t *testing.T) {
+	var mux bytes.Buffer
+	stdout := stdcopy.NewStdWriter(&mux, stdcopy.Stdout)
+	stderr := stdcopy.NewStdWriter(&mux, stdcopy.Stderr)
+	// Frames split lines, and one frame can hold several lines
+	_, _ = io.WriteString(stdout, "2025-01-02T03:04:05.123456789Z listening on ")
+	_, _ = io.WriteString(stdout, ":8080\n2025-01-02T03:04:06Z ready\n")
+	_, _ = io.WriteString(stderr, "2025-01-02T03:04:07Z warning: slow\r\n")
+	_, _ = io.WriteString(stdout, "2025-01-02T03:04:08Z no newline")
+
+	var lines []models.ContainerLogLine
+	collect := func(line models.ContainerLogLine) error {
+		lines = append(lines, line)
+		return nil
+	}
+	require.NoError(t, demuxContainerLogs(&mux, false, collect))
+	require.Len(t, lines, 4)
+
+	assert.Equal(t, models.LogStreamStdout, lines[0].Stream)
+	assert.Equal(t, "listening on :8080", lines[0].Line)
+	require.NotNil(t, lines[0].Timestamp)
+	assert.Equal(t, time.Date(2025, 1, 2, 3, 4, 5, 123456789, time.UTC), *lines[0].Timestamp)
+	assert.Equal(t, "ready", lines[1].Line)
+	assert.Equal(t, models.LogStreamStderr, lines[2].Stream)
+	assert.Equal(t, "warning: slow", lines[2].Line)
+	assert.Equal(t, "no newline", lines[3].Line)
+
+	// Containers with a TTY log a single raw stream
+	lines = nil
+	raw := "2025-01-02T03:04:05Z $ ls\r\nnot a timestamp\n"
+	require.NoError(t, demuxContainerLogs(strings.NewReader(raw), true, collect))
+	require.Len(t, lines, 2)
+	assert.Equal(t, models.LogStreamStdout, lines[0].Stream)
+	assert.Equal(t, "$ ls", lines[0].Line)
+	assert.Nil(t, lines[1].Timestamp)
+	assert.Equal(t, "not a timestamp", lines[1].Line)
+}
+
+// TestContainerLogsStreamOutlastsWriteTimeout tests that followed logs keep
+// streaming past the write timeout of the server
+func TestContainerLogsStreamOutlastsWriteTimeout(t *testing.T) {
+	const writeTimeout = 200 * time.Millisecond
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Api-Version", "1.47")
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_ping"):
+			_, _ = w.Write([]byte("OK"))
+		case strings.HasSuffix(r.URL.Path, "/version"):
+			_, _ = w.Write([]byte(`{"Version":"27.3.1","ApiVersion":"1.47"}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/web/json"):
+			_, _ = w.Write([]byte(`{"Id":"web","Config":{"Tty":true}}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/web/logs"):
+			_, _ = io.WriteString(w, "2025-01-02T03:04:05Z first\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(3 * writeTimeout)
+			_, _ = io.WriteString(w, "2025-01-02T03:04:06Z second\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(daemon.Close)
+
+	manager := clientmanager.NewDockerClientManager(utils.NewDispatcher(nil, nil), slog.Default())
+	require.NoError(t, manager.Connect(dockerhosts.DockerHost{ID: 1, Name: "local", Endpoint: "tcp://" + daemon.Listener.Addr().String()}))
+	t.Cleanup(func() { manager.Remove(1) })
+	service := &DockerService{Dispatcher: utils.NewDispatcher(nil, nil), Logger: slog.Default(), ClientManager: manager}
+
+	e := echo.New()
+	e.GET("/docker/:clientid/containers/:id/logs/stream", service.ContainerLogsStream)
+	srv := httptest.NewUnstartedServer(e)
+	srv.Config.WriteTimeout = writeTimeout
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	res, err := http.Get(srv.URL + "/docker/1/containers/web/logs/stream")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"line":"first"`)
+	assert.Contains(t, string(body), `"line":"second"`)
+}
@@ -0,0 +1,540 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"visory/internal/models"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo/v4"
+)
+
+// networkNamePattern restricts network names to those usable in container
+// network modes and Compose files
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// builtinNetworks are created by the daemon and cannot be removed
+var builtinNetworks = map[string]bool{"bridge": true, "host": true, "none": true}
+
+// networkModes are the modes of each driver with a mode option
+var networkModes = map[string]struct {
+	option string
+	modes  []string
+}{
+	models.NetworkDriverMacvlan: {"macvlan_mode", []string{"bridge", "vepa", "private", "passthru"}},
+	models.NetworkDriverIPvlan:  {"ipvlan_mode", []string{"l2", "l3", "l3s"}},
+}
+
+//	@Summary      List networks
+//	@Description  List the networks of a Docker client with the containers attached to them
+//	@Tags         docker
+//	@Param        clientid  path  int  true  "Docker client ID"
+//	@Produce      json
+//	@Success      200  {array}   models.DockerNetwork
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/networks [get]
+//
+// ListNetworks returns the networks of a client
+func (s *DockerService) ListNetworks(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+
+	networks, err := cli.NetworkList(ctx, network.ListOptions{})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to list networks", err)
+	}
+	// The list has no endpoints, they are read from the containers instead
+	// of inspecting every network
+	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to list containers", err)
+	}
+	attachNetworkContainers(networks, containers)
+
+	result := make([]models.DockerNetwork, 0, len(networks))
+	for _, n := range networks {
+		result = append(result, networkInfo(n))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return c.JSON(http.StatusOK, result)
+}
+
+//	@Summary      Inspect network
+//	@Description  Get a network of a Docker client with the containers attached to it
+//	@Tags         docker
+//	@Param        clientid  path  int     true  "Docker client ID"
+//	@Param        id        path  string  true  "Network ID or name"
+//	@Produce      json
+//	@Success      200  {object}  models.DockerNetwork
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/networks/{id} [get]
+//
+// InspectNetwork returns a network
+func (s *DockerService) InspectNetwork(c echo.Context) error {
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	n, err := s.inspectNetwork(c.Request().Context(), cli, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, networkInfo(n))
+}
+
+//	@Summary      Create network
+//	@Description  Create a bridge, macvlan or ipvlan network on a Docker client, with optional subnets, gateways and IP ranges
+//	@Tags         docker
+//	@Accept       json
+//	@Param        clientid  path  int                          true  "Docker client ID"
+//	@Param        body      body  models.CreateNetworkRequest  true  "Network to create"
+//	@Produce      json
+//	@Success      201  {object}  models.DockerNetwork
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/networks [post]
+//
+// CreateNetwork creates a network
+func (s *DockerService) CreateNetwork(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	req := new(models.CreateNetworkRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	opts, err := s.networkCreateOptions(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cli.NetworkCreate(ctx, req.Name, opts)
+	if err != nil {
+		switch {
+		case cerrdefs.IsConflict(err):
+			return s.Dispatcher.NewConflict(fmt.Sprintf("Network '%s' already exists", req.Name), err)
+		case cerrdefs.IsInvalidArgument(err), cerrdefs.IsPermissionDenied(err), cerrdefs.IsNotFound(err):
+			// Overlapping subnets and missing parent interfaces end here
+			return s.Dispatcher.NewBadRequest(err.Error(), err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to create network", err)
+	}
+	n, err := s.inspectNetwork(ctx, cli, resp.ID)
+	if err != nil {
+		return err
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_NETWORK_CREATE", Subject: n.Name, Level: "INFO",
+		Message: "network created", Fields: map[string]string{
+			"Client":  c.Param("clientid"),
+			"Network": n.ID,
+			"Driver":  n.Driver,
+		},
+	})
+	return c.JSON(http.StatusCreated, networkInfo(n))
+}
+
+//	@Summary      Delete network
+//	@Description  Delete a network of a Docker client. Builtin networks and networks with attached containers cannot be deleted
+//	@Tags         docker
+//	@Param        clientid  path  int     true  "Docker client ID"
+//	@Param        id        path  string  true  "Network ID or name"
+//	@Produce      json
+//	@Success      200  {object}  map[string]string
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/networks/{id} [delete]
+//
+// DeleteNetwork removes a network
+func (s *DockerService) DeleteNetwork(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	n, err := s.inspectNetwork(ctx, cli, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if builtinNetworks[n.Name] {
+		return s.Dispatcher.NewBadRequest(fmt.Sprintf("Network '%s' is builtin and cannot be deleted", n.Name), nil)
+	}
+	if len(n.Containers) > 0 {
+		info := networkInfo(n)
+		names := make([]string, 0, len(info.Containers))
+		for _, ctr := range info.Containers {
+			names = append(names, ctr.Name)
+		}
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Network '%s' is used by %s, disconnect them first", n.Name, strings.Join(names, ", ")), nil)
+	}
+
+	if err := cli.NetworkRemove(ctx, n.ID); err != nil {
+		if cerrdefs.IsPermissionDenied(err) || cerrdefs.IsConflict(err) {
+			return s.Dispatcher.NewConflict(err.Error(), err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to delete network", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_NETWORK_DELETE", Subject: n.Name, Level: "INFO",
+		Message: "network deleted", Fields: map[string]string{
+			"Client":  c.Param("clientid"),
+			"Network": n.ID,
+		},
+	})
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Network '%s' deleted successfully", n.Name),
+	})
+}
+
+//	@Summary      Connect container to network
+//	@Description  Attach a container to a network, with optional static addresses and aliases
+//	@Tags         docker
+//	@Accept       json
+//	@Param        clientid  path  int                           true  "Docker client ID"
+//	@Param        id        path  string                        true  "Network ID or name"
+//	@Param        body      body  models.NetworkConnectRequest  true  "Container to attach"
+//	@Produce      json
+//	@Success      200  {object}  map[string]string
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/networks/{id}/connect [post]
+//
+// ConnectNetwork attaches a container to a network
+func (s *DockerService) ConnectNetwork(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	req := new(models.NetworkConnectRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	settings, err := s.networkEndpointSettings(req)
+	if err != nil {
+		return err
+	}
+	n, err := s.inspectNetwork(ctx, cli, c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	if err := cli.NetworkConnect(ctx, n.ID, req.Container, settings); err != nil {
+		switch {
+		case cerrdefs.IsNotFound(err):
+			return s.Dispatcher.NewNotFound(fmt.Sprintf("Container '%s' not found", req.Container), err)
+		case cerrdefs.IsConflict(err), cerrdefs.IsPermissionDenied(err):
+			// Already attached, or attached to a network excluding others
+			return s.Dispatcher.NewConflict(err.Error(), err)
+		case cerrdefs.IsInvalidArgument(err):
+			return s.Dispatcher.NewBadRequest(err.Error(), err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to connect container", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_NETWORK_CONNECT", Subject: n.Name, Level: "INFO",
+		Message: "container connected to network", Fields: map[string]string{
+			"Client":    c.Param("clientid"),
+			"Container": req.Container,
+			"IPv4":      req.IPv4Address,
+			"IPv6":      req.IPv6Address,
+			"Aliases":   strings.Join(req.Aliases, ", "),
+		},
+	})
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Container '%s' connected to '%s'", req.Container, n.Name),
+	})
+}
+
+//	@Summary      Disconnect container from network
+//	@Description  Detach a container from a network
+//	@Tags         docker
+//	@Accept       json
+//	@Param        clientid  path  int                              true  "Docker client ID"
+//	@Param        id        path  string                           true  "Network ID or name"
+//	@Param        body      body  models.NetworkDisconnectRequest  true  "Container to detach"
+//	@Produce      json
+//	@Success      200  {object}  map[string]string
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/networks/{id}/disconnect [post]
+//
+// DisconnectNetwork detaches a container from a network
+func (s *DockerService) DisconnectNetwork(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	req := new(models.NetworkDisconnectRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	if req.Container = strings.TrimSpace(req.Container); req.Container == "" {
+		return s.Dispatcher.NewBadRequest("Container is required", nil)
+	}
+	n, err := s.inspectNetwork(ctx, cli, c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	if err := cli.NetworkDisconnect(ctx, n.ID, req.Container, req.Force); err != nil {
+		switch {
+		case cerrdefs.IsNotFound(err):
+			return s.Dispatcher.NewNotFound(fmt.Sprintf("Container '%s' not found", req.Container), err)
+		case cerrdefs.IsInvalidArgument(err), cerrdefs.IsPermissionDenied(err):
+			// Not attached to the network
+			return s.Dispatcher.NewBadRequest(err.Error(), err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to disconnect container", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_NETWORK_DISCONNECT", Subject: n.Name, Level: "INFO",
+		Message: "container disconnected from network", Fields: map[string]string{
+			"Client":    c.Param("clientid"),
+			"Container": req.Container,
+			"Force":     fmt.Sprint(req.Force),
+		},
+	})
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Container '%s' disconnected from '%s'", req.Container, n.Name),
+	})
+}
+
+func (s *DockerService) inspectNetwork(ctx context.Context, cli *client.Client, id string) (network.Inspect, error) {
+	n, err := cli.NetworkInspect(ctx, id, network.InspectOptions{})
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return n, s.Dispatcher.NewNotFound(fmt.Sprintf("Network '%s' not found", id), err)
+		}
+		return n, s.Dispatcher.NewInternalServerError("Failed to inspect network", err)
+	}
+	return n, nil
+}
+
+// networkCreateOptions validates a create request into the options of the
+// daemon
+func (s *DockerService) networkCreateOptions(req *models.CreateNetworkRequest) (network.CreateOptions, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if !networkNamePattern.MatchString(req.Name) {
+		return network.CreateOptions{}, s.Dispatcher.NewBadRequest("Network name must start with a letter or digit and contain only letters, digits, '_', '.' and '-'", nil)
+	}
+	if builtinNetworks[req.Name] {
+		return network.CreateOptions{}, s.Dispatcher.NewBadRequest(fmt.Sprintf("Network name '%s' is reserved", req.Name), nil)
+	}
+	if req.Driver == "" {
+		req.Driver = models.NetworkDriverBridge
+	}
+
+	options := map[string]string{}
+	for k, v := range req.Options {
+		options[k] = v
+	}
+	switch req.Driver {
+	case models.NetworkDriverBridge:
+		if req.Parent != "" || req.Mode != "" {
+			return network.CreateOptions{}, s.Dispatcher.NewBadRequest("Parent and mode only apply to macvlan and ipvlan networks", nil)
+		}
+	case models.NetworkDriverMacvlan, models.NetworkDriverIPvlan:
+		if req.Parent != "" {
+			options["parent"] = req.Parent
+		}
+		if req.Mode != "" {
+			modes := networkModes[req.Driver]
+			if !slices.Contains(modes.modes, req.Mode) {
+				return network.CreateOptions{}, s.Dispatcher.NewBadRequest(fmt.Sprintf("Mode of %s networks must be one of %s", req.Driver, strings.Join(modes.modes, ", ")), nil)
+			}
+			options[modes.option] = req.Mode
+		}
+	default:
+		return network.CreateOptions{}, s.Dispatcher.NewBadRequest("Driver must be 'bridge', 'macvlan' or 'ipvlan'", nil)
+	}
+
+	ipv6 := req.IPv6
+	var ipam *network.IPAM
+	if len(req.Subnets) > 0 {
+		ipam = &network.IPAM{Driver: "default"}
+		for _, sub := range req.Subnets {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(sub.Subnet))
+			if err != nil {
+				return network.CreateOptions{}, s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid subnet '%s', expected CIDR notation", sub.Subnet), err)
+			}
+			ipv6 = ipv6 || prefix.Addr().Is6()
+			ipam.Config = append(ipam.Config, network.IPAMConfig{
+				Subnet:  prefix.String(),
+				Gateway: strings.TrimSpace(sub.Gateway),
+				IPRange: strings.TrimSpace(sub.IPRange),
+			})
+		}
+		if err := network.ValidateIPAM(ipam, true); err != nil {
+			return network.CreateOptions{}, s.Dispatcher.NewBadRequest(strings.ReplaceAll(err.Error(), "\n", " "), err)
+		}
+	}
+
+	return network.CreateOptions{
+		Driver:     req.Driver,
+		EnableIPv6: &ipv6,
+		IPAM:       ipam,
+		Internal:   req.Internal,
+		Attachable: req.Attachable,
+		Options:    options,
+		Labels:     req.Labels,
+	}, nil
+}
+
+// networkEndpointSettings validates a connect request into the endpoint
+// settings of the container
+func (s *DockerService) networkEndpointSettings(req *models.NetworkConnectRequest) (*network.EndpointSettings, error) {
+	if req.Container = strings.TrimSpace(req.Container); req.Container == "" {
+		return nil, s.Dispatcher.NewBadRequest("Container is required", nil)
+	}
+	settings := &network.EndpointSettings{}
+	for _, alias := range req.Aliases {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			settings.Aliases = append(settings.Aliases, alias)
+		}
+	}
+	if req.IPv4Address == "" && req.IPv6Address == "" {
+		return settings, nil
+	}
+
+	settings.IPAMConfig = &network.EndpointIPAMConfig{}
+	for _, addr := range []struct {
+		value *string
+		dst   *string
+		is4   bool
+	}{
+		{&req.IPv4Address, &settings.IPAMConfig.IPv4Address, true},
+		{&req.IPv6Address, &settings.IPAMConfig.IPv6Address, false},
+	} {
+		if *addr.value == "" {
+			continue
+		}
+		ip, err := netip.ParseAddr(strings.TrimSpace(*addr.value))
+		if err != nil || ip.Is4() != addr.is4 {
+			family := "IPv6"
+			if addr.is4 {
+				family = "IPv4"
+			}
+			return nil, s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid %s address '%s'", family, *addr.value), err)
+		}
+		*addr.dst = ip.String()
+	}
+	return settings, nil
+}
+
+// attachNetworkContainers fills the endpoints of listed networks from the
+// networks of the containers
+func attachNetworkContainers(networks []network.Summary, containers []container.Summary) {
+	byID := make(map[string]*network.Summary, len(networks))
+	for i := range networks {
+		byID[networks[i].ID] = &networks[i]
+	}
+	for _, ctr := range containers {
+		if ctr.NetworkSettings == nil {
+			continue
+		}
+		name := ctr.ID
+		if len(ctr.Names) > 0 {
+			name = strings.TrimPrefix(ctr.Names[0], "/")
+		}
+		for _, ep := range ctr.NetworkSettings.Networks {
+			n := byID[ep.NetworkID]
+			if n == nil {
+				continue
+			}
+			if n.Containers == nil {
+				n.Containers = map[string]network.EndpointResource{}
+			}
+			res := network.EndpointResource{Name: name, EndpointID: ep.EndpointID, MacAddress: ep.MacAddress}
+			if ep.IPAddress != "" {
+				res.IPv4Address = fmt.Sprintf("%s/%d", ep.IPAddress, ep.IPPrefixLen)
+			}
+			if ep.GlobalIPv6Address != "" {
+				res.IPv6Address = fmt.Sprintf("%s/%d", ep.GlobalIPv6Address, ep.GlobalIPv6PrefixLen)
+			}
+			n.Containers[ctr.ID] = res
+		}
+	}
+}
+
+// networkInfo describes a network
+func networkInfo(n network.Inspect) models.DockerNetwork {
+	info := models.DockerNetwork{
+		ID:         n.ID,
+		Name:       n.Name,
+		Driver:     n.Driver,
+		Scope:      n.Scope,
+		Created:    n.Created,
+		Internal:   n.Internal,
+		Attachable: n.Attachable,
+		IPv6:       n.EnableIPv6,
+		Builtin:    builtinNetworks[n.Name],
+		Subnets:    make([]models.NetworkSubnet, 0, len(n.IPAM.Config)),
+		Labels:     n.Labels,
+		Options:    n.Options,
+		Containers: make([]models.NetworkContainer, 0, len(n.Containers)),
+	}
+	for _, cfg := range n.IPAM.Config {
+		info.Subnets = append(info.Subnets, models.NetworkSubnet{Subnet: cfg.Subnet, Gateway: cfg.Gateway, IPRange: cfg.IPRange})
+	}
+	for id, ep := range n.Containers {
+		info.Containers = append(info.Containers, models.NetworkContainer{
+			ID:          id,
+			Name:        ep.Name,
+			IPv4Address: ep.IPv4Address,
+			IPv6Address: ep.IPv6Address,
+			MacAddress:  ep.MacAddress,
+		})
+	}
+	sort.Slice(info.Containers, func(i, j int) bool { return info.Containers[i].Name < info.Containers[j].Name })
+	if info.Labels == nil {
+		info.Labels = map[string]string{}
+	}
+	if info.Options == nil {
+		info.Options = map[string]string{}
+	}
+	return info
+}
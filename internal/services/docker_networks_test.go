@@ -0,0 +1,115 @@
+package services
+
+import (
+	"log/slog"
+	"testing"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNetworkCreateOptions tests that create requests are validated into
+// the options of the daemon
+func TestNetworkCreateOptions(t *testing.T) {
+	service := &DockerService{Dispatcher: utils.NewDispatcher(nil, nil), Logger: slog.Default()}
+
+	opts, err := service.networkCreateOptions(&models.CreateNetworkRequest{
+		Name:   "lan",
+		Driver: models.NetworkDriverMacvlan,
+		Parent: "eth0.20",
+		Mode:   "bridge",
+		Subnets: []models.NetworkSubnet{
+			{Subnet: "192.168.20.0/24", Gateway: "192.168.20.1", IPRange: "192.168.20.128/25"},
+			{Subnet: "fd00:20::/64"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "macvlan", opts.Driver)
+	assert.Equal(t, map[string]string{"parent": "eth0.20", "macvlan_mode": "bridge"}, opts.Options)
+	require.Len(t, opts.IPAM.Config, 2)
+	assert.Equal(t, network.IPAMConfig{Subnet: "192.168.20.0/24", Gateway: "192.168.20.1", IPRange: "192.168.20.128/25"}, opts.IPAM.Config[0])
+	assert.True(t, *opts.EnableIPv6, "an IPv6 subnet enables IPv6")
+
+	opts, err = service.networkCreateOptions(&models.CreateNetworkRequest{Name: "backend", Internal: true})
+	require.NoError(t, err)
+	assert.Equal(t, "bridge", opts.Driver)
+	assert.Nil(t, opts.IPAM)
+	assert.False(t, *opts.EnableIPv6)
+	assert.True(t, opts.Internal)
+
+	invalid := map[string]models.CreateNetworkRequest{
+		"no name":          {},
+		"reserved name":    {Name: "host"},
+		"name":             {Name: "my net"},
+		"driver":           {Name: "x", Driver: "overlay"},
+		"bridge parent":    {Name: "x", Parent: "eth0"},
+		"ipvlan mode":      {Name: "x", Driver: models.NetworkDriverIPvlan, Mode: "bridge"},
+		"subnet":           {Name: "x", Subnets: []models.NetworkSubnet{{Subnet: "10.0.0.0"}}},
+		"unmasked subnet":  {Name: "x", Subnets: []models.NetworkSubnet{{Subnet: "10.0.0.1/24"}}},
+		"gateway outside":  {Name: "x", Subnets: []models.NetworkSubnet{{Subnet: "10.0.0.0/24", Gateway: "10.0.1.1"}}},
+		"ip range outside": {Name: "x", Subnets: []models.NetworkSubnet{{Subnet: "10.0.0.0/24", IPRange: "10.0.0.0/16"}}},
+	}
+	for name, req := range invalid {
+		_, err := service.networkCreateOptions(&req)
+		assert.Error(t, err, name)
+	}
+}
+
+// TestNetworkEndpointSettings tests static addresses and aliases of
+// connect requests
+func TestNetworkEndpointSettings(t *testing.T) {
+	service := &DockerService{Dispatcher: utils.NewDispatcher(nil, nil), Logger: slog.Default()}
+
+	settings, err := service.networkEndpointSettings(&models.NetworkConnectRequest{
+		Container:   " web ",
+		IPv4Address: "192.168.20.10",
+		Aliases:     []string{"www", " "},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &network.EndpointIPAMConfig{IPv4Address: "192.168.20.10"}, settings.IPAMConfig)
+	assert.Equal(t, []string{"www"}, settings.Aliases)
+
+	settings, err = service.networkEndpointSettings(&models.NetworkConnectRequest{Container: "web"})
+	require.NoError(t, err)
+	assert.Nil(t, settings.IPAMConfig)
+
+	for name, req := range map[string]models.NetworkConnectRequest{
+		"no container": {IPv4Address: "10.0.0.2"},
+		"ipv4":         {Container: "web", IPv4Address: "10.0.0"},
+		"ipv6 as ipv4": {Container: "web", IPv4Address: "fd00::2"},
+		"ipv4 as ipv6": {Container: "web", IPv6Address: "10.0.0.2"},
+	} {
+		_, err := service.networkEndpointSettings(&req)
+		assert.Error(t, err, name)
+	}
+}
+
+// TestAttachNetworkContainers tests that listed networks get the endpoints
+// of the containers
+func TestAttachNetworkContainers(t *testing.T) {
+	networks := []network.Summary{
+		{ID: "lan-id", Name: "lan", IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "10.0.0.0/24"}}}},
+		{ID: "bridge-id", Name: "bridge"},
+	}
+	attachNetworkContainers(networks, []container.Summary{{
+		ID:    "web-id",
+		Names: []string{"/web"},
+		NetworkSettings: &container.NetworkSettingsSummary{Networks: map[string]*network.EndpointSettings{
+			"lan": {NetworkID: "lan-id", IPAddress: "10.0.0.10", IPPrefixLen: 24, MacAddress: "02:42:0a:00:00:0a"},
+		}},
+	}})
+
+	lan := networkInfo(networks[0])
+	assert.Equal(t, []models.NetworkContainer{{ID: "web-id", Name: "web", IPv4Address: "10.0.0.10/24", MacAddress: "02:42:0a:00:00:0a"}}, lan.Containers)
+	assert.Equal(t, []models.NetworkSubnet{{Subnet: "10.0.0.0/24"}}, lan.Subnets)
+	assert.False(t, lan.Builtin)
+
+	bridge := networkInfo(networks[1])
+	assert.True(t, bridge.Builtin)
+	assert.Empty(t, bridge.Containers)
+}
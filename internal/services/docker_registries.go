@@ -0,0 +1,438 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"visory/internal/database"
+	"visory/internal/database/registries"
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo/v4"
+)
+
+// dockerHubRegistry is the name Docker Hub is stored under, whichever of its
+// addresses is given
+const dockerHubRegistry = "docker.io"
+
+// RegistryCredentials resolves the stored credentials of the registry of an
+// image, so every pull of private images is authenticated
+type RegistryCredentials struct {
+	db     *database.Service
+	logger *slog.Logger
+}
+
+// NewRegistryCredentials creates a RegistryCredentials reading from db
+func NewRegistryCredentials(db *database.Service, logger *slog.Logger) *RegistryCredentials {
+	return &RegistryCredentials{db: db, logger: logger}
+}
+
+// Auth returns the credentials of the registry of an image encoded for the
+// Docker API, empty when none are stored. Credentials that can no longer be
+// decrypted are skipped, so public images still pull anonymously
+func (r *RegistryCredentials) Auth(ctx context.Context, ref string) (string, error) {
+	if r == nil || r.db == nil {
+		return "", nil
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", err
+	}
+	host := reference.Domain(named)
+	cred, err := r.db.Registry.GetRegistryCredentialByRegistry(ctx, host)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	auth, err := registryAuthConfig(cred)
+	if err != nil {
+		r.logger.Warn("Pulling anonymously, stored registry credentials are unreadable", "registry", cred.Registry, "error", err)
+		return "", nil
+	}
+	return registry.EncodeAuthConfig(auth)
+}
+
+// AuthConfigs returns every stored credentials by server address, for
+// builds which may pull base images from any registry
+func (r *RegistryCredentials) AuthConfigs(ctx context.Context) (map[string]registry.AuthConfig, error) {
+	if r == nil || r.db == nil {
+		return nil, nil
+	}
+	creds, err := r.db.Registry.ListRegistryCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	configs := make(map[string]registry.AuthConfig, len(creds))
+	for _, cred := range creds {
+		auth, err := registryAuthConfig(cred)
+		if err != nil {
+			r.logger.Warn("Skipping unreadable registry credentials", "registry", cred.Registry, "error", err)
+			continue
+		}
+		configs[auth.ServerAddress] = auth
+	}
+	return configs, nil
+}
+
+// Pull pulls an image with the credentials of its registry, see pullImage
+func (r *RegistryCredentials) Pull(ctx context.Context, cli *client.Client, ref string, opts image.PullOptions, progress func(models.ImagePullProgress)) error {
+	auth, err := r.Auth(ctx, ref)
+	if err != nil {
+		return err
+	}
+	opts.RegistryAuth = auth
+	return pullImage(ctx, cli, ref, opts, progress)
+}
+
+// registryAuthConfig decrypts stored credentials. Docker Hub is addressed
+// by its legacy index URL, as the daemon expects
+func registryAuthConfig(cred registries.RegistryCredential) (registry.AuthConfig, error) {
+	secret, err := utils.DecryptSecret(cred.Secret)
+	if err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("credentials of %s: %w", cred.Registry, err)
+	}
+	server := cred.Registry
+	if server == dockerHubRegistry {
+		server = "https://index.docker.io/v1/"
+	}
+	return registry.AuthConfig{
+		Username:      cred.Username,
+		Password:      secret,
+		ServerAddress: server,
+	}, nil
+}
+
+// normalizeRegistry reduces a registry address to the host[:port] used in
+// image references
+func normalizeRegistry(address string) (string, error) {
+	host := strings.ToLower(strings.TrimSpace(address))
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com", "hub.docker.com":
+		host = dockerHubRegistry
+	}
+	if host == "" || strings.ContainsAny(host, " @?#") {
+		return "", fmt.Errorf("invalid registry '%s'", address)
+	}
+	return host, nil
+}
+
+//	@Summary      Pull image
+//	@Description  Pull an image, with the stored credentials of its registry. The response is a stream of models.ImagePullEvent lines (application/x-ndjson): the progress of each layer, then the result or an error
+//	@Tags         docker
+//	@Accept       json
+//	@Param        clientid  path  int                       true  "Docker client ID"
+//	@Param        body      body  models.ImagePullRequest  true  "Image to pull"
+//	@Produce      json
+//	@Success      200  {object}  models.ImagePullEvent
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/images/pull [post]
+//
+// PullImage pulls an image and streams its progress
+func (s *DockerService) PullImage(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	req := new(models.ImagePullRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	ref, err := s.imagePullReference(req)
+	if err != nil {
+		return err
+	}
+	auth, err := s.Registries.Auth(ctx, ref)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to read registry credentials", err)
+	}
+
+	// The status is sent before the pull starts, its outcome is reported in
+	// the stream. Large pulls run for longer than the write timeout
+	stream := startNDJSON(c, func(message string) models.ImagePullEvent {
+		return models.ImagePullEvent{Error: message}
+	})
+
+	s.Logger.Info("Pulling image", "image", ref, "platform", req.Platform, "authenticated", auth != "")
+	err = pullImage(ctx, cli, ref, image.PullOptions{Platform: req.Platform, RegistryAuth: auth}, func(p models.ImagePullProgress) {
+		stream.Send(models.ImagePullEvent{Progress: &p})
+	})
+	fields := map[string]string{"Client": c.Param("clientid"), "Authenticated": strconv.FormatBool(auth != "")}
+	if err != nil {
+		fields["Error"] = err.Error()
+		_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+			UserId: userIDFromContext(c), Event: "DOCKER_IMAGE_PULL", Subject: ref, Level: "ERROR",
+			Message: "image pull failed", Fields: fields,
+		})
+		stream.Send(models.ImagePullEvent{Error: err.Error()})
+		return nil
+	}
+
+	result := models.ImagePullResult{Image: ref, Authenticated: auth != ""}
+	if inspect, err := cli.ImageInspect(ctx, ref); err == nil {
+		result.ID = inspect.ID
+	}
+	fields["ID"] = result.ID
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_IMAGE_PULL", Subject: ref, Level: "INFO",
+		Message: "image pulled", Fields: fields,
+	})
+	stream.Send(models.ImagePullEvent{Result: &result})
+	return nil
+}
+
+// imagePullReference validates a pull request and returns the reference to
+// pull. Without a tag or digest, latest is pulled as the docker CLI does
+func (s *DockerService) imagePullReference(req *models.ImagePullRequest) (string, error) {
+	ref := strings.TrimSpace(req.Image)
+	if ref == "" {
+		return "", s.Dispatcher.NewBadRequest("Image is required", nil)
+	}
+	if tag := strings.TrimSpace(req.Tag); tag != "" {
+		ref += ":" + tag
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", s.Dispatcher.NewBadRequest(fmt.Sprintf("Invalid image reference '%s'", ref), err)
+	}
+	if _, err := parsePlatform(req.Platform); err != nil {
+		return "", s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named)), nil
+}
+
+//	@Summary      List registry credentials
+//	@Description  List the stored registry credentials. Passwords and tokens are never returned
+//	@Tags         docker
+//	@Produce      json
+//	@Success      200  {array}   models.RegistryCredential
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/registries [get]
+//
+// ListRegistries returns the stored registry credentials
+func (s *DockerService) ListRegistries(c echo.Context) error {
+	creds, err := s.db.Registry.ListRegistryCredentials(c.Request().Context())
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to list registry credentials", err)
+	}
+	result := make([]models.RegistryCredential, 0, len(creds))
+	for _, cred := range creds {
+		result = append(result, registryCredentialInfo(cred))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+//	@Summary      Add registry credentials
+//	@Description  Store the credentials of an image registry, used by every pull of its images. The password or token is encrypted at rest
+//	@Tags         docker
+//	@Accept       json
+//	@Param        body  body  models.RegistryCredentialRequest  true  "Registry credentials"
+//	@Produce      json
+//	@Success      201  {object}  models.RegistryCredential
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/registries [post]
+//
+// CreateRegistry stores registry credentials
+func (s *DockerService) CreateRegistry(c echo.Context) error {
+	req := new(models.RegistryCredentialRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	if req.Password == nil || *req.Password == "" {
+		return s.Dispatcher.NewBadRequest("A password or token is required", nil)
+	}
+	params := registries.RegistryCredential{}
+	if err := s.applyRegistryRequest(&params, req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if _, err := s.db.Registry.GetRegistryCredentialByRegistry(ctx, params.Registry); err == nil {
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Credentials of '%s' already exist", params.Registry), nil)
+	}
+	cred, err := s.db.Registry.CreateRegistryCredential(ctx, registries.CreateRegistryCredentialParams{
+		Registry: params.Registry,
+		Username: params.Username,
+		Secret:   params.Secret,
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to save registry credentials", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_REGISTRY_CREATE", Subject: cred.Registry, Level: "INFO",
+		Message: "registry credentials added", Fields: map[string]string{
+			"ID":       strconv.FormatInt(cred.ID, 10),
+			"Username": cred.Username,
+		},
+	})
+	return c.JSON(http.StatusCreated, registryCredentialInfo(cred))
+}
+
+//	@Summary      Edit registry credentials
+//	@Description  Change the registry, username or password of stored credentials. An omitted password is kept
+//	@Tags         docker
+//	@Accept       json
+//	@Param        id    path  int                               true  "Registry credentials ID"
+//	@Param        body  body  models.RegistryCredentialRequest  true  "Registry credentials"
+//	@Produce      json
+//	@Success      200  {object}  models.RegistryCredential
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/registries/{id} [put]
+//
+// UpdateRegistry edits registry credentials
+func (s *DockerService) UpdateRegistry(c echo.Context) error {
+	cred, err := s.registryFromParam(c)
+	if err != nil {
+		return err
+	}
+	req := new(models.RegistryCredentialRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	previous := cred
+	if err := s.applyRegistryRequest(&cred, req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if cred.Registry != previous.Registry {
+		if _, err := s.db.Registry.GetRegistryCredentialByRegistry(ctx, cred.Registry); err == nil {
+			return s.Dispatcher.NewConflict(fmt.Sprintf("Credentials of '%s' already exist", cred.Registry), nil)
+		}
+	}
+	cred, err = s.db.Registry.UpdateRegistryCredential(ctx, registries.UpdateRegistryCredentialParams{
+		Registry: cred.Registry,
+		Username: cred.Username,
+		Secret:   cred.Secret,
+		ID:       cred.ID,
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to save registry credentials", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_REGISTRY_UPDATE", Subject: cred.Registry, Level: "INFO",
+		Message: "registry credentials updated", Fields: map[string]string{
+			"ID":       strconv.FormatInt(cred.ID, 10),
+			"Registry": previous.Registry + " -> " + cred.Registry,
+			"Username": previous.Username + " -> " + cred.Username,
+			"Password": strconv.FormatBool(req.Password != nil),
+		},
+	})
+	return c.JSON(http.StatusOK, registryCredentialInfo(cred))
+}
+
+//	@Summary      Remove registry credentials
+//	@Description  Remove stored registry credentials. Pulls of the registry are then anonymous
+//	@Tags         docker
+//	@Param        id  path  int  true  "Registry credentials ID"
+//	@Produce      json
+//	@Success      200  {object}  map[string]string
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/registries/{id} [delete]
+//
+// DeleteRegistry removes registry credentials
+func (s *DockerService) DeleteRegistry(c echo.Context) error {
+	cred, err := s.registryFromParam(c)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Registry.DeleteRegistryCredential(c.Request().Context(), cred.ID); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to delete registry credentials", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_REGISTRY_DELETE", Subject: cred.Registry, Level: "INFO",
+		Message: "registry credentials removed", Fields: map[string]string{
+			"ID": strconv.FormatInt(cred.ID, 10),
+		},
+	})
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Credentials of '%s' removed successfully", cred.Registry),
+	})
+}
+
+// applyRegistryRequest validates a request and applies it to cred,
+// encrypting a new password
+func (s *DockerService) applyRegistryRequest(cred *registries.RegistryCredential, req *models.RegistryCredentialRequest) error {
+	host, err := normalizeRegistry(req.Registry)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+	cred.Registry = host
+	cred.Username = strings.TrimSpace(req.Username)
+	if cred.Username == "" {
+		return s.Dispatcher.NewBadRequest("Username is required", nil)
+	}
+	if req.Password == nil {
+		return nil
+	}
+	if *req.Password == "" {
+		return s.Dispatcher.NewBadRequest("The password or token cannot be empty", nil)
+	}
+	if cred.Secret, err = utils.EncryptSecret(*req.Password); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to encrypt the password", err)
+	}
+	return nil
+}
+
+func (s *DockerService) registryFromParam(c echo.Context) (registries.RegistryCredential, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return registries.RegistryCredential{}, s.Dispatcher.NewBadRequest("Invalid registry credentials ID", err)
+	}
+	cred, err := s.db.Registry.GetRegistryCredentialByID(c.Request().Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return registries.RegistryCredential{}, s.Dispatcher.NewNotFound("Registry credentials not found", err)
+		}
+		return registries.RegistryCredential{}, s.Dispatcher.NewInternalServerError("Failed to fetch registry credentials", err)
+	}
+	return cred, nil
+}
+
+// registryCredentialInfo describes credentials without their secret
+func registryCredentialInfo(cred registries.RegistryCredential) models.RegistryCredential {
+	return models.RegistryCredential{
+		ID:        cred.ID,
+		Registry:  cred.Registry,
+		Username:  cred.Username,
+		CreatedAt: cred.CreatedAt,
+		UpdatedAt: cred.UpdatedAt,
+	}
+}
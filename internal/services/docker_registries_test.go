@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"visory/internal/models"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNormalizeRegistry tests that the addresses of a registry resolve to
+// the host of its image references
+func TestNormalizeRegistry(t *testing.T) {
+	for in, want := range map[string]string{
+		"ghcr.io":                     "ghcr.io",
+		"https://GHCR.io/":            "ghcr.io",
+		"registry.local:5000/v2/":     "registry.local:5000",
+		"https://index.docker.io/v1/": dockerHubRegistry,
+		"registry-1.docker.io":        dockerHubRegistry,
+		"docker.io":                   dockerHubRegistry,
+	} {
+		got, err := normalizeRegistry(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	for _, in := range []string{"", "https://", "user@ghcr.io", "my registry"} {
+		_, err := normalizeRegistry(in)
+		assert.Error(t, err, in)
+	}
+}
+
+// TestRegistryCredentials tests that stored credentials are encrypted and
+// used for the images of their registry only
+func TestRegistryCredentials(t *testing.T) {
+	service := newTestDockerService(t)
+	models.ENV_VARS.CredentialsKey = "test-credentials-key"
+	ctx := context.Background()
+
+	rec, err := dockerHostRequest(t, service, service.CreateRegistry, http.MethodPost, "",
+		`{"registry":"https://ghcr.io/","username":"octocat","password":"ghp_token"}`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "ghp_token")
+	var cred models.RegistryCredential
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &cred))
+	assert.Equal(t, "ghcr.io", cred.Registry)
+
+	stored, err := service.db.Registry.GetRegistryCredentialByID(ctx, cred.ID)
+	require.NoError(t, err)
+	assert.NotContains(t, stored.Secret, "ghp_token")
+
+	auth, err := service.Registries.Auth(ctx, "ghcr.io/octocat/app:1.0")
+	require.NoError(t, err)
+	decoded, err := registry.DecodeAuthConfig(auth)
+	require.NoError(t, err)
+	assert.Equal(t, registry.AuthConfig{Username: "octocat", Password: "ghp_token", ServerAddress: "ghcr.io"}, *decoded)
+
+	auth, err = service.Registries.Auth(ctx, "nginx:1.27")
+	require.NoError(t, err)
+	assert.Empty(t, auth, "Docker Hub has no credentials")
+
+	var httpErr *echo.HTTPError
+	_, err = dockerHostRequest(t, service, service.CreateRegistry, http.MethodPost, "",
+		`{"registry":"ghcr.io","username":"other","password":"x"}`)
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusConflict, httpErr.Code)
+	_, err = dockerHostRequest(t, service, service.CreateRegistry, http.MethodPost, "",
+		`{"registry":"docker.io","username":"octocat"}`)
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+
+	// Without a password the current one is kept
+	id := strconv.FormatInt(cred.ID, 10)
+	rec, err = dockerHostRequest(t, service, service.UpdateRegistry, http.MethodPut, id,
+		`{"registry":"index.docker.io","username":"hubuser"}`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rec.Code)
+	auth, err = service.Registries.Auth(ctx, "library/nginx")
+	require.NoError(t, err)
+	decoded, err = registry.DecodeAuthConfig(auth)
+	require.NoError(t, err)
+	assert.Equal(t, registry.AuthConfig{Username: "hubuser", Password: "ghp_token", ServerAddress: "https://index.docker.io/v1/"}, *decoded)
+
+	// Credentials sealed with another key fall back to anonymous pulls
+	models.ENV_VARS.CredentialsKey = "rotated-credentials-key"
+	auth, err = service.Registries.Auth(ctx, "library/nginx")
+	require.NoError(t, err)
+	assert.Empty(t, auth)
+	configs, err := service.Registries.AuthConfigs(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, configs)
+	models.ENV_VARS.CredentialsKey = "test-credentials-key"
+
+	rec, err = dockerHostRequest(t, service, service.DeleteRegistry, http.MethodDelete, id, "")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rec.Code)
+	_, err = dockerHostRequest(t, service, service.DeleteRegistry, http.MethodDelete, id, "")
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusNotFound, httpErr.Code)
+	auth, err = service.Registries.Auth(ctx, "nginx")
+	require.NoError(t, err)
+	assert.Empty(t, auth)
+}
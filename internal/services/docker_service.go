@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	clientmanager "visory/internal/clientManager"
+	"visory/internal/database"
 	"visory/internal/utils"
 
 	"github.com/docker/docker/api/types/container"
@@ -13,26 +14,27 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-type ClientInfo struct {
-	ID     int    `json:"id"`
-	Status string `json:"status"`
-}
-
 type DockerService struct {
+	db            *database.Service
 	Dispatcher    *utils.Dispatcher
 	Logger        *slog.Logger
 	ClientManager *clientmanager.Docker
+	Registries    *RegistryCredentials
+
+	// stackLocks serializes changes to each stack
+	stackLocks stackLocks
 }
 
 // NewDockerService creates a new DockerService with dependency injection
-func NewDockerService(dispatcher *utils.Dispatcher, logger *slog.Logger) *DockerService {
+func NewDockerService(db *database.Service, dispatcher *utils.Dispatcher, logger *slog.Logger) *DockerService {
 	service := &DockerService{
+		db:            db,
 		Dispatcher:    dispatcher.WithGroup("docker"),
 		Logger:        logger.WithGroup("docker"),
 		ClientManager: clientmanager.NewDockerClientManager(dispatcher, logger),
+		Registries:    NewRegistryCredentials(db, logger.WithGroup("docker")),
 	}
-	service.ClientManager.InitializeDockerClients()
-	service.ClientManager.InitilizeDefaultDockerClient()
+	service.initializeDockerHosts()
 	return service
 }
 
@@ -165,55 +167,6 @@ func (s *DockerService) ContainerStatsStream(c echo.Context) error {
 	return c.Stream(http.StatusOK, "application/json", stats.Body)
 }
 
-// ContainerLogs returns container logs
-func (s *DockerService) ContainerLogs(c echo.Context) error {
-	ctx := c.Request().Context()
-	containerID := c.Param("id")
-
-	cli, err := s.ClientManager.GetClient(c)
-	if err != nil {
-		return err
-	}
-
-	logs, err := cli.ContainerLogs(ctx, containerID, container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Timestamps: true,
-		Follow:     false,
-	})
-	if err != nil {
-		return s.Dispatcher.NewInternalServerError("Failed to get container logs", err)
-	}
-	defer logs.Close()
-
-	c.Response().Header().Set(echo.HeaderContentType, "text/plain")
-	return c.Stream(http.StatusOK, "text/plain", logs)
-}
-
-// CreateContainer creates a new container
-func (s *DockerService) CreateContainer(c echo.Context) error {
-	ctx := c.Request().Context()
-
-	cli, err := s.ClientManager.GetClient(c)
-	if err != nil {
-		return err
-	}
-
-	var config container.Config
-	if err := c.Bind(&config); err != nil {
-		return s.Dispatcher.NewInternalServerError("Failed to bind request", err)
-	}
-
-	containerName := c.QueryParam("name")
-
-	resp, err := cli.ContainerCreate(ctx, &config, nil, nil, nil, containerName)
-	if err != nil {
-		return s.Dispatcher.NewInternalServerError("Failed to create container", err)
-	}
-
-	return c.JSON(http.StatusCreated, resp)
-}
-
 // StartContainer starts a container
 func (s *DockerService) StartContainer(c echo.Context) error {
 	ctx := c.Request().Context()
@@ -0,0 +1,885 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"visory/internal/database/dockerstacks"
+	"visory/internal/models"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo/v4"
+)
+
+// stackState is what exists on a host for a stack, found by its labels
+type stackState struct {
+	// containers by service
+	containers map[string][]container.Summary
+	networks   map[string]network.Summary
+	volumes    map[string]*volume.Volume
+}
+
+// stackLocks holds a lock per stack, so a slow deploy only holds back
+// changes to the same stack
+type stackLocks struct {
+	mu    sync.Mutex
+	locks map[stackKey]*stackLock
+}
+
+type stackKey struct {
+	clientID int64
+	name     string
+}
+
+type stackLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks the stack called name of a client and returns its unlock
+func (l *stackLocks) lock(clientID int64, name string) func() {
+	key := stackKey{clientID: clientID, name: name}
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[stackKey]*stackLock{}
+	}
+	sl, ok := l.locks[key]
+	if !ok {
+		sl = &stackLock{}
+		l.locks[key] = sl
+	}
+	sl.waiters++
+	l.mu.Unlock()
+
+	sl.Lock()
+	return func() {
+		sl.Unlock()
+		l.mu.Lock()
+		if sl.waiters--; sl.waiters == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+//	@Summary      List stacks
+//	@Description  List the Compose stacks deployed on a Docker client, with how many of their services are running
+//	@Tags         docker
+//	@Param        clientid  path  int  true  "Docker client ID"
+//	@Produce      json
+//	@Success      200  {array}   models.Stack
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/stacks [get]
+//
+// ListStacks returns the stacks of a Docker client
+func (s *DockerService) ListStacks(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	clientID, err := strconv.ParseInt(c.Param("clientid"), 10, 64)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid client ID", err)
+	}
+
+	stored, err := s.db.DockerStack.ListDockerStacks(ctx, clientID)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to list stacks", err)
+	}
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel)),
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to list containers", err)
+	}
+	byProject := map[string][]container.Summary{}
+	for _, ctr := range containers {
+		project := ctr.Labels[composeProjectLabel]
+		byProject[project] = append(byProject[project], ctr)
+	}
+
+	stacks := make([]models.Stack, 0, len(stored))
+	for _, st := range stored {
+		state := stackState{containers: map[string][]container.Summary{}}
+		for _, ctr := range byProject[st.Name] {
+			svc := ctr.Labels[composeServiceLabel]
+			state.containers[svc] = append(state.containers[svc], ctr)
+		}
+		stack, _ := s.stackDetails(st, state)
+		stacks = append(stacks, stack.Stack)
+	}
+	return c.JSON(http.StatusOK, stacks)
+}
+
+//	@Summary      Get stack
+//	@Description  Get a stack with its Compose definition, the containers of its services, and its networks and volumes
+//	@Tags         docker
+//	@Param        clientid  path  int     true  "Docker client ID"
+//	@Param        name      path  string  true  "Stack name"
+//	@Produce      json
+//	@Success      200  {object}  models.StackDetails
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/stacks/{name} [get]
+//
+// GetStack returns a stack
+func (s *DockerService) GetStack(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	stored, err := s.stackFromParam(c)
+	if err != nil {
+		return err
+	}
+	state, err := s.stackState(ctx, cli, stored.Name)
+	if err != nil {
+		return err
+	}
+	details, _ := s.stackDetails(stored, state)
+	return c.JSON(http.StatusOK, details)
+}
+
+//	@Summary      Deploy stack
+//	@Description  Deploy a Compose file, with an optional .env content for its variables. Networks, volumes and containers are created and labeled with the stack name, and images are pulled per pull_policy
+//	@Tags         docker
+//	@Accept       json
+//	@Param        clientid  path  int                  true  "Docker client ID"
+//	@Param        body      body  models.StackRequest  true  "Compose project"
+//	@Produce      json
+//	@Success      201  {object}  models.StackDeployResponse
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/stacks [post]
+//
+// DeployStack deploys a new stack
+func (s *DockerService) DeployStack(c echo.Context) error {
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	clientID, err := strconv.ParseInt(c.Param("clientid"), 10, 64)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid client ID", err)
+	}
+	req := new(models.StackRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	project, err := loadStack(strings.TrimSpace(req.Name), req.Compose, req.Env)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+	if err := s.checkStackHostAccess(c, project); err != nil {
+		return err
+	}
+
+	defer s.stackLocks.lock(clientID, project.Name)()
+
+	// The deploy goes on when the client disconnects, so the stack is not
+	// left half created. Pulls easily outlast the write timeout
+	ctx := context.WithoutCancel(c.Request().Context())
+	clearWriteDeadline(c)
+	_, err = s.db.DockerStack.GetDockerStack(ctx, dockerstacks.GetDockerStackParams{ClientID: clientID, Name: project.Name})
+	switch {
+	case err == nil:
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Stack '%s' already exists", project.Name), nil)
+	case !errors.Is(err, sql.ErrNoRows):
+		return s.Dispatcher.NewInternalServerError("Failed to fetch stack", err)
+	}
+
+	if err := s.checkStackExternals(ctx, cli, project); err != nil {
+		return err
+	}
+
+	// The definition is saved before the deploy, a stack that fails to
+	// deploy can then be fixed or removed as a whole
+	stored, err := s.db.DockerStack.CreateDockerStack(ctx, dockerstacks.CreateDockerStackParams{
+		ClientID: clientID,
+		Name:     project.Name,
+		Compose:  req.Compose,
+		Env:      optionalString(req.Env),
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to save stack", err)
+	}
+
+	changes, err := s.deployStack(ctx, cli, project, false)
+	s.logStackEvent(c, "DOCKER_STACK_DEPLOY", stored, "stack deployed", changes, err)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, models.StackDeployResponse{Name: project.Name, Changes: changes})
+}
+
+//	@Summary      Update stack
+//	@Description  Re-deploy a stack with a new Compose file and .env content. Services whose configuration or image changed are recreated, removed services and networks are deleted, volumes are kept. With dry_run, the changes are only listed
+//	@Tags         docker
+//	@Accept       json
+//	@Param        clientid  path   int                  true   "Docker client ID"
+//	@Param        name      path   string               true   "Stack name"
+//	@Param        dry_run   query  bool                 false  "List the changes without applying them"
+//	@Param        body      body   models.StackRequest  true   "Compose project"
+//	@Produce      json
+//	@Success      200  {object}  models.StackDeployResponse
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/stacks/{name} [put]
+//
+// UpdateStack re-deploys a stack
+func (s *DockerService) UpdateStack(c echo.Context) error {
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	dryRun := false
+	if v := c.QueryParam("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return s.Dispatcher.NewBadRequest("Invalid dry_run value", err)
+		}
+	}
+	stored, err := s.stackFromParam(c)
+	if err != nil {
+		return err
+	}
+	req := new(models.StackRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	project, err := loadStack(stored.Name, req.Compose, req.Env)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+	if err := s.checkStackHostAccess(c, project); err != nil {
+		return err
+	}
+
+	defer s.stackLocks.lock(stored.ClientID, stored.Name)()
+
+	ctx := context.WithoutCancel(c.Request().Context())
+	clearWriteDeadline(c)
+	// A definition the host cannot deploy is not saved
+	if err := s.checkStackExternals(ctx, cli, project); err != nil {
+		return err
+	}
+	if dryRun {
+		changes, err := s.deployStack(ctx, cli, project, true)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, models.StackDeployResponse{Name: project.Name, DryRun: true, Changes: changes})
+	}
+
+	stored, err = s.db.DockerStack.UpdateDockerStack(ctx, dockerstacks.UpdateDockerStackParams{
+		Compose: req.Compose,
+		Env:     optionalString(req.Env),
+		ID:      stored.ID,
+	})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to save stack", err)
+	}
+
+	changes, err := s.deployStack(ctx, cli, project, false)
+	s.logStackEvent(c, "DOCKER_STACK_UPDATE", stored, "stack updated", changes, err)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, models.StackDeployResponse{Name: project.Name, Changes: changes})
+}
+
+//	@Summary      Start stack
+//	@Description  Start the containers of a stack, dependencies first
+//	@Tags         docker
+//	@Param        clientid  path  int     true  "Docker client ID"
+//	@Param        name      path  string  true  "Stack name"
+//	@Produce      json
+//	@Success      200  {object}  map[string]string
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/stacks/{name}/start [post]
+//
+// StartStack starts a stack
+func (s *DockerService) StartStack(c echo.Context) error {
+	return s.setStackRunning(c, true)
+}
+
+//	@Summary      Stop stack
+//	@Description  Stop the containers of a stack, dependents first. Nothing is removed
+//	@Tags         docker
+//	@Param        clientid  path  int     true  "Docker client ID"
+//	@Param        name      path  string  true  "Stack name"
+//	@Produce      json
+//	@Success      200  {object}  map[string]string
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/stacks/{name}/stop [post]
+//
+// StopStack stops a stack
+func (s *DockerService) StopStack(c echo.Context) error {
+	return s.setStackRunning(c, false)
+}
+
+func (s *DockerService) setStackRunning(c echo.Context, running bool) error {
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	stored, err := s.stackFromParam(c)
+	if err != nil {
+		return err
+	}
+
+	defer s.stackLocks.lock(stored.ClientID, stored.Name)()
+
+	ctx := context.WithoutCancel(c.Request().Context())
+	state, err := s.stackState(ctx, cli, stored.Name)
+	if err != nil {
+		return err
+	}
+	order := stackServiceOrder(stored, state)
+	verb, done := "start", "started"
+	if !running {
+		verb, done = "stop", "stopped"
+		slices.Reverse(order)
+	}
+	for _, svc := range order {
+		for _, ctr := range state.containers[svc] {
+			var err error
+			if running && ctr.State != container.StateRunning {
+				err = cli.ContainerStart(ctx, ctr.ID, container.StartOptions{})
+			} else if !running && ctr.State == container.StateRunning {
+				err = cli.ContainerStop(ctx, ctr.ID, container.StopOptions{})
+			}
+			if err != nil {
+				return s.Dispatcher.NewInternalServerError(fmt.Sprintf("Failed to %s service '%s'", verb, svc), err)
+			}
+		}
+	}
+
+	s.logStackEvent(c, "DOCKER_STACK_"+strings.ToUpper(verb), stored, "stack "+done, nil, nil)
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Stack '%s' %s successfully", stored.Name, done),
+	})
+}
+
+//	@Summary      Remove stack
+//	@Description  Remove the containers and networks of a stack, and its definition. Named volumes are kept unless volumes is set
+//	@Tags         docker
+//	@Param        clientid  path   int     true   "Docker client ID"
+//	@Param        name      path   string  true   "Stack name"
+//	@Param        volumes   query  bool    false  "Remove the volumes of the stack too"
+//	@Produce      json
+//	@Success      200  {object}  map[string]string
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/stacks/{name} [delete]
+//
+// DeleteStack removes a stack
+func (s *DockerService) DeleteStack(c echo.Context) error {
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	removeVolumes := false
+	if v := c.QueryParam("volumes"); v != "" {
+		if removeVolumes, err = strconv.ParseBool(v); err != nil {
+			return s.Dispatcher.NewBadRequest("Invalid volumes value", err)
+		}
+	}
+	stored, err := s.stackFromParam(c)
+	if err != nil {
+		return err
+	}
+
+	defer s.stackLocks.lock(stored.ClientID, stored.Name)()
+
+	ctx := context.WithoutCancel(c.Request().Context())
+	state, err := s.stackState(ctx, cli, stored.Name)
+	if err != nil {
+		return err
+	}
+	order := stackServiceOrder(stored, state)
+	slices.Reverse(order)
+	for _, svc := range order {
+		for _, ctr := range state.containers[svc] {
+			if err := cli.ContainerRemove(ctx, ctr.ID, container.RemoveOptions{Force: true, RemoveVolumes: true}); err != nil && !cerrdefs.IsNotFound(err) {
+				return s.Dispatcher.NewInternalServerError(fmt.Sprintf("Failed to remove service '%s'", svc), err)
+			}
+		}
+	}
+	for _, name := range sortedKeys(state.networks) {
+		if err := cli.NetworkRemove(ctx, state.networks[name].ID); err != nil && !cerrdefs.IsNotFound(err) {
+			return s.Dispatcher.NewInternalServerError(fmt.Sprintf("Failed to remove network '%s'", name), err)
+		}
+	}
+	if removeVolumes {
+		for _, name := range sortedKeys(state.volumes) {
+			if err := cli.VolumeRemove(ctx, name, false); err != nil && !cerrdefs.IsNotFound(err) {
+				return s.Dispatcher.NewInternalServerError(fmt.Sprintf("Failed to remove volume '%s'", name), err)
+			}
+		}
+	}
+	if err := s.db.DockerStack.DeleteDockerStack(ctx, stored.ID); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to delete stack", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_STACK_DELETE", Subject: stored.Name, Level: "INFO",
+		Message: "stack removed", Fields: map[string]string{
+			"Client":  c.Param("clientid"),
+			"Volumes": strconv.FormatBool(removeVolumes),
+		},
+	})
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Stack '%s' removed successfully", stored.Name),
+	})
+}
+
+// checkStackHostAccess refuses services that get root on the Docker host
+// unless the caller may have it, as for containers created one by one
+func (s *DockerService) checkStackHostAccess(c echo.Context, p *stackProject) error {
+	if hasPolicy(c, models.RBAC_DOCKER_EXEC) {
+		return nil
+	}
+	for _, svc := range p.Services {
+		if access := hostAccess(&svc.HostConfig); len(access) > 0 {
+			return s.Dispatcher.NewForbidden(fmt.Sprintf("Service '%s' uses %s, which requires the docker_exec policy", svc.Name, strings.Join(access, ", ")), nil)
+		}
+	}
+	return nil
+}
+
+// checkStackExternals checks that the external networks and volumes of a
+// project exist on the host
+func (s *DockerService) checkStackExternals(ctx context.Context, cli *client.Client, p *stackProject) error {
+	for _, n := range p.Networks {
+		if !n.External {
+			continue
+		}
+		if _, err := cli.NetworkInspect(ctx, n.Name, network.InspectOptions{}); err != nil {
+			if cerrdefs.IsNotFound(err) {
+				return s.Dispatcher.NewBadRequest(fmt.Sprintf("External network '%s' does not exist", n.Name), err)
+			}
+			return s.Dispatcher.NewInternalServerError("Failed to inspect network", err)
+		}
+	}
+	for _, v := range p.Volumes {
+		if !v.External {
+			continue
+		}
+		if _, err := cli.VolumeInspect(ctx, v.Name); err != nil {
+			if cerrdefs.IsNotFound(err) {
+				return s.Dispatcher.NewBadRequest(fmt.Sprintf("External volume '%s' does not exist", v.Name), err)
+			}
+			return s.Dispatcher.NewInternalServerError("Failed to inspect volume", err)
+		}
+	}
+	return nil
+}
+
+// deployStack brings the resources of a stack on the host in line with its
+// project and returns the changes made. The external resources are checked
+// first with checkStackExternals. With dryRun, the changes are only
+// computed, images are not pulled so an image update is not reported
+func (s *DockerService) deployStack(ctx context.Context, cli *client.Client, p *stackProject, dryRun bool) ([]models.StackChange, error) {
+	if !dryRun {
+		pulled := map[string]bool{}
+		for _, svc := range p.Services {
+			ref := svc.Config.Image
+			if pulled[ref] || svc.Pull == models.PullNever {
+				continue
+			}
+			if svc.Pull == models.PullMissing {
+				if _, err := cli.ImageInspect(ctx, ref); err == nil {
+					continue
+				} else if !cerrdefs.IsNotFound(err) {
+					return nil, s.Dispatcher.NewInternalServerError("Failed to inspect image", err)
+				}
+			}
+			s.Logger.Info("Pulling image", "stack", p.Name, "service", svc.Name, "image", ref)
+			if err := s.Registries.Pull(ctx, cli, ref, image.PullOptions{}, nil); err != nil {
+				return nil, s.Dispatcher.NewInternalServerError(fmt.Sprintf("Failed to pull image of service '%s'", svc.Name), err)
+			}
+			pulled[ref] = true
+		}
+	}
+
+	state, err := s.stackState(ctx, cli, p.Name)
+	if err != nil {
+		return nil, err
+	}
+	imageIDs := map[string]string{}
+	for _, svc := range p.Services {
+		if _, ok := imageIDs[svc.Config.Image]; ok {
+			continue
+		}
+		// An image missing locally is not compared, it is pulled on deploy
+		if img, err := cli.ImageInspect(ctx, svc.Config.Image); err == nil {
+			imageIDs[svc.Config.Image] = img.ID
+		} else {
+			imageIDs[svc.Config.Image] = ""
+		}
+	}
+	changes := planStack(p, state, imageIDs)
+	if dryRun {
+		return changes, nil
+	}
+
+	services := map[string]stackService{}
+	for _, svc := range p.Services {
+		services[svc.Name] = svc
+	}
+	for _, ch := range changes {
+		if ch.Type == models.StackResourceService && ch.Action == models.StackChangeRemove {
+			if err := removeContainers(ctx, cli, state.containers[ch.Name]); err != nil {
+				return changes, s.Dispatcher.NewInternalServerError(fmt.Sprintf("Failed to remove service '%s'", ch.Name), err)
+			}
+		}
+	}
+	for _, ch := range changes {
+		var err error
+		switch {
+		case ch.Action != models.StackChangeCreate:
+		case ch.Type == models.StackResourceNetwork:
+			n := slices.IndexFunc(p.Networks, func(n stackNetwork) bool { return n.Name == ch.Name })
+			_, err = cli.NetworkCreate(ctx, ch.Name, p.Networks[n].Options)
+		case ch.Type == models.StackResourceVolume:
+			v := slices.IndexFunc(p.Volumes, func(v stackVolume) bool { return v.Name == ch.Name })
+			_, err = cli.VolumeCreate(ctx, p.Volumes[v].Options)
+		}
+		if err != nil {
+			return changes, s.Dispatcher.NewInternalServerError(fmt.Sprintf("Failed to create %s '%s'", ch.Type, ch.Name), err)
+		}
+	}
+	for _, ch := range changes {
+		if ch.Type != models.StackResourceService || ch.Action == models.StackChangeRemove {
+			continue
+		}
+		svc := services[ch.Name]
+		var err error
+		switch ch.Action {
+		case models.StackChangeRecreate:
+			if err = removeContainers(ctx, cli, state.containers[svc.Name]); err == nil {
+				err = createStackContainer(ctx, cli, svc)
+			}
+		case models.StackChangeCreate:
+			err = createStackContainer(ctx, cli, svc)
+		case models.StackChangeKeep:
+			for _, ctr := range state.containers[svc.Name] {
+				if ctr.State != container.StateRunning {
+					err = errors.Join(err, cli.ContainerStart(ctx, ctr.ID, container.StartOptions{}))
+				}
+			}
+		}
+		if err != nil {
+			if cerrdefs.IsConflict(err) {
+				return changes, s.Dispatcher.NewConflict(fmt.Sprintf("Container name '%s' of service '%s' is already in use", svc.ContainerName, svc.Name), err)
+			}
+			return changes, s.Dispatcher.NewInternalServerError(fmt.Sprintf("Failed to deploy service '%s'", svc.Name), err)
+		}
+	}
+	for _, ch := range changes {
+		if ch.Type == models.StackResourceNetwork && ch.Action == models.StackChangeRemove {
+			// A network still used by a container outside the stack stays
+			if err := cli.NetworkRemove(ctx, state.networks[ch.Name].ID); err != nil {
+				s.Logger.Warn("Failed to remove stack network", "stack", p.Name, "network", ch.Name, "error", err)
+			}
+		}
+	}
+	s.Logger.Info("Stack deployed", "stack", p.Name, "changes", len(changes))
+	return changes, nil
+}
+
+// planStack lists the changes that bring a host from state to the project.
+// imageIDs holds the local ID of the image of each service, a container
+// running another image is recreated
+func planStack(p *stackProject, state stackState, imageIDs map[string]string) []models.StackChange {
+	changes := []models.StackChange{}
+	planned := map[string]bool{}
+	for _, n := range p.Networks {
+		if n.External {
+			continue
+		}
+		planned[n.Name] = true
+		action := models.StackChangeCreate
+		if _, ok := state.networks[n.Name]; ok {
+			action = models.StackChangeKeep
+		}
+		changes = append(changes, models.StackChange{Type: models.StackResourceNetwork, Name: n.Name, Action: action})
+	}
+	for _, name := range sortedKeys(state.networks) {
+		if !planned[name] {
+			changes = append(changes, models.StackChange{Type: models.StackResourceNetwork, Name: name, Action: models.StackChangeRemove})
+		}
+	}
+	// Volumes left out of the project are kept, they may hold data
+	for _, v := range p.Volumes {
+		if v.External {
+			continue
+		}
+		action := models.StackChangeCreate
+		if _, ok := state.volumes[v.Name]; ok {
+			action = models.StackChangeKeep
+		}
+		changes = append(changes, models.StackChange{Type: models.StackResourceVolume, Name: v.Name, Action: action})
+	}
+
+	services := map[string]bool{}
+	for _, svc := range p.Services {
+		services[svc.Name] = true
+		change := models.StackChange{Type: models.StackResourceService, Name: svc.Name, Action: models.StackChangeKeep}
+		containers := state.containers[svc.Name]
+		switch {
+		case len(containers) == 0:
+			change.Action = models.StackChangeCreate
+		case len(containers) > 1:
+			change.Action, change.Reason = models.StackChangeRecreate, "service has several containers"
+		case containers[0].Labels[composeHashLabel] != svc.Hash:
+			change.Action, change.Reason = models.StackChangeRecreate, "configuration changed"
+		case imageIDs[svc.Config.Image] != "" && containers[0].ImageID != imageIDs[svc.Config.Image]:
+			change.Action, change.Reason = models.StackChangeRecreate, "image updated"
+		}
+		changes = append(changes, change)
+	}
+	for _, name := range sortedKeys(state.containers) {
+		if !services[name] {
+			changes = append(changes, models.StackChange{Type: models.StackResourceService, Name: name, Action: models.StackChangeRemove})
+		}
+	}
+	return changes
+}
+
+// createStackContainer creates and starts the container of a service. The
+// daemon attaches a single network at creation, others are connected after
+func createStackContainer(ctx context.Context, cli *client.Client, svc stackService) error {
+	var networking *network.NetworkingConfig
+	if len(svc.Networks) > 0 {
+		first := svc.Networks[0].Settings
+		networking = &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{
+			svc.Networks[0].Network: &first,
+		}}
+	}
+	config, hostConfig := svc.Config, svc.HostConfig
+	resp, err := cli.ContainerCreate(ctx, &config, &hostConfig, networking, nil, svc.ContainerName)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range svc.Networks[min(1, len(svc.Networks)):] {
+		settings := endpoint.Settings
+		if err := cli.NetworkConnect(ctx, endpoint.Network, resp.ID, &settings); err != nil {
+			return err
+		}
+	}
+	return cli.ContainerStart(ctx, resp.ID, container.StartOptions{})
+}
+
+func removeContainers(ctx context.Context, cli *client.Client, containers []container.Summary) error {
+	for _, ctr := range containers {
+		if err := cli.ContainerRemove(ctx, ctr.ID, container.RemoveOptions{Force: true}); err != nil && !cerrdefs.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// stackState finds the containers, networks and volumes of a stack
+func (s *DockerService) stackState(ctx context.Context, cli *client.Client, name string) (stackState, error) {
+	state := stackState{
+		containers: map[string][]container.Summary{},
+		networks:   map[string]network.Summary{},
+		volumes:    map[string]*volume.Volume{},
+	}
+	label := filters.NewArgs(filters.Arg("label", composeProjectLabel+"="+name))
+
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true, Filters: label})
+	if err != nil {
+		return state, s.Dispatcher.NewInternalServerError("Failed to list stack containers", err)
+	}
+	for _, ctr := range containers {
+		svc := ctr.Labels[composeServiceLabel]
+		state.containers[svc] = append(state.containers[svc], ctr)
+	}
+	networks, err := cli.NetworkList(ctx, network.ListOptions{Filters: label})
+	if err != nil {
+		return state, s.Dispatcher.NewInternalServerError("Failed to list stack networks", err)
+	}
+	for _, n := range networks {
+		state.networks[n.Name] = n
+	}
+	volumes, err := cli.VolumeList(ctx, volume.ListOptions{Filters: label})
+	if err != nil {
+		return state, s.Dispatcher.NewInternalServerError("Failed to list stack volumes", err)
+	}
+	for _, v := range volumes.Volumes {
+		state.volumes[v.Name] = v
+	}
+	return state, nil
+}
+
+// stackDetails describes a stored stack from what runs on the host. The
+// error is that of the stored definition, which is still described
+func (s *DockerService) stackDetails(stored dockerstacks.DockerStack, state stackState) (models.StackDetails, error) {
+	details := models.StackDetails{
+		Stack: models.Stack{
+			ID:        stored.ID,
+			ClientID:  stored.ClientID,
+			Name:      stored.Name,
+			CreatedAt: stored.CreatedAt,
+			UpdatedAt: stored.UpdatedAt,
+		},
+		Compose:  stored.Compose,
+		Services: []models.StackService{},
+		Networks: sortedKeys(state.networks),
+		Volumes:  sortedKeys(state.volumes),
+	}
+	if stored.Env != nil {
+		details.Env = *stored.Env
+	}
+
+	project, err := loadStack(stored.Name, stored.Compose, details.Env)
+	var services []stackService
+	if project != nil {
+		services = project.Services
+	}
+	for _, svc := range services {
+		info := models.StackService{Name: svc.Name, Image: svc.Config.Image}
+		if containers := state.containers[svc.Name]; len(containers) > 0 {
+			ctr := containers[0]
+			info.ContainerID = ctr.ID
+			if len(ctr.Names) > 0 {
+				info.ContainerName = strings.TrimPrefix(ctr.Names[0], "/")
+			}
+			info.State, info.Status = string(ctr.State), ctr.Status
+			if ctr.State == container.StateRunning {
+				details.Running++
+			}
+		}
+		details.Services = append(details.Services, info)
+	}
+	details.ServiceCount = len(details.Services)
+
+	switch {
+	case details.Running > 0 && details.Running == details.ServiceCount:
+		details.Status = models.StackRunning
+	case details.Running > 0:
+		details.Status = models.StackPartial
+	default:
+		details.Status = models.StackStopped
+	}
+	return details, err
+}
+
+// stackServiceOrder lists the services of a stack in start order, followed
+// by those found on the host only
+func stackServiceOrder(stored dockerstacks.DockerStack, state stackState) []string {
+	env := ""
+	if stored.Env != nil {
+		env = *stored.Env
+	}
+	var order []string
+	if project, err := loadStack(stored.Name, stored.Compose, env); err == nil {
+		for _, svc := range project.Services {
+			order = append(order, svc.Name)
+		}
+	}
+	for _, name := range sortedKeys(state.containers) {
+		if !slices.Contains(order, name) {
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+func (s *DockerService) stackFromParam(c echo.Context) (dockerstacks.DockerStack, error) {
+	clientID, err := strconv.ParseInt(c.Param("clientid"), 10, 64)
+	if err != nil {
+		return dockerstacks.DockerStack{}, s.Dispatcher.NewBadRequest("Invalid client ID", err)
+	}
+	stack, err := s.db.DockerStack.GetDockerStack(c.Request().Context(), dockerstacks.GetDockerStackParams{
+		ClientID: clientID,
+		Name:     c.Param("name"),
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return dockerstacks.DockerStack{}, s.Dispatcher.NewNotFound("Stack not found", err)
+		}
+		return dockerstacks.DockerStack{}, s.Dispatcher.NewInternalServerError("Failed to fetch stack", err)
+	}
+	return stack, nil
+}
+
+// logStackEvent records a change of a stack in the audit log, with the
+// number of resources changed and the error of a failed deploy
+func (s *DockerService) logStackEvent(c echo.Context, event string, stored dockerstacks.DockerStack, message string, changes []models.StackChange, err error) {
+	fields := map[string]string{"Client": c.Param("clientid")}
+	counts := map[string]int{}
+	for _, ch := range changes {
+		counts[ch.Action]++
+	}
+	for action, n := range counts {
+		if action != models.StackChangeKeep {
+			fields[strings.ToUpper(action[:1])+action[1:]] = strconv.Itoa(n)
+		}
+	}
+	level := "INFO"
+	if err != nil {
+		level, message = "ERROR", message+" with errors"
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			fields["Error"] = fmt.Sprint(httpErr.Message)
+		} else {
+			fields["Error"] = err.Error()
+		}
+	}
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: event, Subject: stored.Name, Level: level,
+		Message: message, Fields: fields,
+	})
+}
+
+// optionalString returns nil for an empty string
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,298 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"visory/internal/models"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCompose = `
+name: blog
+services:
+  web:
+    image: nginx:${NGINX_TAG:-1.27}
+    ports:
+      - "${WEB_PORT}:80"
+      - target: 443
+        published: "8443"
+    depends_on:
+      app:
+        condition: service_healthy
+    networks: [front, back]
+    restart: unless-stopped
+  app:
+    image: ghost:5
+    command: node index.js --title "My blog"
+    environment:
+      database__client: mysql
+      database__connection__password: $DB_PASSWORD
+      PRICE: $$5
+    volumes:
+      - content:/var/lib/ghost/content
+      - /etc/localtime:/etc/localtime:ro
+      - type: tmpfs
+        target: /tmp
+    depends_on: [db]
+    networks:
+      back:
+        aliases: [ghost]
+    mem_limit: 512m
+    cpus: 0.5
+  db:
+    image: mysql:8
+    networks: [back]
+    healthcheck:
+      test: mysqladmin ping
+      interval: 10s
+      retries: 3
+networks:
+  front:
+  back:
+    ipam:
+      config:
+        - subnet: 172.28.0.0/16
+volumes:
+  content:
+`
+
+const testEnv = `
+WEB_PORT=8080
+DB_PASSWORD="s3cret"
+`
+
+// TestLoadStack tests that a Compose file resolves into labeled resources
+// started in dependency order
+func TestLoadStack(t *testing.T) {
+	p, err := loadStack("", testCompose, testEnv)
+	require.NoError(t, err)
+	assert.Equal(t, "blog", p.Name)
+
+	var order []string
+	for _, svc := range p.Services {
+		order = append(order, svc.Name)
+	}
+	assert.Equal(t, []string{"db", "app", "web"}, order)
+
+	db, app, web := p.Services[0], p.Services[1], p.Services[2]
+	assert.Equal(t, "nginx:1.27", web.Config.Image)
+	assert.Equal(t, "blog-web-1", web.ContainerName)
+	assert.Equal(t, models.PullMissing, web.Pull)
+	assert.Equal(t, []nat.PortBinding{{HostPort: "8080"}}, web.HostConfig.PortBindings["80/tcp"])
+	assert.Equal(t, []nat.PortBinding{{HostPort: "8443"}}, web.HostConfig.PortBindings["443/tcp"])
+	assert.Equal(t, container.RestartPolicyUnlessStopped, web.HostConfig.RestartPolicy.Name)
+	require.Len(t, web.Networks, 2)
+	assert.Equal(t, "blog_back", web.Networks[0].Network)
+	assert.Equal(t, "blog_front", web.Networks[1].Network)
+	assert.Equal(t, container.NetworkMode("blog_back"), web.HostConfig.NetworkMode)
+
+	assert.Equal(t, []string{"node", "index.js", "--title", "My blog"}, []string(app.Config.Cmd))
+	assert.Equal(t, []string{"PRICE=$5", "database__client=mysql", "database__connection__password=s3cret"}, app.Config.Env)
+	assert.Equal(t, []string{"blog_content:/var/lib/ghost/content", "/etc/localtime:/etc/localtime:ro"}, app.HostConfig.Binds)
+	assert.Equal(t, []mount.Mount{{Type: mount.TypeTmpfs, Target: "/tmp"}}, app.HostConfig.Mounts)
+	assert.Equal(t, int64(512*1024*1024), app.HostConfig.Memory)
+	assert.Equal(t, int64(5e8), app.HostConfig.NanoCPUs)
+	assert.Equal(t, []string{"app", "ghost"}, app.Networks[0].Settings.Aliases)
+
+	assert.Equal(t, []string{"CMD-SHELL", "mysqladmin ping"}, db.Config.Healthcheck.Test)
+	assert.Equal(t, 3, db.Config.Healthcheck.Retries)
+
+	for _, svc := range p.Services {
+		assert.Equal(t, "blog", svc.Config.Labels[composeProjectLabel])
+		assert.Equal(t, svc.Name, svc.Config.Labels[composeServiceLabel])
+		assert.Equal(t, svc.Hash, svc.Config.Labels[composeHashLabel])
+	}
+
+	require.Len(t, p.Networks, 2)
+	assert.Equal(t, "blog_back", p.Networks[0].Name)
+	assert.Equal(t, "172.28.0.0/16", p.Networks[0].Options.IPAM.Config[0].Subnet)
+	assert.Equal(t, "blog", p.Networks[0].Options.Labels[composeProjectLabel])
+	require.Len(t, p.Volumes, 1)
+	assert.Equal(t, "blog_content", p.Volumes[0].Options.Name)
+	assert.Equal(t, "content", p.Volumes[0].Options.Labels[composeVolumeLabel])
+
+	// The hash only changes with the configuration
+	again, err := loadStack("blog", testCompose, testEnv)
+	require.NoError(t, err)
+	assert.Equal(t, web.Hash, again.Services[2].Hash)
+	changed, err := loadStack("blog", testCompose, testEnv+"WEB_PORT=9090\n")
+	require.NoError(t, err)
+	assert.NotEqual(t, web.Hash, changed.Services[2].Hash)
+	assert.Equal(t, app.Hash, changed.Services[1].Hash)
+}
+
+// TestLoadStackDefaults tests the default network and external resources
+func TestLoadStackDefaults(t *testing.T) {
+	p, err := loadStack("Demo", "services:\n  web:\n    image: nginx\n", "")
+	assert.Error(t, err, "uppercase names are rejected")
+	assert.Nil(t, p)
+
+	p, err = loadStack("demo", `
+services:
+  web:
+    image: nginx
+  cache:
+    image: redis
+    networks: [shared]
+    volumes: [data:/data]
+networks:
+  shared:
+    external: true
+volumes:
+  data:
+    name: redis-data
+`, "")
+	require.NoError(t, err)
+	assert.Equal(t, "demo_default", p.Services[1].Networks[0].Network)
+	assert.Equal(t, "shared", p.Services[0].Networks[0].Network)
+	require.Len(t, p.Networks, 2)
+	assert.Equal(t, "demo_default", p.Networks[0].Name)
+	assert.True(t, p.Networks[1].External)
+	assert.Equal(t, "redis-data", p.Volumes[0].Name)
+	assert.Equal(t, []string{"redis-data:/data"}, p.Services[0].HostConfig.Binds)
+}
+
+// TestLoadStackInvalid tests that definitions the host cannot run are
+// rejected before anything is created
+func TestLoadStackInvalid(t *testing.T) {
+	invalid := map[string]string{
+		"empty":              "",
+		"no service":         "name: x\nservices: {}\n",
+		"no image":           "services:\n  web:\n    restart: always\n",
+		"build":              "services:\n  web:\n    build: .\n",
+		"undefined network":  "services:\n  web:\n    image: nginx\n    networks: [front]\n",
+		"undefined volume":   "services:\n  web:\n    image: nginx\n    volumes: [data:/data]\n",
+		"relative bind":      "services:\n  web:\n    image: nginx\n    volumes: [./html:/usr/share/nginx/html]\n",
+		"relative target":    "services:\n  web:\n    image: nginx\n    volumes: [/srv:html]\n",
+		"missing dependency": "services:\n  web:\n    image: nginx\n    depends_on: [db]\n",
+		"cycle":              "services:\n  a:\n    image: x\n    depends_on: [b]\n  b:\n    image: x\n    depends_on: [a]\n",
+		"restart":            "services:\n  web:\n    image: nginx\n    restart: sometimes\n",
+		"port":               "services:\n  web:\n    image: nginx\n    ports: [\"web:80\"]\n",
+		"required variable":  "services:\n  web:\n    image: nginx:${TAG:?must be set}\n",
+		"unclosed variable":  "services:\n  web:\n    image: nginx:${TAG\n",
+		"pull policy":        "services:\n  web:\n    image: nginx\n    pull_policy: build\n",
+		"unclosed quote":     "services:\n  web:\n    image: nginx\n    command: echo \"hi\n",
+	}
+	for name, compose := range invalid {
+		_, err := loadStack("test", compose, "")
+		assert.Error(t, err, name)
+	}
+}
+
+// TestInterpolate tests the variable forms of Compose files
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"SET": "value", "EMPTY": ""}
+	for in, want := range map[string]string{
+		"$SET and ${SET}":        "value and value",
+		"${UNSET:-default}":      "default",
+		"${EMPTY:-default}":      "default",
+		"${EMPTY-default}":       "",
+		"${SET:+alt}":            "alt",
+		"${UNSET+alt}":           "",
+		"${UNSET:-${SET}}":       "value",
+		"$$SET costs $$5":        "$SET costs $5",
+		"trailing $":             "trailing $",
+		"$UNSET.":                ".",
+		"${SET:?never reported}": "value",
+	} {
+		got, err := interpolate(in, env)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+}
+
+// TestPlanStack tests the diff of a re-deploy
+func TestPlanStack(t *testing.T) {
+	p, err := loadStack("blog", testCompose, testEnv)
+	require.NoError(t, err)
+	hash := map[string]string{}
+	for _, svc := range p.Services {
+		hash[svc.Name] = svc.Hash
+	}
+	running := func(svc, hash, imageID string) []container.Summary {
+		return []container.Summary{{
+			ID: svc + "-id", ImageID: imageID, State: container.StateRunning,
+			Labels: map[string]string{composeServiceLabel: svc, composeHashLabel: hash},
+		}}
+	}
+
+	state := stackState{
+		containers: map[string][]container.Summary{
+			"db":     running("db", hash["db"], "sha256:mysql"),
+			"app":    running("app", "outdated", "sha256:ghost"),
+			"web":    running("web", hash["web"], "sha256:old-nginx"),
+			"worker": running("worker", "any", "sha256:ghost"),
+		},
+		networks: map[string]network.Summary{
+			"blog_back":   {ID: "back"},
+			"blog_legacy": {ID: "legacy"},
+		},
+		volumes: map[string]*volume.Volume{"blog_content": {Name: "blog_content"}},
+	}
+	images := map[string]string{"mysql:8": "sha256:mysql", "ghost:5": "sha256:ghost", "nginx:1.27": "sha256:nginx"}
+
+	assert.Equal(t, []models.StackChange{
+		{Type: models.StackResourceNetwork, Name: "blog_back", Action: models.StackChangeKeep},
+		{Type: models.StackResourceNetwork, Name: "blog_front", Action: models.StackChangeCreate},
+		{Type: models.StackResourceNetwork, Name: "blog_legacy", Action: models.StackChangeRemove},
+		{Type: models.StackResourceVolume, Name: "blog_content", Action: models.StackChangeKeep},
+		{Type: models.StackResourceService, Name: "db", Action: models.StackChangeKeep},
+		{Type: models.StackResourceService, Name: "app", Action: models.StackChangeRecreate, Reason: "configuration changed"},
+		{Type: models.StackResourceService, Name: "web", Action: models.StackChangeRecreate, Reason: "image updated"},
+		{Type: models.StackResourceService, Name: "worker", Action: models.StackChangeRemove},
+	}, planStack(p, state, images))
+
+	// A first deploy creates everything
+	empty := stackState{containers: map[string][]container.Summary{}}
+	for _, ch := range planStack(p, empty, nil) {
+		assert.Equal(t, models.StackChangeCreate, ch.Action, ch.Name)
+	}
+}
+
+// TestStackLocks tests that changes to a stack wait for each other while
+// other stacks are not held back
+func TestStackLocks(t *testing.T) {
+	var locks stackLocks
+	unlock := locks.lock(1, "blog")
+
+	other := make(chan struct{})
+	go func() {
+		locks.lock(2, "blog")()
+		locks.lock(1, "shop")()
+		close(other)
+	}()
+	select {
+	case <-other:
+	case <-time.After(5 * time.Second):
+		t.Fatal("other stacks are held back")
+	}
+
+	same := make(chan struct{})
+	go func() {
+		locks.lock(1, "blog")()
+		close(same)
+	}()
+	select {
+	case <-same:
+		t.Fatal("the same stack was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-same:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stack was not unlocked")
+	}
+
+	locks.mu.Lock()
+	assert.Empty(t, locks.locks)
+	locks.mu.Unlock()
+}
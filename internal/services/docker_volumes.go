@@ -0,0 +1,329 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"visory/internal/models"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo/v4"
+)
+
+// volumeNamePattern is what the daemon accepts as a volume name
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+//	@Summary      List volumes
+//	@Description  List the volumes of a Docker client with their size and the containers using them
+//	@Tags         docker
+//	@Param        clientid  path  int  true  "Docker client ID"
+//	@Produce      json
+//	@Success      200  {array}   models.DockerVolume
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/volumes [get]
+//
+// ListVolumes returns the volumes of a client
+func (s *DockerService) ListVolumes(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+
+	list, err := cli.VolumeList(ctx, volume.ListOptions{})
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to list volumes", err)
+	}
+	sizes, users, err := s.volumeUsage(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	result := make([]models.DockerVolume, 0, len(list.Volumes))
+	for _, v := range list.Volumes {
+		result = append(result, volumeInfo(*v, sizes, users))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return c.JSON(http.StatusOK, result)
+}
+
+//	@Summary      Inspect volume
+//	@Description  Get a volume of a Docker client with its size and the containers using it
+//	@Tags         docker
+//	@Param        clientid  path  int     true  "Docker client ID"
+//	@Param        name      path  string  true  "Volume name"
+//	@Produce      json
+//	@Success      200  {object}  models.DockerVolume
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/volumes/{name} [get]
+//
+// InspectVolume returns a volume
+func (s *DockerService) InspectVolume(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+
+	v, err := s.inspectVolume(ctx, cli, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	sizes, users, err := s.volumeUsage(ctx, cli)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, volumeInfo(v, sizes, users))
+}
+
+//	@Summary      Create volume
+//	@Description  Create a volume on a Docker client. Without a name the daemon generates one
+//	@Tags         docker
+//	@Accept       json
+//	@Param        clientid  path  int                         true  "Docker client ID"
+//	@Param        body      body  models.CreateVolumeRequest  true  "Volume to create"
+//	@Produce      json
+//	@Success      201  {object}  models.DockerVolume
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/volumes [post]
+//
+// CreateVolume creates a volume
+func (s *DockerService) CreateVolume(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	req := new(models.CreateVolumeRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name != "" && !volumeNamePattern.MatchString(req.Name) {
+		return s.Dispatcher.NewBadRequest("Volume name must start with a letter or digit and contain only letters, digits, '_', '.' and '-'", nil)
+	}
+	if req.Driver == "" {
+		req.Driver = "local"
+	}
+
+	// The daemon returns an existing volume of the same name instead of
+	// failing, which would hide a typo in a second volume
+	if req.Name != "" {
+		if _, err := cli.VolumeInspect(ctx, req.Name); err == nil {
+			return s.Dispatcher.NewConflict(fmt.Sprintf("Volume '%s' already exists", req.Name), nil)
+		}
+	}
+	v, err := cli.VolumeCreate(ctx, volume.CreateOptions{
+		Name:       req.Name,
+		Driver:     req.Driver,
+		DriverOpts: req.DriverOpts,
+		Labels:     req.Labels,
+	})
+	if err != nil {
+		if cerrdefs.IsInvalidArgument(err) || cerrdefs.IsNotFound(err) {
+			return s.Dispatcher.NewBadRequest(err.Error(), err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to create volume", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_VOLUME_CREATE", Subject: v.Name, Level: "INFO",
+		Message: "volume created", Fields: map[string]string{
+			"Client": c.Param("clientid"),
+			"Driver": v.Driver,
+		},
+	})
+	return c.JSON(http.StatusCreated, volumeInfo(v, nil, nil))
+}
+
+//	@Summary      Delete volume
+//	@Description  Delete a volume of a Docker client. A volume used by containers is only deleted with force, which removes those containers first. A volume used by running containers is never deleted, the containers are listed in the conflict
+//	@Tags         docker
+//	@Param        clientid  path   int     true   "Docker client ID"
+//	@Param        name      path   string  true   "Volume name"
+//	@Param        force     query  bool    false  "Remove the stopped containers using the volume, and delete the volume even when its driver fails to remove its data"
+//	@Produce      json
+//	@Success      200  {object}  map[string]string
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /docker/{clientid}/volumes/{name} [delete]
+//
+// DeleteVolume removes a volume
+func (s *DockerService) DeleteVolume(c echo.Context) error {
+	ctx := c.Request().Context()
+	cli, err := s.ClientManager.GetClient(c)
+	if err != nil {
+		return err
+	}
+	force := c.QueryParam("force") == "true"
+
+	v, err := s.inspectVolume(ctx, cli, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	_, users, err := s.volumeUsage(ctx, cli)
+	if err != nil {
+		return err
+	}
+	// The daemon refuses to delete a volume a container references, even
+	// with force. Stopped containers are removed first when forced, running
+	// ones are only named
+	inUse := users[v.Name]
+	var running, stopped []string
+	for _, ctr := range inUse {
+		switch container.ContainerState(ctr.State) {
+		case container.StateRunning, container.StatePaused, container.StateRestarting:
+			running = append(running, ctr.Name)
+		default:
+			stopped = append(stopped, ctr.Name)
+		}
+	}
+	switch {
+	case len(running) > 0:
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Volume '%s' is used by running containers %s, stop and remove them first", v.Name, strings.Join(running, ", ")), nil)
+	case len(stopped) > 0 && !force:
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Volume '%s' is used by %s, delete it with force to remove them", v.Name, strings.Join(stopped, ", ")), nil)
+	}
+
+	removed := make([]string, 0, len(inUse))
+	for _, ctr := range inUse {
+		// Without force the daemon refuses a container that started since
+		if err := cli.ContainerRemove(ctx, ctr.ID, container.RemoveOptions{}); err != nil && !cerrdefs.IsNotFound(err) {
+			if cerrdefs.IsConflict(err) {
+				return s.Dispatcher.NewConflict(fmt.Sprintf("Container '%s' using the volume is running", ctr.Name), err)
+			}
+			return s.Dispatcher.NewInternalServerError(fmt.Sprintf("Failed to remove container '%s' using the volume", ctr.Name), err)
+		}
+		removed = append(removed, ctr.Name)
+	}
+	if err := cli.VolumeRemove(ctx, v.Name, force); err != nil {
+		if cerrdefs.IsConflict(err) {
+			return s.Dispatcher.NewConflict(fmt.Sprintf("Volume '%s' is in use", v.Name), err)
+		}
+		return s.Dispatcher.NewInternalServerError("Failed to delete volume", err)
+	}
+
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "DOCKER_VOLUME_DELETE", Subject: v.Name, Level: "INFO",
+		Message: "volume deleted", Fields: map[string]string{
+			"Client":            c.Param("clientid"),
+			"Force":             fmt.Sprint(force),
+			"RemovedContainers": strings.Join(removed, ", "),
+		},
+	})
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Volume '%s' deleted successfully", v.Name),
+	})
+}
+
+func (s *DockerService) inspectVolume(ctx context.Context, cli *client.Client, name string) (volume.Volume, error) {
+	v, err := cli.VolumeInspect(ctx, name)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return v, s.Dispatcher.NewNotFound(fmt.Sprintf("Volume '%s' not found", name), err)
+		}
+		return v, s.Dispatcher.NewInternalServerError("Failed to inspect volume", err)
+	}
+	return v, nil
+}
+
+// volumeUsage returns the size of each volume from the disk usage API and
+// the containers mounting each volume
+func (s *DockerService) volumeUsage(ctx context.Context, cli *client.Client) (map[string]int64, map[string][]models.VolumeContainer, error) {
+	du, err := cli.DiskUsage(ctx, types.DiskUsageOptions{Types: []types.DiskUsageObject{types.VolumeObject}})
+	if err != nil {
+		return nil, nil, s.Dispatcher.NewInternalServerError("Failed to get volume sizes", err)
+	}
+	sizes := make(map[string]int64, len(du.Volumes))
+	for _, v := range du.Volumes {
+		if v.UsageData != nil {
+			sizes[v.Name] = v.UsageData.Size
+		}
+	}
+
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, nil, s.Dispatcher.NewInternalServerError("Failed to list containers", err)
+	}
+	return sizes, volumeUsers(containers), nil
+}
+
+// volumeUsers maps volume names to the containers mounting them
+func volumeUsers(containers []container.Summary) map[string][]models.VolumeContainer {
+	users := map[string][]models.VolumeContainer{}
+	for _, ctr := range containers {
+		name := ctr.ID
+		if len(ctr.Names) > 0 {
+			name = strings.TrimPrefix(ctr.Names[0], "/")
+		}
+		for _, m := range ctr.Mounts {
+			if m.Type != mount.TypeVolume || m.Name == "" {
+				continue
+			}
+			users[m.Name] = append(users[m.Name], models.VolumeContainer{
+				ID:          ctr.ID,
+				Name:        name,
+				State:       string(ctr.State),
+				Destination: m.Destination,
+				ReadOnly:    !m.RW,
+			})
+		}
+	}
+	return users
+}
+
+// volumeInfo describes a volume. A volume missing from sizes has an unknown
+// size
+func volumeInfo(v volume.Volume, sizes map[string]int64, users map[string][]models.VolumeContainer) models.DockerVolume {
+	size, ok := sizes[v.Name]
+	if !ok {
+		size = -1
+	}
+	info := models.DockerVolume{
+		Name:       v.Name,
+		Driver:     v.Driver,
+		Mountpoint: v.Mountpoint,
+		Scope:      v.Scope,
+		CreatedAt:  v.CreatedAt,
+		Labels:     v.Labels,
+		Options:    v.Options,
+		Size:       size,
+		Containers: users[v.Name],
+	}
+	if info.Labels == nil {
+		info.Labels = map[string]string{}
+	}
+	if info.Options == nil {
+		info.Options = map[string]string{}
+	}
+	if info.Containers == nil {
+		info.Containers = []models.VolumeContainer{}
+	}
+	return info
+}
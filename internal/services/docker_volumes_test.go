@@ -0,0 +1,126 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	clientmanager "visory/internal/clientManager"
+	"visory/internal/database/dockerhosts"
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestVolumeInfo tests that volumes are described with their size and the
+// containers mounting them
+func TestVolumeInfo(t *testing.T) {
+	users := volumeUsers([]container.Summary{
+		{
+			ID: "web-id", Names: []string{"/web"}, State: container.StateRunning,
+			Mounts: []container.MountPoint{
+				{Type: "volume", Name: "web_data", Destination: "/data", RW: true},
+				{Type: "bind", Source: "/etc/localtime", Destination: "/etc/localtime"},
+			},
+		},
+		{
+			ID: "backup-id", Names: []string{"/backup"}, State: container.StateExited,
+			Mounts: []container.MountPoint{{Type: "volume", Name: "web_data", Destination: "/backup"}},
+		},
+	})
+
+	info := volumeInfo(volume.Volume{Name: "web_data", Driver: "local", Mountpoint: "/var/lib/docker/volumes/web_data/_data"},
+		map[string]int64{"web_data": 4096}, users)
+	assert.Equal(t, int64(4096), info.Size)
+	assert.Equal(t, map[string]string{}, info.Labels)
+	assert.Equal(t, []models.VolumeContainer{
+		{ID: "web-id", Name: "web", State: "running", Destination: "/data"},
+		{ID: "backup-id", Name: "backup", State: "exited", Destination: "/backup", ReadOnly: true},
+	}, info.Containers)
+
+	unused := volumeInfo(volume.Volume{Name: "nfs", Driver: "netshare"}, map[string]int64{}, users)
+	assert.Equal(t, int64(-1), unused.Size)
+	assert.Empty(t, unused.Containers)
+	assert.NotNil(t, unused.Containers)
+}
+
+// TestDeleteVolume tests that a volume used by stopped containers is only
+// deleted with force, and one used by a running container never is
+func TestDeleteVolume(t *testing.T) {
+	var mu sync.Mutex
+	var removed []string
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Api-Version", "1.47")
+		w.Header().Set("Content-Type", "application/json")
+		p := r.URL.Path
+		switch {
+		case strings.HasSuffix(p, "/_ping"):
+			_, _ = w.Write([]byte("OK"))
+		case strings.HasSuffix(p, "/version"):
+			_, _ = w.Write([]byte(`{"Version":"27.3.1","ApiVersion":"1.47"}`))
+		case strings.HasSuffix(p, "/system/df"):
+			_, _ = w.Write([]byte(`{"Volumes":[]}`))
+		case strings.HasSuffix(p, "/containers/json"):
+			_, _ = w.Write([]byte(`[
+				{"Id":"job-id","Names":["/job"],"State":"exited","Mounts":[{"Type":"volume","Name":"cache","Destination":"/cache"}]},
+				{"Id":"db-id","Names":["/db"],"State":"running","Mounts":[{"Type":"volume","Name":"db_data","Destination":"/data"}]},
+				{"Id":"old-db-id","Names":["/old-db"],"State":"exited","Mounts":[{"Type":"volume","Name":"db_data","Destination":"/data"}]}
+			]`))
+		case r.Method == http.MethodGet && strings.Contains(p, "/volumes/"):
+			name := path.Base(p)
+			_, _ = w.Write([]byte(`{"Name":"` + name + `","Driver":"local"}`))
+		case r.Method == http.MethodDelete:
+			mu.Lock()
+			removed = append(removed, strings.TrimPrefix(p, "/v1.47"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(daemon.Close)
+
+	manager := clientmanager.NewDockerClientManager(utils.NewDispatcher(nil, nil), slog.Default())
+	require.NoError(t, manager.Connect(dockerhosts.DockerHost{ID: 1, Name: "local", Endpoint: "tcp://" + daemon.Listener.Addr().String()}))
+	t.Cleanup(func() { manager.Remove(1) })
+	service := &DockerService{Dispatcher: utils.NewDispatcher(nil, nil), Logger: slog.Default(), ClientManager: manager}
+
+	e := echo.New()
+	deleteVolume := func(name, query string) error {
+		req := httptest.NewRequest(http.MethodDelete, "/?"+query, nil)
+		c := e.NewContext(req, httptest.NewRecorder())
+		c.SetParamNames("clientid", "name")
+		c.SetParamValues("1", name)
+		return service.DeleteVolume(c)
+	}
+	status := func(err error) int {
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			return httpErr.Code
+		}
+		return 0
+	}
+
+	assert.Equal(t, http.StatusConflict, status(deleteVolume("cache", "")))
+	assert.Empty(t, removed)
+
+	require.NoError(t, deleteVolume("cache", "force=true"))
+	assert.Equal(t, []string{"/containers/job-id", "/volumes/cache"}, removed)
+
+	removed = nil
+	err := deleteVolume("db_data", "force=true")
+	assert.Equal(t, http.StatusConflict, status(err))
+	assert.Contains(t, fmt.Sprint(err.(*echo.HTTPError).Message), "db")
+	assert.Empty(t, removed)
+}
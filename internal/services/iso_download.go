@@ -0,0 +1,658 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// isoDownloadDir holds partial downloads and their state inside the ISO
+	// directory. ListISOs skips hidden entries, so they never show up there
+	isoDownloadDir       = ".downloads"
+	isoDownloadAttempts  = 5
+	isoDownloadRetryBase = 2 * time.Second
+	// isoDownloadStallTimeout aborts an attempt that received no data for
+	// this long, the next attempt resumes where it stopped
+	isoDownloadStallTimeout = time.Minute
+	isoSumsMaxSize          = 1 << 20
+)
+
+var errDownloadStalled = errors.New("download stalled")
+
+// isoDownload is a background ISO download. Its fields are guarded by
+// ISOService.downloadsMu
+type isoDownload struct {
+	models.ISODownload
+	cancel context.CancelFunc
+
+	speedAt    time.Time
+	speedBytes int64
+}
+
+// permanentError marks a download failure that retrying will not fix
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// @Summary      Download ISO from URL
+// @Description  Fetch an ISO from an http(s) URL into the ISO library as a background job. The file only appears in the library once complete and, when a SHA-256 or a SHA256SUMS URL is given, verified
+// @Tags         iso
+// @Accept       json
+// @Param        body  body  models.ISODownloadRequest  true  "Download"
+// @Produce      json
+// @Success      202  {object}  models.ISODownload
+// @Failure      400  {object}  models.HTTPError
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Failure      409  {object}  models.HTTPError
+// @Failure      500  {object}  models.HTTPError
+// @Router       /iso/download [post]
+//
+// StartISODownload starts downloading an ISO from a URL
+func (s *ISOService) StartISODownload(c echo.Context) error {
+	req := new(models.ISODownloadRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+
+	u, err := parseDownloadURL(req.URL)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid URL", err)
+	}
+	filename := req.Filename
+	if filename == "" {
+		filename = path.Base(u.Path)
+	}
+	if !validISOName(filename) {
+		return s.Dispatcher.NewBadRequest("Invalid filename", nil)
+	}
+	checksum := strings.ToLower(strings.TrimSpace(req.SHA256))
+	if checksum != "" && !validSHA256(checksum) {
+		return s.Dispatcher.NewBadRequest("Invalid SHA-256 checksum", nil)
+	}
+	if req.SHA256SumsURL != "" {
+		if _, err := parseDownloadURL(req.SHA256SumsURL); err != nil {
+			return s.Dispatcher.NewBadRequest("Invalid SHA256SUMS URL", err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(s.FS.ISOs, filename)); err == nil {
+		return s.Dispatcher.NewConflict(fmt.Sprintf("ISO file '%s' already exists", filename), nil)
+	}
+	if err := os.MkdirAll(s.downloadDir(), 0o755); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to prepare download", err)
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to start download", err)
+	}
+	d := &isoDownload{ISODownload: models.ISODownload{
+		ID:            id.String(),
+		URL:           u.String(),
+		Filename:      filename,
+		SHA256:        checksum,
+		SHA256SumsURL: req.SHA256SumsURL,
+		Status:        models.ISODownloadStatusRunning,
+		StartedAt:     time.Now(),
+		UserID:        userIDFromContext(c),
+	}}
+
+	s.downloadsMu.Lock()
+	for _, other := range s.downloads {
+		if other.Filename == filename && other.Status != models.ISODownloadStatusCompleted {
+			s.downloadsMu.Unlock()
+			return s.Dispatcher.NewConflict(fmt.Sprintf("'%s' is already being downloaded", filename), nil)
+		}
+	}
+	s.downloads[d.ID] = d
+	snapshot := s.startDownload(d)
+	s.downloadsMu.Unlock()
+
+	s.Logger.Info("ISO download started", "id", d.ID, "url", d.URL, "filename", filename)
+	return c.JSON(http.StatusAccepted, snapshot)
+}
+
+// @Summary      List ISO downloads
+// @Description  Get the running, failed and completed ISO downloads
+// @Tags         iso
+// @Produce      json
+// @Success      200  {array}   models.ISODownload
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Router       /iso/downloads [get]
+//
+// ListISODownloads returns the ISO downloads, newest first
+func (s *ISOService) ListISODownloads(c echo.Context) error {
+	s.downloadsMu.Lock()
+	items := make([]models.ISODownload, 0, len(s.downloads))
+	for _, d := range s.downloads {
+		items = append(items, d.snapshot())
+	}
+	s.downloadsMu.Unlock()
+
+	sort.Slice(items, func(i, j int) bool { return items[i].StartedAt.After(items[j].StartedAt) })
+	return c.JSON(http.StatusOK, items)
+}
+
+// @Summary      Get ISO download
+// @Description  Get the progress of an ISO download
+// @Tags         iso
+// @Param        id  path  string  true  "Download ID"
+// @Produce      json
+// @Success      200  {object}  models.ISODownload
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Failure      404  {object}  models.HTTPError
+// @Router       /iso/downloads/{id} [get]
+//
+// GetISODownload returns the progress of an ISO download
+func (s *ISOService) GetISODownload(c echo.Context) error {
+	s.downloadsMu.Lock()
+	defer s.downloadsMu.Unlock()
+
+	d, ok := s.downloads[c.Param("id")]
+	if !ok {
+		return s.Dispatcher.NewNotFound("Download not found", nil)
+	}
+	return c.JSON(http.StatusOK, d.snapshot())
+}
+
+// @Summary      Resume ISO download
+// @Description  Retry a failed ISO download, continuing from the partially downloaded file when the server supports ranges
+// @Tags         iso
+// @Param        id  path  string  true  "Download ID"
+// @Produce      json
+// @Success      202  {object}  models.ISODownload
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Failure      404  {object}  models.HTTPError
+// @Failure      409  {object}  models.HTTPError
+// @Router       /iso/downloads/{id}/resume [post]
+//
+// ResumeISODownload restarts a failed ISO download
+func (s *ISOService) ResumeISODownload(c echo.Context) error {
+	s.downloadsMu.Lock()
+	defer s.downloadsMu.Unlock()
+
+	d, ok := s.downloads[c.Param("id")]
+	if !ok {
+		return s.Dispatcher.NewNotFound("Download not found", nil)
+	}
+	if d.Status != models.ISODownloadStatusFailed {
+		return s.Dispatcher.NewConflict("Only failed downloads can be resumed", nil)
+	}
+	return c.JSON(http.StatusAccepted, s.startDownload(d))
+}
+
+// @Summary      Cancel ISO download
+// @Description  Stop an ISO download and discard the partial file, or forget a finished one
+// @Tags         iso
+// @Param        id  path  string  true  "Download ID"
+// @Produce      json
+// @Success      200  {object}  map[string]interface{}
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Failure      404  {object}  models.HTTPError
+// @Router       /iso/downloads/{id} [delete]
+//
+// CancelISODownload stops and removes an ISO download
+func (s *ISOService) CancelISODownload(c echo.Context) error {
+	id := c.Param("id")
+
+	s.downloadsMu.Lock()
+	d, ok := s.downloads[id]
+	if !ok {
+		s.downloadsMu.Unlock()
+		return s.Dispatcher.NewNotFound("Download not found", nil)
+	}
+	if d.cancel != nil {
+		d.cancel()
+	}
+	delete(s.downloads, id)
+	s.downloadsMu.Unlock()
+
+	os.Remove(s.partPath(id))
+	os.Remove(s.statePath(id))
+	s.Logger.Info("ISO download removed", "id", id, "filename", d.Filename)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("Download of '%s' removed", d.Filename),
+	})
+}
+
+// resumeDownloads picks up the downloads left behind by a previous run.
+// Those that were still running start again from their partial file
+func (s *ISOService) resumeDownloads() {
+	entries, err := os.ReadDir(s.downloadDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.Logger.Warn("Failed to read ISO downloads", "error", err)
+		}
+		return
+	}
+
+	s.downloadsMu.Lock()
+	defer s.downloadsMu.Unlock()
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(s.downloadDir(), entry.Name()))
+		if err != nil {
+			s.Logger.Warn("Failed to read ISO download state", "file", entry.Name(), "error", err)
+			continue
+		}
+		d := &isoDownload{}
+		if err := json.Unmarshal(raw, &d.ISODownload); err != nil || d.ID == "" {
+			s.Logger.Warn("Invalid ISO download state", "file", entry.Name(), "error", err)
+			continue
+		}
+		if info, err := os.Stat(s.partPath(d.ID)); err == nil {
+			d.BytesDone = info.Size()
+		}
+		s.downloads[d.ID] = d
+		if d.Status != models.ISODownloadStatusFailed {
+			s.Logger.Info("Resuming ISO download", "id", d.ID, "filename", d.Filename)
+			s.startDownload(d)
+		}
+	}
+}
+
+// startDownload runs a download in the background. It must be called with
+// s.downloadsMu held
+func (s *ISOService) startDownload(d *isoDownload) models.ISODownload {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.Status = models.ISODownloadStatusRunning
+	d.Error = ""
+	d.FinishedAt = nil
+	d.BytesPerSec = 0
+	snapshot := d.snapshot()
+	s.saveDownload(snapshot)
+
+	go s.runDownload(ctx, d)
+	return snapshot
+}
+
+func (s *ISOService) runDownload(ctx context.Context, d *isoDownload) {
+	err := s.fetchISO(ctx, d)
+	if ctx.Err() != nil {
+		// Canceled, CancelISODownload cleans up
+		return
+	}
+
+	now := time.Now()
+	s.downloadsMu.Lock()
+	d.cancel = nil
+	d.FinishedAt = &now
+	d.BytesPerSec = 0
+	if err != nil {
+		d.Status = models.ISODownloadStatusFailed
+		d.Error = err.Error()
+	} else {
+		d.Status = models.ISODownloadStatusCompleted
+	}
+	snapshot := d.snapshot()
+	s.downloadsMu.Unlock()
+
+	fields := map[string]string{
+		"File": snapshot.Filename,
+		"URL":  snapshot.URL,
+		"Size": strconv.FormatInt(snapshot.BytesDone, 10),
+	}
+	if err != nil {
+		// Keep the state so the download can be resumed, even after a restart
+		s.saveDownload(snapshot)
+		s.Logger.Error("ISO download failed", "id", snapshot.ID, "url", snapshot.URL, "error", err)
+		fields["Error"] = err.Error()
+		s.Dispatcher.SendError("ISO download failed", fmt.Sprintf("Downloading '%s' failed", snapshot.Filename), fields)
+		_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+			UserId: snapshot.UserID, Event: "ISO_DOWNLOAD", Subject: snapshot.Filename, Level: "ERROR",
+			Message: err.Error(), Fields: fields,
+		})
+		return
+	}
+
+	os.Remove(s.statePath(snapshot.ID))
+	if snapshot.Verified {
+		fields["SHA256"] = snapshot.SHA256
+	}
+	s.Logger.Info("ISO download completed", "id", snapshot.ID, "filename", snapshot.Filename, "verified", snapshot.Verified)
+	s.Dispatcher.SendSuccess("ISO download completed", fmt.Sprintf("'%s' was added to the ISO library", snapshot.Filename), fields)
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: snapshot.UserID, Event: "ISO_DOWNLOAD", Subject: snapshot.Filename, Level: "INFO",
+		Message: "download completed", Fields: fields,
+	})
+}
+
+// fetchISO downloads, verifies and publishes an ISO, retrying transfers that
+// fail on the way
+func (s *ISOService) fetchISO(ctx context.Context, d *isoDownload) error {
+	s.downloadsMu.Lock()
+	id, rawURL, filename, checksum, sumsURL := d.ID, d.URL, d.Filename, d.SHA256, d.SHA256SumsURL
+	s.downloadsMu.Unlock()
+
+	if checksum == "" && sumsURL != "" {
+		u, _ := url.Parse(rawURL)
+		sum, err := s.fetchChecksum(ctx, sumsURL, filename, path.Base(u.Path))
+		if err != nil {
+			return err
+		}
+		checksum = sum
+		s.downloadsMu.Lock()
+		d.SHA256 = sum
+		snapshot := d.snapshot()
+		s.downloadsMu.Unlock()
+		s.saveDownload(snapshot)
+	}
+
+	base := s.downloadRetryBase
+	if base <= 0 {
+		base = isoDownloadRetryBase
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.transfer(ctx, d)
+		if err == nil {
+			break
+		}
+		var permanent permanentError
+		if ctx.Err() != nil || errors.As(err, &permanent) || attempt >= isoDownloadAttempts {
+			return err
+		}
+		delay := base << (attempt - 1)
+		s.Logger.Warn("ISO download interrupted, retrying", "id", id, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	part := s.partPath(id)
+	if checksum != "" {
+		s.downloadsMu.Lock()
+		d.Status = models.ISODownloadStatusVerifying
+		s.downloadsMu.Unlock()
+
+		sum, err := utils.FileSHA256(part)
+		if err != nil {
+			return fmt.Errorf("failed to hash download: %w", err)
+		}
+		if sum != checksum {
+			// Resuming would keep the bad bytes, start from scratch next time
+			os.Remove(part)
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, sum)
+		}
+		s.downloadsMu.Lock()
+		d.Verified = true
+		s.downloadsMu.Unlock()
+	}
+
+	dst := filepath.Join(s.FS.ISOs, filename)
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("ISO file '%s' already exists", filename)
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return fmt.Errorf("failed to move download into the ISO library: %w", err)
+	}
+	if checksum != "" {
+		s.storeISOChecksum(filename, checksum)
+	} else {
+		s.queueISOHash(filename)
+	}
+	return nil
+}
+
+// transfer fetches the rest of a download, appending to its partial file
+func (s *ISOService) transfer(ctx context.Context, d *isoDownload) error {
+	s.downloadsMu.Lock()
+	id, rawURL := d.ID, d.URL
+	s.downloadsMu.Unlock()
+
+	f, err := os.OpenFile(s.partPath(id), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return permanentError{err}
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stall := time.AfterFunc(isoDownloadStallTimeout, func() { cancel(errDownloadStalled) })
+	defer stall.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return permanentError{err}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var total int64
+	resumed := false
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		total = contentRangeTotal(resp.Header.Get("Content-Range"))
+		resumed = offset > 0
+	case http.StatusOK:
+		// The server ignored the range, start over
+		if err := f.Truncate(0); err != nil {
+			return permanentError{err}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return permanentError{err}
+		}
+		offset = 0
+		total = max(resp.ContentLength, 0)
+	case http.StatusRequestedRangeNotSatisfiable:
+		if total = contentRangeTotal(resp.Header.Get("Content-Range")); total > 0 && total == offset {
+			// Everything was already there
+			return nil
+		}
+		if err := f.Truncate(0); err != nil {
+			return permanentError{err}
+		}
+		return fmt.Errorf("server rejected resuming at byte %d", offset)
+	default:
+		err := fmt.Errorf("server answered %s", resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return err
+		}
+		return permanentError{err}
+	}
+
+	s.downloadsMu.Lock()
+	d.BytesDone = offset
+	d.BytesTotal = total
+	if resumed {
+		d.Resumes++
+	}
+	d.speedAt, d.speedBytes = time.Now(), offset
+	s.downloadsMu.Unlock()
+
+	_, err = io.Copy(f, io.TeeReader(resp.Body, &downloadProgress{s: s, d: d, stall: stall}))
+	if cause := context.Cause(ctx); errors.Is(cause, errDownloadStalled) {
+		return cause
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	s.downloadsMu.Lock()
+	done := d.BytesDone
+	s.downloadsMu.Unlock()
+	if total > 0 && done != total {
+		return fmt.Errorf("transfer ended after %d of %d bytes", done, total)
+	}
+	return nil
+}
+
+// downloadProgress counts the bytes written to a download
+type downloadProgress struct {
+	s     *ISOService
+	d     *isoDownload
+	stall *time.Timer
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.stall.Reset(isoDownloadStallTimeout)
+
+	p.s.downloadsMu.Lock()
+	defer p.s.downloadsMu.Unlock()
+	d := p.d
+	d.BytesDone += int64(len(b))
+	if elapsed := time.Since(d.speedAt); elapsed >= time.Second {
+		d.BytesPerSec = int64(float64(d.BytesDone-d.speedBytes) / elapsed.Seconds())
+		d.speedAt, d.speedBytes = time.Now(), d.BytesDone
+	}
+	return len(b), nil
+}
+
+// fetchChecksum looks up the checksum of one of names in a SHA256SUMS file.
+// Both the GNU ("<sum>  name") and BSD ("SHA256 (name) = <sum>") formats are
+// understood
+func (s *ISOService) fetchChecksum(ctx context.Context, sumsURL string, names ...string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sumsURL, nil)
+	if err != nil {
+		return "", permanentError{err}
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch SHA256SUMS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch SHA256SUMS: server answered %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, isoSumsMaxSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var sum, name string
+		if rest, ok := strings.CutPrefix(line, "SHA256 ("); ok {
+			name, sum, _ = strings.Cut(rest, ") = ")
+		} else if fields := strings.Fields(line); len(fields) == 2 {
+			sum, name = fields[0], strings.TrimPrefix(fields[1], "*")
+		}
+		sum = strings.ToLower(sum)
+		if !validSHA256(sum) {
+			continue
+		}
+		for _, n := range names {
+			if path.Base(name) == n {
+				return sum, nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read SHA256SUMS: %w", err)
+	}
+	return "", permanentError{fmt.Errorf("no checksum for %s in SHA256SUMS", names[0])}
+}
+
+// saveDownload persists the state of a download next to its partial file
+func (s *ISOService) saveDownload(d models.ISODownload) {
+	raw, err := json.Marshal(d)
+	if err == nil {
+		err = os.WriteFile(s.statePath(d.ID), raw, 0o644)
+	}
+	if err != nil {
+		s.Logger.Warn("Failed to save ISO download state", "id", d.ID, "error", err)
+	}
+}
+
+func (s *ISOService) downloadDir() string {
+	return filepath.Join(s.FS.ISOs, isoDownloadDir)
+}
+
+func (s *ISOService) partPath(id string) string {
+	return filepath.Join(s.downloadDir(), id+".part")
+}
+
+func (s *ISOService) statePath(id string) string {
+	return filepath.Join(s.downloadDir(), id+".json")
+}
+
+// snapshot returns a copy of the download's state. It must be called with
+// ISOService.downloadsMu held
+func (d *isoDownload) snapshot() models.ISODownload {
+	out := d.ISODownload
+	if out.BytesTotal > 0 {
+		out.Progress = float64(out.BytesDone) / float64(out.BytesTotal) * 100
+	}
+	if out.Status == models.ISODownloadStatusCompleted {
+		out.Progress = 100
+	}
+	return out
+}
+
+// contentRangeTotal returns the complete length from a Content-Range header
+// such as "bytes 100-199/200", 0 when unknown
+func contentRangeTotal(header string) int64 {
+	_, total, ok := strings.Cut(header, "/")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func parseDownloadURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("only http and https URLs are supported")
+	}
+	return u, nil
+}
+
+// validISOName reports whether name is a plain, visible file name
+func validISOName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+func validSHA256(sum string) bool {
+	if len(sum) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+)
+
+// isoMetaDir holds a JSON sidecar per ISO with its checksum and header, so
+// multi-gigabyte files are hashed once rather than on every listing
+const isoMetaDir = ".meta"
+
+// isoMeta is the cached metadata of an ISO. It is valid while the file keeps
+// the size and modification time it had when the metadata was computed
+type isoMeta struct {
+	Size          int64            `json:"size"`
+	Modified      time.Time        `json:"modified"`
+	SHA256        string           `json:"sha256,omitempty"`
+	ChecksumError string           `json:"checksum_error,omitempty"`
+	Header        models.ISOHeader `json:"header"`
+	HeaderError   string           `json:"header_error,omitempty"`
+}
+
+func (m isoMeta) matches(info os.FileInfo) bool {
+	return m.Size == info.Size() && m.Modified.Equal(info.ModTime())
+}
+
+// isoInfo describes an ISO of the library from its cached metadata. Stale or
+// missing metadata is rebuilt: the header right away, since it only takes a
+// few sector reads, and the checksum in the background
+func (s *ISOService) isoInfo(name string, info os.FileInfo) models.ISOInfo {
+	meta, ok := s.loadISOMeta(name)
+	if !ok || !meta.matches(info) {
+		meta = s.inspectISO(name, info)
+		s.saveISOMeta(name, meta)
+	}
+
+	out := models.ISOInfo{
+		Name:           name,
+		Size:           info.Size(),
+		Modified:       info.ModTime(),
+		SHA256:         meta.SHA256,
+		ChecksumStatus: models.ISOChecksumReady,
+		ISOHeader:      meta.Header,
+		HeaderError:    meta.HeaderError,
+	}
+	switch {
+	case meta.ChecksumError != "":
+		out.ChecksumStatus = models.ISOChecksumFailed
+	case meta.SHA256 == "":
+		out.ChecksumStatus = models.ISOChecksumPending
+		s.queueISOHash(name)
+	}
+	return out
+}
+
+// storeISOChecksum records the checksum of an ISO that was computed, or
+// verified, while it was written
+func (s *ISOService) storeISOChecksum(name, sum string) {
+	info, err := os.Stat(filepath.Join(s.FS.ISOs, name))
+	if err != nil {
+		s.Logger.Warn("Failed to stat ISO", "filename", name, "error", err)
+		return
+	}
+	meta := s.inspectISO(name, info)
+	meta.SHA256 = sum
+	s.saveISOMeta(name, meta)
+}
+
+// queueISOHash hashes an ISO in the background. Files are hashed one at a
+// time so a freshly populated library does not saturate the disk
+func (s *ISOService) queueISOHash(name string) {
+	s.metaMu.Lock()
+	if s.hashing[name] {
+		s.metaMu.Unlock()
+		return
+	}
+	s.hashing[name] = true
+	s.metaMu.Unlock()
+
+	s.hashWG.Add(1)
+	go func() {
+		defer s.hashWG.Done()
+		defer func() {
+			s.metaMu.Lock()
+			delete(s.hashing, name)
+			s.metaMu.Unlock()
+		}()
+
+		s.hashSlot <- struct{}{}
+		defer func() { <-s.hashSlot }()
+
+		path := filepath.Join(s.FS.ISOs, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+		sum, hashErr := utils.FileSHA256(path)
+
+		// The file changed while it was hashed, the next listing starts over
+		after, err := os.Stat(path)
+		if err != nil || after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+			return
+		}
+
+		meta, ok := s.loadISOMeta(name)
+		if !ok || !meta.matches(info) {
+			meta = s.inspectISO(name, info)
+		}
+		if hashErr != nil {
+			s.Logger.Error("Failed to hash ISO", "filename", name, "error", hashErr)
+			meta.ChecksumError = hashErr.Error()
+		} else {
+			s.Logger.Info("ISO checksum computed", "filename", name, "size", info.Size(), "duration", time.Since(start))
+			meta.SHA256 = sum
+		}
+		s.saveISOMeta(name, meta)
+	}()
+}
+
+func (s *ISOService) inspectISO(name string, info os.FileInfo) isoMeta {
+	meta := isoMeta{Size: info.Size(), Modified: info.ModTime()}
+	header, err := utils.InspectISO(filepath.Join(s.FS.ISOs, name))
+	if err != nil {
+		meta.HeaderError = err.Error()
+	} else {
+		meta.Header = header
+	}
+	return meta
+}
+
+func (s *ISOService) loadISOMeta(name string) (isoMeta, bool) {
+	var meta isoMeta
+	raw, err := os.ReadFile(s.isoMetaPath(name))
+	if err != nil {
+		return meta, false
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return meta, false
+	}
+	return meta, true
+}
+
+func (s *ISOService) saveISOMeta(name string, meta isoMeta) {
+	raw, err := json.Marshal(meta)
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(s.FS.ISOs, isoMetaDir), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(s.isoMetaPath(name), raw, 0o644)
+	}
+	if err != nil {
+		s.Logger.Warn("Failed to save ISO metadata", "filename", name, "error", err)
+	}
+}
+
+func (s *ISOService) removeISOMeta(name string) {
+	if err := os.Remove(s.isoMetaPath(name)); err != nil && !os.IsNotExist(err) {
+		s.Logger.Warn("Failed to remove ISO metadata", "filename", name, "error", err)
+	}
+}
+
+func (s *ISOService) isoMetaPath(name string) string {
+	return filepath.Join(s.FS.ISOs, isoMetaDir, name+".json")
+}
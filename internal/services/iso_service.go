@@ -1,13 +1,19 @@
 package services
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"visory/internal/models"
 	"visory/internal/utils"
 
 	"github.com/labstack/echo/v4"
@@ -17,22 +23,44 @@ type ISOService struct {
 	Dispatcher *utils.Dispatcher
 	Logger     *slog.Logger
 	FS         *utils.FS
+
+	httpClient        *http.Client
+	downloadRetryBase time.Duration
+	downloadsMu       sync.Mutex
+	downloads         map[string]*isoDownload
+	uploadsMu         sync.Mutex
+	uploads           map[string]*uploadSession
+	metaMu            sync.Mutex
+	hashing           map[string]bool
+	hashSlot          chan struct{}
+	hashWG            sync.WaitGroup
 }
 
 // NewISOService creates a new ISOService with dependency injection
 func NewISOService(dispatcher *utils.Dispatcher, fs *utils.FS, logger *slog.Logger) *ISOService {
-	return &ISOService{
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	service := &ISOService{
 		Dispatcher: dispatcher.WithGroup("iso"),
 		Logger:     logger.WithGroup("iso"),
 		FS:         fs,
+		httpClient: &http.Client{Transport: transport},
+		downloads:  map[string]*isoDownload{},
+		uploads:    map[string]*uploadSession{},
+		hashing:    map[string]bool{},
+		hashSlot:   make(chan struct{}, 1),
 	}
+	service.resumeDownloads()
+	service.resumeUploads()
+	return service
 }
 
 // @Summary      List ISO files
-// @Description  Get a list of all available ISO files
+// @Description  Get a list of all available ISO files with their checksum and volume header
 // @Tags         iso
 // @Produce      json
-// @Success      200  {array}   map[string]interface{}
+// @Success      200  {array}   models.ISOInfo
 // @Failure      401  {object}  models.HTTPError
 // @Failure      403  {object}  models.HTTPError
 // @Failure      500  {object}  models.HTTPError
@@ -46,21 +74,17 @@ func (s *ISOService) ListISOs(c echo.Context) error {
 		return s.Dispatcher.NewInternalServerError("Failed to list ISO files", err)
 	}
 
-	isos := make([]map[string]interface{}, 0)
+	isos := make([]models.ISOInfo, 0)
 	for _, entry := range entries {
-		if !entry.IsDir() {
+		// Hidden entries hold partial downloads, uploads and cached metadata
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
 			info, err := entry.Info()
 			if err != nil {
 				s.Logger.Warn("Failed to get file info", "name", entry.Name(), "error", err)
 				continue
 			}
 
-			isos = append(isos, map[string]interface{}{
-				"name":         entry.Name(),
-				"size":         info.Size(),
-				"modified":     info.ModTime(),
-				"is_directory": entry.IsDir(),
-			})
+			isos = append(isos, s.isoInfo(entry.Name(), info))
 		}
 	}
 
@@ -68,11 +92,11 @@ func (s *ISOService) ListISOs(c echo.Context) error {
 }
 
 // @Summary      Get ISO file info
-// @Description  Get detailed information about a specific ISO file
+// @Description  Get detailed information about a specific ISO file: its SHA-256, volume label, creation date and whether it is bootable
 // @Tags         iso
 // @Param        filename  path  string  true  "ISO filename"
 // @Produce      json
-// @Success      200  {object}  map[string]interface{}
+// @Success      200  {object}  models.ISOInfo
 // @Failure      401  {object}  models.HTTPError
 // @Failure      403  {object}  models.HTTPError
 // @Failure      404  {object}  models.HTTPError
@@ -116,12 +140,7 @@ func (s *ISOService) GetISOInfo(c echo.Context) error {
 		return s.Dispatcher.NewBadRequest("Path is a directory, not a file", nil)
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"name":         info.Name(),
-		"size":         info.Size(),
-		"modified":     info.ModTime(),
-		"is_directory": info.IsDir(),
-	})
+	return c.JSON(http.StatusOK, s.isoInfo(info.Name(), info))
 }
 
 // @Summary      Upload ISO file
@@ -183,8 +202,9 @@ func (s *ISOService) UploadISO(c echo.Context) error {
 	}
 	defer dst.Close()
 
-	// Copy file content
-	if _, err := io.Copy(dst, src); err != nil {
+	// Copy file content, hashing it on the way
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, hash), src); err != nil {
 		s.Logger.Error("Failed to copy file content", "filename", file.Filename, "error", err)
 		os.Remove(dstPath) // Clean up partial file
 		return s.Dispatcher.NewInternalServerError("Failed to save ISO file", err)
@@ -196,6 +216,7 @@ func (s *ISOService) UploadISO(c echo.Context) error {
 		return s.Dispatcher.NewInternalServerError("Failed to verify ISO file", err)
 	}
 
+	s.storeISOChecksum(info.Name(), hex.EncodeToString(hash.Sum(nil)))
 	s.Logger.Info("ISO file uploaded successfully", "filename", file.Filename, "size", info.Size())
 
 	return c.JSON(http.StatusCreated, map[string]interface{}{
@@ -260,6 +281,7 @@ func (s *ISOService) DeleteISO(c echo.Context) error {
 		s.Logger.Error("Failed to delete file", "filename", filename, "error", err)
 		return s.Dispatcher.NewInternalServerError("Failed to delete ISO file", err)
 	}
+	s.removeISOMeta(info.Name())
 
 	s.Logger.Info("ISO file deleted successfully", "filename", filename)
 
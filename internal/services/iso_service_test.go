@@ -0,0 +1,403 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestISOServer serves data as /images/test.iso, with ranges, and its
+// checksum as /SHA256SUMS. ranged counts the requests that asked for a range
+func newTestISOServer(t *testing.T, data []byte) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	ranged := &atomic.Int32{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images/test.iso", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranged.Add(1)
+		}
+		http.ServeContent(w, r, "test.iso", time.Time{}, bytes.NewReader(data))
+	})
+	mux.HandleFunc("/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s *other.iso\n%s *test.iso\n", strings.Repeat("0", 64), hex.EncodeToString(sum[:]))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, ranged
+}
+
+func newTestISOService(t *testing.T, fs *utils.FS) *ISOService {
+	t.Helper()
+	service := NewISOService(&utils.Dispatcher{}, fs, slog.Default())
+	service.downloadRetryBase = time.Millisecond
+	// Background hashing must not outlive the temporary ISO directory
+	t.Cleanup(service.hashWG.Wait)
+	return service
+}
+
+// waitForDownload waits until a download finished and returns its state
+func waitForDownload(t *testing.T, service *ISOService, id string) models.ISODownload {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		service.downloadsMu.Lock()
+		d := service.downloads[id].snapshot()
+		service.downloadsMu.Unlock()
+		if d.Status == models.ISODownloadStatusCompleted || d.Status == models.ISODownloadStatusFailed {
+			return d
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("download %s did not finish", id)
+	return models.ISODownload{}
+}
+
+func startTestDownload(t *testing.T, service *ISOService, body string) (models.ISODownload, error) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/iso/download", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if err := service.StartISODownload(echo.New().NewContext(req, rec)); err != nil {
+		return models.ISODownload{}, err
+	}
+	var d models.ISODownload
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &d))
+	return d, nil
+}
+
+func listTestISOs(t *testing.T, service *ISOService) []string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/iso", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, service.ListISOs(echo.New().NewContext(req, rec)))
+	var isos []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &isos))
+	names := []string{}
+	for _, iso := range isos {
+		names = append(names, iso["name"].(string))
+	}
+	return names
+}
+
+// TestISODownload tests downloading, verifying and resuming ISOs
+func TestISODownload(t *testing.T) {
+	data := make([]byte, 256*1024)
+	_, err := rand.Read(data)
+	assert.NoError(t, err)
+	server, ranged := newTestISOServer(t, data)
+
+	fs := &utils.FS{ISOs: t.TempDir()}
+	service := newTestISOService(t, fs)
+
+	d, err := startTestDownload(t, service, fmt.Sprintf(`{"url":"%s/images/test.iso","sha256sums_url":"%s/SHA256SUMS"}`, server.URL, server.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, "test.iso", d.Filename)
+	d = waitForDownload(t, service, d.ID)
+	assert.Equal(t, models.ISODownloadStatusCompleted, d.Status, d.Error)
+	assert.True(t, d.Verified)
+	assert.Equal(t, float64(100), d.Progress)
+	saved, err := os.ReadFile(filepath.Join(fs.ISOs, "test.iso"))
+	assert.NoError(t, err)
+	assert.Equal(t, data, saved)
+
+	// The file is already in the library
+	_, err = startTestDownload(t, service, fmt.Sprintf(`{"url":"%s/images/test.iso"}`, server.URL))
+	assert.Error(t, err)
+
+	for _, body := range []string{
+		`{"url":"ftp://example.com/a.iso"}`,
+		fmt.Sprintf(`{"url":"%s/images/test.iso","filename":"../a.iso"}`, server.URL),
+		fmt.Sprintf(`{"url":"%s/images/test.iso","filename":"b.iso","sha256":"xyz"}`, server.URL),
+	} {
+		_, err := startTestDownload(t, service, body)
+		assert.Error(t, err, body)
+	}
+
+	// A bad checksum fails the download and keeps it out of the library
+	d, err = startTestDownload(t, service, fmt.Sprintf(`{"url":"%s/images/test.iso","filename":"bad.iso","sha256":"%s"}`, server.URL, strings.Repeat("a", 64)))
+	assert.NoError(t, err)
+	d = waitForDownload(t, service, d.ID)
+	assert.Equal(t, models.ISODownloadStatusFailed, d.Status)
+	assert.Contains(t, d.Error, "checksum mismatch")
+	assert.NoFileExists(t, filepath.Join(fs.ISOs, "bad.iso"))
+
+	// A download interrupted halfway is resumed from its partial file when
+	// the service starts again, and never listed before it completes
+	interrupted := models.ISODownload{
+		ID:       "interrupted",
+		URL:      server.URL + "/images/test.iso",
+		Filename: "resumed.iso",
+		Status:   models.ISODownloadStatusRunning,
+	}
+	service.saveDownload(interrupted)
+	assert.NoError(t, os.WriteFile(service.partPath(interrupted.ID), data[:len(data)/2], 0o644))
+	assert.Equal(t, []string{"test.iso"}, listTestISOs(t, service))
+
+	restarted := newTestISOService(t, fs)
+	d = waitForDownload(t, restarted, interrupted.ID)
+	assert.Equal(t, models.ISODownloadStatusCompleted, d.Status, d.Error)
+	assert.Equal(t, 1, d.Resumes)
+	assert.Equal(t, int32(1), ranged.Load())
+	saved, err = os.ReadFile(filepath.Join(fs.ISOs, "resumed.iso"))
+	assert.NoError(t, err)
+	assert.Equal(t, data, saved)
+	assert.NoFileExists(t, restarted.statePath(interrupted.ID))
+	assert.Equal(t, []string{"resumed.iso", "test.iso"}, listTestISOs(t, restarted))
+}
+
+// tusRequest calls a resumable upload handler with the tus headers set
+func tusRequest(t *testing.T, handler echo.HandlerFunc, method, id string, headers map[string]string, body []byte) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/iso/uploads", bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	if id != "" {
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+	}
+	return rec, handler(c)
+}
+
+func tusMetadata(pairs ...string) string {
+	var parts []string
+	for i := 0; i < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+func tusStatus(err error) int {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	return 0
+}
+
+// TestResumableUpload tests the tus upload protocol, resuming after a
+// restart, checksums and expiry
+func TestResumableUpload(t *testing.T) {
+	data := make([]byte, 64*1024)
+	_, err := rand.Read(data)
+	assert.NoError(t, err)
+	sum := sha256.Sum256(data)
+	half := len(data) / 2
+
+	fs := &utils.FS{ISOs: t.TempDir(), Images: t.TempDir()}
+	service := newTestISOService(t, fs)
+
+	create := func(service *ISOService, metadata string) string {
+		rec, err := tusRequest(t, service.CreateUpload, http.MethodPost, "", map[string]string{
+			"Upload-Length":   strconv.Itoa(len(data)),
+			"Upload-Metadata": metadata,
+		}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		location := rec.Header().Get("Location")
+		assert.True(t, strings.HasPrefix(location, "/api/iso/uploads/"), location)
+		return path.Base(location)
+	}
+	patch := func(service *ISOService, id string, offset int, chunk []byte, checksum string) (*httptest.ResponseRecorder, error) {
+		headers := map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}
+		if checksum != "" {
+			headers["Upload-Checksum"] = "sha256 " + checksum
+		}
+		return tusRequest(t, service.PatchUpload, http.MethodPatch, id, headers, chunk)
+	}
+	chunkSum := func(b []byte) string {
+		s := sha256.Sum256(b)
+		return base64.StdEncoding.EncodeToString(s[:])
+	}
+
+	id := create(service, tusMetadata("filename", "server.iso", "sha256", hex.EncodeToString(sum[:])))
+
+	rec, err := patch(service, id, 0, data[:half], chunkSum(data[:half]))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(half), rec.Header().Get("Upload-Offset"))
+
+	_, err = patch(service, id, 0, data[:half], "")
+	assert.Equal(t, http.StatusConflict, tusStatus(err))
+	_, err = patch(service, id, half, data[half:], chunkSum(data[:half]))
+	assert.Equal(t, 460, tusStatus(err))
+
+	req := httptest.NewRequest(http.MethodHead, "/", nil)
+	rec = httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	assert.Equal(t, http.StatusPreconditionFailed, tusStatus(service.HeadUpload(c)))
+
+	// Partial uploads survive a restart and stay out of the library
+	restarted := newTestISOService(t, fs)
+	rec, err = tusRequest(t, restarted.HeadUpload, http.MethodHead, id, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(half), rec.Header().Get("Upload-Offset"))
+	assert.Empty(t, listTestISOs(t, restarted))
+
+	_, err = patch(restarted, id, half, data[half:], chunkSum(data[half:]))
+	assert.NoError(t, err)
+	saved, err := os.ReadFile(filepath.Join(fs.ISOs, "server.iso"))
+	assert.NoError(t, err)
+	assert.Equal(t, data, saved)
+	_, err = tusRequest(t, restarted.HeadUpload, http.MethodHead, id, nil, nil)
+	assert.Equal(t, http.StatusNotFound, tusStatus(err))
+
+	// The final checksum must match
+	id = create(restarted, tusMetadata("filename", "corrupt.iso", "sha256", strings.Repeat("b", 64)))
+	_, err = patch(restarted, id, 0, data, "")
+	assert.Equal(t, 460, tusStatus(err))
+	assert.NoFileExists(t, filepath.Join(fs.ISOs, "corrupt.iso"))
+
+	// Disk images go next to the VM disks
+	id = create(restarted, tusMetadata("filename", "disk.qcow2", "type", "image"))
+	_, err = patch(restarted, id, 0, data, "")
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(fs.Images, "disk.qcow2"))
+
+	// Abandoned uploads expire
+	id = create(restarted, tusMetadata("filename", "abandoned.iso"))
+	_, err = patch(restarted, id, 0, data[:half], "")
+	assert.NoError(t, err)
+	restarted.expireUploads(time.Now().Add(uploadExpiry() + time.Minute))
+	_, err = tusRequest(t, restarted.HeadUpload, http.MethodHead, id, nil, nil)
+	assert.Equal(t, http.StatusNotFound, tusStatus(err))
+	entries, err := os.ReadDir(filepath.Join(fs.ISOs, uploadDir))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	for _, metadata := range []string{tusMetadata("filename", "../x.iso"), tusMetadata("filename", "x.iso", "type", "rootfs"), "filename !!!"} {
+		_, err := tusRequest(t, restarted.CreateUpload, http.MethodPost, "", map[string]string{
+			"Upload-Length":   "10",
+			"Upload-Metadata": metadata,
+		}, nil)
+		assert.Equal(t, http.StatusBadRequest, tusStatus(err), metadata)
+	}
+}
+
+// writeBootableTestISO writes an ISO 9660 image with a volume label, a
+// creation date and an El Torito catalog booting on BIOS and EFI
+func writeBootableTestISO(t *testing.T, path string) []byte {
+	t.Helper()
+	const sector = 2048
+	data := make([]byte, 20*sector)
+
+	pvd := data[16*sector:]
+	pvd[0] = 1
+	copy(pvd[1:6], "CD001")
+	copy(pvd[8:40], fmt.Sprintf("%-32s", "LINUX"))
+	copy(pvd[40:72], fmt.Sprintf("%-32s", "TEST_LIVE"))
+	copy(pvd[813:829], "2024031512300000")
+	pvd[829] = 8 // UTC+2
+
+	boot := data[17*sector:]
+	copy(boot[1:6], "CD001")
+	copy(boot[7:39], "EL TORITO SPECIFICATION")
+	boot[71] = 19 // Catalog sector
+
+	terminator := data[18*sector:]
+	terminator[0] = 255
+	copy(terminator[1:6], "CD001")
+
+	catalog := data[19*sector:]
+	catalog[0] = 1 // Validation entry for x86 BIOS
+	catalog[30], catalog[31] = 0x55, 0xaa
+	catalog[32] = 0x88 // Bootable default entry
+	catalog[64] = 0x91 // Last section header, for EFI
+	catalog[65] = 0xef
+	catalog[66] = 1
+	catalog[96] = 0x88
+
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+	return data
+}
+
+// TestISOInfo tests ISOs are listed with their header and a checksum that
+// is computed once in the background
+func TestISOInfo(t *testing.T) {
+	fs := &utils.FS{ISOs: t.TempDir()}
+	service := newTestISOService(t, fs)
+	data := writeBootableTestISO(t, filepath.Join(fs.ISOs, "live.iso"))
+	assert.NoError(t, os.WriteFile(filepath.Join(fs.ISOs, "notes.txt"), []byte("not an image"), 0o644))
+	sum := sha256.Sum256(data)
+
+	info := func(name string) models.ISOInfo {
+		t.Helper()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/iso/"+name, nil), httptest.NewRecorder())
+		c.SetParamNames("filename")
+		c.SetParamValues(name)
+		assert.NoError(t, service.GetISOInfo(c))
+		var out models.ISOInfo
+		assert.NoError(t, json.Unmarshal(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes(), &out))
+		return out
+	}
+
+	iso := info("live.iso")
+	assert.Equal(t, "iso9660", iso.Format)
+	assert.Equal(t, "TEST_LIVE", iso.VolumeLabel)
+	assert.Equal(t, "LINUX", iso.SystemID)
+	if assert.NotNil(t, iso.Created) {
+		assert.True(t, iso.Created.Equal(time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC)), iso.Created.String())
+	}
+	assert.True(t, iso.Bootable)
+	assert.Equal(t, []string{"bios", "efi"}, iso.BootPlatforms)
+	assert.Empty(t, iso.HeaderError)
+
+	service.hashWG.Wait()
+	iso = info("live.iso")
+	assert.Equal(t, models.ISOChecksumReady, iso.ChecksumStatus)
+	assert.Equal(t, hex.EncodeToString(sum[:]), iso.SHA256)
+
+	// Other files are listed with the reason they have no header
+	notes := info("notes.txt")
+	assert.False(t, notes.Bootable)
+	assert.Empty(t, notes.Format)
+	assert.NotEmpty(t, notes.HeaderError)
+	assert.Equal(t, []string{"live.iso", "notes.txt"}, listTestISOs(t, service))
+
+	// Changing a file invalidates its cached checksum
+	service.hashWG.Wait()
+	data[0] = 1
+	assert.NoError(t, os.WriteFile(filepath.Join(fs.ISOs, "live.iso"), data, 0o644))
+	assert.NoError(t, os.Chtimes(filepath.Join(fs.ISOs, "live.iso"), time.Now(), time.Now().Add(time.Minute)))
+	assert.Equal(t, models.ISOChecksumPending, info("live.iso").ChecksumStatus)
+	service.hashWG.Wait()
+	sum = sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), info("live.iso").SHA256)
+
+	// Deleting an ISO drops its metadata
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/iso/live.iso", nil), httptest.NewRecorder())
+	c.SetParamNames("filename")
+	c.SetParamValues("live.iso")
+	assert.NoError(t, service.DeleteISO(c))
+	assert.NoFileExists(t, filepath.Join(fs.ISOs, isoMetaDir, "live.iso.json"))
+}
@@ -0,0 +1,593 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Resumable uploads follow the tus 1.0.0 protocol (https://tus.io), so any
+// tus client can resume an upload after the connection dropped
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,expiration,termination,checksum"
+	tusChecksumAlgorithms = "sha256"
+	tusOffsetContentType  = "application/offset+octet-stream"
+	// statusChecksumMismatch is the tus status for a chunk or upload whose
+	// checksum does not match
+	statusChecksumMismatch = 460
+
+	// uploadDir holds unfinished uploads inside the ISO and image directories
+	uploadDir             = ".uploads"
+	uploadCleanupInterval = 15 * time.Minute
+	defaultUploadExpiry   = 24 * time.Hour
+	// uploadChunkTimeout replaces the server timeouts for chunk requests
+	uploadChunkTimeout = time.Hour
+)
+
+// uploadSession is an unfinished upload. Its fields are guarded by
+// ISOService.uploadsMu
+type uploadSession struct {
+	models.UploadSession
+	busy bool // a PATCH is writing to the upload
+}
+
+// @Summary      Resumable upload capabilities
+// @Description  Report the tus protocol version and extensions supported for resumable uploads
+// @Tags         iso
+// @Success      204
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Router       /iso/uploads [options]
+//
+// UploadOptions answers tus capability discovery
+func (s *ISOService) UploadOptions(c echo.Context) error {
+	h := c.Response().Header()
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Tus-Version", tusVersion)
+	h.Set("Tus-Extension", tusExtensions)
+	h.Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// @Summary      List resumable uploads
+// @Description  Get the unfinished ISO and disk image uploads
+// @Tags         iso
+// @Produce      json
+// @Success      200  {array}   models.UploadSession
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Router       /iso/uploads [get]
+//
+// ListUploads returns the unfinished uploads, newest first
+func (s *ISOService) ListUploads(c echo.Context) error {
+	s.uploadsMu.Lock()
+	items := make([]models.UploadSession, 0, len(s.uploads))
+	for _, u := range s.uploads {
+		items = append(items, u.UploadSession)
+	}
+	s.uploadsMu.Unlock()
+
+	sort.Slice(items, func(i, j int) bool { return items[i].CreatedAt.After(items[j].CreatedAt) })
+	return c.JSON(http.StatusOK, items)
+}
+
+// @Summary      Create resumable upload
+// @Description  Start a tus upload. Upload-Metadata carries the base64 encoded filename, type (iso or image, default iso) and optional sha256 checked once the upload is complete
+// @Tags         iso
+// @Param        Tus-Resumable    header  string  true   "1.0.0"
+// @Param        Upload-Length    header  int     true   "Size of the file in bytes"
+// @Param        Upload-Metadata  header  string  true   "filename, type and sha256, base64 encoded"
+// @Success      201
+// @Failure      400  {object}  models.HTTPError
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Failure      409  {object}  models.HTTPError
+// @Failure      412  {object}  models.HTTPError
+// @Failure      413  {object}  models.HTTPError
+// @Failure      500  {object}  models.HTTPError
+// @Router       /iso/uploads [post]
+//
+// CreateUpload starts a resumable upload
+func (s *ISOService) CreateUpload(c echo.Context) error {
+	if err := s.checkTusVersion(c); err != nil {
+		return err
+	}
+
+	length, err := strconv.ParseInt(c.Request().Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return s.Dispatcher.NewBadRequest("Invalid Upload-Length", err)
+	}
+	meta, err := parseUploadMetadata(c.Request().Header.Get("Upload-Metadata"))
+	if err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid Upload-Metadata", err)
+	}
+
+	filename := meta["filename"]
+	if filename == "" {
+		filename = meta["name"]
+	}
+	if !validISOName(filename) {
+		return s.Dispatcher.NewBadRequest("Invalid filename", nil)
+	}
+	uploadType := meta["type"]
+	if uploadType == "" {
+		uploadType = models.UploadTypeISO
+	}
+	destDir := s.uploadTarget(uploadType)
+	if destDir == "" {
+		return s.Dispatcher.NewBadRequest("Invalid upload type", nil)
+	}
+	checksum := strings.ToLower(meta["sha256"])
+	if checksum != "" && !validSHA256(checksum) {
+		return s.Dispatcher.NewBadRequest("Invalid SHA-256 checksum", nil)
+	}
+
+	if _, err := os.Stat(filepath.Join(destDir, filename)); err == nil {
+		return s.Dispatcher.NewConflict(fmt.Sprintf("'%s' already exists", filename), nil)
+	}
+	if err := os.MkdirAll(filepath.Join(destDir, uploadDir), 0o755); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to prepare upload", err)
+	}
+	if _, free, err := utils.DiskUsage(destDir); err == nil && uint64(length) > free {
+		return s.Dispatcher.NewHTTPError(http.StatusRequestEntityTooLarge, "Not enough free disk space for this upload", nil)
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to create upload", err)
+	}
+	now := time.Now()
+	u := &uploadSession{UploadSession: models.UploadSession{
+		ID:        id.String(),
+		Filename:  filename,
+		Type:      uploadType,
+		Length:    length,
+		SHA256:    checksum,
+		CreatedAt: now,
+		ExpiresAt: now.Add(uploadExpiry()),
+		UserID:    userIDFromContext(c),
+	}}
+
+	s.uploadsMu.Lock()
+	for _, other := range s.uploads {
+		if other.Type == uploadType && other.Filename == filename {
+			s.uploadsMu.Unlock()
+			return s.Dispatcher.NewConflict(fmt.Sprintf("'%s' is already being uploaded", filename), nil)
+		}
+	}
+	s.uploads[u.ID] = u
+	s.uploadsMu.Unlock()
+
+	if err := os.WriteFile(s.uploadDataPath(u.UploadSession), nil, 0o644); err != nil {
+		s.removeUpload(u.UploadSession)
+		return s.Dispatcher.NewInternalServerError("Failed to create upload", err)
+	}
+	s.saveUpload(u.UploadSession)
+	s.Logger.Info("Upload created", "id", u.ID, "filename", filename, "type", uploadType, "length", length)
+
+	h := c.Response().Header()
+	h.Set("Location", path.Join(c.Request().URL.Path, u.ID))
+	h.Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.NoContent(http.StatusCreated)
+}
+
+// @Summary      Get resumable upload offset
+// @Description  Get how many bytes of a tus upload the server has, to resume from there
+// @Tags         iso
+// @Param        id             path    string  true  "Upload ID"
+// @Param        Tus-Resumable  header  string  true  "1.0.0"
+// @Success      200
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Failure      404  {object}  models.HTTPError
+// @Failure      412  {object}  models.HTTPError
+// @Router       /iso/uploads/{id} [head]
+//
+// HeadUpload reports the offset of a resumable upload
+func (s *ISOService) HeadUpload(c echo.Context) error {
+	if err := s.checkTusVersion(c); err != nil {
+		return err
+	}
+	u, ok := s.lookupUpload(c.Param("id"))
+	if !ok {
+		return s.Dispatcher.NewNotFound("Upload not found", nil)
+	}
+
+	h := c.Response().Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	h.Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.NoContent(http.StatusOK)
+}
+
+// @Summary      Upload a chunk
+// @Description  Append a chunk to a tus upload at Upload-Offset. An optional Upload-Checksum ("sha256 <base64>") is checked for the chunk. The file is verified and moved into place once complete
+// @Tags         iso
+// @Accept       application/offset+octet-stream
+// @Param        id               path    string  true   "Upload ID"
+// @Param        Tus-Resumable    header  string  true   "1.0.0"
+// @Param        Upload-Offset    header  int     true   "Offset of the chunk"
+// @Param        Upload-Checksum  header  string  false  "Checksum of the chunk"
+// @Success      204
+// @Failure      400  {object}  models.HTTPError
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Failure      404  {object}  models.HTTPError
+// @Failure      409  {object}  models.HTTPError
+// @Failure      412  {object}  models.HTTPError
+// @Failure      415  {object}  models.HTTPError
+// @Failure      460  {object}  models.HTTPError
+// @Failure      500  {object}  models.HTTPError
+// @Router       /iso/uploads/{id} [patch]
+//
+// PatchUpload appends a chunk to a resumable upload
+func (s *ISOService) PatchUpload(c echo.Context) error {
+	if err := s.checkTusVersion(c); err != nil {
+		return err
+	}
+	r := c.Request()
+	if r.Header.Get("Content-Type") != tusOffsetContentType {
+		return s.Dispatcher.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type must be "+tusOffsetContentType, nil)
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return s.Dispatcher.NewBadRequest("Invalid Upload-Offset", err)
+	}
+	var chunkHash hash.Hash
+	var chunkSum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		algorithm, encoded, _ := strings.Cut(header, " ")
+		if algorithm != "sha256" {
+			return s.Dispatcher.NewBadRequest("Unsupported checksum algorithm", nil)
+		}
+		if chunkSum, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return s.Dispatcher.NewBadRequest("Invalid Upload-Checksum", err)
+		}
+		chunkHash = sha256.New()
+	}
+
+	s.uploadsMu.Lock()
+	u, ok := s.uploads[c.Param("id")]
+	if !ok {
+		s.uploadsMu.Unlock()
+		return s.Dispatcher.NewNotFound("Upload not found", nil)
+	}
+	if u.busy {
+		s.uploadsMu.Unlock()
+		return s.Dispatcher.NewConflict("Another chunk of this upload is being written", nil)
+	}
+	if u.Offset != offset {
+		s.uploadsMu.Unlock()
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Upload-Offset %d does not match the upload offset %d", offset, u.Offset), nil)
+	}
+	u.busy = true
+	session := u.UploadSession
+	s.uploadsMu.Unlock()
+	defer func() {
+		s.uploadsMu.Lock()
+		u.busy = false
+		s.uploadsMu.Unlock()
+	}()
+
+	// Chunks of large images easily outlast the server's timeouts, and the
+	// reply to a stored chunk must not be lost or the client sends it again
+	rc := http.NewResponseController(c.Response().Writer)
+	_ = rc.SetReadDeadline(time.Now().Add(uploadChunkTimeout))
+	_ = rc.SetWriteDeadline(time.Now().Add(uploadChunkTimeout))
+
+	f, err := os.OpenFile(s.uploadDataPath(session), os.O_WRONLY, 0o644)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to open upload", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to write upload", err)
+	}
+
+	var body io.Reader = io.LimitReader(r.Body, session.Length-offset)
+	if chunkHash != nil {
+		body = io.TeeReader(body, chunkHash)
+	}
+	written, copyErr := io.Copy(f, body)
+	if chunkHash != nil && (copyErr != nil || !bytes.Equal(chunkHash.Sum(nil), chunkSum)) {
+		// Drop the whole chunk, the client sends it again
+		_ = f.Truncate(offset)
+		if copyErr != nil {
+			return s.Dispatcher.NewInternalServerError("Failed to write upload", copyErr)
+		}
+		return s.Dispatcher.NewHTTPError(statusChecksumMismatch, "Chunk checksum mismatch", nil)
+	}
+	if err := f.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	// Keep whatever arrived, even from an interrupted request
+	s.uploadsMu.Lock()
+	u.Offset = offset + written
+	u.ExpiresAt = time.Now().Add(uploadExpiry())
+	session = u.UploadSession
+	s.uploadsMu.Unlock()
+	s.saveUpload(session)
+
+	if copyErr != nil {
+		s.Logger.Warn("Upload chunk interrupted", "id", session.ID, "offset", session.Offset, "error", copyErr)
+		return s.Dispatcher.NewInternalServerError("Failed to write upload", copyErr)
+	}
+
+	h := c.Response().Header()
+	h.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	h.Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	if session.Offset == session.Length {
+		if err := s.finishUpload(session); err != nil {
+			return err
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// @Summary      Cancel resumable upload
+// @Description  Abort a tus upload and discard what was received
+// @Tags         iso
+// @Param        id             path    string  true  "Upload ID"
+// @Param        Tus-Resumable  header  string  true  "1.0.0"
+// @Success      204
+// @Failure      401  {object}  models.HTTPError
+// @Failure      403  {object}  models.HTTPError
+// @Failure      404  {object}  models.HTTPError
+// @Failure      409  {object}  models.HTTPError
+// @Failure      412  {object}  models.HTTPError
+// @Router       /iso/uploads/{id} [delete]
+//
+// DeleteUpload aborts a resumable upload
+func (s *ISOService) DeleteUpload(c echo.Context) error {
+	if err := s.checkTusVersion(c); err != nil {
+		return err
+	}
+	u, ok := s.lookupUpload(c.Param("id"))
+	if !ok {
+		return s.Dispatcher.NewNotFound("Upload not found", nil)
+	}
+	if u.busy {
+		return s.Dispatcher.NewConflict("A chunk of this upload is being written", nil)
+	}
+	s.removeUpload(u.UploadSession)
+	s.Logger.Info("Upload canceled", "id", u.ID, "filename", u.Filename)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// StartUploadCleanup periodically discards uploads that were abandoned for
+// longer than the upload expiry
+func (s *ISOService) StartUploadCleanup(ctx context.Context) {
+	ticker := time.NewTicker(uploadCleanupInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.expireUploads(now)
+			}
+		}
+	}()
+}
+
+// expireUploads removes the uploads that expired before now
+func (s *ISOService) expireUploads(now time.Time) {
+	s.uploadsMu.Lock()
+	var expired []models.UploadSession
+	for _, u := range s.uploads {
+		if !u.busy && now.After(u.ExpiresAt) {
+			expired = append(expired, u.UploadSession)
+		}
+	}
+	s.uploadsMu.Unlock()
+
+	for _, u := range expired {
+		s.removeUpload(u)
+		s.Logger.Info("Removed expired upload", "id", u.ID, "filename", u.Filename, "offset", u.Offset, "length", u.Length)
+	}
+}
+
+// finishUpload verifies a complete upload and moves it into place
+func (s *ISOService) finishUpload(u models.UploadSession) error {
+	data := s.uploadDataPath(u)
+	defer s.removeUpload(u)
+
+	fields := map[string]string{
+		"File": u.Filename,
+		"Type": u.Type,
+		"Size": strconv.FormatInt(u.Length, 10),
+	}
+	if u.SHA256 != "" {
+		sum, err := utils.FileSHA256(data)
+		if err != nil {
+			return s.Dispatcher.NewInternalServerError("Failed to verify upload", err)
+		}
+		if sum != u.SHA256 {
+			s.Logger.Error("Upload checksum mismatch", "id", u.ID, "filename", u.Filename, "expected", u.SHA256, "got", sum)
+			return s.Dispatcher.NewHTTPError(statusChecksumMismatch, fmt.Sprintf("Checksum mismatch: expected %s, got %s", u.SHA256, sum), nil)
+		}
+		fields["SHA256"] = sum
+	}
+
+	dst := filepath.Join(s.uploadTarget(u.Type), u.Filename)
+	if _, err := os.Stat(dst); err == nil {
+		return s.Dispatcher.NewConflict(fmt.Sprintf("'%s' already exists", u.Filename), nil)
+	}
+	if err := os.Rename(data, dst); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to store upload", err)
+	}
+	if u.Type == models.UploadTypeISO {
+		if u.SHA256 != "" {
+			s.storeISOChecksum(u.Filename, u.SHA256)
+		} else {
+			s.queueISOHash(u.Filename)
+		}
+	}
+
+	s.Logger.Info("Upload completed", "id", u.ID, "filename", u.Filename, "type", u.Type, "size", u.Length)
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: u.UserID, Event: "UPLOAD", Subject: u.Filename, Level: "INFO",
+		Message: fmt.Sprintf("%s upload completed", u.Type), Fields: fields,
+	})
+	return nil
+}
+
+// resumeUploads loads the unfinished uploads left behind by a previous run.
+// The data file is the source of truth for the offset
+func (s *ISOService) resumeUploads() {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+
+	for _, uploadType := range []string{models.UploadTypeISO, models.UploadTypeImage} {
+		base := s.uploadTarget(uploadType)
+		if base == "" {
+			continue
+		}
+		dir := filepath.Join(base, uploadDir)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.Logger.Warn("Failed to read uploads", "dir", dir, "error", err)
+			}
+			continue
+		}
+		for _, entry := range entries {
+			if filepath.Ext(entry.Name()) != ".json" {
+				continue
+			}
+			raw, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				s.Logger.Warn("Failed to read upload state", "file", entry.Name(), "error", err)
+				continue
+			}
+			u := &uploadSession{}
+			if err := json.Unmarshal(raw, &u.UploadSession); err != nil || u.ID == "" || u.Type != uploadType {
+				s.Logger.Warn("Invalid upload state", "file", entry.Name(), "error", err)
+				continue
+			}
+			info, err := os.Stat(s.uploadDataPath(u.UploadSession))
+			if err != nil {
+				s.Logger.Warn("Upload data is missing", "id", u.ID, "error", err)
+				continue
+			}
+			u.Offset = min(info.Size(), u.Length)
+			s.uploads[u.ID] = u
+		}
+	}
+}
+
+func (s *ISOService) lookupUpload(id string) (uploadSession, bool) {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	u, ok := s.uploads[id]
+	if !ok {
+		return uploadSession{}, false
+	}
+	return *u, true
+}
+
+// removeUpload forgets an upload and deletes its files
+func (s *ISOService) removeUpload(u models.UploadSession) {
+	s.uploadsMu.Lock()
+	delete(s.uploads, u.ID)
+	s.uploadsMu.Unlock()
+
+	if err := os.Remove(s.uploadDataPath(u)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.Logger.Warn("Failed to remove upload data", "id", u.ID, "error", err)
+	}
+	os.Remove(s.uploadStatePath(u))
+}
+
+// saveUpload persists the state of an upload next to its data
+func (s *ISOService) saveUpload(u models.UploadSession) {
+	raw, err := json.Marshal(u)
+	if err == nil {
+		err = os.WriteFile(s.uploadStatePath(u), raw, 0o644)
+	}
+	if err != nil {
+		s.Logger.Warn("Failed to save upload state", "id", u.ID, "error", err)
+	}
+}
+
+// uploadTarget returns the directory uploads of a type end up in, empty for
+// unknown types
+func (s *ISOService) uploadTarget(uploadType string) string {
+	switch uploadType {
+	case models.UploadTypeISO:
+		return s.FS.ISOs
+	case models.UploadTypeImage:
+		return s.FS.Images
+	}
+	return ""
+}
+
+func (s *ISOService) uploadDataPath(u models.UploadSession) string {
+	return filepath.Join(s.uploadTarget(u.Type), uploadDir, u.ID+".bin")
+}
+
+func (s *ISOService) uploadStatePath(u models.UploadSession) string {
+	return filepath.Join(s.uploadTarget(u.Type), uploadDir, u.ID+".json")
+}
+
+// checkTusVersion rejects tus requests for another protocol version and
+// sets the Tus-Resumable response header
+func (s *ISOService) checkTusVersion(c echo.Context) error {
+	c.Response().Header().Set("Tus-Resumable", tusVersion)
+	if v := c.Request().Header.Get("Tus-Resumable"); v != tusVersion {
+		c.Response().Header().Set("Tus-Version", tusVersion)
+		return s.Dispatcher.NewHTTPError(http.StatusPreconditionFailed, "Unsupported tus version", nil)
+	}
+	return nil
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma separated
+// keys, each followed by a space and its base64 encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q is not base64: %w", key, err)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+func uploadExpiry() time.Duration {
+	if models.ENV_VARS.UploadExpiryHours > 0 {
+		return time.Duration(models.ENV_VARS.UploadExpiryHours) * time.Hour
+	}
+	return defaultUploadExpiry
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Used when the environment leaves a capacity threshold unset
+const (
+	defaultCPUOvercommitRatio    = 4
+	defaultMemoryOvercommitRatio = 1
+	defaultMinFreeMemoryMB       = 512
+	defaultMinFreeDiskPercent    = 10
+)
+
+// capacityMode returns the configured capacity mode, rejecting by default
+func capacityMode() string {
+	if slices.Contains(models.CapacityModes, models.ENV_VARS.CapacityMode) {
+		return models.ENV_VARS.CapacityMode
+	}
+	return models.CapacityModeReject
+}
+
+func orDefault[T uint64 | float64](v, def T) T {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// hostCapacity collects the host's resources, what running VMs already hold
+// and the configured limits
+func (s *QemuService) hostCapacity() (models.HostCapacity, error) {
+	capacity := models.HostCapacity{
+		Mode:                  capacityMode(),
+		CPUOvercommitRatio:    orDefault(models.ENV_VARS.CPUOvercommitRatio, defaultCPUOvercommitRatio),
+		MemoryOvercommitRatio: orDefault(models.ENV_VARS.MemoryOvercommitRatio, defaultMemoryOvercommitRatio),
+		MinFreeMemoryKiB:      orDefault(models.ENV_VARS.MinFreeMemoryMB, defaultMinFreeMemoryMB) * 1024,
+		MinFreeDiskPercent:    orDefault(models.ENV_VARS.MinFreeDiskPercent, defaultMinFreeDiskPercent),
+		DiskPath:              s.FS.Images,
+	}
+
+	_, memoryKiB, cpus, _, _, _, _, _, err := s.LibVirt.NodeGetInfo()
+	if err != nil {
+		return capacity, fmt.Errorf("failed to get host info: %w", err)
+	}
+	freeMemory, err := s.LibVirt.NodeGetFreeMemory()
+	if err != nil {
+		return capacity, fmt.Errorf("failed to get host free memory: %w", err)
+	}
+	capacity.CPUs = int(cpus)
+	capacity.MemoryKiB = memoryKiB
+	capacity.FreeMemoryKiB = freeMemory / 1024
+	capacity.VCPULimit = uint64(float64(cpus) * capacity.CPUOvercommitRatio)
+	capacity.MemoryLimitKiB = uint64(float64(memoryKiB) * capacity.MemoryOvercommitRatio)
+
+	stats := libvirt.DomainStatsBalloon | libvirt.DomainStatsVCPU
+	records, err := s.LibVirt.ConnectGetAllDomainStats(nil, uint32(stats), uint32(libvirt.ConnectGetAllDomainsStatsActive))
+	if err != nil {
+		return capacity, fmt.Errorf("failed to get domain stats: %w", err)
+	}
+	for _, r := range records {
+		capacity.AllocatedVCPUs += typedParamUint64(r.Params, "vcpu.maximum")
+		capacity.AllocatedMemoryKiB += typedParamUint64(r.Params, "balloon.maximum")
+	}
+
+	capacity.DiskTotalBytes, capacity.DiskFreeBytes, err = utils.DiskUsage(s.FS.Images)
+	if err != nil {
+		return capacity, fmt.Errorf("failed to get image filesystem usage: %w", err)
+	}
+	return capacity, nil
+}
+
+// checkCapacity checks a planned VM against the host's capacity. Memory and
+// disk sizes are in MiB
+func checkCapacity(c models.HostCapacity, memoryMB int64, vcpus int32, diskMB int64) []models.CapacityCheck {
+	memoryKiB := uint64(max(memoryMB, 0)) * 1024
+	diskBytes := uint64(max(diskMB, 0)) * 1024 * 1024
+	reservedDisk := uint64(float64(c.DiskTotalBytes) * c.MinFreeDiskPercent / 100)
+
+	return []models.CapacityCheck{
+		newCapacityCheck("vcpus", uint64(max(vcpus, 0)), headroom(c.VCPULimit, c.AllocatedVCPUs),
+			"%d vCPUs requested but only %d of %d are left (%d CPUs × %g overcommit)",
+			c.VCPULimit, c.CPUs, c.CPUOvercommitRatio),
+		newCapacityCheck("memory", memoryKiB, headroom(c.MemoryLimitKiB, c.AllocatedMemoryKiB),
+			"%d KiB of memory requested but only %d of %d KiB are left (%g overcommit)",
+			c.MemoryLimitKiB, c.MemoryOvercommitRatio),
+		newCapacityCheck("free_memory", memoryKiB, headroom(c.FreeMemoryKiB, c.MinFreeMemoryKiB),
+			"%d KiB of memory requested but only %d KiB are free above the %d KiB reserve",
+			c.MinFreeMemoryKiB),
+		newCapacityCheck("disk", diskBytes, headroom(c.DiskFreeBytes, reservedDisk),
+			"%d bytes of disk requested but only %d are free above the %g%% reserve",
+			c.MinFreeDiskPercent),
+	}
+}
+
+// newCapacityCheck builds the check of one resource. The message format gets
+// the requested amount, the headroom and then args
+func newCapacityCheck(resource string, requested, available uint64, format string, args ...any) models.CapacityCheck {
+	check := models.CapacityCheck{
+		Resource:  resource,
+		Requested: requested,
+		Available: available,
+		OK:        requested <= available,
+	}
+	if !check.OK {
+		check.Message = fmt.Sprintf(format, append([]any{requested, available}, args...)...)
+	}
+	return check
+}
+
+func headroom(limit, used uint64) uint64 {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+// capacityFailures returns the messages of the failed checks
+func capacityFailures(checks []models.CapacityCheck) []string {
+	var failures []string
+	for _, check := range checks {
+		if !check.OK {
+			failures = append(failures, check.Message)
+		}
+	}
+	return failures
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"visory/internal/utils"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/gofrs/uuid"
+)
+
+// domainCacheTTL bounds how stale cached domain details can get when a change
+// does not raise a lifecycle event (e.g. metadata edited with virsh)
+const domainCacheTTL = 30 * time.Second
+
+// domainDetails holds the parts of a domain's XML the API needs on every
+// request, so they do not cost a DomainGetXMLDesc round trip each time
+type domainDetails struct {
+	Description string
+	Labels      map[string]string
+	VNCIP       string
+	VNCPort     int
+	fetchedAt   time.Time
+}
+
+type domainCache struct {
+	mu      sync.RWMutex
+	entries map[string]domainDetails
+}
+
+func (c *domainCache) get(key string) (domainDetails, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	d, ok := c.entries[key]
+	if !ok || time.Since(d.fetchedAt) > domainCacheTTL {
+		return domainDetails{}, false
+	}
+	return d, true
+}
+
+func (c *domainCache) set(key string, d domainDetails) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]domainDetails{}
+	}
+	d.fetchedAt = time.Now()
+	c.entries[key] = d
+}
+
+func (c *domainCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *domainCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// domainDetails returns the cached details of a domain, reading its XML on a miss
+func (s *QemuService) domainDetails(domain libvirt.Domain) (domainDetails, error) {
+	key := domainUUIDString(domain)
+	if d, ok := s.cache.get(key); ok {
+		return d, nil
+	}
+
+	domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		return domainDetails{}, err
+	}
+	description, meta, err := utils.MetadataFromDomainXML(domainXML)
+	if err != nil {
+		return domainDetails{}, err
+	}
+	d := domainDetails{Description: description, Labels: meta.LabelMap()}
+	if len(d.Labels) == 0 {
+		d.Labels = nil
+	}
+	d.VNCIP, d.VNCPort, err = utils.VNCFromDomainXML(domainXML)
+	if err != nil && err != utils.ErrVNCNotFound {
+		s.Logger.Warn("Failed to parse VNC info from domain xml", "domain", domain.Name, "error", err)
+	}
+
+	s.cache.set(key, d)
+	return d, nil
+}
+
+// watchDomainEvents drops cached details of domains as libvirt reports
+// lifecycle changes for them (start, stop, define, undefine, ...), forgets
+// the screenshots of domains that stopped or were undefined and feeds the
+// restart watchdog
+func (s *QemuService) watchDomainEvents(ctx context.Context) {
+	events, err := s.LibVirt.LifecycleEvents(ctx)
+	if err != nil {
+		s.Logger.Warn("Failed to subscribe to domain lifecycle events", "error", err)
+		return
+	}
+
+	go func() {
+		for ev := range events {
+			key := domainUUIDString(ev.Dom)
+			s.cache.invalidate(key)
+			switch libvirt.DomainEventType(ev.Event) {
+			case libvirt.DomainEventStopped, libvirt.DomainEventUndefined:
+				s.forgetScreenshot(key)
+			}
+			s.handleRestartEvent(ev)
+		}
+		// Without events the cache can no longer be trusted beyond its TTL
+		s.cache.clear()
+		s.Logger.Warn("Domain lifecycle event stream closed")
+	}()
+}
+
+// typedParamUint64 returns the numeric value of a domain stats field
+func typedParamUint64(params []libvirt.TypedParam, field string) uint64 {
+	for _, p := range params {
+		if p.Field != field {
+			continue
+		}
+		switch v := p.Value.I.(type) {
+		case uint64:
+			return v
+		case int64:
+			return uint64(v)
+		case uint32:
+			return uint64(v)
+		case int32:
+			return uint64(v)
+		}
+	}
+	return 0
+}
+
+func domainUUIDString(domain libvirt.Domain) string {
+	id, err := uuid.FromBytes(domain.UUID[:])
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
@@ -0,0 +1,696 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo/v4"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// imageJobSuffix marks the file a convert or compact writes before it is
+// moved into place. Leftovers of an interrupted run are removed on startup
+const imageJobSuffix = ".part"
+
+// Extensions given to converted images
+var diskImageExtensions = map[string]string{
+	"qcow2": ".qcow2",
+	"raw":   ".img",
+	"vmdk":  ".vmdk",
+	"vdi":   ".vdi",
+	"vhdx":  ".vhdx",
+}
+
+// imageJobs tracks the converts and compacts of this process
+type imageJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*models.DiskImageJob
+}
+
+// writing returns the running job writing the image called name
+func (j *imageJobs) writing(name string) *models.DiskImageJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, job := range j.jobs {
+		if job.Status == models.DiskImageJobStatusRunning && job.Target == name {
+			out := *job
+			return &out
+		}
+	}
+	return nil
+}
+
+// busy returns the running job reading or writing the image called name
+func (j *imageJobs) busy(name string) *models.DiskImageJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, job := range j.jobs {
+		if job.Status == models.DiskImageJobStatusRunning && (job.Image == name || job.Target == name) {
+			out := *job
+			return &out
+		}
+	}
+	return nil
+}
+
+//	@Summary      List disk images
+//	@Description  Get every disk image with its format, virtual and actual size, backing chain and the VMs using it. Images nothing uses are flagged as orphaned
+//	@Tags         qemu
+//	@Produce      json
+//	@Success      200  {array}   models.DiskImage
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/images [get]
+//
+// ListDiskImages returns the disk images of the image directory
+func (s *QemuService) ListDiskImages(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	images, err := s.diskImages()
+	if err != nil {
+		s.Logger.Error("Failed to list disk images", "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to list disk images", err)
+	}
+	return c.JSON(http.StatusOK, images)
+}
+
+//	@Summary      Get disk image
+//	@Description  Get the format, sizes, backing chain and users of a disk image
+//	@Tags         qemu
+//	@Param        name  path  string  true  "Image file name"
+//	@Produce      json
+//	@Success      200  {object}  models.DiskImage
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/images/{name} [get]
+//
+// GetDiskImage returns a single disk image
+func (s *QemuService) GetDiskImage(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	image, err := s.diskImage(c.Param("name"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, image)
+}
+
+//	@Summary      Convert disk image
+//	@Description  Convert a disk image to qcow2, raw, vmdk, vdi or vhdx in the background. The result is a new standalone image, the original and the VMs using it are left as they are
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        name  path  string                          true  "Image file name"
+//	@Param        body  body  models.ConvertDiskImageRequest  true  "Target format"
+//	@Produce      json
+//	@Success      202  {object}  models.DiskImageJob
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/images/{name}/convert [post]
+//
+// ConvertDiskImage starts converting a disk image to another format
+func (s *QemuService) ConvertDiskImage(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	req := new(models.ConvertDiskImageRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request body", err)
+	}
+	if !slices.Contains(models.DiskImageFormats, req.Format) {
+		return s.Dispatcher.NewBadRequest("Invalid format", nil)
+	}
+	if req.Compress && req.Format != "qcow2" {
+		return s.Dispatcher.NewBadRequest("Only qcow2 images can be compressed", nil)
+	}
+
+	image, err := s.diskImageForJob(c.Param("name"))
+	if err != nil {
+		return err
+	}
+	target := req.Name
+	if target == "" {
+		target = strings.TrimSuffix(image.Name, filepath.Ext(image.Name)) + diskImageExtensions[req.Format]
+	}
+	targetPath, err := s.diskImagePath(target)
+	if err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid image name", err)
+	}
+	if target == image.Name {
+		return s.Dispatcher.NewBadRequest("The converted image needs another name, use compact to rewrite an image in place", nil)
+	}
+	if _, err := os.Stat(targetPath); err == nil {
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Image '%s' already exists", target), nil)
+	}
+
+	job, err := s.startImageJob(c, image, models.DiskImageJobConvert, target, req.Format, func(ctx context.Context, part string) error {
+		return s.images.ConvertDiskImage(ctx, image.Path, part, utils.DiskConvertOptions{Format: req.Format, Compress: req.Compress})
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, job)
+}
+
+//	@Summary      Compact disk image
+//	@Description  Rewrite a disk image in the background without the space its guest freed, optionally compressing it. The backing file of an overlay is kept. VMs using the image must be shut off
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        name  path  string                          true   "Image file name"
+//	@Param        body  body  models.CompactDiskImageRequest  false  "Compaction options"
+//	@Produce      json
+//	@Success      202  {object}  models.DiskImageJob
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/images/{name}/compact [post]
+//
+// CompactDiskImage starts compacting a disk image in place
+func (s *QemuService) CompactDiskImage(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	req := new(models.CompactDiskImageRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request body", err)
+	}
+
+	image, err := s.diskImageForJob(c.Param("name"))
+	if err != nil {
+		return err
+	}
+	if req.Compress && image.Format != "qcow2" {
+		return s.Dispatcher.NewBadRequest("Only qcow2 images can be compressed", nil)
+	}
+	opts := utils.DiskConvertOptions{Format: image.Format, Compress: req.Compress}
+	if len(image.BackingChain) > 0 {
+		opts.BackingFile = image.BackingChain[0].Path
+		opts.BackingFormat = image.BackingChain[0].Format
+	}
+
+	job, err := s.startImageJob(c, image, models.DiskImageJobCompact, image.Name, image.Format, func(ctx context.Context, part string) error {
+		return s.images.ConvertDiskImage(ctx, image.Path, part, opts)
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, job)
+}
+
+//	@Summary      List disk image jobs
+//	@Description  Get the converts and compacts started since the server started
+//	@Tags         qemu
+//	@Produce      json
+//	@Success      200  {array}   models.DiskImageJob
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Router       /qemu/image-jobs [get]
+//
+// ListDiskImageJobs returns the disk image jobs, newest first
+func (s *QemuService) ListDiskImageJobs(c echo.Context) error {
+	s.imageJobs.mu.Lock()
+	jobs := make([]models.DiskImageJob, 0, len(s.imageJobs.jobs))
+	for _, job := range s.imageJobs.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.imageJobs.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.After(jobs[j].StartedAt) })
+	return c.JSON(http.StatusOK, jobs)
+}
+
+//	@Summary      Get disk image job
+//	@Description  Get the state of a convert or compact started since the server started
+//	@Tags         qemu
+//	@Param        id  path  string  true  "Job ID"
+//	@Produce      json
+//	@Success      200  {object}  models.DiskImageJob
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Router       /qemu/image-jobs/{id} [get]
+//
+// GetDiskImageJob returns the state of a disk image job
+func (s *QemuService) GetDiskImageJob(c echo.Context) error {
+	s.imageJobs.mu.Lock()
+	job, ok := s.imageJobs.jobs[c.Param("id")]
+	var out models.DiskImageJob
+	if ok {
+		out = *job
+	}
+	s.imageJobs.mu.Unlock()
+	if !ok {
+		return s.Dispatcher.NewNotFound("Disk image job not found", nil)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+//	@Summary      Delete disk image
+//	@Description  Delete a disk image no VM uses, directly or as a backing file, and that no other image is built on
+//	@Tags         qemu
+//	@Param        name  path  string  true  "Image file name"
+//	@Produce      json
+//	@Success      200  {object}  map[string]interface{}
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/images/{name} [delete]
+//
+// DeleteDiskImage deletes an orphaned disk image
+func (s *QemuService) DeleteDiskImage(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	image, err := s.diskImage(c.Param("name"))
+	if err != nil {
+		return err
+	}
+	if image.Job != nil {
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Image '%s' is busy with a %s job", image.Name, image.Job.Operation), nil)
+	}
+	if len(image.UsedBy) > 0 {
+		names := []string{}
+		for _, u := range image.UsedBy {
+			if !slices.Contains(names, u.Name) {
+				names = append(names, u.Name)
+			}
+		}
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Image '%s' is used by %s", image.Name, strings.Join(names, ", ")), nil)
+	}
+	if len(image.BackingOf) > 0 {
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Image '%s' is the backing file of %s", image.Name, strings.Join(image.BackingOf, ", ")), nil)
+	}
+
+	if err := os.Remove(image.Path); err != nil {
+		s.Logger.Error("Failed to delete disk image", "name", image.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to delete disk image", err)
+	}
+
+	s.Logger.Info("Disk image deleted", "name", image.Name, "size", image.ActualSize)
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: userIDFromContext(c), Event: "IMAGE_DELETE", Subject: image.Name, Level: "INFO",
+		Message: "disk image deleted", Fields: map[string]string{
+			"Format": image.Format,
+			"Size":   strconv.FormatInt(image.ActualSize, 10),
+		},
+	})
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("Disk image '%s' deleted successfully", image.Name),
+	})
+}
+
+// diskImage returns the image called name, as listed by diskImages
+func (s *QemuService) diskImage(name string) (models.DiskImage, error) {
+	path, err := s.diskImagePath(name)
+	if err != nil {
+		return models.DiskImage{}, s.Dispatcher.NewBadRequest("Invalid image name", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return models.DiskImage{}, s.Dispatcher.NewNotFound("Disk image not found", err)
+		}
+		return models.DiskImage{}, s.Dispatcher.NewInternalServerError("Failed to read disk image", err)
+	}
+
+	images, err := s.diskImages()
+	if err != nil {
+		s.Logger.Error("Failed to list disk images", "error", err)
+		return models.DiskImage{}, s.Dispatcher.NewInternalServerError("Failed to read disk image", err)
+	}
+	for _, image := range images {
+		if image.Name == name {
+			return image, nil
+		}
+	}
+	return models.DiskImage{}, s.Dispatcher.NewNotFound("Disk image not found", nil)
+}
+
+// diskImageForJob returns the image called name if it can be rewritten:
+// it was inspected, is idle and no running VM has it open
+func (s *QemuService) diskImageForJob(name string) (models.DiskImage, error) {
+	image, err := s.diskImage(name)
+	if err != nil {
+		return image, err
+	}
+	if image.Error != "" {
+		return image, s.Dispatcher.NewConflict(fmt.Sprintf("Image '%s' could not be inspected: %s", image.Name, image.Error), nil)
+	}
+	if image.Job != nil {
+		return image, s.Dispatcher.NewConflict(fmt.Sprintf("Image '%s' is busy with a %s job", image.Name, image.Job.Operation), nil)
+	}
+	for _, u := range image.UsedBy {
+		if u.Active {
+			return image, s.Dispatcher.NewConflict(fmt.Sprintf("Image '%s' is in use by the running VM %s", image.Name, u.Name), nil)
+		}
+	}
+	return image, nil
+}
+
+// diskImages inspects every image of the image directory and finds the VMs
+// using them. A VM using an overlay also uses every image of its chain
+func (s *QemuService) diskImages() ([]models.DiskImage, error) {
+	entries, err := os.ReadDir(s.FS.Images)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.diskImageUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []models.DiskImage{}
+	for _, entry := range entries {
+		// Hidden entries hold unfinished uploads and jobs
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		image := models.DiskImage{
+			Name:        entry.Name(),
+			Path:        filepath.Join(s.FS.Images, entry.Name()),
+			ActualSize:  info.Size(),
+			VirtualSize: info.Size(),
+			Modified:    info.ModTime(),
+			UsedBy:      users[filepath.Join(s.FS.Images, entry.Name())],
+			Job:         s.imageJobs.busy(entry.Name()),
+		}
+		if chain, err := s.images.DiskImageInfo(image.Path); err != nil {
+			image.Error = err.Error()
+		} else if len(chain) > 0 {
+			image.Format = chain[0].Format
+			image.VirtualSize = chain[0].VirtualSize
+			image.ActualSize = chain[0].ActualSize
+			image.BackingChain = chain[1:]
+		}
+		images = append(images, image)
+	}
+
+	byPath := map[string]*models.DiskImage{}
+	for i := range images {
+		byPath[images[i].Path] = &images[i]
+	}
+	for _, image := range images {
+		direct := users[image.Path]
+		for _, layer := range image.BackingChain {
+			base, ok := byPath[filepath.Clean(layer.Path)]
+			if !ok {
+				continue
+			}
+			if !slices.Contains(base.BackingOf, image.Name) {
+				base.BackingOf = append(base.BackingOf, image.Name)
+			}
+			for _, u := range direct {
+				u.Backing = true
+				base.UsedBy = addDiskImageUser(base.UsedBy, u)
+			}
+		}
+	}
+	for i := range images {
+		images[i].Orphaned = len(images[i].UsedBy) == 0 && len(images[i].BackingOf) == 0 && images[i].Job == nil
+	}
+	return images, nil
+}
+
+// diskImageUsers maps the files used by the disks of every domain to those
+// disks. Both the running and the persistent definition are read, since
+// they differ after a live media or disk change
+func (s *QemuService) diskImageUsers() (map[string][]models.DiskImageUser, error) {
+	domains, _, err := s.LibVirt.ConnectListAllDomains(1, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string][]models.DiskImageUser{}
+	for _, domain := range domains {
+		active, _ := s.LibVirt.DomainIsActive(domain)
+		flags := []libvirt.DomainXMLFlags{0}
+		if persistent, _ := s.LibVirt.DomainIsPersistent(domain); active == 1 && persistent == 1 {
+			flags = append(flags, libvirt.DomainXMLInactive)
+		}
+		for _, flag := range flags {
+			domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, flag)
+			if err != nil {
+				s.Logger.Warn("Failed to read domain xml", "name", domain.Name, "error", err)
+				continue
+			}
+			def := &libvirtxml.Domain{}
+			if err := def.Unmarshal(domainXML); err != nil || def.Devices == nil {
+				continue
+			}
+			for i := range def.Devices.Disks {
+				disk := &def.Devices.Disks[i]
+				u := models.DiskImageUser{UUID: domainUUIDString(domain), Name: domain.Name, Active: active == 1}
+				if disk.Target != nil {
+					u.Device = disk.Target.Dev
+				}
+				if file := utils.DiskSourceFile(disk); file != "" {
+					users[filepath.Clean(file)] = addDiskImageUser(users[filepath.Clean(file)], u)
+				}
+				// Running domains list their backing chain too
+				u.Backing = true
+				for b := disk.BackingStore; b != nil; b = b.BackingStore {
+					if b.Source != nil && b.Source.File != nil && b.Source.File.File != "" {
+						file := filepath.Clean(b.Source.File.File)
+						users[file] = addDiskImageUser(users[file], u)
+					}
+				}
+			}
+		}
+	}
+	return users, nil
+}
+
+func addDiskImageUser(users []models.DiskImageUser, u models.DiskImageUser) []models.DiskImageUser {
+	for _, existing := range users {
+		if existing.UUID == u.UUID && existing.Device == u.Device {
+			return users
+		}
+	}
+	return append(users, u)
+}
+
+// startImageJob runs write in the background into a hidden file, which then
+// replaces or becomes the target image. Jobs writing the same image conflict
+func (s *QemuService) startImageJob(c echo.Context, image models.DiskImage, operation, target, format string, write func(ctx context.Context, part string) error) (models.DiskImageJob, error) {
+	id, _ := uuid.NewV4()
+	job := &models.DiskImageJob{
+		ID:         id.String(),
+		Operation:  operation,
+		Image:      image.Name,
+		Target:     target,
+		Format:     format,
+		Status:     models.DiskImageJobStatusRunning,
+		SizeBefore: image.ActualSize,
+		StartedAt:  time.Now(),
+		UserID:     userIDFromContext(c),
+	}
+	s.imageJobs.mu.Lock()
+	for _, other := range s.imageJobs.jobs {
+		if other.Status == models.DiskImageJobStatusRunning && (other.Image == target || other.Target == target || other.Target == image.Name) {
+			s.imageJobs.mu.Unlock()
+			return models.DiskImageJob{}, s.Dispatcher.NewConflict(fmt.Sprintf("Image '%s' is already being written", target), nil)
+		}
+	}
+	s.imageJobs.jobs[job.ID] = job
+	snapshot := *job
+	s.imageJobs.mu.Unlock()
+
+	s.Logger.Info("Disk image job started", "id", job.ID, "operation", operation, "image", image.Name, "target", target, "format", format)
+	go s.runImageJob(job, write)
+	return snapshot, nil
+}
+
+func (s *QemuService) runImageJob(job *models.DiskImageJob, write func(ctx context.Context, part string) error) {
+	part := filepath.Join(s.FS.Images, "."+job.ID+imageJobSuffix)
+	target := filepath.Join(s.FS.Images, job.Target)
+
+	err := write(context.Background(), part)
+	if err == nil && job.Image == job.Target {
+		// A VM started behind the job's back would lose its writes to the
+		// rename, so the compacted image is dropped instead
+		err = s.checkImageIdle(target)
+	}
+	if err == nil {
+		err = os.Rename(part, target)
+	}
+	var sizeAfter int64
+	if err != nil {
+		os.Remove(part)
+	} else if chain, infoErr := s.images.DiskImageInfo(target); infoErr == nil && len(chain) > 0 {
+		sizeAfter = chain[0].ActualSize
+	}
+
+	now := time.Now()
+	s.imageJobs.mu.Lock()
+	job.FinishedAt = &now
+	job.SizeAfter = sizeAfter
+	if err != nil {
+		job.Status = models.DiskImageJobStatusFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = models.DiskImageJobStatusCompleted
+	}
+	snapshot := *job
+	s.imageJobs.mu.Unlock()
+
+	event := "IMAGE_" + strings.ToUpper(snapshot.Operation)
+	fields := map[string]string{
+		"Image":  snapshot.Image,
+		"Target": snapshot.Target,
+		"Format": snapshot.Format,
+		"Before": strconv.FormatInt(snapshot.SizeBefore, 10),
+	}
+	if err != nil {
+		s.Logger.Error("Disk image job failed", "id", snapshot.ID, "operation", snapshot.Operation, "image", snapshot.Image, "error", err)
+		fields["Error"] = err.Error()
+		s.Dispatcher.SendError("Disk image "+snapshot.Operation+" failed", fmt.Sprintf("Could not %s '%s'", snapshot.Operation, snapshot.Image), fields)
+		_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+			UserId: snapshot.UserID, Event: event, Subject: snapshot.Image, Level: "ERROR",
+			Message: err.Error(), Fields: fields,
+		})
+		return
+	}
+
+	fields["After"] = strconv.FormatInt(snapshot.SizeAfter, 10)
+	s.Logger.Info("Disk image job completed", "id", snapshot.ID, "operation", snapshot.Operation, "image", snapshot.Image, "size_before", snapshot.SizeBefore, "size_after", snapshot.SizeAfter)
+	s.Dispatcher.SendSuccess("Disk image "+snapshot.Operation+" completed", fmt.Sprintf("'%s' was written", snapshot.Target), fields)
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: snapshot.UserID, Event: event, Subject: snapshot.Image, Level: "INFO",
+		Message: snapshot.Operation + " completed", Fields: fields,
+	})
+}
+
+// checkImageIdle fails when a running VM uses the image at path
+func (s *QemuService) checkImageIdle(path string) error {
+	users, err := s.diskImageUsers()
+	if err != nil {
+		return fmt.Errorf("failed to check the VMs using the image: %w", err)
+	}
+	for _, u := range users[filepath.Clean(path)] {
+		if u.Active {
+			return fmt.Errorf("the VM %s was started while the image was rewritten, its original is kept", u.Name)
+		}
+	}
+	return nil
+}
+
+// domainImageJob returns the running job rewriting a disk of domain or an
+// image of their backing chains, nil when there is none
+func (s *QemuService) domainImageJob(domain libvirt.Domain) *models.DiskImageJob {
+	s.imageJobs.mu.Lock()
+	running := 0
+	for _, job := range s.imageJobs.jobs {
+		if job.Status == models.DiskImageJobStatusRunning {
+			running++
+		}
+	}
+	s.imageJobs.mu.Unlock()
+	if running == 0 {
+		return nil
+	}
+
+	domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		s.Logger.Warn("Failed to read domain xml", "name", domain.Name, "error", err)
+		return nil
+	}
+	def := &libvirtxml.Domain{}
+	if err := def.Unmarshal(domainXML); err != nil || def.Devices == nil {
+		return nil
+	}
+	for i := range def.Devices.Disks {
+		file := utils.DiskSourceFile(&def.Devices.Disks[i])
+		if file == "" {
+			continue
+		}
+		files := []string{file}
+		if chain, err := s.images.DiskImageInfo(file); err == nil {
+			for _, layer := range chain {
+				files = append(files, layer.Path)
+			}
+		}
+		for _, f := range files {
+			if filepath.Dir(filepath.Clean(f)) != filepath.Clean(s.FS.Images) {
+				continue
+			}
+			if job := s.imageJobs.writing(filepath.Base(f)); job != nil {
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+// removeStaleImageJobs deletes the files of jobs interrupted by a restart
+func (s *QemuService) removeStaleImageJobs() {
+	parts, _ := filepath.Glob(filepath.Join(s.FS.Images, ".*"+imageJobSuffix))
+	for _, part := range parts {
+		if err := os.Remove(part); err == nil {
+			s.Logger.Info("Removed unfinished disk image job", "path", part)
+		}
+	}
+}
+
+// removeDomainDisks deletes the disk images a domain definition created in
+// the image directory, for domains that never came to exist
+func (s *QemuService) removeDomainDisks(domainXML string) {
+	def := &libvirtxml.Domain{}
+	if err := def.Unmarshal(domainXML); err != nil || def.Devices == nil {
+		return
+	}
+	for i := range def.Devices.Disks {
+		disk := &def.Devices.Disks[i]
+		file := utils.DiskSourceFile(disk)
+		if disk.Device == "cdrom" || file == "" || filepath.Dir(file) != filepath.Clean(s.FS.Images) {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			s.Logger.Warn("Failed to remove disk image", "path", file, "error", err)
+		}
+	}
+}
+
+// diskImagePath returns the path of the image called name, which must be a
+// plain file name of the image directory
+func (s *QemuService) diskImagePath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid image name %q", name)
+	}
+	return filepath.Join(s.FS.Images, name), nil
+}
@@ -0,0 +1,353 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"visory/internal/models"
+	"visory/internal/utils"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+const (
+	restartBackoffBase = 5 * time.Second
+	restartBackoffMax  = 5 * time.Minute
+	// restartStableAfter is how long a restarted VM must stay up before its
+	// attempts counter starts over
+	restartStableAfter = 10 * time.Minute
+	// defaultRestartMaxAttempts is used when neither the VM nor the
+	// environment sets a limit
+	defaultRestartMaxAttempts = 5
+)
+
+// restartTracker is the watchdog's view of a VM with a restart policy
+type restartTracker struct {
+	Name        string
+	Policy      string
+	MaxAttempts int
+	Persistent  bool
+	XML         string // live definition, needed to recreate transient domains
+
+	Attempts    int
+	GivenUp     bool
+	LastRestart time.Time
+	NextAttempt time.Time
+
+	expectStop bool
+	timer      *time.Timer
+}
+
+// restartWatchdog restarts crashed or stopped VMs according to their
+// restart policy, backing off exponentially and giving up on flapping VMs
+type restartWatchdog struct {
+	mu          sync.Mutex
+	domains     map[string]*restartTracker
+	backoffBase time.Duration
+}
+
+// startRestartWatchdog picks up the restart policies of existing domains.
+// Changes are then followed through lifecycle events
+func (s *QemuService) startRestartWatchdog() {
+	domains, _, err := s.LibVirt.ConnectListAllDomains(1, 0)
+	if err != nil {
+		s.Logger.Warn("Failed to list domains for the restart watchdog", "error", err)
+		return
+	}
+	for _, domain := range domains {
+		s.trackDomain(domain)
+	}
+}
+
+// trackDomain refreshes the watchdog's entry for a domain from its XML,
+// keeping the restart counters of a domain that is already tracked
+func (s *QemuService) trackDomain(domain libvirt.Domain) {
+	key := domainUUIDString(domain)
+	domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		s.Logger.Warn("Failed to read domain for the restart watchdog", "domain", domain.Name, "error", err)
+		return
+	}
+	_, meta, err := utils.MetadataFromDomainXML(domainXML)
+	if err != nil {
+		s.Logger.Warn("Failed to parse domain metadata", "domain", domain.Name, "error", err)
+		return
+	}
+	persistent, _ := s.LibVirt.DomainIsPersistent(domain)
+
+	w := &s.restarts
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	policy := meta.RestartPolicy()
+	if policy == models.RestartPolicyNever {
+		if t, ok := w.domains[key]; ok && t.timer != nil {
+			t.timer.Stop()
+		}
+		delete(w.domains, key)
+		return
+	}
+
+	if w.domains == nil {
+		w.domains = map[string]*restartTracker{}
+	}
+	t, ok := w.domains[key]
+	if !ok {
+		t = &restartTracker{}
+		w.domains[key] = t
+	}
+	t.Name = domain.Name
+	t.Policy = policy
+	t.MaxAttempts = meta.Restart.MaxAttempts
+	t.Persistent = persistent == 1
+	t.XML = domainXML
+}
+
+// expectStop marks a VM as being stopped on purpose, so the watchdog leaves
+// it alone even with the "always" policy. It is cleared again when the stop
+// request fails, so a later crash is still restarted
+func (s *QemuService) expectStop(vmUUID string, expected bool) {
+	s.restarts.mu.Lock()
+	defer s.restarts.mu.Unlock()
+	if t, ok := s.restarts.domains[vmUUID]; ok {
+		t.expectStop = expected
+	}
+}
+
+// resetRestarts clears the attempts counter and any pending restart, e.g.
+// after the VM was started by hand
+func (s *QemuService) resetRestarts(vmUUID string) {
+	s.restarts.mu.Lock()
+	defer s.restarts.mu.Unlock()
+	if t, ok := s.restarts.domains[vmUUID]; ok {
+		if t.timer != nil {
+			t.timer.Stop()
+			t.timer = nil
+		}
+		t.Attempts = 0
+		t.GivenUp = false
+		t.NextAttempt = time.Time{}
+	}
+}
+
+// handleRestartEvent reacts to a domain lifecycle event
+func (s *QemuService) handleRestartEvent(ev libvirt.DomainEventLifecycleMsg) {
+	key := domainUUIDString(ev.Dom)
+
+	switch libvirt.DomainEventType(ev.Event) {
+	case libvirt.DomainEventDefined, libvirt.DomainEventStarted:
+		s.trackDomain(ev.Dom)
+		return
+	case libvirt.DomainEventUndefined:
+		s.restarts.mu.Lock()
+		if t, ok := s.restarts.domains[key]; ok {
+			if t.timer != nil {
+				t.timer.Stop()
+			}
+			delete(s.restarts.domains, key)
+		}
+		s.restarts.mu.Unlock()
+		return
+	case libvirt.DomainEventStopped:
+	default:
+		return
+	}
+
+	if audit := s.domainStopped(key, libvirt.DomainEventStoppedDetailType(ev.Detail)); audit != nil {
+		_ = s.Dispatcher.InsertEventIntoDB(*audit)
+	}
+}
+
+// domainStopped schedules the restart of a tracked VM that stopped on its
+// own. It returns the audit event to record once s.restarts.mu is released
+func (s *QemuService) domainStopped(key string, detail libvirt.DomainEventStoppedDetailType) *models.LogEventData {
+	w := &s.restarts
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t, ok := w.domains[key]
+	if !ok {
+		return nil
+	}
+
+	crashed := detail == libvirt.DomainEventStoppedCrashed || detail == libvirt.DomainEventStoppedFailed
+	if detail == libvirt.DomainEventStoppedShutdown && t.expectStop {
+		t.expectStop = false
+		t.Attempts = 0
+		return nil
+	}
+
+	switch {
+	case crashed:
+	case t.Policy == models.RestartPolicyAlways && detail == libvirt.DomainEventStoppedShutdown:
+	default:
+		// Destroyed, saved, migrated or restored from a snapshot on purpose
+		return nil
+	}
+
+	reason := "stopped unexpectedly"
+	if crashed {
+		reason = "crashed"
+	}
+	return s.scheduleRestart(key, t, reason)
+}
+
+// scheduleRestart arms the restart timer of a tracked VM or gives up when it
+// keeps failing. It must be called with s.restarts.mu held, and returns the
+// audit event of giving up for the caller to record after unlocking
+func (s *QemuService) scheduleRestart(key string, t *restartTracker, reason string) *models.LogEventData {
+	if !t.LastRestart.IsZero() && time.Since(t.LastRestart) > restartStableAfter {
+		t.Attempts = 0
+	}
+	if t.GivenUp || t.timer != nil {
+		return nil
+	}
+
+	fields := map[string]string{
+		"VM":       t.Name,
+		"UUID":     key,
+		"Policy":   t.Policy,
+		"Attempts": strconv.Itoa(t.Attempts),
+	}
+
+	maxAttempts := s.restartMaxAttempts(t)
+	if t.Attempts >= maxAttempts {
+		t.GivenUp = true
+		t.NextAttempt = time.Time{}
+		s.Logger.Error("Giving up restarting virtual machine", "name", t.Name, "uuid", key, "attempts", t.Attempts)
+		s.Dispatcher.SendError("VM restart loop", fmt.Sprintf("'%s' %s again after %d restarts, giving up", t.Name, reason, t.Attempts), fields)
+		return &models.LogEventData{
+			UserId: systemUserID, Event: "VM_RESTART", Subject: key, Level: "ERROR",
+			Message: fmt.Sprintf("gave up after %d restarts", t.Attempts), Fields: fields,
+		}
+	}
+
+	base := s.restarts.backoffBase
+	if base <= 0 {
+		base = restartBackoffBase
+	}
+	delay := base << t.Attempts
+	if delay > restartBackoffMax || delay <= 0 {
+		delay = restartBackoffMax
+	}
+	t.Attempts++
+	t.NextAttempt = time.Now().Add(delay)
+	t.timer = time.AfterFunc(delay, func() { s.restartDomain(key) })
+
+	s.Logger.Warn("Virtual machine will be restarted", "name", t.Name, "uuid", key, "reason", reason, "delay", delay, "attempt", t.Attempts)
+	return nil
+}
+
+// restartDomain starts a tracked VM again, rescheduling on failure
+func (s *QemuService) restartDomain(key string) {
+	w := &s.restarts
+	w.mu.Lock()
+	t, ok := w.domains[key]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	t.timer = nil
+	t.NextAttempt = time.Time{}
+	name, persistent, domainXML, attempt := t.Name, t.Persistent, t.XML, t.Attempts
+	w.mu.Unlock()
+
+	var err error
+	domain, lookupErr := s.GetDomainByUUID(key)
+	switch {
+	case lookupErr == nil:
+		if active, _ := s.LibVirt.DomainIsActive(domain); active == 1 {
+			// Started by someone else in the meantime
+			return
+		}
+		if job := s.domainImageJob(domain); job != nil {
+			err = fmt.Errorf("image '%s' is busy with a %s job", job.Target, job.Operation)
+			break
+		}
+		err = s.LibVirt.DomainCreate(domain)
+	case !persistent:
+		// Transient domains are gone once stopped, recreate them
+		_, err = s.LibVirt.DomainCreateXML(domainXML, 0)
+	default:
+		err = lookupErr
+	}
+
+	fields := map[string]string{
+		"VM":      name,
+		"UUID":    key,
+		"Attempt": strconv.Itoa(attempt),
+	}
+
+	if err != nil {
+		s.Logger.Error("Failed to restart virtual machine", "name", name, "uuid", key, "error", err)
+		fields["Error"] = err.Error()
+		s.Dispatcher.SendError("VM restart failed", fmt.Sprintf("Restarting '%s' failed", name), fields)
+		_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+			UserId: systemUserID, Event: "VM_RESTART", Subject: key, Level: "ERROR",
+			Message: err.Error(), Fields: fields,
+		})
+
+		var giveUp *models.LogEventData
+		w.mu.Lock()
+		if t, ok := w.domains[key]; ok {
+			giveUp = s.scheduleRestart(key, t, "failed to restart")
+		}
+		w.mu.Unlock()
+		if giveUp != nil {
+			_ = s.Dispatcher.InsertEventIntoDB(*giveUp)
+		}
+		return
+	}
+
+	w.mu.Lock()
+	if t, ok := w.domains[key]; ok {
+		t.LastRestart = time.Now()
+	}
+	w.mu.Unlock()
+
+	s.Logger.Info("Virtual machine restarted", "name", name, "uuid", key, "attempt", attempt)
+	s.Dispatcher.SendWarning("VM restarted", fmt.Sprintf("'%s' was restarted by its restart policy", name), fields)
+	_ = s.Dispatcher.InsertEventIntoDB(models.LogEventData{
+		UserId: systemUserID, Event: "VM_RESTART", Subject: key, Level: "WARN",
+		Message: fmt.Sprintf("restarted (attempt %d)", attempt), Fields: fields,
+	})
+}
+
+func (s *QemuService) restartMaxAttempts(t *restartTracker) int {
+	if t.MaxAttempts > 0 {
+		return t.MaxAttempts
+	}
+	if models.ENV_VARS.VMRestartMaxAttempts > 0 {
+		return models.ENV_VARS.VMRestartMaxAttempts
+	}
+	return defaultRestartMaxAttempts
+}
+
+// restartStatus returns the policy of a VM along with the watchdog's state
+func (s *QemuService) restartStatus(vmUUID string, meta *utils.VMMetadata) models.VMRestartStatus {
+	status := models.VMRestartStatus{Policy: meta.RestartPolicy()}
+	t := &restartTracker{}
+	if meta.Restart != nil {
+		t.MaxAttempts = meta.Restart.MaxAttempts
+	}
+
+	s.restarts.mu.Lock()
+	if tracked, ok := s.restarts.domains[vmUUID]; ok {
+		t = tracked
+		status.Attempts = t.Attempts
+		status.GivenUp = t.GivenUp
+		if !t.LastRestart.IsZero() {
+			last := t.LastRestart
+			status.LastRestart = &last
+		}
+		if !t.NextAttempt.IsZero() {
+			next := t.NextAttempt
+			status.NextAttempt = &next
+		}
+	}
+	status.MaxAttempts = s.restartMaxAttempts(t)
+	s.restarts.mu.Unlock()
+	return status
+}
@@ -1,56 +1,112 @@
 package services
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"log/slog"
 	"net/http"
-	"net/url"
+	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"visory/internal/hypervisor"
 	"visory/internal/models"
 	"visory/internal/utils"
 
 	"github.com/digitalocean/go-libvirt"
 	"github.com/gofrs/uuid"
 	"github.com/labstack/echo/v4"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
 
+// screenshotCacheTTL limits how often a single VM's display is captured
+const screenshotCacheTTL = 5 * time.Second
+
 type QemuService struct {
 	Dispatcher *utils.Dispatcher
 	Logger     *slog.Logger
-	LibVirt    *libvirt.Libvirt
+	LibVirt    hypervisor.Driver
 	FS         *utils.FS
+
+	// createDisk provisions VM disks, nil means qemu-img on the host
+	createDisk func(path string, sizeMB uint) (string, error)
+	// images inspects and converts disk images, qemu-img unless the driver
+	// does it itself
+	images       hypervisor.DiskImageTool
+	imageJobs    imageJobs
+	cache        domainCache
+	restarts     restartWatchdog
+	screenshotMu sync.Mutex
+	screenshots  map[string]*cachedScreenshot
 }
 
-func NewQemuService(dispatcher *utils.Dispatcher, fs *utils.FS, logger *slog.Logger) *QemuService {
-	service := &QemuService{
-		Dispatcher: dispatcher.WithGroup("qemu"),
-		Logger:     logger.WithGroup("qemu"),
-	}
+// cachedScreenshot is the last capture of one VM display. Its mutex is held
+// while the capture is refreshed, so only requests for the same VM wait on it
+type cachedScreenshot struct {
+	mu         sync.Mutex
+	image      image.Image
+	capturedAt time.Time
+}
 
-	// Connect to libvirt QEMU system
-	uri, _ := url.Parse(string(libvirt.QEMUSession))
-	l, err := libvirt.ConnectToURI(uri)
+func NewQemuService(dispatcher *utils.Dispatcher, fs *utils.FS, logger *slog.Logger) *QemuService {
+	driver, err := hypervisor.New(models.ENV_VARS.HypervisorDriver)
 	if err != nil {
-		logger.Error("Failed to connect to libvirt", "error", err)
+		logger.Error("Failed to connect to hypervisor", "driver", models.ENV_VARS.HypervisorDriver, "error", err)
 		// Return service without LibVirt connection - methods will check for nil
-		return service
+		return &QemuService{
+			Dispatcher: dispatcher.WithGroup("qemu"),
+			Logger:     logger.WithGroup("qemu"),
+			FS:         fs,
+		}
 	}
+	return NewQemuServiceWithDriver(dispatcher, fs, logger, driver)
+}
 
-	service.LibVirt = l
-	return &QemuService{
+// NewQemuServiceWithDriver creates a QEMU service on top of an already
+// connected hypervisor driver
+func NewQemuServiceWithDriver(dispatcher *utils.Dispatcher, fs *utils.FS, logger *slog.Logger, driver hypervisor.Driver) *QemuService {
+	service := &QemuService{
 		Dispatcher: dispatcher.WithGroup("qemu"),
 		Logger:     logger.WithGroup("qemu"),
-		LibVirt:    l,
+		LibVirt:    driver,
 		FS:         fs,
 	}
+	if dc, ok := driver.(hypervisor.DiskCreator); ok {
+		service.createDisk = dc.CreateDiskImage
+	}
+	service.images = utils.QemuImg{}
+	if tool, ok := driver.(hypervisor.DiskImageTool); ok {
+		service.images = tool
+	}
+	service.imageJobs.jobs = map[string]*models.DiskImageJob{}
+	service.removeStaleImageJobs()
+
+	service.startRestartWatchdog()
+	service.watchDomainEvents(context.Background())
+	return service
 }
 
 //	@Summary      List virtual machines
-//	@Description  Get a list of all QEMU virtual machines
+//	@Description  Get a list of QEMU virtual machines, optionally filtered, sorted and paginated. The total number of matches is returned in the X-Total-Count header
 //	@Tags         qemu
 //	@Produce      json
+//	@Param        selector   query  string  false  "Label selector, e.g. env=staging,owner!=alice"
+//	@Param        state      query  string  false  "Comma separated states, e.g. running,paused"
+//	@Param        search     query  string  false  "Case insensitive name search"
+//	@Param        sort       query  string  false  "name, state, memory, vcpus or id, prefix with - to reverse"
+//	@Param        page       query  int     false  "Page number (default 1)"
+//	@Param        page_size  query  int     false  "Page size (default all)"
 //	@Success      200  {array}   models.VirtualMachine
+//	@Failure      400  {object}  models.HTTPError
 //	@Failure      401  {object}  models.HTTPError
 //	@Failure      403  {object}  models.HTTPError
 //	@Failure      500  {object}  models.HTTPError
@@ -62,35 +118,43 @@ func (s *QemuService) GetVirtualMachines(c echo.Context) error {
 		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
 	}
 
-	flags := libvirt.ConnectListDomainsActive | libvirt.ConnectListDomainsInactive
-	domains, _, err := s.LibVirt.ConnectListAllDomains(1, flags)
+	req := new(models.VMListRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid query parameters", err)
+	}
+
+	list, total, err := s.listVirtualMachines(req, false)
 	if err != nil {
-		s.Logger.Error("Failed to list domains", "error", err)
-		return s.Dispatcher.NewInternalServerError("Failed to list virtual machines", err)
+		return err
 	}
 
-	vms := make([]models.VirtualMachine, 0, len(domains))
-	for _, domain := range domains {
-		domainUUID, err := uuid.FromBytes(domain.UUID[:])
-		if err != nil {
-			s.Logger.Warn("Failed to parse domain UUID", "error", err)
-			continue
-		}
+	vms := make([]models.VirtualMachine, 0, len(list))
+	for _, vm := range list {
 		vms = append(vms, models.VirtualMachine{
-			ID:   domain.ID,
-			Name: domain.Name,
-			UUID: domainUUID.String(),
+			ID:          vm.ID,
+			Name:        vm.Name,
+			UUID:        vm.UUID,
+			Description: vm.Description,
+			Labels:      vm.Labels,
 		})
 	}
 
+	c.Response().Header().Set("X-Total-Count", strconv.Itoa(total))
 	return c.JSON(http.StatusOK, vms)
 }
 
 //	@Summary      Get virtual machine info
-//	@Description  Get detailed information about all virtual machines
+//	@Description  Get detailed information about virtual machines, accepting the same filters as the VM list. The total number of matches is returned in the X-Total-Count header
 //	@Tags         qemu
 //	@Produce      json
+//	@Param        selector   query  string  false  "Label selector, e.g. env=staging,owner!=alice"
+//	@Param        state      query  string  false  "Comma separated states, e.g. running,paused"
+//	@Param        search     query  string  false  "Case insensitive name search"
+//	@Param        sort       query  string  false  "name, state, memory, vcpus or id, prefix with - to reverse"
+//	@Param        page       query  int     false  "Page number (default 1)"
+//	@Param        page_size  query  int     false  "Page size (default all)"
 //	@Success      200  {array}   models.VirtualMachineWithInfo
+//	@Failure      400  {object}  models.HTTPError
 //	@Failure      401  {object}  models.HTTPError
 //	@Failure      403  {object}  models.HTTPError
 //	@Failure      500  {object}  models.HTTPError
@@ -102,43 +166,382 @@ func (s *QemuService) GetVirtualMachinesInfo(c echo.Context) error {
 		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
 	}
 
-	flags := libvirt.ConnectListDomainsActive | libvirt.ConnectListDomainsInactive
-	domains, _, err := s.LibVirt.ConnectListAllDomains(1, flags)
+	req := new(models.VMListRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid query parameters", err)
+	}
+
+	vms, total, err := s.listVirtualMachines(req, true)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("X-Total-Count", strconv.Itoa(total))
+	return c.JSON(http.StatusOK, vms)
+}
+
+// listVirtualMachines applies the filters, sorting and pagination of req and
+// returns the requested page along with the number of matching VMs. Runtime
+// info for all domains comes from a single ConnectGetAllDomainStats call and
+// is only fetched when withInfo is set or a filter/sort needs it. Labels and
+// descriptions come from the domain cache
+func (s *QemuService) listVirtualMachines(req *models.VMListRequest, withInfo bool) ([]models.VirtualMachineWithInfo, int, error) {
+	selector, err := utils.ParseLabelSelector(req.Selector)
 	if err != nil {
-		s.Logger.Error("Failed to list domains", "error", err)
-		return s.Dispatcher.NewInternalServerError("Failed to list virtual machines", err)
+		return nil, 0, s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+
+	states := map[uint8]bool{}
+	for _, name := range strings.Split(req.State, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		state, ok := models.VMStateNames[name]
+		if !ok {
+			return nil, 0, s.Dispatcher.NewBadRequest(fmt.Sprintf("Unknown state %q", name), nil)
+		}
+		states[state] = true
+	}
+
+	sortKey := strings.TrimPrefix(req.Sort, "-")
+	desc := strings.HasPrefix(req.Sort, "-")
+	switch sortKey {
+	case "", "name", "id", "state", "memory", "vcpus":
+	default:
+		return nil, 0, s.Dispatcher.NewBadRequest(fmt.Sprintf("Unknown sort field %q", sortKey), nil)
 	}
+	needInfo := withInfo || len(states) > 0 || sortKey == "state" || sortKey == "memory" || sortKey == "vcpus"
 
-	vms := make([]models.VirtualMachineWithInfo, 0, len(domains))
-	for _, domain := range domains {
-		domainUUID, err := uuid.FromBytes(domain.UUID[:])
+	type entry struct {
+		domain libvirt.Domain
+		vm     models.VirtualMachineWithInfo
+	}
+	var entries []entry
+
+	if needInfo {
+		stats := libvirt.DomainStatsState | libvirt.DomainStatsCPUTotal | libvirt.DomainStatsBalloon | libvirt.DomainStatsVCPU
+		records, err := s.LibVirt.ConnectGetAllDomainStats(nil, uint32(stats), 0)
 		if err != nil {
-			s.Logger.Warn("Failed to parse domain UUID", "error", err)
+			s.Logger.Error("Failed to get domain stats", "error", err)
+			return nil, 0, s.Dispatcher.NewInternalServerError("Failed to list virtual machines", err)
+		}
+		for _, r := range records {
+			entries = append(entries, entry{domain: r.Dom, vm: models.VirtualMachineWithInfo{
+				VirtualMachineInfo: models.VirtualMachineInfo{
+					State:     uint8(typedParamUint64(r.Params, "state.state")),
+					MaxMemKB:  typedParamUint64(r.Params, "balloon.maximum"),
+					MemoryKB:  typedParamUint64(r.Params, "balloon.current"),
+					VCPUs:     uint16(typedParamUint64(r.Params, "vcpu.current")),
+					CPUTimeNs: typedParamUint64(r.Params, "cpu.time"),
+				},
+			}})
+		}
+	} else {
+		flags := libvirt.ConnectListDomainsActive | libvirt.ConnectListDomainsInactive
+		domains, _, err := s.LibVirt.ConnectListAllDomains(1, flags)
+		if err != nil {
+			s.Logger.Error("Failed to list domains", "error", err)
+			return nil, 0, s.Dispatcher.NewInternalServerError("Failed to list virtual machines", err)
+		}
+		for _, d := range domains {
+			entries = append(entries, entry{domain: d})
+		}
+	}
+
+	search := strings.ToLower(req.Search)
+	matched := entries[:0]
+	for _, e := range entries {
+		if search != "" && !strings.Contains(strings.ToLower(e.domain.Name), search) {
+			continue
+		}
+		if len(states) > 0 && !states[e.vm.State] {
 			continue
 		}
 
-		// Get domain info
-		rState, rMaxMem, rMemory, rNrVirtCPU, rCPUTime, err := s.LibVirt.DomainGetInfo(domain)
+		domainUUID, err := uuid.FromBytes(e.domain.UUID[:])
 		if err != nil {
-			s.Logger.Warn("Failed to get domain info", "domain", domain.Name, "error", err)
+			s.Logger.Warn("Failed to parse domain UUID", "error", err)
 			continue
 		}
+		e.vm.ID = e.domain.ID
+		e.vm.Name = e.domain.Name
+		e.vm.UUID = domainUUID.String()
 
-		vms = append(vms, models.VirtualMachineWithInfo{
-			ID:   domain.ID,
-			Name: domain.Name,
-			UUID: domainUUID.String(),
-			VirtualMachineInfo: models.VirtualMachineInfo{
-				State:     rState,
-				MaxMemKB:  rMaxMem,
-				MemoryKB:  rMemory,
-				VCPUs:     rNrVirtCPU,
-				CPUTimeNs: rCPUTime,
-			},
-		})
+		// Label filters need metadata up front, otherwise it is only loaded
+		// for the page being returned
+		if len(selector) > 0 {
+			details, err := s.domainDetails(e.domain)
+			if err != nil {
+				s.Logger.Warn("Failed to get domain metadata", "domain", e.domain.Name, "error", err)
+			}
+			if !selector.Matches(details.Labels) {
+				continue
+			}
+			e.vm.Description = details.Description
+			e.vm.Labels = details.Labels
+		}
+		matched = append(matched, e)
 	}
 
-	return c.JSON(http.StatusOK, vms)
+	slices.SortStableFunc(matched, func(a, b entry) int {
+		return compareVirtualMachines(a.vm, b.vm, sortKey, desc)
+	})
+
+	total := len(matched)
+	if req.PageSize > 0 {
+		page := max(req.Page, 1)
+		start := min((page-1)*req.PageSize, total)
+		end := min(start+req.PageSize, total)
+		matched = matched[start:end]
+	}
+
+	vms := make([]models.VirtualMachineWithInfo, 0, len(matched))
+	for _, e := range matched {
+		if len(selector) == 0 {
+			details, err := s.domainDetails(e.domain)
+			if err != nil {
+				s.Logger.Warn("Failed to get domain metadata", "domain", e.domain.Name, "error", err)
+			}
+			e.vm.Description = details.Description
+			e.vm.Labels = details.Labels
+		}
+		vms = append(vms, e.vm)
+	}
+	return vms, total, nil
+}
+
+func compareVirtualMachines(a, b models.VirtualMachineWithInfo, key string, desc bool) int {
+	var r int
+	switch key {
+	case "id":
+		r = cmp.Compare(a.ID, b.ID)
+	case "state":
+		r = cmp.Compare(a.State, b.State)
+	case "memory":
+		r = cmp.Compare(a.MemoryKB, b.MemoryKB)
+	case "vcpus":
+		r = cmp.Compare(a.VCPUs, b.VCPUs)
+	}
+	if r == 0 {
+		r = cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	}
+	if desc {
+		return -r
+	}
+	return r
+}
+
+//	@Summary      Update virtual machine metadata
+//	@Description  Set the description and/or labels of a virtual machine. They are stored in the domain's libvirt metadata
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        uuid  path  string                          true  "Virtual Machine UUID"
+//	@Param        body  body  models.UpdateVMMetadataRequest  true  "Description and labels"
+//	@Produce      json
+//	@Success      200  {object}  models.VirtualMachine
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/metadata [put]
+//
+// UpdateVirtualMachineMetadata changes the description and labels of a VM
+func (s *QemuService) UpdateVirtualMachineMetadata(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	req := new(models.UpdateVMMetadataRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	if err := utils.ValidateLabels(req.Labels); err != nil {
+		return s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+
+	domain, err := s.GetDomainByUUID(vmUUID)
+	if err != nil {
+		return s.domainLookupError(err)
+	}
+
+	if req.Description != nil {
+		if err := s.setDomainMetadata(domain, libvirt.DomainMetadataDescription, *req.Description, "", ""); err != nil {
+			s.Logger.Error("Failed to set domain description", "name", domain.Name, "error", err)
+			return s.Dispatcher.NewInternalServerError("Failed to update virtual machine metadata", err)
+		}
+	}
+
+	if req.Labels != nil {
+		domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, 0)
+		if err != nil {
+			return s.Dispatcher.NewInternalServerError("Failed to update virtual machine metadata", err)
+		}
+		_, meta, err := utils.MetadataFromDomainXML(domainXML)
+		if err != nil {
+			return s.Dispatcher.NewInternalServerError("Failed to update virtual machine metadata", err)
+		}
+		meta.SetLabels(req.Labels)
+		metaXML, err := meta.Marshal()
+		if err != nil {
+			return s.Dispatcher.NewInternalServerError("Failed to update virtual machine metadata", err)
+		}
+		if err := s.setDomainMetadata(domain, libvirt.DomainMetadataElement, metaXML, utils.VMMetadataKey, utils.VMMetadataURI); err != nil {
+			s.Logger.Error("Failed to set domain labels", "name", domain.Name, "error", err)
+			return s.Dispatcher.NewInternalServerError("Failed to update virtual machine metadata", err)
+		}
+	}
+
+	s.cache.invalidate(domainUUIDString(domain))
+	details, err := s.domainDetails(domain)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to read virtual machine metadata", err)
+	}
+	return c.JSON(http.StatusOK, models.VirtualMachine{
+		ID:          domain.ID,
+		Name:        domain.Name,
+		UUID:        domainUUIDString(domain),
+		Description: details.Description,
+		Labels:      details.Labels,
+	})
+}
+
+//	@Summary      Get virtual machine restart policy
+//	@Description  Get the restart policy of a virtual machine along with the crash watchdog's state for it
+//	@Tags         qemu
+//	@Param        uuid  path  string  true  "Virtual Machine UUID"
+//	@Produce      json
+//	@Success      200  {object}  models.VMRestartStatus
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/restart-policy [get]
+//
+// GetVirtualMachineRestartPolicy returns the restart policy of a VM
+func (s *QemuService) GetVirtualMachineRestartPolicy(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	domain, err := s.GetDomainByUUID(vmUUID)
+	if err != nil {
+		return s.domainLookupError(err)
+	}
+
+	domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to read virtual machine metadata", err)
+	}
+	_, meta, err := utils.MetadataFromDomainXML(domainXML)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to read virtual machine metadata", err)
+	}
+
+	return c.JSON(http.StatusOK, s.restartStatus(domainUUIDString(domain), meta))
+}
+
+//	@Summary      Update virtual machine restart policy
+//	@Description  Set the restart policy (never, on-crash or always) of a virtual machine. Changing the policy resets the watchdog's attempts counter
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        uuid  path  string                             true  "Virtual Machine UUID"
+//	@Param        body  body  models.UpdateRestartPolicyRequest  true  "Restart policy"
+//	@Produce      json
+//	@Success      200  {object}  models.VMRestartStatus
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/restart-policy [put]
+//
+// UpdateVirtualMachineRestartPolicy changes the restart policy of a VM
+func (s *QemuService) UpdateVirtualMachineRestartPolicy(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	req := new(models.UpdateRestartPolicyRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	if !slices.Contains(models.RestartPolicies, req.Policy) {
+		return s.Dispatcher.NewBadRequest("Invalid restart policy", nil)
+	}
+	if req.MaxAttempts < 0 {
+		return s.Dispatcher.NewBadRequest("Max attempts must not be negative", nil)
+	}
+
+	domain, err := s.GetDomainByUUID(vmUUID)
+	if err != nil {
+		return s.domainLookupError(err)
+	}
+
+	domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine restart policy", err)
+	}
+	_, meta, err := utils.MetadataFromDomainXML(domainXML)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine restart policy", err)
+	}
+	meta.Restart = nil
+	if req.Policy != models.RestartPolicyNever {
+		meta.Restart = &utils.VMRestart{Policy: req.Policy, MaxAttempts: req.MaxAttempts}
+	}
+	metaXML, err := meta.Marshal()
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine restart policy", err)
+	}
+	if err := s.setDomainMetadata(domain, libvirt.DomainMetadataElement, metaXML, utils.VMMetadataKey, utils.VMMetadataURI); err != nil {
+		s.Logger.Error("Failed to set domain restart policy", "name", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine restart policy", err)
+	}
+
+	key := domainUUIDString(domain)
+	s.cache.invalidate(key)
+	s.trackDomain(domain)
+	s.resetRestarts(key)
+	return c.JSON(http.StatusOK, s.restartStatus(key, meta))
+}
+
+// setDomainMetadata writes metadata to the running domain and, for
+// persistent domains, to their config so it survives restarts
+func (s *QemuService) setDomainMetadata(domain libvirt.Domain, kind libvirt.DomainMetadataType, value, key, uri string) error {
+	var flags libvirt.DomainModificationImpact
+	if active, err := s.LibVirt.DomainIsActive(domain); err == nil && active == 1 {
+		flags |= libvirt.DomainAffectLive
+	}
+	if persistent, err := s.LibVirt.DomainIsPersistent(domain); err == nil && persistent == 1 {
+		flags |= libvirt.DomainAffectConfig
+	}
+
+	var metadata, keyOpt, uriOpt libvirt.OptString
+	if value != "" {
+		metadata = libvirt.OptString{value}
+	}
+	if key != "" {
+		keyOpt = libvirt.OptString{key}
+		uriOpt = libvirt.OptString{uri}
+	}
+	return s.LibVirt.DomainSetMetadata(domain, int32(kind), metadata, keyOpt, uriOpt, flags)
 }
 
 //	@Summary      Get specific virtual machine
@@ -164,28 +567,22 @@ func (s *QemuService) GetVirtualMachine(c echo.Context) error {
 		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
 	}
 
-	flags := libvirt.ConnectListDomainsActive | libvirt.ConnectListDomainsInactive
-	domains, _, err := s.LibVirt.ConnectListAllDomains(1, flags)
+	domain, err := s.GetDomainByUUID(vmUUID)
 	if err != nil {
-		s.Logger.Error("Failed to list domains", "error", err)
-		return s.Dispatcher.NewInternalServerError("Failed to list virtual machines", err)
+		return s.domainLookupError(err)
 	}
 
-	for _, domain := range domains {
-		domainUUID, err := uuid.FromBytes(domain.UUID[:])
-		if err != nil {
-			continue
-		}
-		if domainUUID.String() == vmUUID {
-			return c.JSON(http.StatusOK, models.VirtualMachine{
-				ID:   domain.ID,
-				Name: domain.Name,
-				UUID: domainUUID.String(),
-			})
-		}
+	details, err := s.domainDetails(domain)
+	if err != nil {
+		s.Logger.Warn("Failed to get domain metadata", "domain", domain.Name, "error", err)
 	}
-
-	return s.Dispatcher.NewNotFound("Virtual machine not found", nil)
+	return c.JSON(http.StatusOK, models.VirtualMachine{
+		ID:          domain.ID,
+		Name:        domain.Name,
+		UUID:        domainUUIDString(domain),
+		Description: details.Description,
+		Labels:      details.Labels,
+	})
 }
 
 //	@Summary      Get virtual machine detailed info
@@ -213,53 +610,39 @@ func (s *QemuService) GetVirtualMachineInfo(c echo.Context) error {
 		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
 	}
 
-	flags := libvirt.ConnectListDomainsActive | libvirt.ConnectListDomainsInactive
-	domains, _, err := s.LibVirt.ConnectListAllDomains(1, flags)
+	domain, err := s.GetDomainByUUID(vmUUID)
 	if err != nil {
-		s.Logger.Error("Failed to list domains", "error", err)
-		return s.Dispatcher.NewInternalServerError("Failed to list virtual machines", err)
+		return s.domainLookupError(err)
 	}
 
-	for _, domain := range domains {
-		domainUUID, err := uuid.FromBytes(domain.UUID[:])
-		if err != nil {
-			continue
-		}
-		if domainUUID.String() == vmUUID {
-			// Get domain info
-			rState, rMaxMem, rMemory, rNrVirtCPU, rCPUTime, err := s.LibVirt.DomainGetInfo(domain)
-			if err != nil {
-				s.Logger.Error("Failed to get domain info", "domain", domain.Name, "error", err)
-				return s.Dispatcher.NewInternalServerError("Failed to get virtual machine info", err)
-			}
-			dXml, err := s.LibVirt.DomainGetXMLDesc(domain, libvirt.DomainXMLUpdateCPU)
-			if err != nil {
-				s.Logger.Error("Failed to get domain xml", "domain", domain.Name, "error", err)
-				return s.Dispatcher.NewInternalServerError("Failed to get virtual machine info", err)
-			}
-			rVNCIP, rVNCPort, err := utils.VNCFromDomainXML(dXml)
-			if err != nil {
-				s.Logger.Warn("Failed to parse VNC info from domain xml", "domain", domain.Name, "error", err)
-			}
-
-			return c.JSON(http.StatusOK, models.VirtualMachineWithInfo{
-				ID:   domain.ID,
-				Name: domain.Name,
-				UUID: domainUUID.String(),
-				VirtualMachineInfo: models.VirtualMachineInfo{
-					State:     rState,
-					MaxMemKB:  rMaxMem,
-					MemoryKB:  rMemory,
-					VCPUs:     rNrVirtCPU,
-					CPUTimeNs: rCPUTime,
-					VNCIP:     rVNCIP,
-					VNCPort:   rVNCPort,
-				},
-			})
-		}
+	// Get domain info
+	rState, rMaxMem, rMemory, rNrVirtCPU, rCPUTime, err := s.LibVirt.DomainGetInfo(domain)
+	if err != nil {
+		s.Logger.Error("Failed to get domain info", "domain", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to get virtual machine info", err)
+	}
+	details, err := s.domainDetails(domain)
+	if err != nil {
+		s.Logger.Error("Failed to get domain xml", "domain", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to get virtual machine info", err)
 	}
 
-	return s.Dispatcher.NewNotFound("Virtual machine not found", nil)
+	return c.JSON(http.StatusOK, models.VirtualMachineWithInfo{
+		ID:          domain.ID,
+		Name:        domain.Name,
+		UUID:        domainUUIDString(domain),
+		Description: details.Description,
+		Labels:      details.Labels,
+		VirtualMachineInfo: models.VirtualMachineInfo{
+			State:     rState,
+			MaxMemKB:  rMaxMem,
+			MemoryKB:  rMemory,
+			VCPUs:     rNrVirtCPU,
+			CPUTimeNs: rCPUTime,
+			VNCIP:     details.VNCIP,
+			VNCPort:   details.VNCPort,
+		},
+	})
 }
 
 //	@Summary      Start virtual machine
@@ -271,6 +654,7 @@ func (s *QemuService) GetVirtualMachineInfo(c echo.Context) error {
 //	@Failure      401  {object}  models.HTTPError
 //	@Failure      403  {object}  models.HTTPError
 //	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
 //	@Failure      500  {object}  models.HTTPError
 //	@Router       /qemu/virtual-machines/{uuid}/start [post]
 //
@@ -287,8 +671,7 @@ func (s *QemuService) StartVirtualMachine(c echo.Context) error {
 
 	domain, err := s.GetDomainByUUID(vmUUID)
 	if err != nil {
-		s.Logger.Error("Failed to find domain", "uuid", vmUUID, "error", err)
-		return s.Dispatcher.NewNotFound("Virtual machine not found", err)
+		return s.domainLookupError(err)
 	}
 
 	// Get domain info to check state
@@ -310,13 +693,17 @@ func (s *QemuService) StartVirtualMachine(c echo.Context) error {
 		}
 		action = "resumed"
 	} else {
-		// Start stopped VM
+		// Start stopped VM, unless a job is rewriting one of its disks
+		if job := s.domainImageJob(domain); job != nil {
+			return s.Dispatcher.NewConflict(fmt.Sprintf("Image '%s' of the virtual machine is busy with a %s job", job.Target, job.Operation), nil)
+		}
 		if err := s.LibVirt.DomainCreate(domain); err != nil {
 			s.Logger.Error("Failed to start domain", "name", domain.Name, "error", err)
 			return s.Dispatcher.NewInternalServerError("Failed to start virtual machine", err)
 		}
 		action = "started"
 	}
+	s.resetRestarts(domainUUIDString(domain))
 
 	return c.JSON(http.StatusOK, models.VMActionResponse{
 		Success: true,
@@ -349,8 +736,7 @@ func (s *QemuService) RebootVirtualMachine(c echo.Context) error {
 
 	domain, err := s.GetDomainByUUID(vmUUID)
 	if err != nil {
-		s.Logger.Error("Failed to find domain", "uuid", vmUUID, "error", err)
-		return s.Dispatcher.NewNotFound("Virtual machine not found", err)
+		return s.domainLookupError(err)
 	}
 
 	if err := s.LibVirt.DomainReboot(domain, libvirt.DomainRebootDefault); err != nil {
@@ -389,11 +775,13 @@ func (s *QemuService) ShutdownVirtualMachine(c echo.Context) error {
 
 	domain, err := s.GetDomainByUUID(vmUUID)
 	if err != nil {
-		s.Logger.Error("Failed to find domain", "uuid", vmUUID, "error", err)
-		return s.Dispatcher.NewNotFound("Virtual machine not found", err)
+		return s.domainLookupError(err)
 	}
 
+	// Marked before the call, as the stopped event can beat its return
+	s.expectStop(domainUUIDString(domain), true)
 	if err := s.LibVirt.DomainShutdown(domain); err != nil {
+		s.expectStop(domainUUIDString(domain), false)
 		s.Logger.Error("Failed to shutdown domain", "name", domain.Name, "error", err)
 		return s.Dispatcher.NewInternalServerError("Failed to shutdown virtual machine", err)
 	}
@@ -404,44 +792,209 @@ func (s *QemuService) ShutdownVirtualMachine(c echo.Context) error {
 	})
 }
 
-type CreateVirtualMachineRequest struct{}
-
-//	@Summary      Create virtual machine
-//	@Description  Create a new virtual machine
+//	@Summary      Get virtual machine screenshot
+//	@Description  Capture the display of a running virtual machine as a PNG. Captures are cached for a few seconds
 //	@Tags         qemu
-//	@Accept       json
-//	@Param        body  body  models.CreateVMRequest  true  "VM creation parameters"
-//	@Produce      json
-//	@Success      201  {object}  models.VirtualMachine
+//	@Param        uuid       path   string  true   "Virtual Machine UUID"
+//	@Param        max_width  query  int     false  "Scale the image down to at most this width"
+//	@Produce      png
+//	@Success      200  {file}    binary
 //	@Failure      400  {object}  models.HTTPError
 //	@Failure      401  {object}  models.HTTPError
 //	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
 //	@Failure      500  {object}  models.HTTPError
-//	@Router       /qemu/virtual-machines [post]
+//	@Router       /qemu/virtual-machines/{uuid}/screenshot [get]
 //
-// CreateVirtualMachine creates a new virtual machine
-func (s *QemuService) CreateVirtualMachine(c echo.Context) error {
+// GetVirtualMachineScreenshot returns the current display of a VM as PNG
+func (s *QemuService) GetVirtualMachineScreenshot(c echo.Context) error {
 	if s.LibVirt == nil {
 		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
 	}
 
-	req := new(models.CreateVMRequest)
-	if err := c.Bind(req); err != nil {
-		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
 	}
-	// Validate request
-	if req.Name == "" {
-		return s.Dispatcher.NewBadRequest("Virtual machine name is required", nil)
+
+	maxWidth := 0
+	if v := c.QueryParam("max_width"); v != "" {
+		w, err := strconv.Atoi(v)
+		if err != nil || w <= 0 {
+			return s.Dispatcher.NewBadRequest("max_width must be a positive integer", err)
+		}
+		maxWidth = w
 	}
-	if req.Memory <= 0 {
-		return s.Dispatcher.NewBadRequest("Memory must be greater than 0", nil)
+
+	img, capturedAt, err := s.captureScreenshot(vmUUID)
+	if err != nil {
+		return err
 	}
-	if req.VCPUs <= 0 {
-		return s.Dispatcher.NewBadRequest("VCPUs must be greater than 0", nil)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, utils.ScaleImage(img, maxWidth)); err != nil {
+		s.Logger.Error("Failed to encode screenshot", "uuid", vmUUID, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to encode screenshot", err)
+	}
+
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(screenshotCacheTTL.Seconds())))
+	c.Response().Header().Set("Last-Modified", capturedAt.UTC().Format(http.TimeFormat))
+	return c.Blob(http.StatusOK, "image/png", buf.Bytes())
+}
+
+// captureScreenshot returns a recent capture of the VM display, taking a new
+// one only when the cached capture is older than screenshotCacheTTL
+func (s *QemuService) captureScreenshot(vmUUID string) (image.Image, time.Time, error) {
+	s.screenshotMu.Lock()
+	if s.screenshots == nil {
+		s.screenshots = map[string]*cachedScreenshot{}
+	}
+	cached, ok := s.screenshots[vmUUID]
+	if !ok {
+		cached = &cachedScreenshot{}
+		s.screenshots[vmUUID] = cached
+	}
+	s.screenshotMu.Unlock()
+
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+
+	if cached.image != nil && time.Since(cached.capturedAt) < screenshotCacheTTL {
+		return cached.image, cached.capturedAt, nil
+	}
+
+	domain, err := s.GetDomainByUUID(vmUUID)
+	if err != nil {
+		s.forgetScreenshot(vmUUID)
+		return nil, time.Time{}, s.domainLookupError(err)
+	}
+
+	state, _, _, _, _, err := s.LibVirt.DomainGetInfo(domain)
+	if err != nil {
+		s.Logger.Error("Failed to get domain info", "name", domain.Name, "error", err)
+		return nil, time.Time{}, s.Dispatcher.NewInternalServerError("Failed to get virtual machine state", err)
+	}
+	if state != models.VIR_DOMAIN_RUNNING && state != models.VIR_DOMAIN_PAUSED {
+		s.forgetScreenshot(vmUUID)
+		return nil, time.Time{}, s.Dispatcher.NewConflict("Virtual machine is not running", nil)
+	}
+
+	var raw bytes.Buffer
+	mime, err := s.LibVirt.DomainScreenshot(domain, &raw, 0, 0)
+	if err != nil {
+		s.Logger.Error("Failed to capture screenshot", "name", domain.Name, "error", err)
+		return nil, time.Time{}, s.Dispatcher.NewInternalServerError("Failed to capture screenshot", err)
+	}
+	mimeType := ""
+	if len(mime) > 0 {
+		mimeType = mime[0]
+	}
+
+	img, err := utils.DecodeScreenshot(raw.Bytes(), mimeType)
+	if err != nil {
+		s.Logger.Error("Failed to decode screenshot", "name", domain.Name, "mime", mimeType, "error", err)
+		return nil, time.Time{}, s.Dispatcher.NewInternalServerError("Failed to decode screenshot", err)
+	}
+
+	cached.image = img
+	cached.capturedAt = time.Now()
+	return cached.image, cached.capturedAt, nil
+}
+
+// forgetScreenshot drops the cached capture of a VM that stopped or is gone.
+// A capture still in flight keeps its own entry and is not cached again
+func (s *QemuService) forgetScreenshot(vmUUID string) {
+	s.screenshotMu.Lock()
+	delete(s.screenshots, vmUUID)
+	s.screenshotMu.Unlock()
+}
+
+type CreateVirtualMachineRequest struct{}
+
+//	@Summary      Create virtual machine
+//	@Description  Create a new virtual machine
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        body  body  models.CreateVMRequest  true  "VM creation parameters"
+//	@Produce      json
+//	@Success      201  {object}  models.VirtualMachine
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Failure      503  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines [post]
+//
+// CreateVirtualMachine creates a new virtual machine
+func (s *QemuService) CreateVirtualMachine(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	req := new(models.CreateVMRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	// Validate request
+	if req.Name == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine name is required", nil)
+	}
+	detection, ok := s.detectOS(req.OSImage, req.OSVariant)
+	if !ok {
+		return s.Dispatcher.NewBadRequest("Unknown OS variant", nil)
+	}
+	applyOSDefaults(req, detection.Profile)
+	if req.Memory <= 0 {
+		return s.Dispatcher.NewBadRequest("Memory must be greater than 0", nil)
+	}
+	if req.VCPUs <= 0 {
+		return s.Dispatcher.NewBadRequest("VCPUs must be greater than 0", nil)
 	}
 	if req.DiskSize <= 0 {
 		return s.Dispatcher.NewBadRequest("Disk size must be greater than 0", nil)
 	}
+	if err := utils.ValidateLabels(req.Labels); err != nil {
+		return s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+	if req.RestartPolicy != "" && !slices.Contains(models.RestartPolicies, req.RestartPolicy) {
+		return s.Dispatcher.NewBadRequest("Invalid restart policy", nil)
+	}
+	if !slices.Contains(utils.DiskBuses, req.DiskBus) {
+		return s.Dispatcher.NewBadRequest("Invalid disk bus", nil)
+	}
+	if !slices.Contains(utils.NICModels, req.NICModel) {
+		return s.Dispatcher.NewBadRequest("Invalid NIC model", nil)
+	}
+	if !slices.Contains(utils.Firmwares, req.Firmware) {
+		return s.Dispatcher.NewBadRequest("Invalid firmware", nil)
+	}
+	if err := utils.ValidateTuning(req.Tuning, uint(req.VCPUs), s.hostTopology()); err != nil {
+		return s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+
+	var warnings []string
+	if capacityMode() != models.CapacityModeOff {
+		capacity, err := s.hostCapacity()
+		if err != nil && capacityMode() == models.CapacityModeReject {
+			// Rejecting means creates never go past an unchecked host
+			s.Logger.Error("Failed to check host capacity", "name", req.Name, "error", err)
+			return s.Dispatcher.NewHTTPError(http.StatusServiceUnavailable, "Failed to check host capacity", err)
+		}
+		if err != nil {
+			s.Logger.Warn("Failed to check host capacity", "name", req.Name, "error", err)
+		} else if failures := capacityFailures(checkCapacity(capacity, req.Memory, req.VCPUs, req.DiskSize)); len(failures) > 0 {
+			if capacity.Mode == models.CapacityModeReject {
+				return s.Dispatcher.NewConflict("Not enough host capacity: "+strings.Join(failures, "; "), nil)
+			}
+			warnings = failures
+			s.Logger.Warn("Creating virtual machine beyond host capacity", "name", req.Name, "warnings", failures)
+			s.Dispatcher.SendWarning("VM exceeds host capacity", fmt.Sprintf("'%s' was created beyond the host's capacity", req.Name), map[string]string{
+				"VM":       req.Name,
+				"Warnings": strings.Join(failures, "\n"),
+			})
+		}
+	}
 
 	// Log the creation attempt
 	s.Logger.Info("Creating virtual machine",
@@ -449,6 +1002,8 @@ func (s *QemuService) CreateVirtualMachine(c echo.Context) error {
 		"memory_mb", req.Memory,
 		"vcpus", req.VCPUs,
 		"disk_size_gb", req.DiskSize,
+		"os", detection.Profile.ID,
+		"os_matched_by", detection.MatchedBy,
 	)
 
 	xmlDom, err := utils.BuildLibVirtDomain(&utils.LibVirtDomainParams{
@@ -462,6 +1017,15 @@ func (s *QemuService) CreateVirtualMachine(c echo.Context) error {
 		SpiceListenIpAddr:     "127.0.0.1",
 		VNCListenPort:         -1,
 		VNCListenIpAddr:       "127.0.0.1",
+		Description:           req.Description,
+		Labels:                req.Labels,
+		RestartPolicy:         req.RestartPolicy,
+		DiskBus:               req.DiskBus,
+		NICModel:              req.NICModel,
+		Firmware:              req.Firmware,
+		TPM:                   detection.Profile.TPM && req.Firmware == "efi",
+		Tuning:                req.Tuning,
+		CreateDisk:            s.createDisk,
 	})
 	fmt.Printf("xmlDom: %v\n", xmlDom)
 	if err != nil {
@@ -469,13 +1033,27 @@ func (s *QemuService) CreateVirtualMachine(c echo.Context) error {
 		return s.Dispatcher.NewInternalServerError("Failed to create virtual machine", err)
 	}
 
-	var rDom libvirt.Domain
-	if req.Autostart {
-		rDom, err = s.LibVirt.DomainCreateXML(xmlDom, libvirt.DomainStartValidate)
-	} else {
-		rDom, err = s.LibVirt.DomainCreateXML(xmlDom, libvirt.DomainStartPaused)
+	// Define the domain before starting it so it outlives its first boot and
+	// changes to its next boot (tuning, boot order) have somewhere to go
+	defined, err := s.LibVirt.DomainDefineXMLFlags(xmlDom, libvirt.DomainDefineValidate)
+	if err != nil {
+		// The domain never existed, nothing else will clean up its disk
+		s.removeDomainDisks(xmlDom)
+		s.Logger.Error("Failed to create virtual machine", "name", req.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to create virtual machine", err)
 	}
+
+	var startFlags uint32
+	if !req.Autostart {
+		startFlags = uint32(libvirt.DomainStartPaused)
+	}
+	rDom, err := s.LibVirt.DomainCreateWithFlags(defined, startFlags)
 	if err != nil {
+		if undefErr := s.LibVirt.DomainUndefineFlags(defined, libvirt.DomainUndefineNvram); undefErr != nil {
+			s.Logger.Error("Failed to undefine virtual machine that did not start", "name", req.Name, "error", undefErr)
+		} else {
+			s.removeDomainDisks(xmlDom)
+		}
 		s.Logger.Error("Failed to create virtual machine", "name", req.Name, "error", err)
 		return s.Dispatcher.NewInternalServerError("Failed to create virtual machine", err)
 	}
@@ -487,29 +1065,602 @@ func (s *QemuService) CreateVirtualMachine(c echo.Context) error {
 	}
 
 	return c.JSON(http.StatusCreated, models.VirtualMachine{
-		ID:   rDom.ID,
-		Name: rDom.Name,
-		UUID: uuid.String(),
+		ID:          rDom.ID,
+		Name:        rDom.Name,
+		UUID:        uuid.String(),
+		Description: req.Description,
+		Labels:      req.Labels,
+		Warnings:    warnings,
 	})
 }
 
-// Helper function to get domain by UUID
-func (s *QemuService) GetDomainByUUID(vmUUID string) (libvirt.Domain, error) {
-	flags := libvirt.ConnectListDomainsActive | libvirt.ConnectListDomainsInactive
-	domains, _, err := s.LibVirt.ConnectListAllDomains(1, flags)
+//	@Summary      Get virtual machine tuning
+//	@Description  Get the performance tuning of a virtual machine: CPU pinning, IO threads, hugepages, disk cache and IO modes, network queues and CPU topology
+//	@Tags         qemu
+//	@Param        uuid  path  string  true  "Virtual Machine UUID"
+//	@Produce      json
+//	@Success      200  {object}  models.VMTuning
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/tuning [get]
+//
+// GetVirtualMachineTuning returns the performance tuning of a VM
+func (s *QemuService) GetVirtualMachineTuning(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	domain, err := s.GetDomainByUUID(vmUUID)
 	if err != nil {
-		return libvirt.Domain{}, err
+		return s.domainLookupError(err)
 	}
 
-	for _, domain := range domains {
-		domainUUID, err := uuid.FromBytes(domain.UUID[:])
-		if err != nil {
-			continue
+	def, err := s.inactiveDomainDef(domain)
+	if err != nil {
+		s.Logger.Error("Failed to read domain xml", "name", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to read virtual machine tuning", err)
+	}
+	return c.JSON(http.StatusOK, utils.TuningFromDomain(def))
+}
+
+//	@Summary      Update virtual machine tuning
+//	@Description  Replace the performance tuning of a virtual machine. Running VMs pick the changes up on their next boot. Transient VMs started outside Visory have no next boot and are refused
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        uuid  path  string           true  "Virtual Machine UUID"
+//	@Param        body  body  models.VMTuning  true  "Tuning"
+//	@Produce      json
+//	@Success      200  {object}  models.VMTuningResponse
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/tuning [put]
+//
+// UpdateVirtualMachineTuning replaces the performance tuning of a VM
+func (s *QemuService) UpdateVirtualMachineTuning(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	req := new(models.VMTuning)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+
+	domain, err := s.GetDomainByUUID(vmUUID)
+	if err != nil {
+		return s.domainLookupError(err)
+	}
+	if err := s.requirePersistent(domain, "tuning"); err != nil {
+		return err
+	}
+
+	def, err := s.inactiveDomainDef(domain)
+	if err != nil {
+		s.Logger.Error("Failed to read domain xml", "name", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine tuning", err)
+	}
+	var vcpus uint
+	if def.VCPU != nil {
+		vcpus = def.VCPU.Value
+	}
+	if err := utils.ValidateTuning(req, vcpus, s.hostTopology()); err != nil {
+		return s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+
+	utils.ApplyTuning(def, req)
+	domainXML, err := def.Marshal()
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine tuning", err)
+	}
+	if _, err := s.LibVirt.DomainDefineXML(domainXML); err != nil {
+		s.Logger.Error("Failed to define domain", "name", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine tuning", err)
+	}
+	s.cache.invalidate(domainUUIDString(domain))
+
+	active, _ := s.LibVirt.DomainIsActive(domain)
+	return c.JSON(http.StatusOK, models.VMTuningResponse{
+		Tuning:          utils.TuningFromDomain(def),
+		RestartRequired: active == 1,
+	})
+}
+
+//	@Summary      Get virtual machine media
+//	@Description  Get the ISO in the CD-ROM drive of a virtual machine and its boot order
+//	@Tags         qemu
+//	@Param        uuid  path  string  true  "Virtual Machine UUID"
+//	@Produce      json
+//	@Success      200  {object}  models.VMMedia
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/media [get]
+//
+// GetVirtualMachineMedia returns the installation media of a VM
+func (s *QemuService) GetVirtualMachineMedia(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	domain, err := s.GetDomainByUUID(vmUUID)
+	if err != nil {
+		return s.domainLookupError(err)
+	}
+
+	media, err := s.vmMedia(domain)
+	if err != nil {
+		s.Logger.Error("Failed to read domain xml", "name", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to read virtual machine media", err)
+	}
+	return c.JSON(http.StatusOK, media)
+}
+
+//	@Summary      Insert virtual machine media
+//	@Description  Insert an ISO from the library into the CD-ROM drive of a running or stopped virtual machine, replacing the current one
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        uuid  path  string                     true  "Virtual Machine UUID"
+//	@Param        body  body  models.ChangeMediaRequest  true  "ISO to insert"
+//	@Produce      json
+//	@Success      200  {object}  models.VMMedia
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/media [put]
+//
+// InsertVirtualMachineMedia inserts or swaps the ISO of a VM
+func (s *QemuService) InsertVirtualMachineMedia(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	req := new(models.ChangeMediaRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+	if req.OSImage == "" {
+		return s.Dispatcher.NewBadRequest("ISO is required", nil)
+	}
+	isoPath, err := s.isoPath(req.OSImage)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.Dispatcher.NewNotFound("ISO file not found", err)
 		}
-		if domainUUID.String() == vmUUID {
-			return domain, nil
+		return s.Dispatcher.NewBadRequest("Invalid ISO", err)
+	}
+	return s.changeMedia(c, isoPath)
+}
+
+//	@Summary      Eject virtual machine media
+//	@Description  Eject the ISO from the CD-ROM drive of a running or stopped virtual machine
+//	@Tags         qemu
+//	@Param        uuid  path  string  true  "Virtual Machine UUID"
+//	@Produce      json
+//	@Success      200  {object}  models.VMMedia
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/media [delete]
+//
+// EjectVirtualMachineMedia empties the CD-ROM drive of a VM
+func (s *QemuService) EjectVirtualMachineMedia(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+	return s.changeMedia(c, "")
+}
+
+// changeMedia points the CD-ROM drive of the VM in the uuid param at
+// isoPath, or ejects it when isoPath is empty. Running VMs see the change
+// right away and persistent ones keep it across reboots
+func (s *QemuService) changeMedia(c echo.Context, isoPath string) error {
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	domain, err := s.GetDomainByUUID(vmUUID)
+	if err != nil {
+		return s.domainLookupError(err)
+	}
+
+	domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		s.Logger.Error("Failed to read domain xml", "name", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to change virtual machine media", err)
+	}
+	def := &libvirtxml.Domain{}
+	if err := def.Unmarshal(domainXML); err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to change virtual machine media", err)
+	}
+	cdrom := utils.CDROMDisk(def)
+	if cdrom == nil {
+		return s.Dispatcher.NewConflict("Virtual machine has no CD-ROM drive", nil)
+	}
+
+	update := *cdrom
+	update.Source = nil
+	if isoPath != "" {
+		update.Source = &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{File: isoPath},
 		}
 	}
+	deviceXML, err := update.Marshal()
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to change virtual machine media", err)
+	}
+
+	var flags libvirt.DomainDeviceModifyFlags
+	if active, _ := s.LibVirt.DomainIsActive(domain); active == 1 {
+		flags |= libvirt.DomainDeviceModifyLive
+	}
+	if persistent, _ := s.LibVirt.DomainIsPersistent(domain); persistent == 1 {
+		flags |= libvirt.DomainDeviceModifyConfig
+	}
+	if err := s.LibVirt.DomainUpdateDeviceFlags(domain, deviceXML, flags); err != nil {
+		s.Logger.Error("Failed to change virtual machine media", "name", domain.Name, "iso", isoPath, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to change virtual machine media", err)
+	}
+	s.cache.invalidate(domainUUIDString(domain))
+	s.Logger.Info("Changed virtual machine media", "name", domain.Name, "iso", isoPath)
+
+	media, err := s.vmMedia(domain)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to read virtual machine media", err)
+	}
+	return c.JSON(http.StatusOK, media)
+}
+
+//	@Summary      Update virtual machine boot order
+//	@Description  Set the order of the boot devices (disk, cdrom, network) of a virtual machine. Devices left out are not booted from. Running VMs pick the change up on their next boot. Transient VMs have no next boot and are refused
+//	@Tags         qemu
+//	@Accept       json
+//	@Param        uuid  path  string                         true  "Virtual Machine UUID"
+//	@Param        body  body  models.UpdateBootOrderRequest  true  "Boot order"
+//	@Produce      json
+//	@Success      200  {object}  models.VMBootOrderResponse
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Failure      409  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/virtual-machines/{uuid}/boot-order [put]
+//
+// UpdateVirtualMachineBootOrder changes the boot device order of a VM
+func (s *QemuService) UpdateVirtualMachineBootOrder(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	vmUUID := c.Param("uuid")
+	if vmUUID == "" {
+		return s.Dispatcher.NewBadRequest("Virtual machine UUID is required", nil)
+	}
+
+	req := new(models.UpdateBootOrderRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid request format", err)
+	}
+
+	domain, err := s.GetDomainByUUID(vmUUID)
+	if err != nil {
+		return s.domainLookupError(err)
+	}
+	if err := s.requirePersistent(domain, "boot order"); err != nil {
+		return err
+	}
+
+	def, err := s.inactiveDomainDef(domain)
+	if err != nil {
+		s.Logger.Error("Failed to read domain xml", "name", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine boot order", err)
+	}
+	if err := utils.SetBootOrder(def, req.Order); err != nil {
+		return s.Dispatcher.NewBadRequest(err.Error(), err)
+	}
+	domainXML, err := def.Marshal()
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine boot order", err)
+	}
+	if _, err := s.LibVirt.DomainDefineXML(domainXML); err != nil {
+		s.Logger.Error("Failed to define domain", "name", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to update virtual machine boot order", err)
+	}
+	s.cache.invalidate(domainUUIDString(domain))
+
+	active, _ := s.LibVirt.DomainIsActive(domain)
+	return c.JSON(http.StatusOK, models.VMBootOrderResponse{
+		Order:           utils.BootOrder(def),
+		RestartRequired: active == 1,
+	})
+}
+
+// vmMedia reports the current CD-ROM media of a domain along with the
+// boot order of its next boot
+func (s *QemuService) vmMedia(domain libvirt.Domain) (models.VMMedia, error) {
+	media := models.VMMedia{BootOrder: []string{}}
+	domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		return media, err
+	}
+	def := &libvirtxml.Domain{}
+	if err := def.Unmarshal(domainXML); err != nil {
+		return media, err
+	}
+	if cdrom := utils.CDROMDisk(def); cdrom != nil {
+		if cdrom.Target != nil {
+			media.Device = cdrom.Target.Dev
+		}
+		media.Path = utils.DiskSourceFile(cdrom)
+		if media.Path != "" && filepath.Dir(media.Path) == filepath.Clean(s.FS.ISOs) {
+			media.OSImage = filepath.Base(media.Path)
+		}
+	}
+
+	inactive, err := s.inactiveDomainDef(domain)
+	if err != nil {
+		return media, err
+	}
+	media.BootOrder = utils.BootOrder(inactive)
+	return media, nil
+}
+
+// isoPath resolves the name of an ISO in the library, refusing anything
+// outside of it
+func (s *QemuService) isoPath(name string) (string, error) {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid ISO name %q", name)
+	}
+	path := filepath.Join(s.FS.ISOs, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", name)
+	}
+	return path, nil
+}
+
+//	@Summary      Get host CPU topology
+//	@Description  Get the host's CPUs, NUMA nodes and hugepage pools, for choosing valid pinning
+//	@Tags         qemu
+//	@Produce      json
+//	@Success      200  {object}  models.HostTopology
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/host/topology [get]
+//
+// GetHostTopology returns the host CPU and NUMA topology
+func (s *QemuService) GetHostTopology(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	capsXML, err := s.LibVirt.ConnectGetCapabilities()
+	if err != nil {
+		s.Logger.Error("Failed to get host capabilities", "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to get host topology", err)
+	}
+	host, err := utils.HostTopologyFromCaps(capsXML)
+	if err != nil {
+		return s.Dispatcher.NewInternalServerError("Failed to parse host topology", err)
+	}
+	return c.JSON(http.StatusOK, host)
+}
+
+//	@Summary      Get host capacity
+//	@Description  Get the host's CPUs, memory and image storage, what running VMs already hold and the limits applied when creating VMs. Pass memory, vcpus and disk to check a planned VM
+//	@Tags         qemu
+//	@Produce      json
+//	@Param        memory  query  int  false  "Memory of the planned VM in MiB"
+//	@Param        vcpus   query  int  false  "vCPUs of the planned VM"
+//	@Param        disk    query  int  false  "Disk size of the planned VM in MiB"
+//	@Success      200  {object}  models.HostCapacity
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      500  {object}  models.HTTPError
+//	@Router       /qemu/capacity [get]
+//
+// GetHostCapacity returns the host capacity summary
+func (s *QemuService) GetHostCapacity(c echo.Context) error {
+	if s.LibVirt == nil {
+		return s.Dispatcher.NewInternalServerError("LibVirt connection not available", nil)
+	}
+
+	req := new(models.CapacityRequest)
+	if err := c.Bind(req); err != nil {
+		return s.Dispatcher.NewBadRequest("Invalid query parameters", err)
+	}
+	if req.Memory < 0 || req.VCPUs < 0 || req.DiskSize < 0 {
+		return s.Dispatcher.NewBadRequest("Requested resources must not be negative", nil)
+	}
+
+	capacity, err := s.hostCapacity()
+	if err != nil {
+		s.Logger.Error("Failed to get host capacity", "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to get host capacity", err)
+	}
+	if req.Memory > 0 || req.VCPUs > 0 || req.DiskSize > 0 {
+		capacity.Checks = checkCapacity(capacity, req.Memory, req.VCPUs, req.DiskSize)
+	}
+	return c.JSON(http.StatusOK, capacity)
+}
+
+// hostTopology returns the host topology, or nil when it cannot be read so
+// callers skip host specific validation
+func (s *QemuService) hostTopology() *models.HostTopology {
+	capsXML, err := s.LibVirt.ConnectGetCapabilities()
+	if err != nil {
+		s.Logger.Warn("Failed to get host capabilities", "error", err)
+		return nil
+	}
+	host, err := utils.HostTopologyFromCaps(capsXML)
+	if err != nil {
+		s.Logger.Warn("Failed to parse host capabilities", "error", err)
+		return nil
+	}
+	return host
+}
 
-	return libvirt.Domain{}, fmt.Errorf("domain not found")
+// requirePersistent refuses changes to the next boot of a transient domain.
+// It has none, and defining the changes would quietly make it persistent
+func (s *QemuService) requirePersistent(domain libvirt.Domain, what string) error {
+	persistent, err := s.LibVirt.DomainIsPersistent(domain)
+	if err != nil {
+		s.Logger.Error("Failed to check if domain is persistent", "name", domain.Name, "error", err)
+		return s.Dispatcher.NewInternalServerError("Failed to read virtual machine state", err)
+	}
+	if persistent != 1 {
+		return s.Dispatcher.NewConflict(fmt.Sprintf("Virtual machine is transient, its %s cannot be changed", what), nil)
+	}
+	return nil
+}
+
+// inactiveDomainDef returns the persistent (next boot) definition of a domain
+func (s *QemuService) inactiveDomainDef(domain libvirt.Domain) (*libvirtxml.Domain, error) {
+	domainXML, err := s.LibVirt.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		return nil, err
+	}
+	def := &libvirtxml.Domain{}
+	if err := def.Unmarshal(domainXML); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+//	@Summary      List OS profiles
+//	@Description  Get the bundled OS database with the recommended hardware for each guest OS
+//	@Tags         qemu
+//	@Produce      json
+//	@Success      200  {array}   models.OSProfile
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Router       /qemu/os-profiles [get]
+//
+// GetOSProfiles returns the bundled OS profiles
+func (s *QemuService) GetOSProfiles(c echo.Context) error {
+	return c.JSON(http.StatusOK, utils.OSProfiles())
+}
+
+//	@Summary      Detect OS of an image
+//	@Description  Identify the guest OS of an ISO from its volume label or file name and return the recommended hardware
+//	@Tags         qemu
+//	@Param        os_image  query  string  true  "ISO filename"
+//	@Produce      json
+//	@Success      200  {object}  models.OSDetection
+//	@Failure      400  {object}  models.HTTPError
+//	@Failure      401  {object}  models.HTTPError
+//	@Failure      403  {object}  models.HTTPError
+//	@Failure      404  {object}  models.HTTPError
+//	@Router       /qemu/os-profiles/detect [get]
+//
+// DetectOSProfile returns the OS profile detected for an ISO
+func (s *QemuService) DetectOSProfile(c echo.Context) error {
+	osImage := c.QueryParam("os_image")
+	if osImage == "" {
+		return s.Dispatcher.NewBadRequest("OS image is required", nil)
+	}
+	if filepath.Base(osImage) != osImage {
+		return s.Dispatcher.NewBadRequest("Invalid OS image", nil)
+	}
+	if _, err := os.Stat(filepath.Join(s.FS.ISOs, osImage)); err != nil {
+		return s.Dispatcher.NewNotFound("OS image not found", err)
+	}
+
+	detection, _ := s.detectOS(osImage, "")
+	return c.JSON(http.StatusOK, detection)
+}
+
+// detectOS picks the OS profile for a new VM, from the requested variant or
+// else from its installation image. It fails only for unknown variants
+func (s *QemuService) detectOS(osImage, variant string) (models.OSDetection, bool) {
+	if variant != "" {
+		profile, ok := utils.LookupOSProfile(variant)
+		return models.OSDetection{OSImage: osImage, MatchedBy: "os_variant", Profile: profile}, ok
+	}
+	if osImage == "" {
+		return models.OSDetection{MatchedBy: "default", Profile: utils.GenericOSProfile}, true
+	}
+	return utils.DetectOS(filepath.Join(s.FS.ISOs, osImage)), true
+}
+
+// applyOSDefaults fills the hardware settings a request left out from the
+// OS profile
+func applyOSDefaults(req *models.CreateVMRequest, profile models.OSProfile) {
+	if req.Memory == 0 {
+		req.Memory = profile.Memory
+	}
+	if req.VCPUs == 0 {
+		req.VCPUs = profile.VCPUs
+	}
+	if req.DiskSize == 0 {
+		req.DiskSize = profile.DiskSize
+	}
+	if req.DiskBus == "" {
+		req.DiskBus = profile.DiskBus
+	}
+	if req.NICModel == "" {
+		req.NICModel = profile.NICModel
+	}
+	if req.Firmware == "" {
+		req.Firmware = profile.Firmware
+	}
+}
+
+// errInvalidDomainUUID is returned by GetDomainByUUID for a malformed UUID
+var errInvalidDomainUUID = errors.New("invalid domain uuid")
+
+// GetDomainByUUID looks a domain up directly by its UUID
+func (s *QemuService) GetDomainByUUID(vmUUID string) (libvirt.Domain, error) {
+	id, err := uuid.FromString(vmUUID)
+	if err != nil {
+		return libvirt.Domain{}, fmt.Errorf("%w: %w", errInvalidDomainUUID, err)
+	}
+
+	var lvUUID libvirt.UUID
+	copy(lvUUID[:], id.Bytes())
+	return s.LibVirt.DomainLookupByUUID(lvUUID)
+}
+
+// domainLookupError reports a failed GetDomainByUUID as a missing VM only
+// when libvirt has no such domain, and as a server error otherwise, such as
+// when the connection to libvirt is lost
+func (s *QemuService) domainLookupError(err error) error {
+	if errors.Is(err, errInvalidDomainUUID) || libvirt.IsNotFound(err) {
+		return s.Dispatcher.NewNotFound("Virtual machine not found", err)
+	}
+	s.Logger.Error("Failed to look up domain", "error", err)
+	return s.Dispatcher.NewInternalServerError("Failed to look up virtual machine", err)
 }
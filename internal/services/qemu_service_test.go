@@ -1,13 +1,25 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/digitalocean/go-libvirt"
 	"github.com/labstack/echo/v4"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
 	"github.com/stretchr/testify/assert"
+	"visory/internal/hypervisor"
+	"visory/internal/models"
 	"visory/internal/utils"
 )
 
@@ -215,3 +227,810 @@ func TestGetVirtualMachinesInfoWithoutLibVirt(t *testing.T) {
 	err := service.GetVirtualMachinesInfo(c)
 	assert.Error(t, err, "should return error when LibVirt is not available")
 }
+
+// TestGetVirtualMachineScreenshotWithoutLibVirt tests screenshot error handling
+func TestGetVirtualMachineScreenshotWithoutLibVirt(t *testing.T) {
+	dispatcher := &utils.Dispatcher{}
+	logger := slog.Default()
+
+	service := &QemuService{
+		Dispatcher: dispatcher.WithGroup("qemu"),
+		Logger:     logger.WithGroup("qemu"),
+		LibVirt:    nil,
+	}
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/qemu/virtual-machines/test-uuid/screenshot?max_width=320", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("uuid")
+	c.SetParamValues("test-uuid")
+
+	err := service.GetVirtualMachineScreenshot(c)
+	assert.Error(t, err, "should return error when LibVirt is not available")
+}
+
+// newFakeQemuService returns a service backed by the in-memory hypervisor.
+// Capacity checks are off since the fake's disks live on the real filesystem
+func newFakeQemuService(t *testing.T, seed bool) *QemuService {
+	t.Helper()
+	env := models.ENV_VARS
+	t.Cleanup(func() { models.ENV_VARS = env })
+	models.ENV_VARS.CapacityMode = models.CapacityModeOff
+
+	driver := hypervisor.NewFake()
+	if seed {
+		assert.NoError(t, driver.SeedDemo())
+	}
+	fs := &utils.FS{Images: t.TempDir(), ISOs: t.TempDir()}
+	return NewQemuServiceWithDriver(&utils.Dispatcher{}, fs, slog.Default(), driver)
+}
+
+// TestGetVirtualMachinesWithFakeDriver tests listing and label filtering
+func TestGetVirtualMachinesWithFakeDriver(t *testing.T) {
+	service := newFakeQemuService(t, true)
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/qemu/virtual-machines?sort=name", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, service.GetVirtualMachines(e.NewContext(req, rec)))
+
+	var vms []models.VirtualMachine
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vms))
+	assert.Len(t, vms, 3)
+	assert.Equal(t, "demo-build", vms[0].Name)
+	assert.Equal(t, "3", rec.Header().Get("X-Total-Count"))
+
+	req = httptest.NewRequest(http.MethodGet, "/qemu/virtual-machines/info?selector=role=database", nil)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, service.GetVirtualMachinesInfo(e.NewContext(req, rec)))
+
+	var infos []models.VirtualMachineWithInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, "demo-db", infos[0].Name)
+		assert.Equal(t, uint8(models.VIR_DOMAIN_RUNNING), infos[0].State)
+		assert.Equal(t, uint64(4096*1024), infos[0].MaxMemKB)
+	}
+}
+
+// brokenLookupDriver fails domain lookups the way a dropped libvirt
+// connection does
+type brokenLookupDriver struct {
+	hypervisor.Driver
+}
+
+func (brokenLookupDriver) DomainLookupByUUID(libvirt.UUID) (libvirt.Domain, error) {
+	return libvirt.Domain{}, errors.New("connection reset by peer")
+}
+
+// TestGetVirtualMachineLookupWithFakeDriver tests only a missing domain is
+// reported as not found, by every handler that looks one up
+func TestGetVirtualMachineLookupWithFakeDriver(t *testing.T) {
+	service := newFakeQemuService(t, true)
+	e := echo.New()
+
+	get := func(handler echo.HandlerFunc, vmUUID string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("uuid")
+		c.SetParamValues(vmUUID)
+		var httpErr *echo.HTTPError
+		if err := handler(c); errors.As(err, &httpErr) {
+			return httpErr.Code
+		}
+		return rec.Code
+	}
+
+	domains, _, err := service.LibVirt.ConnectListAllDomains(1, 0)
+	assert.NoError(t, err)
+	vmUUID := domainUUIDString(domains[0])
+
+	for _, handler := range []echo.HandlerFunc{service.GetVirtualMachine, service.GetVirtualMachineInfo} {
+		assert.Equal(t, http.StatusOK, get(handler, vmUUID))
+		assert.Equal(t, http.StatusNotFound, get(handler, "6f1e1c58-0c8e-4c4a-9f3e-000000000000"))
+		assert.Equal(t, http.StatusNotFound, get(handler, "not-a-uuid"))
+	}
+
+	service.LibVirt = brokenLookupDriver{service.LibVirt}
+	for _, handler := range []echo.HandlerFunc{
+		service.GetVirtualMachine, service.GetVirtualMachineInfo,
+		service.StartVirtualMachine, service.RebootVirtualMachine, service.ShutdownVirtualMachine,
+		service.GetVirtualMachineTuning, service.GetVirtualMachineMedia, service.GetVirtualMachineRestartPolicy,
+	} {
+		assert.Equal(t, http.StatusInternalServerError, get(handler, vmUUID))
+	}
+}
+
+// TestVirtualMachineLifecycleWithFakeDriver tests create, start and shutdown
+func TestVirtualMachineLifecycleWithFakeDriver(t *testing.T) {
+	service := newFakeQemuService(t, false)
+	e := echo.New()
+
+	body := `{"name":"test-vm","memory":512,"vcpus":1,"disk":1024,"labels":{"env":"test"}}`
+	req := httptest.NewRequest(http.MethodPost, "/qemu/virtual-machines", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, service.CreateVirtualMachine(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var vm models.VirtualMachine
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vm))
+	assert.NotEmpty(t, vm.UUID)
+
+	info := func() models.VirtualMachineWithInfo {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("uuid")
+		c.SetParamValues(vm.UUID)
+		assert.NoError(t, service.GetVirtualMachineInfo(c))
+		var out models.VirtualMachineWithInfo
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return out
+	}
+
+	// Created without autostart, so the VM starts paused
+	assert.Equal(t, uint8(models.VIR_DOMAIN_PAUSED), info().State)
+	assert.Equal(t, map[string]string{"env": "test"}, info().Labels)
+
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	rec = httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("uuid")
+	c.SetParamValues(vm.UUID)
+	assert.NoError(t, service.StartVirtualMachine(c))
+	assert.Equal(t, uint8(models.VIR_DOMAIN_RUNNING), info().State)
+	assert.NotZero(t, info().VNCPort)
+
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("uuid")
+	c.SetParamValues(vm.UUID)
+	assert.NoError(t, service.ShutdownVirtualMachine(c))
+
+	// VMs are defined, so they are still around once they stop
+	assert.Equal(t, uint8(models.VIR_DOMAIN_SHUTOFF), info().State)
+	assert.Equal(t, map[string]string{"env": "test"}, info().Labels)
+}
+
+// TestRestartPolicyWithFakeDriver tests the crash watchdog restarts a VM and
+// gives up once it keeps crashing
+func TestRestartPolicyWithFakeDriver(t *testing.T) {
+	driver := hypervisor.NewFake()
+	assert.NoError(t, driver.SeedDemo())
+	fs := &utils.FS{Images: t.TempDir(), ISOs: t.TempDir()}
+	service := NewQemuServiceWithDriver(&utils.Dispatcher{}, fs, slog.Default(), driver)
+	service.restarts.backoffBase = time.Millisecond
+	e := echo.New()
+
+	domains, _, err := driver.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	assert.NoError(t, err)
+	domain := domains[0]
+	vmUUID := domainUUIDString(domain)
+
+	body := `{"policy":"on-crash","max_attempts":2}`
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("uuid")
+	c.SetParamValues(vmUUID)
+	assert.NoError(t, service.UpdateVirtualMachineRestartPolicy(c))
+
+	status := func() models.VMRestartStatus {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("uuid")
+		c.SetParamValues(vmUUID)
+		assert.NoError(t, service.GetVirtualMachineRestartPolicy(c))
+		var out models.VMRestartStatus
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return out
+	}
+	isActive := func() bool {
+		active, _ := driver.DomainIsActive(domain)
+		return active == 1
+	}
+
+	assert.Equal(t, models.RestartPolicyOnCrash, status().Policy)
+	assert.Equal(t, 2, status().MaxAttempts)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		assert.NoError(t, driver.Crash(domain))
+		assert.Eventually(t, isActive, time.Second, 5*time.Millisecond, "VM should be restarted")
+		assert.Equal(t, attempt, status().Attempts)
+	}
+
+	assert.NoError(t, driver.Crash(domain))
+	assert.Eventually(t, func() bool { return status().GivenUp }, time.Second, 5*time.Millisecond)
+	assert.False(t, isActive())
+
+	// Stopping a VM from Visory never triggers a restart
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("uuid")
+	c.SetParamValues(vmUUID)
+	assert.NoError(t, service.StartVirtualMachine(c))
+	assert.False(t, status().GivenUp)
+
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("uuid")
+	c.SetParamValues(vmUUID)
+	assert.NoError(t, service.ShutdownVirtualMachine(c))
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, isActive())
+	assert.Zero(t, status().Attempts)
+
+	// A failed shutdown leaves the VM watched
+	service.LibVirt = failingShutdownDriver{driver}
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("uuid")
+	c.SetParamValues(vmUUID)
+	var httpErr *echo.HTTPError
+	assert.ErrorAs(t, service.ShutdownVirtualMachine(c), &httpErr)
+	assert.Equal(t, http.StatusInternalServerError, httpErr.Code)
+	service.restarts.mu.Lock()
+	assert.False(t, service.restarts.domains[vmUUID].expectStop)
+	service.restarts.mu.Unlock()
+}
+
+// failingShutdownDriver rejects shutdown requests, e.g. when the guest
+// agent is unavailable
+type failingShutdownDriver struct {
+	hypervisor.Driver
+}
+
+func (failingShutdownDriver) DomainShutdown(libvirt.Domain) error {
+	return errors.New("guest agent is not responding")
+}
+
+// TestScreenshotCacheWithFakeDriver tests captures are reused within the TTL
+// and forgotten once the VM stops
+func TestScreenshotCacheWithFakeDriver(t *testing.T) {
+	driver := hypervisor.NewFake()
+	assert.NoError(t, driver.SeedDemo())
+	fs := &utils.FS{Images: t.TempDir(), ISOs: t.TempDir()}
+	service := NewQemuServiceWithDriver(&utils.Dispatcher{}, fs, slog.Default(), driver)
+	e := echo.New()
+
+	domains, _, err := driver.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	assert.NoError(t, err)
+	assert.Len(t, domains, 2)
+	vmUUID := domainUUIDString(domains[0])
+
+	screenshot := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?max_width=320", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("uuid")
+		c.SetParamValues(vmUUID)
+		assert.NoError(t, service.GetVirtualMachineScreenshot(c))
+		return rec
+	}
+	cached := func() bool {
+		service.screenshotMu.Lock()
+		defer service.screenshotMu.Unlock()
+		_, ok := service.screenshots[vmUUID]
+		return ok
+	}
+
+	first := screenshot()
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "image/png", first.Header().Get(echo.HeaderContentType))
+	_, capturedAt, err := service.captureScreenshot(vmUUID)
+	assert.NoError(t, err)
+
+	second := screenshot()
+	assert.Equal(t, first.Header().Get("Last-Modified"), second.Header().Get("Last-Modified"))
+	assert.Equal(t, first.Body.Bytes(), second.Body.Bytes())
+	_, again, err := service.captureScreenshot(vmUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, capturedAt, again, "capture within the TTL should come from the cache")
+
+	// Another VM is captured on its own entry
+	_, _, err = service.captureScreenshot(domainUUIDString(domains[1]))
+	assert.NoError(t, err)
+
+	assert.NoError(t, driver.DomainShutdown(domains[0]))
+	assert.Eventually(t, func() bool { return !cached() }, time.Second, 5*time.Millisecond)
+
+	_, _, err = service.captureScreenshot(vmUUID)
+	var httpErr *echo.HTTPError
+	if assert.ErrorAs(t, err, &httpErr) {
+		assert.Equal(t, http.StatusConflict, httpErr.Code)
+	}
+	assert.False(t, cached())
+}
+
+// writeTestISO writes a minimal ISO 9660 image carrying only a volume label
+func writeTestISO(t *testing.T, path, label string) {
+	t.Helper()
+	data := make([]byte, 17*2048)
+	pvd := data[16*2048:]
+	pvd[0] = 1
+	copy(pvd[1:6], "CD001")
+	copy(pvd[40:72], fmt.Sprintf("%-32s", label))
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+}
+
+// TestOSDefaultsWithFakeDriver tests the OS profile is detected from the ISO
+// and applied to the hardware the request left out
+func TestOSDefaultsWithFakeDriver(t *testing.T) {
+	service := newFakeQemuService(t, false)
+	e := echo.New()
+
+	writeTestISO(t, filepath.Join(service.FS.ISOs, "windows.iso"), "CCCOMA_X64FRE_EN-US_DV9")
+	writeTestISO(t, filepath.Join(service.FS.ISOs, "Win11_23H2.iso"), "CCCOMA_X64FRE_EN-US_DV9")
+
+	req := httptest.NewRequest(http.MethodGet, "/?os_image=windows.iso", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, service.DetectOSProfile(e.NewContext(req, rec)))
+	var detection models.OSDetection
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &detection))
+	assert.Equal(t, "win10", detection.Profile.ID)
+	assert.Equal(t, "volume_label", detection.MatchedBy)
+
+	body := `{"name":"win11","os_image":"Win11_23H2.iso"}`
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, service.CreateVirtualMachine(e.NewContext(req, rec)))
+	var vm models.VirtualMachine
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vm))
+
+	domain, err := service.GetDomainByUUID(vm.UUID)
+	assert.NoError(t, err)
+	domainXML, err := service.LibVirt.DomainGetXMLDesc(domain, 0)
+	assert.NoError(t, err)
+	var def libvirtxml.Domain
+	assert.NoError(t, def.Unmarshal(domainXML))
+
+	assert.Equal(t, uint(4096), def.Memory.Value)
+	assert.Equal(t, "efi", def.OS.Firmware)
+	assert.Equal(t, "sata", def.Devices.Disks[0].Target.Bus)
+	assert.Equal(t, "e1000e", def.Devices.Interfaces[0].Model.Type)
+	assert.Len(t, def.Devices.TPMs, 1)
+
+	body = `{"name":"bad","memory":512,"vcpus":1,"disk":1024,"os_variant":"nope"}`
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	assert.Error(t, service.CreateVirtualMachine(e.NewContext(req, httptest.NewRecorder())))
+}
+
+// TestTuningWithFakeDriver tests tuning is validated against the host and
+// written to the domain definition
+func TestTuningWithFakeDriver(t *testing.T) {
+	service := newFakeQemuService(t, true)
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, service.GetHostTopology(e.NewContext(req, rec)))
+	var host models.HostTopology
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &host))
+	assert.Equal(t, 8, host.CPUs)
+	assert.Len(t, host.NUMANodes, 2)
+
+	domains, _, err := service.LibVirt.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	assert.NoError(t, err)
+	// demo-db has 4 vCPUs
+	vmUUID := domainUUIDString(domains[0])
+
+	update := func(body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("uuid")
+		c.SetParamValues(vmUUID)
+		return rec, service.UpdateVirtualMachineTuning(c)
+	}
+
+	rec, err = update(`{
+		"vcpu_pins": [{"vcpu": 0, "cpuset": "2"}, {"vcpu": 1, "cpuset": "3"}],
+		"emulator_pin": "0-1",
+		"iothreads": 1,
+		"iothread_pins": [{"iothread": 1, "cpuset": "0"}],
+		"hugepages": true,
+		"hugepage_size_kib": 2048,
+		"disk_cache": "none",
+		"disk_io": "native",
+		"net_queues": 4,
+		"topology": {"sockets": 1, "cores": 2, "threads": 2}
+	}`)
+	assert.NoError(t, err)
+	var resp models.VMTuningResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.True(t, resp.RestartRequired)
+	assert.Len(t, resp.Tuning.VCPUPins, 2)
+	assert.Equal(t, uint(2048), resp.Tuning.HugepageSizeKiB)
+	assert.Equal(t, &models.CPUTopology{Sockets: 1, Cores: 2, Threads: 2}, resp.Tuning.Topology)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("uuid")
+	c.SetParamValues(vmUUID)
+	assert.NoError(t, service.GetVirtualMachineTuning(c))
+	var tuning models.VMTuning
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tuning))
+	assert.Equal(t, resp.Tuning, tuning)
+
+	for _, body := range []string{
+		`{"vcpu_pins": [{"vcpu": 9, "cpuset": "0"}]}`,
+		`{"emulator_pin": "12"}`,
+		`{"hugepages": true, "hugepage_size_kib": 1024}`,
+		`{"disk_io": "native", "disk_cache": "writeback"}`,
+		`{"topology": {"sockets": 2, "cores": 1, "threads": 1}}`,
+	} {
+		_, err := update(body)
+		assert.Error(t, err, body)
+	}
+
+	// VMs created through the API are tuned like any other
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"tuned","memory":512,"vcpus":2,"disk":1024}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, service.CreateVirtualMachine(e.NewContext(req, rec)))
+	var vm models.VirtualMachine
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vm))
+	vmUUID = vm.UUID
+	rec, err = update(`{"vcpu_pins": [{"vcpu": 0, "cpuset": "4"}], "topology": {"sockets": 1, "cores": 1, "threads": 2}}`)
+	assert.NoError(t, err)
+	resp = models.VMTuningResponse{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, &models.CPUTopology{Sockets: 1, Cores: 1, Threads: 2}, resp.Tuning.Topology)
+
+	// Transient VMs started outside Visory have no next boot to tune and
+	// must not become persistent
+	domain, err := service.LibVirt.DomainCreateXML(`<domain type="kvm"><name>transient</name></domain>`, 0)
+	assert.NoError(t, err)
+	vmUUID = domainUUIDString(domain)
+	_, err = update(`{"iothreads": 1}`)
+	var httpErr *echo.HTTPError
+	if assert.ErrorAs(t, err, &httpErr) {
+		assert.Equal(t, http.StatusConflict, httpErr.Code)
+	}
+	persistent, err := service.LibVirt.DomainIsPersistent(domain)
+	assert.NoError(t, err)
+	assert.Zero(t, persistent)
+}
+
+// TestCapacityWithFakeDriver tests the capacity summary and the checks run
+// before creating a VM
+func TestCapacityWithFakeDriver(t *testing.T) {
+	service := newFakeQemuService(t, true)
+	e := echo.New()
+	models.ENV_VARS.CapacityMode = models.CapacityModeReject
+
+	req := httptest.NewRequest(http.MethodGet, "/qemu/capacity?vcpus=40&memory=1024", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, service.GetHostCapacity(e.NewContext(req, rec)))
+	var capacity models.HostCapacity
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &capacity))
+	assert.Equal(t, models.CapacityModeReject, capacity.Mode)
+	assert.Equal(t, 8, capacity.CPUs)
+	assert.Equal(t, uint64(32), capacity.VCPULimit)
+	// demo-web and demo-db are running
+	assert.Equal(t, uint64(6), capacity.AllocatedVCPUs)
+	assert.Equal(t, uint64(6144*1024), capacity.AllocatedMemoryKiB)
+	assert.Equal(t, capacity.MemoryKiB-capacity.AllocatedMemoryKiB, capacity.FreeMemoryKiB)
+	assert.NotZero(t, capacity.DiskTotalBytes)
+	assert.Len(t, capacity.Checks, 4)
+	for _, check := range capacity.Checks {
+		assert.Equal(t, check.Resource != "vcpus", check.OK, check.Resource)
+	}
+
+	create := func(body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPost, "/qemu/virtual-machines", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		return rec, service.CreateVirtualMachine(e.NewContext(req, rec))
+	}
+
+	_, err := create(`{"name":"too-big","memory":512,"vcpus":27,"disk":1024}`)
+	var httpErr *echo.HTTPError
+	assert.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusConflict, httpErr.Code)
+
+	_, err = create(`{"name":"too-much-memory","memory":32768,"vcpus":1,"disk":1024}`)
+	assert.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusConflict, httpErr.Code)
+
+	models.ENV_VARS.CapacityMode = models.CapacityModeWarn
+	rec, err = create(`{"name":"too-big","memory":512,"vcpus":27,"disk":1024}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var vm models.VirtualMachine
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vm))
+	assert.Len(t, vm.Warnings, 1)
+
+	models.ENV_VARS.CapacityMode = models.CapacityModeOff
+	rec, err = create(`{"name":"off","memory":512,"vcpus":64,"disk":1024}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	// Reject mode does not create VMs on a host it cannot check
+	models.ENV_VARS.CapacityMode = models.CapacityModeReject
+	service.FS.Images = filepath.Join(t.TempDir(), "missing")
+	_, err = create(`{"name":"unchecked","memory":512,"vcpus":1,"disk":1024}`)
+	assert.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusServiceUnavailable, httpErr.Code)
+}
+
+// TestMediaWithFakeDriver tests ejecting and swapping the ISO of a VM and
+// changing its boot order once installed
+func TestMediaWithFakeDriver(t *testing.T) {
+	service := newFakeQemuService(t, false)
+	e := echo.New()
+
+	writeTestISO(t, filepath.Join(service.FS.ISOs, "debian.iso"), "Debian 12")
+	writeTestISO(t, filepath.Join(service.FS.ISOs, "drivers.iso"), "DRIVERS")
+
+	body := `{"name":"installer","os_image":"debian.iso"}`
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, service.CreateVirtualMachine(e.NewContext(req, rec)))
+	var vm models.VirtualMachine
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vm))
+
+	call := func(method, body string, handler echo.HandlerFunc) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(method, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("uuid")
+		c.SetParamValues(vm.UUID)
+		return rec, handler(c)
+	}
+	media := func(rec *httptest.ResponseRecorder) models.VMMedia {
+		var m models.VMMedia
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &m))
+		return m
+	}
+
+	rec, err := call(http.MethodGet, "", service.GetVirtualMachineMedia)
+	assert.NoError(t, err)
+	m := media(rec)
+	assert.Equal(t, "debian.iso", m.OSImage)
+	assert.Equal(t, "sda", m.Device)
+	assert.Equal(t, []string{"cdrom", "disk"}, m.BootOrder)
+
+	rec, err = call(http.MethodDelete, "", service.EjectVirtualMachineMedia)
+	assert.NoError(t, err)
+	m = media(rec)
+	assert.Empty(t, m.OSImage)
+	assert.Empty(t, m.Path)
+
+	rec, err = call(http.MethodPut, `{"os_image":"drivers.iso"}`, service.InsertVirtualMachineMedia)
+	assert.NoError(t, err)
+	assert.Equal(t, "drivers.iso", media(rec).OSImage)
+
+	for _, body := range []string{`{"os_image":"missing.iso"}`, `{"os_image":"../debian.iso"}`, `{}`} {
+		_, err := call(http.MethodPut, body, service.InsertVirtualMachineMedia)
+		assert.Error(t, err, body)
+	}
+
+	rec, err = call(http.MethodPut, `{"order":["disk","cdrom"]}`, service.UpdateVirtualMachineBootOrder)
+	assert.NoError(t, err)
+	var resp models.VMBootOrderResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"disk", "cdrom"}, resp.Order)
+	assert.True(t, resp.RestartRequired)
+
+	rec, err = call(http.MethodGet, "", service.GetVirtualMachineMedia)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"disk", "cdrom"}, media(rec).BootOrder)
+
+	for _, body := range []string{`{"order":[]}`, `{"order":["floppy"]}`, `{"order":["disk","disk"]}`} {
+		_, err := call(http.MethodPut, body, service.UpdateVirtualMachineBootOrder)
+		assert.Error(t, err, body)
+	}
+}
+
+// TestDiskImagesWithFakeDriver tests the disk image inventory, convert,
+// compact and delete, and that failed creates leave no disk behind
+func TestDiskImagesWithFakeDriver(t *testing.T) {
+	service := newFakeQemuService(t, false)
+	e := echo.New()
+	images := service.FS.Images
+
+	call := func(handler echo.HandlerFunc, method, name, body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(method, "/qemu/images", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("name", "id")
+		c.SetParamValues(name, name)
+		return rec, handler(c)
+	}
+	status := func(err error) int {
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			return httpErr.Code
+		}
+		return 0
+	}
+	list := func() map[string]models.DiskImage {
+		rec, err := call(service.ListDiskImages, http.MethodGet, "", "")
+		assert.NoError(t, err)
+		var out []models.DiskImage
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		byName := map[string]models.DiskImage{}
+		for _, image := range out {
+			byName[image.Name] = image
+		}
+		return byName
+	}
+	wait := func(rec *httptest.ResponseRecorder) models.DiskImageJob {
+		var job models.DiskImageJob
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			rec, err := call(service.GetDiskImageJob, http.MethodGet, job.ID, "")
+			assert.NoError(t, err)
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+			if job.Status != models.DiskImageJobStatusRunning {
+				return job
+			}
+		}
+		t.Fatalf("disk image job %s did not finish", job.ID)
+		return job
+	}
+
+	body := `{"name":"app","memory":512,"vcpus":1,"disk":1024}`
+	req := httptest.NewRequest(http.MethodPost, "/qemu/virtual-machines", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	assert.NoError(t, service.CreateVirtualMachine(e.NewContext(req, httptest.NewRecorder())))
+
+	// The duplicate name makes DomainCreateXML fail, its disk must go too
+	req = httptest.NewRequest(http.MethodPost, "/qemu/virtual-machines", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	assert.Error(t, service.CreateVirtualMachine(e.NewContext(req, httptest.NewRecorder())))
+	disks, err := filepath.Glob(filepath.Join(images, "*.qcow2"))
+	assert.NoError(t, err)
+	assert.Len(t, disks, 1)
+	appDisk := filepath.Base(disks[0])
+
+	// An orphaned base image with an overlay on top
+	base, err := service.createDisk(filepath.Join(images, "base"), 2048)
+	assert.NoError(t, err)
+	assert.NoError(t, service.images.ConvertDiskImage(t.Context(), base, filepath.Join(images, "overlay.qcow2"), utils.DiskConvertOptions{
+		Format: "qcow2", BackingFile: base, BackingFormat: "qcow2",
+	}))
+
+	byName := list()
+	assert.Len(t, byName, 3)
+	app := byName[appDisk]
+	assert.Equal(t, "qcow2", app.Format)
+	assert.Equal(t, int64(1024<<20), app.VirtualSize)
+	if assert.Len(t, app.UsedBy, 1) {
+		assert.Equal(t, "app", app.UsedBy[0].Name)
+		assert.Equal(t, "vda", app.UsedBy[0].Device)
+		assert.True(t, app.UsedBy[0].Active)
+	}
+	assert.False(t, app.Orphaned)
+	assert.Equal(t, []string{"overlay.qcow2"}, byName["base.qcow2"].BackingOf)
+	assert.False(t, byName["base.qcow2"].Orphaned)
+	if assert.Len(t, byName["overlay.qcow2"].BackingChain, 1) {
+		assert.Equal(t, base, byName["overlay.qcow2"].BackingChain[0].Path)
+	}
+	assert.True(t, byName["overlay.qcow2"].Orphaned)
+
+	// Only orphans can be deleted
+	_, err = call(service.DeleteDiskImage, http.MethodDelete, appDisk, "")
+	assert.Equal(t, http.StatusConflict, status(err))
+	_, err = call(service.DeleteDiskImage, http.MethodDelete, "base.qcow2", "")
+	assert.Equal(t, http.StatusConflict, status(err))
+	_, err = call(service.DeleteDiskImage, http.MethodDelete, "overlay.qcow2", "")
+	assert.NoError(t, err)
+	assert.True(t, list()["base.qcow2"].Orphaned)
+	_, err = call(service.DeleteDiskImage, http.MethodDelete, "../base.qcow2", "")
+	assert.Equal(t, http.StatusBadRequest, status(err))
+
+	// Images of running VMs cannot be rewritten
+	_, err = call(service.CompactDiskImage, http.MethodPost, appDisk, `{}`)
+	assert.Equal(t, http.StatusConflict, status(err))
+
+	for _, body := range []string{`{"format":"ext4"}`, `{"format":"raw","compress":true}`, `{"format":"qcow2"}`} {
+		_, err = call(service.ConvertDiskImage, http.MethodPost, "base.qcow2", body)
+		assert.Equal(t, http.StatusBadRequest, status(err), body)
+	}
+	rec, err := call(service.ConvertDiskImage, http.MethodPost, "base.qcow2", `{"format":"vmdk"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	job := wait(rec)
+	assert.Equal(t, models.DiskImageJobStatusCompleted, job.Status, job.Error)
+	assert.Equal(t, "base.vmdk", job.Target)
+	converted := list()["base.vmdk"]
+	assert.Equal(t, "vmdk", converted.Format)
+	assert.Equal(t, int64(2048<<20), converted.VirtualSize)
+	_, err = call(service.ConvertDiskImage, http.MethodPost, "base.qcow2", `{"format":"vmdk"}`)
+	assert.Equal(t, http.StatusConflict, status(err))
+
+	rec, err = call(service.CompactDiskImage, http.MethodPost, "base.qcow2", `{"compress":true}`)
+	assert.NoError(t, err)
+	job = wait(rec)
+	assert.Equal(t, models.DiskImageJobStatusCompleted, job.Status, job.Error)
+	assert.Equal(t, "qcow2", list()["base.qcow2"].Format)
+
+	rec, err = call(service.ListDiskImageJobs, http.MethodGet, "", "")
+	assert.NoError(t, err)
+	var jobs []models.DiskImageJob
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &jobs))
+	assert.Len(t, jobs, 2)
+
+	// Files of jobs cut short by a restart are cleaned up
+	part := filepath.Join(images, ".interrupted"+imageJobSuffix)
+	assert.NoError(t, os.WriteFile(part, nil, 0o644))
+	service.removeStaleImageJobs()
+	assert.NoFileExists(t, part)
+}
+
+// TestImageJobHoldsDiskWithFakeDriver tests that a VM cannot start while
+// its disk is compacted, and that a compact of a disk a VM opened anyway
+// keeps the original
+func TestImageJobHoldsDiskWithFakeDriver(t *testing.T) {
+	service := newFakeQemuService(t, false)
+	e := echo.New()
+
+	disk, err := service.createDisk(filepath.Join(service.FS.Images, "db"), 1024)
+	assert.NoError(t, err)
+	domain, err := service.LibVirt.DomainDefineXML(fmt.Sprintf(`<domain type="kvm">
+  <name>db</name>
+  <uuid>6f1c5c2e-2b8a-4a8e-9d0c-3b7e2f4a9c11</uuid>
+  <memory unit="MiB">512</memory>
+  <vcpu>1</vcpu>
+  <devices>
+    <disk type="file" device="disk">
+      <source file="%s"/>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+  </devices>
+</domain>`, disk))
+	assert.NoError(t, err)
+	image, err := service.diskImageForJob(filepath.Base(disk))
+	assert.NoError(t, err)
+	before, err := os.ReadFile(disk)
+	assert.NoError(t, err)
+
+	release := make(chan struct{})
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	job, err := service.startImageJob(e.NewContext(req, httptest.NewRecorder()), image, models.DiskImageJobCompact, image.Name, image.Format, func(ctx context.Context, part string) error {
+		<-release
+		return os.WriteFile(part, []byte("compacted"), 0o644)
+	})
+	assert.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("uuid")
+	c.SetParamValues("6f1c5c2e-2b8a-4a8e-9d0c-3b7e2f4a9c11")
+	var httpErr *echo.HTTPError
+	if assert.ErrorAs(t, service.StartVirtualMachine(c), &httpErr) {
+		assert.Equal(t, http.StatusConflict, httpErr.Code)
+	}
+
+	// Started behind the service's back, the job gives up on the rename
+	assert.NoError(t, service.LibVirt.DomainCreate(domain))
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		service.imageJobs.mu.Lock()
+		job = *service.imageJobs.jobs[job.ID]
+		service.imageJobs.mu.Unlock()
+		if job.Status != models.DiskImageJobStatusRunning {
+			break
+		}
+	}
+	assert.Equal(t, models.DiskImageJobStatusFailed, job.Status)
+	assert.Contains(t, job.Error, "db")
+	after, err := os.ReadFile(disk)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
@@ -31,6 +31,7 @@ type TemplatesService struct {
 	Dispatcher    *utils.Dispatcher
 	Logger        *slog.Logger
 	clientManager *clientmanager.Docker
+	registries    *RegistryCredentials
 
 	// Cache
 	cacheMutex      sync.RWMutex
@@ -39,11 +40,12 @@ type TemplatesService struct {
 }
 
 // NewTemplatesService creates a new TemplatesService with dependency injection
-func NewTemplatesService(dispatcher *utils.Dispatcher, logger *slog.Logger, clientManager *clientmanager.Docker) *TemplatesService {
+func NewTemplatesService(dispatcher *utils.Dispatcher, logger *slog.Logger, clientManager *clientmanager.Docker, registries *RegistryCredentials) *TemplatesService {
 	return &TemplatesService{
 		Dispatcher:    dispatcher.WithGroup("templates"),
 		Logger:        logger.WithGroup("templates"),
 		clientManager: clientManager,
+		registries:    registries,
 	}
 }
 
@@ -145,7 +147,9 @@ func (s *TemplatesService) GetTemplate(c echo.Context) error {
 	return c.JSON(http.StatusOK, templates[id])
 }
 
-// DeployTemplate deploys a template to a Docker client
+// DeployTemplate deploys a template to a Docker client. With ?progress=true
+// the response is a stream of models.DeployTemplateEvent lines reporting the
+// pull
 func (s *TemplatesService) DeployTemplate(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -190,15 +194,23 @@ func (s *TemplatesService) DeployTemplate(c echo.Context) error {
 		}
 	}
 
-	// Pull image first
+	// With progress, the status is sent before the pull starts so the
+	// outcome is reported in the stream rather than as an HTTP error
+	stream := progressNDJSON(c, func(message string) models.DeployTemplateEvent {
+		return models.DeployTemplateEvent{Error: message}
+	})
+
+	// Pull image first, with the stored credentials of its registry
 	s.Logger.Info("Pulling image", "image", template.Image)
-	reader, err := cli.ImagePull(ctx, template.Image, image.PullOptions{})
-	if err != nil {
-		return s.Dispatcher.NewInternalServerError("Failed to pull image", err)
+	var progress func(models.ImagePullProgress)
+	if stream != nil {
+		progress = func(p models.ImagePullProgress) {
+			stream.Send(models.DeployTemplateEvent{Progress: &p})
+		}
+	}
+	if err := s.registries.Pull(ctx, cli, template.Image, image.PullOptions{}, progress); err != nil {
+		return stream.Fail(s.Dispatcher.NewInternalServerError("Failed to pull image", err))
 	}
-	defer reader.Close()
-	// Consume the reader to complete the pull
-	_, _ = io.Copy(io.Discard, reader)
 
 	// Build environment variables
 	env := make([]string, 0)
@@ -307,21 +319,26 @@ func (s *TemplatesService) DeployTemplate(c echo.Context) error {
 	// Create container
 	resp, err := cli.ContainerCreate(ctx, config, hostConfig, networkConfig, nil, containerName)
 	if err != nil {
-		return s.Dispatcher.NewInternalServerError("Failed to create container", err)
+		return stream.Fail(s.Dispatcher.NewInternalServerError("Failed to create container", err))
 	}
 
 	// Start container
 	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return s.Dispatcher.NewInternalServerError("Failed to start container", err)
+		return stream.Fail(s.Dispatcher.NewInternalServerError("Failed to start container", err))
 	}
 
 	s.Logger.Info("Template deployed successfully", "template", template.Title, "container_id", resp.ID)
 
-	return c.JSON(http.StatusCreated, models.DeployResponse{
+	result := models.DeployResponse{
 		ContainerID: resp.ID,
 		Name:        containerName,
 		Message:     fmt.Sprintf("Successfully deployed %s", template.Title),
-	})
+	}
+	if stream != nil {
+		stream.Send(models.DeployTemplateEvent{Result: &result})
+		return nil
+	}
+	return c.JSON(http.StatusCreated, result)
 }
 
 // RefreshCache forces a refresh of the templates cache
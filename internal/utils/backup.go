@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// libvirt-go-xml does not ship the backup/checkpoint schemas, so the small
+// subset we need is declared here
+
+type domainBackup struct {
+	XMLName     xml.Name           `xml:"domainbackup"`
+	Mode        string             `xml:"mode,attr"`
+	Incremental string             `xml:"incremental,omitempty"`
+	Disks       []domainBackupDisk `xml:"disks>disk"`
+}
+
+type domainBackupDisk struct {
+	Name   string                  `xml:"name,attr"`
+	Backup string                  `xml:"backup,attr"`
+	Type   string                  `xml:"type,attr,omitempty"`
+	Driver *domainBackupDiskDriver `xml:"driver,omitempty"`
+	Target *domainBackupDiskTarget `xml:"target,omitempty"`
+}
+
+type domainBackupDiskDriver struct {
+	Type string `xml:"type,attr"`
+}
+
+type domainBackupDiskTarget struct {
+	File string `xml:"file,attr"`
+}
+
+type domainCheckpoint struct {
+	XMLName xml.Name               `xml:"domaincheckpoint"`
+	Name    string                 `xml:"name"`
+	Disks   []domainCheckpointDisk `xml:"disks>disk"`
+}
+
+type domainCheckpointDisk struct {
+	Name       string `xml:"name,attr"`
+	Checkpoint string `xml:"checkpoint,attr"`
+}
+
+// BackupDisk is a writable disk of a domain that can be backed up
+type BackupDisk struct {
+	Target string // e.g. vda
+	Source string // path of the disk image on the host
+}
+
+// BackupDisksFromDomainXML returns the file backed, writable disks of a domain
+func BackupDisksFromDomainXML(domainXML string) ([]BackupDisk, error) {
+	var dom libvirtxml.Domain
+	if err := dom.Unmarshal(domainXML); err != nil {
+		return nil, err
+	}
+	if dom.Devices == nil {
+		return nil, nil
+	}
+
+	var disks []BackupDisk
+	for _, d := range dom.Devices.Disks {
+		if d.Device == "cdrom" || d.Device == "floppy" || d.ReadOnly != nil {
+			continue
+		}
+		if d.Target == nil || d.Source == nil || d.Source.File == nil || d.Source.File.File == "" {
+			continue
+		}
+		disks = append(disks, BackupDisk{Target: d.Target.Dev, Source: d.Source.File.File})
+	}
+	return disks, nil
+}
+
+// BuildBackupXML builds a push mode <domainbackup> writing each disk to
+// targets[disk.Target]. When incremental is set only blocks changed since
+// that checkpoint are written
+func BuildBackupXML(disks []BackupDisk, targets map[string]string, incremental string) (string, error) {
+	b := domainBackup{Mode: "push", Incremental: incremental}
+	for _, d := range disks {
+		b.Disks = append(b.Disks, domainBackupDisk{
+			Name:   d.Target,
+			Backup: "yes",
+			Type:   "file",
+			Driver: &domainBackupDiskDriver{Type: "qcow2"},
+			Target: &domainBackupDiskTarget{File: targets[d.Target]},
+		})
+	}
+	out, err := xml.Marshal(b)
+	return string(out), err
+}
+
+// BuildCheckpointXML builds a <domaincheckpoint> tracking dirty blocks of disks
+func BuildCheckpointXML(name string, disks []BackupDisk) (string, error) {
+	cp := domainCheckpoint{Name: name}
+	for _, d := range disks {
+		cp.Disks = append(cp.Disks, domainCheckpointDisk{Name: d.Target, Checkpoint: "bitmap"})
+	}
+	out, err := xml.Marshal(cp)
+	return string(out), err
+}
+
+// ConvertDiskImage copies src into a standalone qcow2 image at dst, flattening
+// any backing chain
+func ConvertDiskImage(src, dst string) error {
+	return runQemuImg("convert", "-O", "qcow2", src, dst)
+}
+
+// RebaseDiskImage points the qcow2 image at path to a new backing file
+// without touching its data
+func RebaseDiskImage(path, backing string) error {
+	return runQemuImg("rebase", "-u", "-F", "qcow2", "-b", backing, path)
+}
+
+// DirSize returns the total size of the regular files directly inside dir
+func DirSize(dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		total += info.Size()
+	}
+	return total
+}
+
+func runQemuImg(args ...string) error {
+	out, err := exec.Command("qemu-img", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img %s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
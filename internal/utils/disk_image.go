@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"visory/internal/models"
+)
+
+// DiskConvertOptions tune how a disk image is rewritten
+type DiskConvertOptions struct {
+	Format   string
+	Compress bool // Compress the clusters, qcow2 only
+	// BackingFile keeps the output on top of this image instead of
+	// flattening the whole chain into it
+	BackingFile   string
+	BackingFormat string
+}
+
+// QemuImg inspects and converts disk images with qemu-img on the host
+type QemuImg struct{}
+
+type qemuImgInfo struct {
+	Filename    string `json:"filename"`
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual-size"`
+	ActualSize  int64  `json:"actual-size"`
+}
+
+// DiskImageInfo returns the image at path followed by its backing files.
+// Images in use by a running domain are read without taking their lock
+func (QemuImg) DiskImageInfo(path string) ([]models.DiskImageLayer, error) {
+	out, err := exec.Command("qemu-img", "info", "--output=json", "--backing-chain", "-U", path).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("qemu-img info: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("qemu-img info: %w", err)
+	}
+	var chain []qemuImgInfo
+	if err := json.Unmarshal(out, &chain); err != nil {
+		return nil, fmt.Errorf("failed to parse qemu-img info: %w", err)
+	}
+	layers := make([]models.DiskImageLayer, 0, len(chain))
+	for _, l := range chain {
+		layers = append(layers, models.DiskImageLayer{
+			Path:        l.Filename,
+			Format:      l.Format,
+			VirtualSize: l.VirtualSize,
+			ActualSize:  l.ActualSize,
+		})
+	}
+	return layers, nil
+}
+
+// ConvertDiskImage writes src to dst in another format. Only allocated data
+// is copied, so converting an image to its own format compacts it
+func (QemuImg) ConvertDiskImage(ctx context.Context, src, dst string, opts DiskConvertOptions) error {
+	args := []string{"convert", "-O", opts.Format}
+	if opts.Compress {
+		args = append(args, "-c")
+	}
+	if opts.BackingFile != "" {
+		args = append(args, "-B", opts.BackingFile, "-F", opts.BackingFormat)
+	}
+	args = append(args, src, dst)
+	out, err := exec.CommandContext(ctx, "qemu-img", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img convert: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -72,6 +72,40 @@ func (m *Dispatcher) InsertIntoDB(data models.LogRequestData) error {
 	return nil
 }
 
+// InsertEventIntoDB records a background event (one that is not tied to an
+// HTTP request) in the audit log
+func (m *Dispatcher) InsertEventIntoDB(data models.LogEventData) error {
+	if m.db == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	jsonifiedDetails, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("error happened", "err", err)
+		return err
+	}
+	details := string(jsonifiedDetails)
+	level := data.Level
+	if level == "" {
+		level = "INFO"
+	}
+
+	_, err = m.db.Log.CreateLog(ctx, logs.CreateLogParams{
+		UserID:       data.UserId,
+		Action:       fmt.Sprintf("%v %v", data.Event, data.Subject),
+		Details:      &details,
+		ServiceGroup: m.getGroupName(),
+		Level:        level,
+	})
+	if err != nil {
+		slog.Error("error inserting event into DB", "err", err)
+		return err
+	}
+
+	return nil
+}
+
 func (m *Dispatcher) NewHTTPError(status int, message string, internal error, otherInfo ...any) *echo.HTTPError {
 	// Convert otherInfo to strings and join them
 	var otherErrs []error
@@ -1,15 +1,23 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+
+	"visory/internal/models"
+
+	"golang.org/x/sys/unix"
 )
 
 type FS struct {
-	root   string
-	Images string
-	ISOs   string
+	root    string
+	Images  string
+	ISOs    string
+	Backups string
 }
 
 func NewFS(root string) *FS {
@@ -19,14 +27,21 @@ func NewFS(root string) *FS {
 	}
 
 	fs := &FS{
-		root:   root,
-		Images: filepath.Join(root, "images"),
-		ISOs:   filepath.Join(root, "templates", "iso"),
+		root:    root,
+		Images:  filepath.Join(root, "images"),
+		ISOs:    filepath.Join(root, "templates", "iso"),
+		Backups: filepath.Join(root, "backups"),
+	}
+	if dir := models.ENV_VARS.BackupDirectory; dir != "" {
+		if abs, err := filepath.Abs(dir); err == nil {
+			fs.Backups = abs
+		}
 	}
 
 	for _, p := range []string{
 		fs.Images,
 		fs.ISOs,
+		fs.Backups,
 	} {
 		if err := os.MkdirAll(p, 0o755); err != nil {
 			panic(fmt.Sprintf("failed to create fs: %s", err))
@@ -35,3 +50,28 @@ func NewFS(root string) *FS {
 
 	return fs
 }
+
+// DiskUsage returns the size and the space available to unprivileged users
+// of the filesystem holding path, in bytes
+func DiskUsage(path string) (total, free uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Blocks * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
+
+// FileSHA256 returns the hex encoded SHA-256 checksum of a file
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
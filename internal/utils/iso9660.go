@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"visory/internal/models"
+)
+
+const (
+	isoSectorSize          = 2048
+	isoVolumeDescriptorSet = 16
+	// isoMaxDescriptors bounds the walk over the volume descriptors and the
+	// UDF volume recognition sequence that follows them
+	isoMaxDescriptors = 64
+	udfAnchorSector   = 256
+)
+
+// El Torito platform ids
+var bootPlatforms = map[byte]string{
+	0x00: "bios",
+	0x01: "ppc",
+	0x02: "mac",
+	0xef: "efi",
+}
+
+// InspectISO reads the volume descriptors of an ISO 9660 and/or UDF image:
+// its label, creation date and whether it is bootable
+func InspectISO(path string) (models.ISOHeader, error) {
+	var h models.ISOHeader
+	f, err := os.Open(path)
+	if err != nil {
+		return h, err
+	}
+	defer f.Close()
+
+	iso9660, udf := false, false
+	var bootCatalog uint32
+	sector := make([]byte, isoSectorSize)
+descriptors:
+	for i := 0; i < isoMaxDescriptors; i++ {
+		if _, err := f.ReadAt(sector, int64(isoVolumeDescriptorSet+i)*isoSectorSize); err != nil {
+			if i == 0 {
+				return h, fmt.Errorf("%s is too small for an ISO image", filepath.Base(path))
+			}
+			break
+		}
+		switch string(sector[1:6]) {
+		case "CD001":
+			iso9660 = true
+			switch sector[0] {
+			case 0: // Boot record
+				if strings.HasPrefix(string(sector[7:39]), "EL TORITO SPECIFICATION") {
+					h.Bootable = true
+					bootCatalog = binary.LittleEndian.Uint32(sector[71:75])
+				}
+			case 1: // Primary volume descriptor
+				h.SystemID = trimISOString(sector[8:40])
+				h.VolumeLabel = trimISOString(sector[40:72])
+				h.Created = parseISODate(sector[813:830])
+			}
+		case "BEA01", "TEA01":
+		case "NSR02", "NSR03":
+			udf = true
+		default:
+			break descriptors
+		}
+	}
+
+	switch {
+	case iso9660 && udf:
+		h.Format = "iso9660+udf"
+	case iso9660:
+		h.Format = "iso9660"
+	case udf:
+		h.Format = "udf"
+	default:
+		return h, fmt.Errorf("%s is not an ISO 9660 or UDF image", filepath.Base(path))
+	}
+
+	if udf {
+		// UDF only images have no ISO 9660 label, bridge images have both
+		label, created := readUDFVolume(f)
+		if h.VolumeLabel == "" {
+			h.VolumeLabel = label
+		}
+		if h.Created == nil {
+			h.Created = created
+		}
+	}
+	if h.Bootable {
+		h.BootPlatforms = readBootPlatforms(f, bootCatalog)
+	}
+	return h, nil
+}
+
+// ReadISOVolumeLabel returns the volume label of an ISO 9660 or UDF image
+func ReadISOVolumeLabel(path string) (string, error) {
+	h, err := InspectISO(path)
+	if err != nil {
+		return "", err
+	}
+	return h.VolumeLabel, nil
+}
+
+// readBootPlatforms lists the platforms of the El Torito boot catalog
+// entries, in catalog order
+func readBootPlatforms(r io.ReaderAt, catalogSector uint32) []string {
+	catalog := make([]byte, isoSectorSize)
+	if _, err := r.ReadAt(catalog, int64(catalogSector)*isoSectorSize); err != nil {
+		return nil
+	}
+	// Validation entry: header id 1 and the 0x55 0xaa key bytes
+	if catalog[0] != 1 || catalog[30] != 0x55 || catalog[31] != 0xaa {
+		return nil
+	}
+
+	var platforms []string
+	add := func(id byte) {
+		name, ok := bootPlatforms[id]
+		if !ok {
+			name = fmt.Sprintf("0x%02x", id)
+		}
+		for _, p := range platforms {
+			if p == name {
+				return
+			}
+		}
+		platforms = append(platforms, name)
+	}
+	add(catalog[1])
+
+	// The default entry follows the validation entry, then section headers
+	// (0x90, or 0x91 for the last one) each followed by their entries
+	for off := 64; off+32 <= len(catalog); {
+		indicator := catalog[off]
+		if indicator != 0x90 && indicator != 0x91 {
+			break
+		}
+		add(catalog[off+1])
+		entries := int(binary.LittleEndian.Uint16(catalog[off+2 : off+4]))
+		off += 32 * (1 + entries)
+		if indicator == 0x91 {
+			break
+		}
+	}
+	return platforms
+}
+
+// readUDFVolume returns the volume identifier and recording date from the
+// UDF primary volume descriptor, found through the anchor at sector 256
+func readUDFVolume(r io.ReaderAt) (string, *time.Time) {
+	sector := make([]byte, isoSectorSize)
+	if _, err := r.ReadAt(sector, udfAnchorSector*isoSectorSize); err != nil {
+		return "", nil
+	}
+	if binary.LittleEndian.Uint16(sector[0:2]) != 2 {
+		return "", nil
+	}
+	length := binary.LittleEndian.Uint32(sector[16:20])
+	location := binary.LittleEndian.Uint32(sector[20:24])
+
+	for i := uint32(0); i < min(length/isoSectorSize, isoMaxDescriptors); i++ {
+		if _, err := r.ReadAt(sector, int64(location+i)*isoSectorSize); err != nil {
+			return "", nil
+		}
+		switch binary.LittleEndian.Uint16(sector[0:2]) {
+		case 1: // Primary volume descriptor
+			return decodeDString(sector[24:56]), parseUDFTimestamp(sector[376:388])
+		case 8: // Terminating descriptor
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// decodeDString decodes an OSTA compressed unicode dstring, whose last byte
+// holds the length of the used part
+func decodeDString(b []byte) string {
+	n := int(b[len(b)-1])
+	if n == 0 || n >= len(b) {
+		return ""
+	}
+	data := b[1:n]
+	switch b[0] {
+	case 8:
+		return strings.TrimRight(string(data), " \x00")
+	case 16:
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(data[2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), " \x00")
+	}
+	return ""
+}
+
+// parseUDFTimestamp decodes a UDF timestamp, nil when unset
+func parseUDFTimestamp(b []byte) *time.Time {
+	year := int(int16(binary.LittleEndian.Uint16(b[2:4])))
+	if year == 0 {
+		return nil
+	}
+	loc := time.UTC
+	typeAndZone := binary.LittleEndian.Uint16(b[0:2])
+	if typeAndZone>>12 == 1 {
+		// 12 bit signed offset from UTC in minutes, -2047 when unspecified
+		offset := int(int16(typeAndZone<<4) >> 4)
+		if offset != -2047 {
+			loc = time.FixedZone("", offset*60)
+		}
+	}
+	t := time.Date(year, time.Month(b[4]), int(b[5]), int(b[6]), int(b[7]), int(b[8]), int(b[9])*10*int(time.Millisecond), loc).UTC()
+	return &t
+}
+
+// parseISODate decodes an ISO 9660 volume date ("YYYYMMDDHHMMSScc" digits
+// and an offset from UTC in 15 minute steps), nil when unset
+func parseISODate(b []byte) *time.Time {
+	digits := string(b[:16])
+	var parts [7]int
+	for i, width := range []int{4, 2, 2, 2, 2, 2, 2} {
+		start := 0
+		if i > 0 {
+			start = 4 + 2*(i-1)
+		}
+		n, err := strconv.Atoi(digits[start : start+width])
+		if err != nil {
+			return nil
+		}
+		parts[i] = n
+	}
+	if parts[0] == 0 {
+		return nil
+	}
+	loc := time.FixedZone("", int(int8(b[16]))*15*60)
+	t := time.Date(parts[0], time.Month(parts[1]), parts[2], parts[3], parts[4], parts[5], parts[6]*10*int(time.Millisecond), loc).UTC()
+	return &t
+}
+
+func trimISOString(b []byte) string {
+	return strings.TrimRight(string(b), " \x00")
+}
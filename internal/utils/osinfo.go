@@ -0,0 +1,115 @@
+package utils
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"visory/internal/models"
+)
+
+// Disk buses, NIC models and firmware accepted when creating a VM
+var (
+	DiskBuses = []string{"virtio", "sata", "ide"}
+	NICModels = []string{"virtio", "e1000e", "e1000", "rtl8139"}
+	Firmwares = []string{"bios", "efi"}
+)
+
+// GenericOSProfile is used when the guest OS cannot be identified. It keeps
+// the virtio devices Visory always used
+var GenericOSProfile = models.OSProfile{
+	ID:       "generic",
+	Name:     "Generic OS",
+	Family:   "other",
+	Memory:   2048,
+	VCPUs:    2,
+	DiskSize: 20480,
+	DiskBus:  "virtio",
+	NICModel: "virtio",
+	Firmware: "bios",
+}
+
+//go:embed osdb.json
+var osDBJSON []byte
+
+type osDBEntry struct {
+	models.OSProfile
+	Label    string `json:"label"`    // regexp matched against the ISO volume label
+	Filename string `json:"filename"` // regexp matched against the ISO file name
+}
+
+type osMatcher struct {
+	profile  models.OSProfile
+	label    *regexp.Regexp
+	filename *regexp.Regexp
+}
+
+var osDB = mustLoadOSDB(osDBJSON)
+
+func mustLoadOSDB(raw []byte) []osMatcher {
+	var entries []osDBEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		panic(fmt.Sprintf("invalid bundled OS database: %s", err))
+	}
+	db := make([]osMatcher, 0, len(entries))
+	for _, e := range entries {
+		m := osMatcher{profile: e.OSProfile}
+		if e.Label != "" {
+			m.label = regexp.MustCompile(e.Label)
+		}
+		if e.Filename != "" {
+			m.filename = regexp.MustCompile(e.Filename)
+		}
+		db = append(db, m)
+	}
+	return db
+}
+
+// OSProfiles returns every profile of the bundled OS database
+func OSProfiles() []models.OSProfile {
+	profiles := make([]models.OSProfile, 0, len(osDB)+1)
+	for _, m := range osDB {
+		profiles = append(profiles, m.profile)
+	}
+	return append(profiles, GenericOSProfile)
+}
+
+// LookupOSProfile returns the profile with the given id
+func LookupOSProfile(id string) (models.OSProfile, bool) {
+	for _, p := range OSProfiles() {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return models.OSProfile{}, false
+}
+
+// DetectOS identifies the guest OS of an installation image from its volume
+// label and file name. Entries are tried in order, so more specific ones
+// (e.g. Windows 11, which shares its label scheme with Windows 10) come first
+func DetectOS(isoPath string) models.OSDetection {
+	det := models.OSDetection{
+		OSImage:   filepath.Base(isoPath),
+		MatchedBy: "default",
+		Profile:   GenericOSProfile,
+	}
+	if label, err := ReadISOVolumeLabel(isoPath); err == nil {
+		det.VolumeLabel = label
+	}
+
+	for _, m := range osDB {
+		switch {
+		case m.label != nil && det.VolumeLabel != "" && m.label.MatchString(det.VolumeLabel):
+			det.MatchedBy = "volume_label"
+		case m.filename != nil && m.filename.MatchString(det.OSImage):
+			det.MatchedBy = "filename"
+		default:
+			continue
+		}
+		det.Profile = m.profile
+		return det
+	}
+	return det
+}
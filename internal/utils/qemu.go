@@ -2,9 +2,12 @@ package utils
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 	"path/filepath"
 
+	"visory/internal/models"
+
 	"github.com/gofrs/uuid"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
@@ -32,19 +35,39 @@ type LibVirtDomainParams struct {
 	SpiceListenIpAddr     string
 	VNCListenPort         int
 	VNCListenIpAddr       string
+	Description           string
+	Labels                map[string]string
+	RestartPolicy         string
+	DiskBus               string // virtio (default), sata or ide
+	NICModel              string // virtio (default), e1000e, e1000 or rtl8139
+	Firmware              string // bios (default) or efi
+	TPM                   bool   // emulated TPM 2.0 and secure boot, needs efi
+	Tuning                *models.VMTuning
+	// CreateDisk overrides how the disk image is provisioned, defaults to qemu-img
+	CreateDisk func(path string, sizeMB uint) (string, error)
 }
 
-// BuildLibVirtDomain and create disk image using provided params, returns DomainXML for libvirt
-func BuildLibVirtDomain(p *LibVirtDomainParams) (string, error) {
+// BuildLibVirtDomain and create disk image using provided params, returns DomainXML for libvirt.
+// The disk image is removed again when building the XML fails
+func BuildLibVirtDomain(p *LibVirtDomainParams) (domainXML string, err error) {
 	uuid, err := uuid.NewV4()
 	if err != nil {
 		return "", err
 	}
 
-	diskImage, err := createDiskImage(filepath.Join(p.DiskLocation, uuid.String()), p.DiskSize)
+	createDisk := p.CreateDisk
+	if createDisk == nil {
+		createDisk = createDiskImage
+	}
+	diskImage, err := createDisk(filepath.Join(p.DiskLocation, uuid.String()), p.DiskSize)
 	if err != nil {
 		return "", err
 	}
+	defer func() {
+		if err != nil {
+			os.Remove(diskImage)
+		}
+	}()
 	g := libvirtxml.DomainGraphic{}
 
 	if p.VNCListenPort >= 0 {
@@ -81,10 +104,33 @@ func BuildLibVirtDomain(p *LibVirtDomainParams) (string, error) {
 
 	graphics := []libvirtxml.DomainGraphic{g}
 
+	var metadata *libvirtxml.DomainMetadata
+	if len(p.Labels) > 0 || (p.RestartPolicy != "" && p.RestartPolicy != models.RestartPolicyNever) {
+		meta := &VMMetadata{}
+		meta.SetLabels(p.Labels)
+		if p.RestartPolicy != "" && p.RestartPolicy != models.RestartPolicyNever {
+			meta.Restart = &VMRestart{Policy: p.RestartPolicy}
+		}
+		metaXML, err := meta.Marshal()
+		if err != nil {
+			return "", err
+		}
+		metadata = &libvirtxml.DomainMetadata{XML: metaXML}
+	}
+
+	disks, controllers, machine := buildDiskLayout(p.DiskBus, diskImage, p.InstallationMediaPath)
+
+	nicModel := p.NICModel
+	if nicModel == "" {
+		nicModel = "virtio"
+	}
+
 	dom := libvirtxml.Domain{
-		UUID: uuid.String(),
-		Type: "kvm",
-		Name: p.Name,
+		UUID:        uuid.String(),
+		Type:        "kvm",
+		Name:        p.Name,
+		Description: p.Description,
+		Metadata:    metadata,
 		Memory: &libvirtxml.DomainMemory{
 			Value: p.MemorySize,
 			Unit:  "MiB",
@@ -100,80 +146,21 @@ func BuildLibVirtDomain(p *LibVirtDomainParams) (string, error) {
 		OS: &libvirtxml.DomainOS{
 			Type: &libvirtxml.DomainOSType{
 				Arch:    "x86_64",
-				Machine: "pc-q35-10.0",
+				Machine: machine,
 				Type:    "hvm",
 			},
 		},
+		Features: &libvirtxml.DomainFeatureList{
+			ACPI: &libvirtxml.DomainFeature{},
+			APIC: &libvirtxml.DomainFeatureAPIC{},
+		},
 		CPU: &libvirtxml.DomainCPU{
 			Mode: "host-passthrough",
 		},
 		Devices: &libvirtxml.DomainDeviceList{
-			Emulator: "/usr/bin/qemu-system-x86_64",
-			Disks: []libvirtxml.DomainDisk{
-				{
-					Driver: &libvirtxml.DomainDiskDriver{
-						Name: "qemu",
-						Type: "qcow2",
-					},
-					Source: &libvirtxml.DomainDiskSource{
-						File: &libvirtxml.DomainDiskSourceFile{
-							File: diskImage,
-						},
-						Index: 0,
-					},
-					BackingStore: &libvirtxml.DomainDiskBackingStore{},
-					Target: &libvirtxml.DomainDiskTarget{
-						Dev: "vda",
-						Bus: "virtio",
-					},
-					Alias: &libvirtxml.DomainAlias{
-						Name: "virtio-disk0",
-					},
-				},
-				{
-					Driver: &libvirtxml.DomainDiskDriver{
-						Name: "qemu",
-					},
-					Device: "cdrom",
-					Boot: &libvirtxml.DomainDeviceBoot{
-						Order: 1,
-					},
-					Target: &libvirtxml.DomainDiskTarget{
-						Dev: "sda",
-						Bus: "sata",
-					},
-					Source: &libvirtxml.DomainDiskSource{
-						File: &libvirtxml.DomainDiskSourceFile{
-							File: p.InstallationMediaPath,
-						},
-						Index: 1,
-					},
-					ReadOnly: &libvirtxml.DomainDiskReadOnly{},
-					Alias: &libvirtxml.DomainAlias{
-						Name: "sata0-0-0",
-					},
-					Address: &libvirtxml.DomainAddress{
-						Drive: &libvirtxml.DomainAddressDrive{},
-					},
-				},
-			},
-			Controllers: []libvirtxml.DomainController{
-				{
-					Type: "sata",
-					Alias: &libvirtxml.DomainAlias{
-						Name: "ide",
-					},
-					Index: new(uint),
-					Address: &libvirtxml.DomainAddress{
-						PCI: &libvirtxml.DomainAddressPCI{
-							Domain:   new(uint),
-							Bus:      new(uint),
-							Slot:     new(uint),
-							Function: new(uint),
-						},
-					},
-				},
-			},
+			Emulator:    "/usr/bin/qemu-system-x86_64",
+			Disks:       disks,
+			Controllers: controllers,
 			Interfaces: []libvirtxml.DomainInterface{
 				{
 					Source: &libvirtxml.DomainInterfaceSource{
@@ -182,16 +169,158 @@ func BuildLibVirtDomain(p *LibVirtDomainParams) (string, error) {
 						},
 					},
 					Model: &libvirtxml.DomainInterfaceModel{
-						Type: "virtio", // common portable model
+						Type: nicModel,
 					},
 				},
 			},
 			Graphics: graphics,
 		},
 	}
+
+	if p.Firmware == "efi" {
+		dom.OS.Firmware = "efi"
+	}
+	if p.TPM {
+		// Windows 11 refuses to install without TPM 2.0 and secure boot
+		dom.OS.Firmware = "efi"
+		dom.OS.FirmwareInfo = &libvirtxml.DomainOSFirmwareInfo{
+			Features: []libvirtxml.DomainOSFirmwareFeature{
+				{Name: "secure-boot", Enabled: "yes"},
+				{Name: "enrolled-keys", Enabled: "yes"},
+			},
+		}
+		dom.Features.SMM = &libvirtxml.DomainFeatureSMM{State: "on"}
+		dom.Devices.TPMs = []libvirtxml.DomainTPM{
+			{
+				Model: "tpm-crb",
+				Backend: &libvirtxml.DomainTPMBackend{
+					Emulator: &libvirtxml.DomainTPMBackendEmulator{Version: "2.0"},
+				},
+			},
+		}
+	}
+	if p.Tuning != nil {
+		ApplyTuning(&dom, p.Tuning)
+	}
 	return dom.Marshal()
 }
 
+// buildDiskLayout returns the system disk and installation cdrom on the
+// requested bus, with the controller and machine type that bus needs. Guests
+// without virtio drivers (e.g. Windows installers) need sata or ide to see
+// their disk at all
+func buildDiskLayout(bus, diskImage, installationMedia string) ([]libvirtxml.DomainDisk, []libvirtxml.DomainController, string) {
+	machine := "pc-q35-10.0"
+	controllerType := "sata"
+	diskTarget := &libvirtxml.DomainDiskTarget{Dev: "vda", Bus: "virtio"}
+	diskAlias := "virtio-disk0"
+	var diskAddress *libvirtxml.DomainAddress
+	cdromTarget := &libvirtxml.DomainDiskTarget{Dev: "sda", Bus: "sata"}
+	cdromAlias := "sata0-0-0"
+	cdromAddress := driveAddress(0, 0)
+
+	switch bus {
+	case "sata":
+		diskTarget = &libvirtxml.DomainDiskTarget{Dev: "sda", Bus: "sata"}
+		diskAlias = "sata0-0-0"
+		diskAddress = driveAddress(0, 0)
+		cdromTarget = &libvirtxml.DomainDiskTarget{Dev: "sdb", Bus: "sata"}
+		cdromAlias = "sata0-0-1"
+		cdromAddress = driveAddress(0, 1)
+	case "ide":
+		// q35 has no IDE controller, fall back to the i440FX machine
+		machine = "pc"
+		controllerType = "ide"
+		diskTarget = &libvirtxml.DomainDiskTarget{Dev: "hda", Bus: "ide"}
+		diskAlias = "ide0-0-0"
+		diskAddress = driveAddress(0, 0)
+		cdromTarget = &libvirtxml.DomainDiskTarget{Dev: "hdc", Bus: "ide"}
+		cdromAlias = "ide0-1-0"
+		cdromAddress = driveAddress(1, 0)
+	}
+
+	disks := []libvirtxml.DomainDisk{
+		{
+			Driver: &libvirtxml.DomainDiskDriver{
+				Name: "qemu",
+				Type: "qcow2",
+			},
+			Source: &libvirtxml.DomainDiskSource{
+				File: &libvirtxml.DomainDiskSourceFile{
+					File: diskImage,
+				},
+				Index: 0,
+			},
+			BackingStore: &libvirtxml.DomainDiskBackingStore{},
+			// Boot the installer first, then the installed system once the
+			// ISO is ejected
+			Boot: &libvirtxml.DomainDeviceBoot{
+				Order: 2,
+			},
+			Target: diskTarget,
+			Alias: &libvirtxml.DomainAlias{
+				Name: diskAlias,
+			},
+			Address: diskAddress,
+		},
+		{
+			Driver: &libvirtxml.DomainDiskDriver{
+				Name: "qemu",
+			},
+			Device: "cdrom",
+			Boot: &libvirtxml.DomainDeviceBoot{
+				Order: 1,
+			},
+			Target: cdromTarget,
+			Source: &libvirtxml.DomainDiskSource{
+				File: &libvirtxml.DomainDiskSourceFile{
+					File: installationMedia,
+				},
+				Index: 1,
+			},
+			ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+			Alias: &libvirtxml.DomainAlias{
+				Name: cdromAlias,
+			},
+			Address: cdromAddress,
+		},
+	}
+
+	controllers := []libvirtxml.DomainController{
+		{
+			Type: controllerType,
+			Alias: &libvirtxml.DomainAlias{
+				Name: "ide",
+			},
+			Index: new(uint),
+			Address: &libvirtxml.DomainAddress{
+				PCI: &libvirtxml.DomainAddressPCI{
+					Domain:   new(uint),
+					Bus:      new(uint),
+					Slot:     new(uint),
+					Function: new(uint),
+				},
+			},
+		},
+	}
+	if controllerType == "ide" {
+		// The i440FX IDE controller is built in, libvirt places it itself
+		controllers[0].Address = nil
+	}
+	return disks, controllers, machine
+}
+
+func driveAddress(bus, unit uint) *libvirtxml.DomainAddress {
+	return &libvirtxml.DomainAddress{
+		Drive: &libvirtxml.DomainAddressDrive{
+			Controller: new(uint),
+			Bus:        &bus,
+			Target:     new(uint),
+			Unit:       &unit,
+		},
+	}
+}
+
 var ErrVNCNotFound = fmt.Errorf("VNC configuration not found in domain XML")
 
 // Extract VNC configuration from domain XML
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// Boot devices accepted in a VM's boot order
+const (
+	BootDeviceDisk    = "disk"
+	BootDeviceCDROM   = "cdrom"
+	BootDeviceNetwork = "network"
+)
+
+// BootDevices lists the accepted boot devices
+var BootDevices = []string{BootDeviceDisk, BootDeviceCDROM, BootDeviceNetwork}
+
+// osBootDevices maps the legacy <os><boot dev=""/> names to boot devices
+var osBootDevices = map[string]string{
+	"hd":      BootDeviceDisk,
+	"cdrom":   BootDeviceCDROM,
+	"network": BootDeviceNetwork,
+}
+
+// CDROMDisk returns the first CD-ROM drive of a domain, or nil
+func CDROMDisk(dom *libvirtxml.Domain) *libvirtxml.DomainDisk {
+	if dom.Devices == nil {
+		return nil
+	}
+	for i := range dom.Devices.Disks {
+		if dom.Devices.Disks[i].Device == "cdrom" {
+			return &dom.Devices.Disks[i]
+		}
+	}
+	return nil
+}
+
+// DiskSourceFile returns the file backing a disk, empty when there is none
+// (e.g. an ejected CD-ROM)
+func DiskSourceFile(disk *libvirtxml.DomainDisk) string {
+	if disk == nil || disk.Source == nil || disk.Source.File == nil {
+		return ""
+	}
+	return disk.Source.File.File
+}
+
+// BootOrder returns the boot devices of a domain, first to last. Per device
+// boot orders take precedence over the <os> boot list, as in libvirt
+func BootOrder(dom *libvirtxml.Domain) []string {
+	type entry struct {
+		order  uint
+		device string
+	}
+	var entries []entry
+	if dom.Devices != nil {
+		for _, disk := range dom.Devices.Disks {
+			if disk.Boot == nil {
+				continue
+			}
+			device := BootDeviceDisk
+			if disk.Device == "cdrom" {
+				device = BootDeviceCDROM
+			}
+			entries = append(entries, entry{disk.Boot.Order, device})
+		}
+		for _, iface := range dom.Devices.Interfaces {
+			if iface.Boot != nil {
+				entries = append(entries, entry{iface.Boot.Order, BootDeviceNetwork})
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].order < entries[j].order })
+
+	order := []string{}
+	for _, e := range entries {
+		if !slices.Contains(order, e.device) {
+			order = append(order, e.device)
+		}
+	}
+	if len(order) == 0 && dom.OS != nil {
+		for _, b := range dom.OS.BootDevices {
+			if device, ok := osBootDevices[b.Dev]; ok && !slices.Contains(order, device) {
+				order = append(order, device)
+			}
+		}
+	}
+	return order
+}
+
+// SetBootOrder replaces the boot order of a domain. Devices left out of
+// order are not booted from
+func SetBootOrder(dom *libvirtxml.Domain, order []string) error {
+	if len(order) == 0 {
+		return fmt.Errorf("boot order must list at least one device")
+	}
+	for i, device := range order {
+		if !slices.Contains(BootDevices, device) {
+			return fmt.Errorf("unknown boot device %q", device)
+		}
+		if slices.Contains(order[:i], device) {
+			return fmt.Errorf("boot device %q is listed twice", device)
+		}
+	}
+	if dom.Devices == nil {
+		return fmt.Errorf("domain has no devices")
+	}
+
+	// The first disk and NIC of each kind get the device's position
+	var disk, cdrom *libvirtxml.DomainDisk
+	for i := range dom.Devices.Disks {
+		d := &dom.Devices.Disks[i]
+		d.Boot = nil
+		switch {
+		case d.Device == "cdrom" && cdrom == nil:
+			cdrom = d
+		case (d.Device == "" || d.Device == "disk") && disk == nil:
+			disk = d
+		}
+	}
+	var nic *libvirtxml.DomainInterface
+	for i := range dom.Devices.Interfaces {
+		dom.Devices.Interfaces[i].Boot = nil
+		if nic == nil {
+			nic = &dom.Devices.Interfaces[i]
+		}
+	}
+	if dom.OS != nil {
+		// libvirt refuses per device boot orders next to <os><boot/>
+		dom.OS.BootDevices = nil
+	}
+
+	for i, device := range order {
+		boot := &libvirtxml.DomainDeviceBoot{Order: uint(i + 1)}
+		switch device {
+		case BootDeviceDisk:
+			if disk == nil {
+				return fmt.Errorf("virtual machine has no disk")
+			}
+			disk.Boot = boot
+		case BootDeviceCDROM:
+			if cdrom == nil {
+				return fmt.Errorf("virtual machine has no CD-ROM drive")
+			}
+			cdrom.Boot = boot
+		case BootDeviceNetwork:
+			if nic == nil {
+				return fmt.Errorf("virtual machine has no network interface")
+			}
+			nic.Boot = boot
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"visory/internal/models"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// Visory keeps its per VM settings in a single element inside the domain's
+// <metadata>, so they travel with the domain XML
+const (
+	VMMetadataURI = "https://github.com/nasoooor29/vv/xmlns/vm/1.0"
+	VMMetadataKey = "visory"
+)
+
+const (
+	maxLabelKeyLength   = 63
+	maxLabelValueLength = 255
+)
+
+var labelKeyRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+
+// VMMetadata is the visory element stored in a domain's <metadata>. The tag
+// namespace must match VMMetadataURI
+type VMMetadata struct {
+	XMLName xml.Name   `xml:"https://github.com/nasoooor29/vv/xmlns/vm/1.0 vm"`
+	Labels  []VMLabel  `xml:"labels>label,omitempty"`
+	Restart *VMRestart `xml:"restart,omitempty"`
+}
+
+type VMLabel struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// VMRestart is the restart policy enforced by the crash watchdog
+type VMRestart struct {
+	Policy      string `xml:"policy,attr"`
+	MaxAttempts int    `xml:"max-attempts,attr,omitempty"`
+}
+
+// RestartPolicy returns the restart policy, "never" when none is set
+func (m *VMMetadata) RestartPolicy() string {
+	if m.Restart == nil || m.Restart.Policy == "" {
+		return models.RestartPolicyNever
+	}
+	return m.Restart.Policy
+}
+
+// LabelMap returns the labels as a map
+func (m *VMMetadata) LabelMap() map[string]string {
+	labels := make(map[string]string, len(m.Labels))
+	for _, l := range m.Labels {
+		labels[l.Key] = l.Value
+	}
+	return labels
+}
+
+// SetLabels replaces the labels, sorted by key for stable XML
+func (m *VMMetadata) SetLabels(labels map[string]string) {
+	m.Labels = m.Labels[:0]
+	for k, v := range labels {
+		m.Labels = append(m.Labels, VMLabel{Key: k, Value: v})
+	}
+	sort.Slice(m.Labels, func(i, j int) bool { return m.Labels[i].Key < m.Labels[j].Key })
+}
+
+// Marshal returns the element in the visory namespace, ready for
+// DomainSetMetadata or a <metadata> block
+func (m *VMMetadata) Marshal() (string, error) {
+	out, err := xml.Marshal(m)
+	return string(out), err
+}
+
+// ParseVMMetadata finds the visory element in a metadata XML fragment. A
+// fragment without one yields empty metadata
+func ParseVMMetadata(fragment string) (*VMMetadata, error) {
+	meta := &VMMetadata{}
+	dec := xml.NewDecoder(strings.NewReader(fragment))
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return meta, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Space == VMMetadataURI && se.Name.Local == "vm" {
+			if err := dec.DecodeElement(meta, &se); err != nil {
+				return nil, err
+			}
+			return meta, nil
+		}
+	}
+}
+
+// MetadataFromDomainXML returns the description and visory metadata of a domain
+func MetadataFromDomainXML(domainXML string) (string, *VMMetadata, error) {
+	var dom libvirtxml.Domain
+	if err := dom.Unmarshal(domainXML); err != nil {
+		return "", nil, err
+	}
+	if dom.Metadata == nil {
+		return dom.Description, &VMMetadata{}, nil
+	}
+	meta, err := ParseVMMetadata(dom.Metadata.XML)
+	return dom.Description, meta, err
+}
+
+// ValidateLabels checks label keys and values are safe to use in selectors
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if len(k) > maxLabelKeyLength || !labelKeyRegex.MatchString(k) {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if len(v) > maxLabelValueLength || strings.ContainsAny(v, ",=!") {
+			return fmt.Errorf("invalid value for label %q", k)
+		}
+	}
+	return nil
+}
+
+// LabelRequirement is a single term of a label selector
+type LabelRequirement struct {
+	Key   string
+	Op    string // "=", "!=", "exists" or "!exists"
+	Value string
+}
+
+// LabelSelector matches labels against all of its requirements
+type LabelSelector []LabelRequirement
+
+// ParseLabelSelector parses a comma separated selector such as
+// "env=staging,owner!=alice,backup,!temporary"
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	var sel LabelSelector
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var req LabelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			k, v, _ := strings.Cut(term, "!=")
+			req = LabelRequirement{Key: strings.TrimSpace(k), Op: "!=", Value: strings.TrimSpace(v)}
+		case strings.Contains(term, "="):
+			k, v, _ := strings.Cut(term, "=")
+			req = LabelRequirement{Key: strings.TrimSpace(k), Op: "=", Value: strings.TrimSpace(strings.TrimPrefix(v, "="))}
+		case strings.HasPrefix(term, "!"):
+			req = LabelRequirement{Key: strings.TrimSpace(term[1:]), Op: "!exists"}
+		default:
+			req = LabelRequirement{Key: term, Op: "exists"}
+		}
+		if !labelKeyRegex.MatchString(req.Key) {
+			return nil, fmt.Errorf("invalid label selector %q", term)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every requirement
+func (sel LabelSelector) Matches(labels map[string]string) bool {
+	for _, req := range sel {
+		v, ok := labels[req.Key]
+		switch req.Op {
+		case "=":
+			if !ok || v != req.Value {
+				return false
+			}
+		case "!=":
+			if ok && v == req.Value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,369 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"visory/internal/models"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// Disk cache and IO modes accepted in VM tuning
+var (
+	DiskCacheModes = []string{"", "default", "none", "writethrough", "writeback", "directsync", "unsafe"}
+	DiskIOModes    = []string{"", "native", "threads", "io_uring"}
+)
+
+const maxIOThreads = 64
+
+// ParseCPUSet expands a libvirt cpuset such as "0-3,^2,8" into CPU ids
+func ParseCPUSet(cpuset string) ([]int, error) {
+	var include, exclude []int
+	for _, part := range strings.Split(cpuset, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("invalid cpuset %q", cpuset)
+		}
+		target := &include
+		if strings.HasPrefix(part, "^") {
+			target = &exclude
+			part = part[1:]
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(lo)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpuset %q", cpuset)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(hi); err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpuset %q", cpuset)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			*target = append(*target, cpu)
+		}
+	}
+
+	var cpus []int
+	for _, cpu := range include {
+		if !slices.Contains(exclude, cpu) && !slices.Contains(cpus, cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("cpuset %q selects no CPUs", cpuset)
+	}
+	slices.Sort(cpus)
+	return cpus, nil
+}
+
+// ValidateTuning checks tuning against the VM's vCPU count and, when known,
+// the host topology
+func ValidateTuning(t *models.VMTuning, vcpus uint, host *models.HostTopology) error {
+	if t == nil {
+		return nil
+	}
+
+	checkCPUSet := func(what, cpuset string) error {
+		cpus, err := ParseCPUSet(cpuset)
+		if err != nil {
+			return fmt.Errorf("%s: %w", what, err)
+		}
+		if host != nil && host.CPUs > 0 && cpus[len(cpus)-1] >= host.CPUs {
+			return fmt.Errorf("%s: host has no CPU %d", what, cpus[len(cpus)-1])
+		}
+		return nil
+	}
+
+	seen := map[uint]bool{}
+	for _, pin := range t.VCPUPins {
+		if pin.VCPU >= vcpus {
+			return fmt.Errorf("vcpu pin: VM has no vCPU %d", pin.VCPU)
+		}
+		if seen[pin.VCPU] {
+			return fmt.Errorf("vcpu pin: vCPU %d pinned twice", pin.VCPU)
+		}
+		seen[pin.VCPU] = true
+		if err := checkCPUSet(fmt.Sprintf("vcpu %d pin", pin.VCPU), pin.CPUSet); err != nil {
+			return err
+		}
+	}
+	if t.EmulatorPin != "" {
+		if err := checkCPUSet("emulator pin", t.EmulatorPin); err != nil {
+			return err
+		}
+	}
+
+	if t.IOThreads > maxIOThreads {
+		return fmt.Errorf("at most %d IO threads are supported", maxIOThreads)
+	}
+	seen = map[uint]bool{}
+	for _, pin := range t.IOThreadPins {
+		if pin.IOThread < 1 || pin.IOThread > t.IOThreads {
+			return fmt.Errorf("iothread pin: VM has no IO thread %d", pin.IOThread)
+		}
+		if seen[pin.IOThread] {
+			return fmt.Errorf("iothread pin: IO thread %d pinned twice", pin.IOThread)
+		}
+		seen[pin.IOThread] = true
+		if err := checkCPUSet(fmt.Sprintf("iothread %d pin", pin.IOThread), pin.CPUSet); err != nil {
+			return err
+		}
+	}
+
+	if t.HugepageSizeKiB > 0 {
+		if !t.Hugepages {
+			return fmt.Errorf("hugepage size set without hugepages")
+		}
+		if host != nil && !hostHasPageSize(host, uint64(t.HugepageSizeKiB)) {
+			return fmt.Errorf("host has no %d KiB hugepages", t.HugepageSizeKiB)
+		}
+	}
+
+	if !slices.Contains(DiskCacheModes, t.DiskCache) {
+		return fmt.Errorf("invalid disk cache mode %q", t.DiskCache)
+	}
+	if !slices.Contains(DiskIOModes, t.DiskIO) {
+		return fmt.Errorf("invalid disk IO mode %q", t.DiskIO)
+	}
+	if t.DiskIO == "native" && t.DiskCache != "none" && t.DiskCache != "directsync" {
+		return fmt.Errorf("native disk IO requires the none or directsync cache mode")
+	}
+
+	if t.NetQueues > vcpus {
+		return fmt.Errorf("net queues cannot exceed the %d vCPUs", vcpus)
+	}
+
+	if topo := t.Topology; topo != nil {
+		if topo.Sockets < 1 || topo.Cores < 1 || topo.Threads < 1 {
+			return fmt.Errorf("CPU topology values must be at least 1")
+		}
+		if uint(topo.Sockets*topo.Cores*topo.Threads) != vcpus {
+			return fmt.Errorf("CPU topology %dx%dx%d does not match %d vCPUs", topo.Sockets, topo.Cores, topo.Threads, vcpus)
+		}
+	}
+	return nil
+}
+
+func hostHasPageSize(host *models.HostTopology, sizeKiB uint64) bool {
+	for _, node := range host.NUMANodes {
+		for _, pool := range node.Hugepages {
+			if pool.SizeKiB == sizeKiB {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ApplyTuning writes tuning into a domain definition, replacing whatever
+// tuning it had. Unrelated cputune and memory backing settings are kept
+func ApplyTuning(dom *libvirtxml.Domain, t *models.VMTuning) {
+	if t == nil {
+		t = &models.VMTuning{}
+	}
+
+	if dom.CPUTune == nil {
+		dom.CPUTune = &libvirtxml.DomainCPUTune{}
+	}
+	dom.CPUTune.VCPUPin = nil
+	for _, pin := range t.VCPUPins {
+		dom.CPUTune.VCPUPin = append(dom.CPUTune.VCPUPin, libvirtxml.DomainCPUTuneVCPUPin{VCPU: pin.VCPU, CPUSet: pin.CPUSet})
+	}
+	dom.CPUTune.EmulatorPin = nil
+	if t.EmulatorPin != "" {
+		dom.CPUTune.EmulatorPin = &libvirtxml.DomainCPUTuneEmulatorPin{CPUSet: t.EmulatorPin}
+	}
+	dom.CPUTune.IOThreadPin = nil
+	for _, pin := range t.IOThreadPins {
+		dom.CPUTune.IOThreadPin = append(dom.CPUTune.IOThreadPin, libvirtxml.DomainCPUTuneIOThreadPin{IOThread: pin.IOThread, CPUSet: pin.CPUSet})
+	}
+	if reflect.ValueOf(*dom.CPUTune).IsZero() {
+		dom.CPUTune = nil
+	}
+
+	dom.IOThreads = t.IOThreads
+
+	if t.Hugepages {
+		if dom.MemoryBacking == nil {
+			dom.MemoryBacking = &libvirtxml.DomainMemoryBacking{}
+		}
+		dom.MemoryBacking.MemoryHugePages = &libvirtxml.DomainMemoryHugepages{}
+		if t.HugepageSizeKiB > 0 {
+			dom.MemoryBacking.MemoryHugePages.Hugepages = []libvirtxml.DomainMemoryHugepage{{Size: t.HugepageSizeKiB, Unit: "KiB"}}
+		}
+	} else if dom.MemoryBacking != nil {
+		dom.MemoryBacking.MemoryHugePages = nil
+		if reflect.ValueOf(*dom.MemoryBacking).IsZero() {
+			dom.MemoryBacking = nil
+		}
+	}
+
+	if t.Topology != nil {
+		if dom.CPU == nil {
+			dom.CPU = &libvirtxml.DomainCPU{Mode: "host-passthrough"}
+		}
+		dom.CPU.Topology = &libvirtxml.DomainCPUTopology{Sockets: t.Topology.Sockets, Cores: t.Topology.Cores, Threads: t.Topology.Threads}
+	} else if dom.CPU != nil {
+		dom.CPU.Topology = nil
+	}
+
+	if dom.Devices == nil {
+		return
+	}
+	for i := range dom.Devices.Disks {
+		disk := &dom.Devices.Disks[i]
+		if disk.Device != "" && disk.Device != "disk" {
+			continue
+		}
+		if disk.Driver == nil {
+			disk.Driver = &libvirtxml.DomainDiskDriver{Name: "qemu"}
+		}
+		disk.Driver.Cache = t.DiskCache
+		disk.Driver.IO = t.DiskIO
+		disk.Driver.IOThread = nil
+		if t.IOThreads > 0 && disk.Target != nil && disk.Target.Bus == "virtio" {
+			first := uint(1)
+			disk.Driver.IOThread = &first
+		}
+	}
+	for i := range dom.Devices.Interfaces {
+		iface := &dom.Devices.Interfaces[i]
+		if iface.Model == nil || iface.Model.Type != "virtio" {
+			continue
+		}
+		if t.NetQueues > 1 {
+			if iface.Driver == nil {
+				iface.Driver = &libvirtxml.DomainInterfaceDriver{}
+			}
+			iface.Driver.Name = "vhost"
+			iface.Driver.Queues = t.NetQueues
+		} else if iface.Driver != nil {
+			iface.Driver.Queues = 0
+		}
+	}
+}
+
+// TuningFromDomain reads the tuning settings back from a domain definition
+func TuningFromDomain(dom *libvirtxml.Domain) models.VMTuning {
+	t := models.VMTuning{IOThreads: dom.IOThreads}
+
+	if dom.CPUTune != nil {
+		for _, pin := range dom.CPUTune.VCPUPin {
+			t.VCPUPins = append(t.VCPUPins, models.VCPUPin{VCPU: pin.VCPU, CPUSet: pin.CPUSet})
+		}
+		if dom.CPUTune.EmulatorPin != nil {
+			t.EmulatorPin = dom.CPUTune.EmulatorPin.CPUSet
+		}
+		for _, pin := range dom.CPUTune.IOThreadPin {
+			t.IOThreadPins = append(t.IOThreadPins, models.IOThreadPin{IOThread: pin.IOThread, CPUSet: pin.CPUSet})
+		}
+	}
+
+	if dom.MemoryBacking != nil && dom.MemoryBacking.MemoryHugePages != nil {
+		t.Hugepages = true
+		if pages := dom.MemoryBacking.MemoryHugePages.Hugepages; len(pages) > 0 {
+			t.HugepageSizeKiB = uint(ToKiB(uint64(pages[0].Size), pages[0].Unit))
+		}
+	}
+
+	if dom.CPU != nil && dom.CPU.Topology != nil {
+		topo := dom.CPU.Topology
+		t.Topology = &models.CPUTopology{Sockets: topo.Sockets, Cores: topo.Cores, Threads: topo.Threads}
+	}
+
+	if dom.Devices != nil {
+		for _, disk := range dom.Devices.Disks {
+			if (disk.Device == "" || disk.Device == "disk") && disk.Driver != nil {
+				t.DiskCache = disk.Driver.Cache
+				t.DiskIO = disk.Driver.IO
+				break
+			}
+		}
+		for _, iface := range dom.Devices.Interfaces {
+			if iface.Driver != nil && iface.Driver.Queues > 1 {
+				t.NetQueues = iface.Driver.Queues
+				break
+			}
+		}
+	}
+	return t
+}
+
+// HostTopologyFromCaps extracts the CPU and NUMA layout from libvirt's host
+// capabilities XML
+func HostTopologyFromCaps(capsXML string) (*models.HostTopology, error) {
+	var caps libvirtxml.Caps
+	if err := caps.Unmarshal(capsXML); err != nil {
+		return nil, err
+	}
+
+	host := &models.HostTopology{NUMANodes: []models.HostNUMANode{}}
+	if cpu := caps.Host.CPU; cpu != nil {
+		host.Arch, host.Model, host.Vendor = cpu.Arch, cpu.Model, cpu.Vendor
+		if cpu.Topology != nil {
+			host.Sockets, host.Cores, host.Threads = cpu.Topology.Sockets, cpu.Topology.Cores, cpu.Topology.Threads
+		}
+	}
+	if caps.Host.NUMA == nil || caps.Host.NUMA.Cells == nil {
+		return host, nil
+	}
+
+	for _, cell := range caps.Host.NUMA.Cells.Cells {
+		node := models.HostNUMANode{ID: cell.ID, CPUs: []models.HostCPU{}, Hugepages: []models.HugepagePool{}}
+		if cell.Memory != nil {
+			node.MemoryKiB = ToKiB(cell.Memory.Size, cell.Memory.Unit)
+		}
+		for _, page := range cell.PageInfo {
+			size := ToKiB(uint64(page.Size), page.Unit)
+			// The smallest size is the regular page size, not a hugepage pool
+			if size <= 4 {
+				continue
+			}
+			node.Hugepages = append(node.Hugepages, models.HugepagePool{SizeKiB: size, Count: page.Count})
+		}
+		if cell.CPUS != nil {
+			for _, c := range cell.CPUS.CPUs {
+				hc := models.HostCPU{ID: c.ID, Siblings: c.Siblings}
+				if c.SocketID != nil {
+					hc.SocketID = *c.SocketID
+				}
+				if c.CoreID != nil {
+					hc.CoreID = *c.CoreID
+				}
+				node.CPUs = append(node.CPUs, hc)
+			}
+		}
+		host.CPUs += len(node.CPUs)
+		host.NUMANodes = append(host.NUMANodes, node)
+	}
+	return host, nil
+}
+
+// ToKiB converts a libvirt scaled integer to KiB
+func ToKiB(value uint64, unit string) uint64 {
+	switch strings.ToLower(unit) {
+	case "b", "bytes":
+		return value / 1024
+	case "", "k", "kib":
+		return value
+	case "kb":
+		return value * 1000 / 1024
+	case "m", "mib":
+		return value * 1024
+	case "mb":
+		return value * 1000 * 1000 / 1024
+	case "g", "gib":
+		return value * 1024 * 1024
+	case "gb":
+		return value * 1000 * 1000 * 1000 / 1024
+	case "t", "tib":
+		return value * 1024 * 1024 * 1024
+	}
+	return value
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// DecodeScreenshot decodes a libvirt domain screenshot. QEMU hands out PPM
+// (P6) images, which the standard library cannot read, newer versions may
+// return PNG directly
+func DecodeScreenshot(data []byte, mime string) (image.Image, error) {
+	if mime == "image/png" || bytes.HasPrefix(data, []byte("\x89PNG")) {
+		return png.Decode(bytes.NewReader(data))
+	}
+	return decodePPM(bytes.NewReader(data))
+}
+
+func decodePPM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+
+	var header [4]int
+	magic, err := ppmToken(br)
+	if err != nil {
+		return nil, err
+	}
+	if magic != "P6" {
+		return nil, fmt.Errorf("unsupported screenshot format %q", magic)
+	}
+	for i := 1; i < len(header); i++ {
+		tok, err := ppmToken(br)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fmt.Sscanf(tok, "%d", &header[i]); err != nil {
+			return nil, fmt.Errorf("invalid ppm header: %w", err)
+		}
+	}
+	width, height, maxVal := header[1], header[2], header[3]
+	if width <= 0 || height <= 0 || maxVal <= 0 || maxVal > 255 {
+		return nil, fmt.Errorf("unsupported ppm dimensions %dx%d (max %d)", width, height, maxVal)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	row := make([]byte, width*3)
+	for y := range height {
+		if _, err := io.ReadFull(br, row); err != nil {
+			return nil, fmt.Errorf("truncated ppm data: %w", err)
+		}
+		for x := range width {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(int(row[x*3]) * 255 / maxVal),
+				G: uint8(int(row[x*3+1]) * 255 / maxVal),
+				B: uint8(int(row[x*3+2]) * 255 / maxVal),
+				A: 255,
+			})
+		}
+	}
+	return img, nil
+}
+
+// ppmToken reads the next whitespace separated header token, skipping
+// comments. The single whitespace byte after the token is consumed
+func ppmToken(br *bufio.Reader) (string, error) {
+	var tok []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("invalid ppm header: %w", err)
+		}
+		switch {
+		case b == '#' && len(tok) == 0:
+			if _, err := br.ReadString('\n'); err != nil {
+				return "", fmt.Errorf("invalid ppm header: %w", err)
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if len(tok) > 0 {
+				return string(tok), nil
+			}
+		default:
+			tok = append(tok, b)
+		}
+	}
+}
+
+// ScaleImage shrinks img to at most maxWidth pixels wide keeping its aspect
+// ratio, averaging the source pixels covered by each destination pixel.
+// Images that already fit are returned unchanged
+func ScaleImage(img image.Image, maxWidth int) image.Image {
+	b := img.Bounds()
+	if maxWidth <= 0 || b.Dx() <= maxWidth {
+		return img
+	}
+
+	dw := maxWidth
+	dh := max(b.Dy()*dw/b.Dx(), 1)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := range dh {
+		sy0 := b.Min.Y + y*b.Dy()/dh
+		sy1 := max(b.Min.Y+(y+1)*b.Dy()/dh, sy0+1)
+		for x := range dw {
+			sx0 := b.Min.X + x*b.Dx()/dw
+			sx1 := max(b.Min.X+(x+1)*b.Dx()/dw, sx0+1)
+
+			var r, g, bl, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, _ := img.At(sx, sy).RGBA()
+					r += cr >> 8
+					g += cg >> 8
+					bl += cb >> 8
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: 255})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"visory/internal/models"
+)
+
+// secretKey derives the AES-256 key of stored secrets from CREDENTIALS_KEY,
+// or SESSION_SECRET when it is unset
+func secretKey() ([]byte, error) {
+	key := models.ENV_VARS.CredentialsKey
+	if key == "" {
+		key = models.ENV_VARS.SessionSecret
+	}
+	if key == "" {
+		return nil, errors.New("no CREDENTIALS_KEY or SESSION_SECRET to encrypt secrets with")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return sum[:], nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	key, err := secretKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecret encrypts a secret to store it, with AES-GCM. The result is
+// base64 encoded, its random nonce first
+func EncryptSecret(plaintext string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret decrypts a secret encrypted by EncryptSecret. It fails when
+// the key changed since
+func DecryptSecret(encoded string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("invalid secret: too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("cannot decrypt secret, was CREDENTIALS_KEY changed?")
+	}
+	return string(plaintext), nil
+}